@@ -0,0 +1,180 @@
+// Package client implements a client for the gribouillis HTTP API described in
+// API.md.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Error is returned when the server answers with an error status.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("server error %d: %s", e.StatusCode, e.Message)
+}
+
+// Limits are the server limits returned by Capabilities.
+type Limits struct {
+	MaxImageSize int64  `json:"max_image_size"`
+	MinImageSize int64  `json:"min_image_size"`
+	MinWidth     int    `json:"min_width"`
+	MinHeight    int    `json:"min_height"`
+	MinDelay     string `json:"min_delay"`
+	RateBurst    int    `json:"rate_burst"`
+}
+
+// Capabilities describes the server version and supported features.
+type Capabilities struct {
+	Version  int      `json:"version"`
+	Features []string `json:"features"`
+	Limits   Limits   `json:"limits"`
+}
+
+// HasFeature returns true if the server supports the named feature.
+func (c *Capabilities) HasFeature(name string) bool {
+	for _, f := range c.Features {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Drawing identifies a saved drawing.
+type Drawing struct {
+	Path string `json:"path"`
+	URL  string `json:"url"`
+	// PreviewPath and PreviewURL locate a downscaled rendition of the
+	// drawing, if the server generates previews.
+	PreviewPath string `json:"preview_path,omitempty"`
+	PreviewURL  string `json:"preview_url,omitempty"`
+	// BlurHash encodes a blurred placeholder of the drawing, see
+	// https://blurha.sh.
+	BlurHash string `json:"blurhash,omitempty"`
+	// PagePath and PageURL locate the HTML page presenting the drawing.
+	PagePath string `json:"page_path"`
+	PageURL  string `json:"page_url"`
+	// DeleteToken lets the uploader delete the drawing with Delete.
+	DeleteToken string `json:"delete_token,omitempty"`
+	// Prompt is the prompt of the day the drawing was tagged with.
+	Prompt string `json:"prompt,omitempty"`
+}
+
+// DrawingInfo describes a saved drawing returned by List.
+type DrawingInfo struct {
+	Name    string    `json:"name"`
+	Path    string    `json:"path"`
+	URL     string    `json:"url"`
+	PageURL string    `json:"page_url"`
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+	// Title, Author and Room are the drawing captions, if any.
+	Title  string `json:"title,omitempty"`
+	Author string `json:"author,omitempty"`
+	Room   string `json:"room,omitempty"`
+}
+
+// Client calls the API of a gribouillis server. It can be used concurrently.
+type Client struct {
+	baseURL string
+	// HTTPClient is used to issue requests, http.DefaultClient if nil.
+	HTTPClient *http.Client
+}
+
+// New returns a client for the server at baseURL, which is the server -base-url
+// prefixed with its scheme and host, like "https://example.com/draw".
+func New(baseURL string) *Client {
+	return &Client{
+		baseURL: strings.TrimRight(baseURL, "/"),
+	}
+}
+
+func (c *Client) do(ctx context.Context, method, path, contentType string,
+	body io.Reader, result interface{}) error {
+
+	req, err := http.NewRequest(method, c.baseURL+"/api/v1"+path, body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	rsp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		e := struct {
+			Error string `json:"error"`
+		}{}
+		err := json.NewDecoder(rsp.Body).Decode(&e)
+		if err != nil || e.Error == "" {
+			e.Error = rsp.Status
+		}
+		return &Error{
+			StatusCode: rsp.StatusCode,
+			Message:    e.Error,
+		}
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(rsp.Body).Decode(result)
+}
+
+// Capabilities returns the server version, features and limits.
+func (c *Client) Capabilities(ctx context.Context) (*Capabilities, error) {
+	caps := &Capabilities{}
+	err := c.do(ctx, "GET", "/capabilities", "", nil, caps)
+	if err != nil {
+		return nil, err
+	}
+	return caps, nil
+}
+
+// Save uploads the PNG image read from r.
+func (c *Client) Save(ctx context.Context, r io.Reader) (*Drawing, error) {
+	d := &Drawing{}
+	err := c.do(ctx, "POST", "/drawings", "image/png", r, d)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// List returns the saved drawings, newest first. It requires the "list"
+// feature.
+func (c *Client) List(ctx context.Context) ([]DrawingInfo, error) {
+	rsp := struct {
+		Drawings []DrawingInfo `json:"drawings"`
+	}{}
+	err := c.do(ctx, "GET", "/drawings", "", nil, &rsp)
+	if err != nil {
+		return nil, err
+	}
+	return rsp.Drawings, nil
+}
+
+// Delete deletes the drawing name, a file name like DrawingInfo.Name, using
+// the delete token returned when saving it. It requires the "delete"
+// feature.
+func (c *Client) Delete(ctx context.Context, name, token string) error {
+	return c.do(ctx, "DELETE", "/drawings/"+url.PathEscape(name)+
+		"?token="+url.QueryEscape(token), "", nil, nil)
+}
@@ -0,0 +1,78 @@
+package client
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "GET /draw/api/v1/capabilities":
+			w.Write([]byte(`{"version":1,"features":["save"]}`))
+		case "GET /draw/api/v1/drawings":
+			w.Write([]byte(`{"drawings":[{"name":"a.png","size":3,` +
+				`"created":"2024-03-01T10:00:00Z"}]}`))
+		case "POST /draw/api/v1/drawings":
+			data, _ := ioutil.ReadAll(r.Body)
+			if string(data) != "png" {
+				w.WriteHeader(500)
+				w.Write([]byte(`{"error":"could not save image"}`))
+				return
+			}
+			w.Write([]byte(`{"path":"/draw/saved/a.png","url":"http://x/draw/saved/a.png"}`))
+		case "DELETE /draw/api/v1/drawings/a.png":
+			if r.URL.Query().Get("token") != "secret" {
+				w.WriteHeader(403)
+				return
+			}
+			w.WriteHeader(204)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	c := New(srv.URL + "/draw/")
+	caps, err := c.Capabilities(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if caps.Version != 1 || !caps.HasFeature("save") || caps.HasFeature("foo") {
+		t.Fatalf("unexpected capabilities: %+v", caps)
+	}
+	d, err := c.Save(ctx, strings.NewReader("png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Path != "/draw/saved/a.png" {
+		t.Fatalf("unexpected path: %s", d.Path)
+	}
+	list, err := c.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Name != "a.png" || list[0].Size != 3 ||
+		list[0].Created.Year() != 2024 {
+		t.Fatalf("unexpected drawings: %+v", list)
+	}
+	err = c.Delete(ctx, "a.png", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Delete(ctx, "a.png", "wrong")
+	if e, ok := err.(*Error); !ok || e.StatusCode != 403 {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err = c.Save(ctx, strings.NewReader("jpg"))
+	e, ok := err.(*Error)
+	if !ok || e.StatusCode != 500 || e.Message != "could not save image" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,174 @@
+// Command gribouillis serves a drawing canvas and saves the drawings. Run it
+// with -help for its usage.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/pmezard/gribouillis/server"
+)
+
+// secretFlags are not copied in the Windows service command line, readable
+// by local users, but may be set with the -config file or the environment
+// variable they are mapped to, if any.
+var secretFlags = map[string]string{
+	"admin-token":        "GRIBOUILLIS_ADMIN_TOKEN",
+	"auth":               "GRIBOUILLIS_AUTH",
+	"matrix-token":       "GRIBOUILLIS_MATRIX_TOKEN",
+	"oidc-client-secret": "GRIBOUILLIS_OIDC_CLIENT_SECRET",
+	"room-secret":        "GRIBOUILLIS_ROOM_SECRET",
+}
+
+func gribouillis() error {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "save":
+			return server.SaveCommand(os.Args[2:])
+		case "jobs":
+			return server.JobsCommand(os.Args[2:])
+		case "check":
+			return server.CheckCommand(os.Args[2:])
+		case "referrers":
+			return server.ReferrersCommand(os.Args[2:])
+		case "stats":
+			return server.StatsCommand(os.Args[2:])
+		case "archive":
+			return server.ArchiveCommand(os.Args[2:])
+		case "export-site":
+			return server.ExportSiteCommand(os.Args[2:])
+		case "import":
+			return server.ImportCommand(os.Args[2:])
+		}
+	}
+	flag.Usage = func() {
+		fmt.Print(`Usage: gribouillis [OPTIONS]
+       gribouillis save [OPTIONS] FILE...
+       gribouillis jobs [OPTIONS]
+       gribouillis check [OPTIONS]
+       gribouillis referrers [OPTIONS] [NAME]
+       gribouillis stats [OPTIONS]
+       gribouillis archive [OPTIONS] NAME...
+       gribouillis export-site [OPTIONS] DIR
+       gribouillis import [OPTIONS] SOURCE
+
+gribouillis starts a web server on -http and exposes a "literallycanvas" web
+drawing canvas on root URL. Saved images are serialized on disk in "images/"
+relatively to the working directory and accessible with random URLs in "saved/"
+subpath.
+
+Use -base-url to set the web server base URL (useful when proxying). The
+features enabled by the options below are described in README.md, the HTTP API
+in API.md.
+
+`)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	cfg := &server.Config{}
+	addr := flag.String("http", "localhost:5001", "HTTP host:port")
+	cfg.RegisterFlags(flag.CommandLine)
+	tlsOpts := &server.TLSOptions{}
+	flag.StringVar(&tlsOpts.CertFile, "tls-cert", "",
+		"PEM certificate file, serve HTTPS with -tls-key")
+	flag.StringVar(&tlsOpts.KeyFile, "tls-key", "", "PEM private key file")
+	flag.StringVar(&tlsOpts.AutocertDomains, "autocert-domain", "",
+		"comma separated domain names of Let's Encrypt certificates")
+	flag.StringVar(&tlsOpts.AutocertCache, "autocert-cache", "autocert",
+		"directory where Let's Encrypt certificates are stored")
+	flag.StringVar(&tlsOpts.AutocertEmail, "autocert-email", "",
+		"contact email of the Let's Encrypt account")
+	flag.StringVar(&tlsOpts.AutocertHTTP, "autocert-http", "",
+		"HTTP host:port answering ACME challenges and redirecting to HTTPS")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second,
+		"maximum time to wait for active requests when shutting down")
+	logLevel := flag.String("log-level", "info",
+		"minimum level of logged messages: debug, info, warn or error")
+	logFormat := flag.String("log-format", "text", "log format: text or json")
+	configPath := flag.String("config", "", "JSON configuration file")
+	service := flag.String("service", "", "install or remove Windows service")
+	flag.Parse()
+	if flag.NArg() != 0 {
+		return fmt.Errorf("no argument expected")
+	}
+	if cfg.AdminToken == "" {
+		// Not the flag default, which usage would print
+		cfg.AdminToken = os.Getenv("GRIBOUILLIS_ADMIN_TOKEN")
+	}
+	if cfg.Auth == "" {
+		cfg.Auth = os.Getenv("GRIBOUILLIS_AUTH")
+	}
+	if cfg.MatrixToken == "" {
+		cfg.MatrixToken = os.Getenv("GRIBOUILLIS_MATRIX_TOKEN")
+	}
+	if cfg.OIDCClientSecret == "" {
+		cfg.OIDCClientSecret = os.Getenv("GRIBOUILLIS_OIDC_CLIENT_SECRET")
+	}
+	if cfg.RoomSecret == "" {
+		cfg.RoomSecret = os.Getenv("GRIBOUILLIS_ROOM_SECRET")
+	}
+	// Logs go where the log package writes, the event log for services
+	logHandler, err := server.NewLogHandler(log.Writer(), *logLevel, *logFormat)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(logHandler))
+	if *service != "" {
+		args := []string{}
+		flag.Visit(func(f *flag.Flag) {
+			if env, ok := secretFlags[f.Name]; ok {
+				slog.Warn("secret flag not passed to the service, use -config or the environment",
+					"flag", f.Name, "env", env)
+			} else if f.Name != "service" {
+				args = append(args, "-"+f.Name+"="+f.Value.String())
+			}
+		})
+		return server.ControlService(*service, args)
+	}
+	tlsConfig, err := tlsOpts.TLSConfig()
+	if err != nil {
+		return err
+	}
+	listener, err := server.Listen(*addr)
+	if err != nil {
+		return err
+	}
+	slog.Info("starting server", "addr", *addr)
+	srv := &http.Server{Addr: *addr, TLSConfig: tlsConfig}
+	// During upgrades, handlers are opened once the previous process released
+	// its state
+	return server.Serve(srv, listener, *shutdownTimeout, func() (http.Handler, func(), error) {
+		handler, err := server.NewHandler(cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		if *configPath == "" {
+			return handler, handler.Close, nil
+		}
+		// The configuration file handler closes the default one
+		config, err := server.LoadConfigFile(*configPath, cfg, handler)
+		if err != nil {
+			handler.Close()
+			return nil, nil, err
+		}
+		return config, config.Close, nil
+	})
+}
+
+func main() {
+	var err error
+	if server.IsService() {
+		err = server.RunService(gribouillis)
+	} else {
+		err = gribouillis()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,15 @@
+module github.com/pmezard/gribouillis
+
+go 1.22
+
+require (
+	github.com/dustin/go-humanize v1.0.1
+	github.com/gorilla/websocket v1.5.3
+	golang.org/x/crypto v0.31.0
+	golang.org/x/sys v0.28.0
+)
+
+require (
+	golang.org/x/net v0.21.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
+)
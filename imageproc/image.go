@@ -0,0 +1,554 @@
+// Package imageproc checks, crops, flattens and encodes posted drawings, and
+// implements the image transformations used to serve them.
+package imageproc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Encoder encodes images as PNG.
+type Encoder interface {
+	Encode(w io.Writer, m image.Image) error
+}
+
+// pngEncoderFactory returns an Encoder using supplied compression level and
+// at most parallelism goroutines, or GOMAXPROCS if zero.
+type pngEncoderFactory func(level png.CompressionLevel, parallelism int) Encoder
+
+// pngEncoders lists the encoders available to -png-encoder.
+var pngEncoders = map[string]pngEncoderFactory{
+	"stdlib":   newStdlibEncoder,
+	"parallel": newParallelEncoder,
+}
+
+// bufferPool lets consecutive png.Encoder calls reuse their buffers.
+type bufferPool struct {
+	pool sync.Pool
+}
+
+func (p *bufferPool) Get() *png.EncoderBuffer {
+	b, _ := p.pool.Get().(*png.EncoderBuffer)
+	return b
+}
+
+func (p *bufferPool) Put(b *png.EncoderBuffer) {
+	p.pool.Put(b)
+}
+
+func newStdlibEncoder(level png.CompressionLevel, parallelism int) Encoder {
+	return &png.Encoder{
+		CompressionLevel: level,
+		BufferPool:       &bufferPool{},
+	}
+}
+
+var compressionLevels = map[string]png.CompressionLevel{
+	"default": png.DefaultCompression,
+	"none":    png.NoCompression,
+	"speed":   png.BestSpeed,
+	"best":    png.BestCompression,
+}
+
+// NewEncoder returns the named encoder configured with named compression
+// level and parallelism.
+func NewEncoder(name, level string, parallelism int) (Encoder, error) {
+	factory, ok := pngEncoders[name]
+	if !ok {
+		names := []string{}
+		for n := range pngEncoders {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown PNG encoder %q, expected one of: %s",
+			name, strings.Join(names, ", "))
+	}
+	lvl, ok := compressionLevels[level]
+	if !ok {
+		return nil, fmt.Errorf("unknown PNG compression level: %s", level)
+	}
+	return factory(lvl, parallelism), nil
+}
+
+const PNGHeader = "\x89PNG\r\n\x1a\n"
+
+var ErrProcessTimeout = errors.New("image processing took too long")
+
+// uploadTypes lists the Content-Type values accepted for posted drawings. An
+// empty one means the client did not set any.
+var uploadTypes = map[string]bool{
+	"":                         true,
+	"image/png":                true,
+	"application/octet-stream": true,
+}
+
+// convertedTypes lists the media types of posted drawings converted to PNG
+// when saving them.
+var convertedTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/gif":  true,
+}
+
+// MediaTypeError is returned when a posted payload is not a PNG image.
+type MediaTypeError struct {
+	Reason string
+}
+
+func (e *MediaTypeError) Error() string {
+	return "unsupported media type: " + e.Reason
+}
+
+// RejectedImageError is returned when a posted PNG image is valid but refused
+// by the server policy.
+type RejectedImageError struct {
+	Reason string
+}
+
+func (e *RejectedImageError) Error() string {
+	return "image rejected: " + e.Reason
+}
+
+// pngDimensions returns the width and height declared in the IHDR chunk of
+// the PNG stream buffered in r, without consuming it.
+func pngDimensions(r *bufio.Reader) (int, int, error) {
+	head, err := r.Peek(len(PNGHeader) + 16)
+	if err != nil || string(head[12:16]) != "IHDR" {
+		return 0, 0, fmt.Errorf("png: invalid format: missing IHDR chunk")
+	}
+	width := binary.BigEndian.Uint32(head[16:20])
+	height := binary.BigEndian.Uint32(head[20:24])
+	return int(width), int(height), nil
+}
+
+// CheckUpload rejects payloads whose declared content type is not accepted or
+// which do not start with the PNG signature, before any decoding. JPEG and GIF
+// payloads are accepted too if convert is set. It returns a reader yielding
+// the whole payload.
+func CheckUpload(contentType string, r io.Reader, convert bool) (*bufio.Reader, error) {
+	if contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return nil, &MediaTypeError{fmt.Sprintf(
+				"invalid content type %q", contentType)}
+		}
+		contentType = mediaType
+	}
+	if !uploadTypes[contentType] && !(convert && convertedTypes[contentType]) {
+		return nil, &MediaTypeError{fmt.Sprintf(
+			"declared content type is %s", contentType)}
+	}
+	br := bufio.NewReaderSize(r, 512)
+	head, err := br.Peek(512)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(head) == 0 {
+		return nil, &MediaTypeError{"payload is empty"}
+	}
+	detected := "image/png"
+	if !bytes.HasPrefix(head, []byte(PNGHeader)) {
+		detected = http.DetectContentType(head)
+	}
+	if convertedTypes[contentType] && detected != contentType {
+		return nil, &MediaTypeError{fmt.Sprintf("payload looks like %s",
+			detected)}
+	}
+	if detected == "image/png" {
+		return br, nil
+	}
+	if convert && convertedTypes[detected] {
+		// Leave room for the JPEG metadata preceding the dimensions
+		return bufio.NewReaderSize(br, maxHeaderSize), nil
+	}
+	return nil, &MediaTypeError{fmt.Sprintf("payload looks like %s",
+		detected)}
+}
+
+// maxHeaderSize is the maximum length of the headers of converted images,
+// up to their dimensions.
+const maxHeaderSize = 256 << 10
+
+// Dimensions returns the width and height of the PNG, JPEG or GIF image
+// buffered in r, without consuming it.
+func Dimensions(r *bufio.Reader) (int, int, error) {
+	head, err := r.Peek(len(PNGHeader))
+	if err == nil && string(head) == PNGHeader {
+		return pngDimensions(r)
+	}
+	head, err = r.Peek(r.Size())
+	if err != nil && err != io.EOF {
+		return 0, 0, err
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(head))
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not read image dimensions: %s", err)
+	}
+	return cfg.Width, cfg.Height, nil
+}
+
+// ctxReader fails reads once its context is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *ctxReader) Read(p []byte) (int, error) {
+	err := r.ctx.Err()
+	if err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// ctxWriter fails writes once its context is done.
+type ctxWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (w *ctxWriter) Write(p []byte) (int, error) {
+	err := w.ctx.Err()
+	if err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
+
+// CopyPNG copies the PNG stream read from r to w, checking its structure on
+// the fly: chunks checksums and ordering, and header validity. Pixel data is
+// not decoded.
+func CopyPNG(w io.Writer, r io.Reader) error {
+	r = io.TeeReader(r, w)
+	header := make([]byte, 8)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return err
+	}
+	if string(header) != PNGHeader {
+		return png.FormatError("not a PNG file")
+	}
+	chunkHeader := make([]byte, 8)
+	seenIDAT := false
+	for i := 0; ; i++ {
+		_, err := io.ReadFull(r, chunkHeader)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		length := binary.BigEndian.Uint32(chunkHeader[:4])
+		name := string(chunkHeader[4:])
+		if length > 0x7fffffff {
+			return png.FormatError("invalid chunk length")
+		}
+		if (i == 0) != (name == "IHDR") {
+			return png.FormatError("IHDR must be the first chunk")
+		}
+		crc := crc32.NewIEEE()
+		crc.Write(chunkHeader[4:])
+		data := &bytes.Buffer{}
+		// Only keep the header, other chunks are checked while streamed
+		var dst io.Writer = crc
+		if name == "IHDR" {
+			dst = io.MultiWriter(crc, data)
+		}
+		_, err = io.CopyN(dst, r, int64(length))
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		sum := make([]byte, 4)
+		_, err = io.ReadFull(r, sum)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if binary.BigEndian.Uint32(sum) != crc.Sum32() {
+			return png.FormatError("invalid checksum")
+		}
+		switch name {
+		case "IHDR":
+			if length != 13 {
+				return png.FormatError("invalid IHDR length")
+			}
+			hdr := append([]byte(PNGHeader), chunkHeader...)
+			hdr = append(append(hdr, data.Bytes()...), sum...)
+			cfg, err := png.DecodeConfig(bytes.NewReader(hdr))
+			if err != nil {
+				return err
+			}
+			if cfg.Width <= 0 || cfg.Height <= 0 {
+				return png.FormatError("invalid image size")
+			}
+		case "IDAT":
+			seenIDAT = true
+		case "IEND":
+			if !seenIDAT {
+				return png.FormatError("no image data")
+			}
+			n, _ := r.Read(make([]byte, 1))
+			if n > 0 {
+				return png.FormatError("trailing data after IEND")
+			}
+			return nil
+		}
+	}
+}
+
+// Options controls how images are processed before being stored.
+type Options struct {
+	Padding int
+	// PaddingColor is the color of the padding, white if nil.
+	PaddingColor *color.NRGBA
+	Encoder      Encoder
+	// KeepColorProfile copies color space chunks of padded images.
+	KeepColorProfile bool
+	// Background, if set, is the color transparent images are flattened on.
+	Background *color.NRGBA
+	// Watermark, if set, is stamped on saved images.
+	Watermark *Watermark
+	// ReduceColors stores padded images with few colors as grayscale or
+	// paletted PNG.
+	ReduceColors bool
+	// Check, if set, validates decoded images before they are stored.
+	Check func(image.Image) error
+}
+
+// Process decode input data as PNG, JPEG or GIF, rotate JPEG images
+// according to their EXIF orientation, pad it with opts padding color at
+// each borders, flatten it on opts background if any, stamp opts
+// watermark if any, and write it again as PNG on output write with opts
+// encoder. It fails early if ctx is done. PNG images without padding,
+// background nor watermark are copied as is after checking their structure.
+// If set, opts check is called with the decoded image before anything is
+// written, and its error returned.
+func Process(ctx context.Context, w io.Writer, r io.Reader,
+	opts *Options) error {
+
+	br := bufio.NewReader(&ctxReader{ctx: ctx, r: r})
+	head, err := br.Peek(len(PNGHeader))
+	if err != nil && err != io.EOF {
+		return err
+	}
+	isPNG := string(head) == PNGHeader
+	reencode := !isPNG || opts.Padding > 0 || opts.Background != nil ||
+		opts.Watermark != nil
+	if !reencode && opts.Check == nil {
+		return CopyPNG(&ctxWriter{ctx: ctx, w: w}, br)
+	}
+	data, err := ioutil.ReadAll(br)
+	if err != nil {
+		return err
+	}
+	var src image.Image
+	if isPNG {
+		src, err = png.Decode(bytes.NewReader(data))
+	} else {
+		var format string
+		src, format, err = image.Decode(bytes.NewReader(data))
+		if err == nil && !convertedTypes["image/"+format] {
+			err = fmt.Errorf("unsupported image format: %s", format)
+		}
+		if err == nil && format == "jpeg" {
+			// Photos are stored as shot, with the camera orientation
+			src = orient(src, jpegOrientation(data))
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if opts.Check != nil {
+		err = opts.Check(src)
+		if err != nil {
+			return err
+		}
+	}
+	if !reencode {
+		return CopyPNG(&ctxWriter{ctx: ctx, w: w}, bytes.NewReader(data))
+	}
+	padding := opts.Padding
+	srcRect := src.Bounds()
+	dstRect := image.Rect(srcRect.Min.X-padding, srcRect.Min.Y-padding,
+		srcRect.Max.X+padding, srcRect.Max.Y+padding)
+	dst := image.NewRGBA(dstRect)
+	var paddingColor color.Color = color.White
+	if opts.PaddingColor != nil {
+		paddingColor = *opts.PaddingColor
+	}
+	for j := dstRect.Min.Y; j < dstRect.Max.Y; j++ {
+		err := ctx.Err()
+		if err != nil {
+			return err
+		}
+		for i := dstRect.Min.X; i < dstRect.Max.X; i++ {
+			if i >= srcRect.Min.X && i < srcRect.Max.X &&
+				j >= srcRect.Min.Y && j < srcRect.Max.Y {
+				c := src.At(i, j)
+				if opts.Background != nil {
+					c = Flatten(c, *opts.Background)
+				}
+				dst.Set(i, j, c)
+			} else {
+				dst.Set(i, j, paddingColor)
+			}
+		}
+	}
+	if opts.Watermark != nil {
+		opts.Watermark.Draw(dst)
+	}
+	var img image.Image = dst
+	if opts.ReduceColors {
+		img = ReduceColors(dst)
+	}
+	enc := opts.Encoder
+	if opts.KeepColorProfile && isPNG {
+		chunks, err := ColorChunks(data)
+		if err != nil {
+			return err
+		}
+		if len(chunks) > 0 {
+			enc = &ChunkEncoder{Encoder: enc, Chunks: chunks}
+		}
+	}
+	return enc.Encode(&ctxWriter{ctx: ctx, w: w}, img)
+}
+
+// NamedColors are the color names accepted by ParseColor.
+var NamedColors = map[string]color.NRGBA{
+	"black":   {0x00, 0x00, 0x00, 0xff},
+	"white":   {0xff, 0xff, 0xff, 0xff},
+	"gray":    {0x80, 0x80, 0x80, 0xff},
+	"grey":    {0x80, 0x80, 0x80, 0xff},
+	"silver":  {0xc0, 0xc0, 0xc0, 0xff},
+	"red":     {0xff, 0x00, 0x00, 0xff},
+	"maroon":  {0x80, 0x00, 0x00, 0xff},
+	"orange":  {0xff, 0xa5, 0x00, 0xff},
+	"yellow":  {0xff, 0xff, 0x00, 0xff},
+	"olive":   {0x80, 0x80, 0x00, 0xff},
+	"lime":    {0x00, 0xff, 0x00, 0xff},
+	"green":   {0x00, 0x80, 0x00, 0xff},
+	"teal":    {0x00, 0x80, 0x80, 0xff},
+	"cyan":    {0x00, 0xff, 0xff, 0xff},
+	"blue":    {0x00, 0x00, 0xff, 0xff},
+	"navy":    {0x00, 0x00, 0x80, 0xff},
+	"purple":  {0x80, 0x00, 0x80, 0xff},
+	"magenta": {0xff, 0x00, 0xff, 0xff},
+	"pink":    {0xff, 0xc0, 0xcb, 0xff},
+	"brown":   {0xa5, 0x2a, 0x2a, 0xff},
+	"beige":   {0xf5, 0xf5, 0xdc, 0xff},
+	"ivory":   {0xff, 0xff, 0xf0, 0xff},
+}
+
+// ParseColor parses one of NamedColors, ignoring case, or a color accepted
+// by ParseBackground other than "none".
+func ParseColor(s string) (color.NRGBA, error) {
+	if c, ok := NamedColors[strings.ToLower(s)]; ok {
+		return c, nil
+	}
+	c, err := ParseBackground(s)
+	if err != nil || c == nil {
+		return color.NRGBA{}, fmt.Errorf("invalid color: %q", s)
+	}
+	return *c, nil
+}
+
+// ParseBackground parses a "#rrggbb" or "#rgb" color, the hash being
+// optional. It returns nil for "none", meaning transparency is kept.
+func ParseBackground(s string) (*color.NRGBA, error) {
+	if s == "none" {
+		return nil, nil
+	}
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	c := &color.NRGBA{A: 0xff}
+	n, err := fmt.Sscanf(hex, "%02x%02x%02x", &c.R, &c.G, &c.B)
+	if err != nil || n != 3 || len(hex) != 6 {
+		return nil, fmt.Errorf("invalid background color: %q", s)
+	}
+	return c, nil
+}
+
+// Flatten returns c composited over the opaque bg color.
+func Flatten(c color.Color, bg color.NRGBA) color.RGBA {
+	r, g, b, a := c.RGBA()
+	blend := func(v uint32, bg uint8) uint8 {
+		return uint8((v + uint32(bg)*0x101*(0xffff-a)/0xffff) >> 8)
+	}
+	return color.RGBA{blend(r, bg.R), blend(g, bg.G), blend(b, bg.B), 0xff}
+}
+
+// inkCoverage returns the fraction of m pixels whose color differs from the
+// top-left one, taken as the background. Counting stops once the fraction
+// exceeds limit.
+func inkCoverage(m image.Image, limit float64) float64 {
+	b := m.Bounds()
+	total := b.Dx() * b.Dy()
+	if total == 0 {
+		return 0
+	}
+	max := int(limit * float64(total))
+	ink := 0
+	if nrgba, ok := m.(*image.NRGBA); ok {
+		bg := nrgba.Pix[0:4]
+		for y := b.Min.Y; y < b.Max.Y && ink <= max; y++ {
+			row := nrgba.Pix[nrgba.PixOffset(b.Min.X, y):nrgba.PixOffset(b.Max.X, y)]
+			for i := 0; i < len(row); i += 4 {
+				p := row[i : i+4]
+				if (p[3] != 0 || bg[3] != 0) && !bytes.Equal(p, bg) {
+					ink++
+				}
+			}
+		}
+	} else {
+		br, bg, bb, ba := m.At(b.Min.X, b.Min.Y).RGBA()
+		for y := b.Min.Y; y < b.Max.Y && ink <= max; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				r, g, b, a := m.At(x, y).RGBA()
+				if r != br || g != bg || b != bb || a != ba {
+					ink++
+				}
+			}
+		}
+	}
+	return float64(ink) / float64(total)
+}
+
+// BlankCheck returns a Process check rejecting images whose ink coverage is
+// less than or equal to minInk, uniform images always being rejected.
+func BlankCheck(minInk float64) func(image.Image) error {
+	return func(m image.Image) error {
+		ink := inkCoverage(m, minInk)
+		if ink == 0 {
+			return &RejectedImageError{"image is blank"}
+		} else if ink <= minInk {
+			return &RejectedImageError{fmt.Sprintf(
+				"ink covers %.3f%% of the image, not more than %.3f%%",
+				100*ink, 100*minInk)}
+		}
+		return nil
+	}
+}
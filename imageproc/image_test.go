@@ -0,0 +1,242 @@
+package imageproc
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"testing"
+)
+
+func encodeTestImage(t *testing.T, w, h int) []byte {
+	buf := &bytes.Buffer{}
+	err := png.Encode(buf, image.NewRGBA(image.Rect(0, 0, w, h)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestProcessCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	data := encodeTestImage(t, 10, 10)
+	opts := &Options{
+		Padding: 20,
+		Encoder: &png.Encoder{},
+	}
+	err := Process(ctx, ioutil.Discard, bytes.NewReader(data), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	err = Process(ctx, ioutil.Discard, bytes.NewReader(data), opts)
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestProcessPaddingColor(t *testing.T) {
+	data := encodeTestImage(t, 10, 10)
+	mat := NamedColors["navy"]
+	opts := &Options{
+		Padding:      5,
+		PaddingColor: &mat,
+		Encoder:      &png.Encoder{},
+	}
+	buf := &bytes.Buffer{}
+	err := Process(context.Background(), buf, bytes.NewReader(data), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 20 || b.Dy() != 20 {
+		t.Fatalf("unexpected bounds: %v", b)
+	}
+	r, g, b, a := img.At(0, 0).RGBA()
+	if r != 0 || g != 0 || b != 0x8080 || a != 0xffff {
+		t.Fatalf("unexpected padding color: %v", img.At(0, 0))
+	}
+}
+
+// encodeRotatedJPEG returns a 16x8 JPEG image, black on its left half and
+// white on its right half, tagged with EXIF orientation.
+func encodeRotatedJPEG(t *testing.T, orientation byte) []byte {
+	src := image.NewGray(image.Rect(0, 0, 16, 8))
+	for y := 0; y < 8; y++ {
+		for x := 8; x < 16; x++ {
+			src.SetGray(x, y, color.Gray{0xff})
+		}
+	}
+	buf := &bytes.Buffer{}
+	err := jpeg.Encode(buf, src, &jpeg.Options{Quality: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Big endian TIFF header with a single IFD entry: orientation, SHORT
+	exif := []byte("Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08\x00\x01" +
+		"\x01\x12\x00\x03\x00\x00\x00\x01\x00" + string(orientation) +
+		"\x00\x00\x00\x00\x00\x00")
+	data := buf.Bytes()
+	app1 := []byte{0xff, 0xe1, 0, byte(len(exif) + 2)}
+	return append(append(append([]byte{}, data[:2]...), append(app1, exif...)...),
+		data[2:]...)
+}
+
+func TestProcessJPEGOrientation(t *testing.T) {
+	for _, c := range []struct {
+		orientation   byte
+		width, height int
+		// dark is a pixel of the black half once oriented
+		dark image.Point
+	}{
+		{1, 16, 8, image.Pt(2, 4)},
+		{3, 16, 8, image.Pt(13, 4)},
+		{6, 8, 16, image.Pt(4, 2)},
+		{8, 8, 16, image.Pt(4, 13)},
+	} {
+		data := encodeRotatedJPEG(t, c.orientation)
+		if o := jpegOrientation(data); o != int(c.orientation) {
+			t.Fatalf("expected orientation %d, got %d", c.orientation, o)
+		}
+		buf := &bytes.Buffer{}
+		err := Process(context.Background(), buf, bytes.NewReader(data),
+			&Options{Padding: 1, Encoder: &png.Encoder{}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := png.Decode(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Orientation is applied before padding
+		b := img.Bounds()
+		if b.Dx() != c.width+2 || b.Dy() != c.height+2 {
+			t.Fatalf("%d: unexpected bounds: %v", c.orientation, b)
+		}
+		dark := c.dark.Add(b.Min).Add(image.Pt(1, 1))
+		light := image.Pt(b.Max.X+b.Min.X-1-dark.X, b.Max.Y+b.Min.Y-1-dark.Y)
+		if r, _, _, _ := img.At(dark.X, dark.Y).RGBA(); r > 0x2000 {
+			t.Fatalf("%d: expected a dark pixel at %v, got %v", c.orientation,
+				dark, img.At(dark.X, dark.Y))
+		}
+		if r, _, _, _ := img.At(light.X, light.Y).RGBA(); r < 0xe000 {
+			t.Fatalf("%d: expected a light pixel at %v, got %v", c.orientation,
+				light, img.At(light.X, light.Y))
+		}
+	}
+}
+
+func TestCopyPNG(t *testing.T) {
+	data := encodeTestImage(t, 10, 10)
+	buf := &bytes.Buffer{}
+	err := CopyPNG(buf, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatal("copied data differ from input")
+	}
+
+	check := func(name string, data []byte) {
+		err := CopyPNG(ioutil.Discard, bytes.NewReader(data))
+		if err == nil {
+			t.Fatalf("%s: invalid PNG was accepted", name)
+		}
+	}
+	check("truncated", data[:len(data)-5])
+	check("trailing", append(append([]byte{}, data...), 0))
+	corrupted := append([]byte{}, data...)
+	corrupted[len(data)/2] ^= 0xff
+	check("corrupted", corrupted)
+	check("text", []byte("not a PNG file"))
+}
+
+func TestBlankCheck(t *testing.T) {
+	newImage := func(ink int) image.Image {
+		m := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+		for i := 0; i < ink; i++ {
+			m.Set(i%10, 1+i/10, color.NRGBA{0, 0, 0, 255})
+		}
+		return m
+	}
+	tests := []struct {
+		ink    int
+		minInk float64
+		blank  bool
+	}{
+		{0, 0, true},
+		{1, 0, false},
+		{1, 0.01, true},
+		{2, 0.01, false},
+		{20, 0.1, false},
+	}
+	for _, test := range tests {
+		err := BlankCheck(test.minInk)(newImage(test.ink))
+		if (err != nil) != test.blank {
+			t.Errorf("%d pixels with %v minimum ink: unexpected result: %v",
+				test.ink, test.minInk, err)
+		}
+	}
+
+	// Transparent pixels are equal whatever their color
+	m := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	m.Set(1, 1, color.NRGBA{255, 0, 0, 0})
+	if ink := inkCoverage(m, 0); ink != 0 {
+		t.Fatalf("unexpected ink coverage: %v", ink)
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	bg, err := ParseBackground("#f80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *bg != (color.NRGBA{0xff, 0x88, 0x00, 0xff}) {
+		t.Fatalf("unexpected background: %v", bg)
+	}
+	for _, s := range []string{"", "#12345", "red", "#gg0000"} {
+		_, err := ParseBackground(s)
+		if err == nil {
+			t.Fatalf("%q: expected an error", s)
+		}
+	}
+	bg, err = ParseBackground("none")
+	if err != nil || bg != nil {
+		t.Fatalf("none: unexpected result: %v, %v", bg, err)
+	}
+	c, err := ParseColor("Navy")
+	if err != nil || c != (color.NRGBA{0, 0, 0x80, 0xff}) {
+		t.Fatalf("navy: unexpected result: %v, %v", c, err)
+	}
+	c, err = ParseColor("#f80")
+	if err != nil || c != (color.NRGBA{0xff, 0x88, 0x00, 0xff}) {
+		t.Fatalf("#f80: unexpected result: %v, %v", c, err)
+	}
+	for _, s := range []string{"none", "chartreuse", ""} {
+		_, err := ParseColor(s)
+		if err == nil {
+			t.Fatalf("%q: expected an error", s)
+		}
+	}
+
+	white := color.NRGBA{0xff, 0xff, 0xff, 0xff}
+	tests := []struct {
+		c        color.Color
+		expected color.RGBA
+	}{
+		{color.NRGBA{0, 0, 0, 0}, color.RGBA{0xff, 0xff, 0xff, 0xff}},
+		{color.NRGBA{0, 0, 0, 0xff}, color.RGBA{0, 0, 0, 0xff}},
+		{color.NRGBA{0, 0, 0xff, 0x80}, color.RGBA{0x7f, 0x7f, 0xff, 0xff}},
+	}
+	for _, test := range tests {
+		if c := Flatten(test.c, white); c != test.expected {
+			t.Errorf("%v: expected %v, got %v", test.c, test.expected, c)
+		}
+	}
+}
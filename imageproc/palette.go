@@ -0,0 +1,73 @@
+package imageproc
+
+import (
+	"image"
+	"image/color"
+)
+
+// ReduceColors returns m as an *image.Gray if all its pixels are opaque gray
+// levels, as an *image.Paletted if it has at most 256 distinct colors, and m
+// itself otherwise. Both encode to smaller PNG files, sketches and line
+// drawings often using a handful of colors.
+func ReduceColors(m image.Image) image.Image {
+	b := m.Bounds()
+	rgba, _ := m.(*image.RGBA)
+	at := func(x, y int) color.NRGBA {
+		var c color.NRGBA
+		if rgba != nil {
+			p := rgba.PixOffset(x, y)
+			c = color.NRGBA{rgba.Pix[p], rgba.Pix[p+1], rgba.Pix[p+2], rgba.Pix[p+3]}
+			if c.A != 0xff {
+				c = color.NRGBAModel.Convert(color.RGBA(c)).(color.NRGBA)
+			}
+		} else {
+			c = color.NRGBAModel.Convert(m.At(x, y)).(color.NRGBA)
+		}
+		if c.A == 0 {
+			// Invisible colors are all the same
+			return color.NRGBA{}
+		}
+		return c
+	}
+	indices := map[color.NRGBA]uint8{}
+	palette := color.Palette{}
+	gray, paletted := true, true
+	for y := b.Min.Y; y < b.Max.Y && (gray || paletted); y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := at(x, y)
+			if gray && (c.A != 0xff || c.R != c.G || c.G != c.B) {
+				gray = false
+			}
+			if !paletted {
+				continue
+			}
+			if _, ok := indices[c]; !ok {
+				if len(palette) == 256 {
+					paletted = false
+					continue
+				}
+				indices[c] = uint8(len(palette))
+				palette = append(palette, c)
+			}
+		}
+	}
+	switch {
+	case gray:
+		dst := image.NewGray(b)
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				dst.Pix[dst.PixOffset(x, y)] = at(x, y).R
+			}
+		}
+		return dst
+	case paletted:
+		dst := image.NewPaletted(b, palette)
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				dst.Pix[dst.PixOffset(x, y)] = indices[at(x, y)]
+			}
+		}
+		return dst
+	}
+	return m
+}
@@ -0,0 +1,70 @@
+package imageproc
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func TestReduceColors(t *testing.T) {
+	newImage := func(colors int, gray bool) *image.RGBA {
+		m := image.NewRGBA(image.Rect(-2, 3, 40, 31))
+		b := m.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				v := ((x-b.Min.X)*b.Dy() + y - b.Min.Y) % colors
+				c := color.RGBA{uint8(v), uint8(v), uint8(v), 0xff}
+				if !gray {
+					c = color.RGBA{uint8(v / 128), uint8(v % 128 / 2), 0,
+						uint8(128 + v%128)}
+				}
+				m.Set(x, y, c)
+			}
+		}
+		return m
+	}
+	tests := []struct {
+		src      *image.RGBA
+		expected string
+	}{
+		{newImage(200, true), "*image.Gray"},
+		{newImage(200, false), "*image.Paletted"},
+		{newImage(256, false), "*image.Paletted"},
+		{newImage(300, false), "*image.RGBA"},
+	}
+	for i, test := range tests {
+		reduced := ReduceColors(test.src)
+		if kind := fmt.Sprintf("%T", reduced); kind != test.expected {
+			t.Fatalf("%d: expected %s, got %s", i, test.expected, kind)
+		}
+		for name, factory := range pngEncoders {
+			enc := factory(png.DefaultCompression, 2)
+			if p, ok := enc.(*parallelEncoder); ok {
+				p.minBand = 100
+			}
+			buf := &bytes.Buffer{}
+			err := enc.Encode(buf, reduced)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dst, err := png.Decode(buf)
+			if err != nil {
+				t.Fatalf("%d: %s: %s", i, name, err)
+			}
+			b, db := test.src.Bounds(), dst.Bounds()
+			for y := 0; y < b.Dy(); y++ {
+				for x := 0; x < b.Dx(); x++ {
+					c1 := color.NRGBAModel.Convert(test.src.At(b.Min.X+x, b.Min.Y+y))
+					c2 := color.NRGBAModel.Convert(dst.At(db.Min.X+x, db.Min.Y+y))
+					if c1 != c2 {
+						t.Fatalf("%d: %s: pixel mismatch at %d,%d: %v != %v",
+							i, name, x, y, c1, c2)
+					}
+				}
+			}
+		}
+	}
+}
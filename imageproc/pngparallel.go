@@ -0,0 +1,370 @@
+package imageproc
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"hash/adler32"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// parallelEncoder encodes large images as PNG using several goroutines. Image
+// rows are split in bands which are filtered and deflated concurrently. Bands
+// but the last one end with a sync flush so their deflate streams can be
+// concatenated in a single zlib stream, whose checksum is combined from bands
+// ones.
+type parallelEncoder struct {
+	level int
+	// parallelism is the maximum number of bands, GOMAXPROCS if zero.
+	parallelism int
+	// minBand is the minimum size of raw band data. Images smaller than that
+	// are encoded in a single band.
+	minBand int
+}
+
+func newParallelEncoder(level png.CompressionLevel, parallelism int) Encoder {
+	flateLevel := flate.DefaultCompression
+	switch level {
+	case png.NoCompression:
+		flateLevel = flate.NoCompression
+	case png.BestSpeed:
+		flateLevel = flate.BestSpeed
+	case png.BestCompression:
+		flateLevel = flate.BestCompression
+	}
+	return &parallelEncoder{
+		level:       flateLevel,
+		parallelism: parallelism,
+		minBand:     1 << 18,
+	}
+}
+
+type band struct {
+	y0, y1 int
+	data   []byte
+	adler  uint32
+	size   int
+	err    error
+}
+
+func (e *parallelEncoder) Encode(w io.Writer, m image.Image) error {
+	b := m.Bounds()
+	width, height := b.Dx(), b.Dy()
+	if width <= 0 || height <= 0 || width >= 1<<31 || height >= 1<<31 {
+		return fmt.Errorf("png: invalid image size: %dx%d", width, height)
+	}
+	bpp, colorType := 4, byte(6)
+	var plte, trns []byte
+	switch mm := m.(type) {
+	case *image.Gray:
+		bpp, colorType = 1, 0
+	case *image.Paletted:
+		if len(mm.Palette) > 0 && len(mm.Palette) <= 256 {
+			bpp, colorType = 1, 3
+			plte, trns = paletteChunks(mm.Palette)
+		}
+	}
+	if o, ok := m.(interface{ Opaque() bool }); ok && o.Opaque() && bpp == 4 {
+		bpp, colorType = 3, 2
+	}
+	// Like image/png, do not filter paletted images
+	filter := e.level != flate.NoCompression && colorType != 3
+	stride := 1 + width*bpp
+
+	parallelism := e.parallelism
+	if parallelism <= 0 {
+		parallelism = runtime.GOMAXPROCS(0)
+	}
+	rows := height
+	if e.minBand > 0 {
+		rows = (e.minBand + stride - 1) / stride
+	}
+	if n := (height + parallelism - 1) / parallelism; n > rows {
+		rows = n
+	}
+	bands := []*band{}
+	for y := b.Min.Y; y < b.Max.Y; y += rows {
+		y1 := y + rows
+		if y1 > b.Max.Y {
+			y1 = b.Max.Y
+		}
+		bands = append(bands, &band{y0: y, y1: y1})
+	}
+	wg := sync.WaitGroup{}
+	for i, bd := range bands {
+		wg.Add(1)
+		go func(bd *band, final bool) {
+			defer wg.Done()
+			e.encodeBand(m, bpp, filter, bd, final)
+		}(bd, i == len(bands)-1)
+	}
+	wg.Wait()
+
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:4], uint32(width))
+	binary.BigEndian.PutUint32(ihdr[4:8], uint32(height))
+	ihdr[8] = 8
+	ihdr[9] = colorType
+	_, err := io.WriteString(w, PNGHeader)
+	if err != nil {
+		return err
+	}
+	err = WriteChunk(w, "IHDR", ihdr)
+	if err != nil {
+		return err
+	}
+	if plte != nil {
+		err = WriteChunk(w, "PLTE", plte)
+		if err != nil {
+			return err
+		}
+	}
+	if trns != nil {
+		err = WriteChunk(w, "tRNS", trns)
+		if err != nil {
+			return err
+		}
+	}
+	adler := uint32(1)
+	for i, bd := range bands {
+		if bd.err != nil {
+			return bd.err
+		}
+		adler = adler32Combine(adler, bd.adler, bd.size)
+		data := bd.data
+		if i == 0 {
+			data = append([]byte{0x78, 0x9c}, data...)
+		}
+		if i == len(bands)-1 {
+			data = binary.BigEndian.AppendUint32(data, adler)
+		}
+		err = WriteChunk(w, "IDAT", data)
+		if err != nil {
+			return err
+		}
+	}
+	return WriteChunk(w, "IEND", nil)
+}
+
+func (e *parallelEncoder) encodeBand(m image.Image, bpp int, filter bool,
+	bd *band, final bool) {
+
+	b := m.Bounds()
+	stride := 1 + b.Dx()*bpp
+	buf := &bytes.Buffer{}
+	fw, err := flate.NewWriter(buf, e.level)
+	if err != nil {
+		bd.err = err
+		return
+	}
+	h := adler32.New()
+	out := io.MultiWriter(fw, h)
+
+	cr := make([]byte, stride)
+	pr := make([]byte, stride)
+	if bd.y0 > b.Min.Y {
+		ReadRow(m, bpp, bd.y0-1, pr[1:])
+	}
+	scratch := [4][]byte{}
+	for i := range scratch {
+		scratch[i] = make([]byte, stride)
+	}
+	for y := bd.y0; y < bd.y1; y++ {
+		ReadRow(m, bpp, y, cr[1:])
+		row := cr
+		if filter {
+			row = FilterRow(cr, pr, bpp, &scratch)
+		}
+		_, err = out.Write(row)
+		if err != nil {
+			bd.err = err
+			return
+		}
+		bd.size += len(row)
+		cr, pr = pr, cr
+	}
+	if final {
+		err = fw.Close()
+	} else {
+		err = fw.Flush()
+	}
+	bd.data = buf.Bytes()
+	bd.adler = h.Sum32()
+	bd.err = err
+}
+
+// ReadRow writes row y of m in row, as 8 bits gray levels or palette indices
+// if bpp is 1, RGB if bpp is 3 and NRGBA otherwise.
+func ReadRow(m image.Image, bpp, y int, row []byte) {
+	b := m.Bounds()
+	switch mm := m.(type) {
+	case *image.Gray:
+		if bpp == 1 {
+			copy(row, mm.Pix[mm.PixOffset(b.Min.X, y):])
+			return
+		}
+	case *image.Paletted:
+		if bpp == 1 {
+			copy(row, mm.Pix[mm.PixOffset(b.Min.X, y):])
+			return
+		}
+	}
+	rgba, _ := m.(*image.RGBA)
+	for x, i := b.Min.X, 0; x < b.Max.X; x, i = x+1, i+bpp {
+		var c color.NRGBA
+		if rgba != nil {
+			p := rgba.PixOffset(x, y)
+			c = color.NRGBA{rgba.Pix[p], rgba.Pix[p+1], rgba.Pix[p+2], rgba.Pix[p+3]}
+			if c.A != 0xff {
+				c = color.NRGBAModel.Convert(color.RGBA(c)).(color.NRGBA)
+			}
+		} else {
+			c = color.NRGBAModel.Convert(m.At(x, y)).(color.NRGBA)
+		}
+		row[i] = c.R
+		row[i+1] = c.G
+		row[i+2] = c.B
+		if bpp == 4 {
+			row[i+3] = c.A
+		}
+	}
+}
+
+// paletteChunks returns the PLTE and tRNS chunks data of p, the latter being
+// nil if all colors are opaque.
+func paletteChunks(p color.Palette) ([]byte, []byte) {
+	plte := make([]byte, 0, 3*len(p))
+	trns := make([]byte, 0, len(p))
+	last := -1
+	for i, c := range p {
+		n := color.NRGBAModel.Convert(c).(color.NRGBA)
+		plte = append(plte, n.R, n.G, n.B)
+		trns = append(trns, n.A)
+		if n.A != 0xff {
+			last = i
+		}
+	}
+	if last < 0 {
+		return plte, nil
+	}
+	return plte, trns[:last+1]
+}
+
+func abs8(d uint8) int {
+	if d < 128 {
+		return int(d)
+	}
+	return 256 - int(d)
+}
+
+func paeth(a, b, c uint8) uint8 {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := p-int(a), p-int(b), p-int(c)
+	if pa < 0 {
+		pa = -pa
+	}
+	if pb < 0 {
+		pb = -pb
+	}
+	if pc < 0 {
+		pc = -pc
+	}
+	if pa <= pb && pa <= pc {
+		return a
+	} else if pb <= pc {
+		return b
+	}
+	return c
+}
+
+// FilterRow returns cr filtered with the PNG filter minimizing the sum of
+// absolute differences, like image/png does. cr and pr are the current and
+// previous rows, prefixed with a filter type byte.
+func FilterRow(cr, pr []byte, bpp int, scratch *[4][]byte) []byte {
+	best, bestSum := cr, 0
+	cr[0] = 0
+	for _, v := range cr[1:] {
+		bestSum += abs8(v)
+	}
+	for f := 1; f <= 4; f++ {
+		out := scratch[f-1]
+		out[0] = byte(f)
+		sum := 0
+		for i := 1; i < len(cr); i++ {
+			var a, c uint8
+			if i > bpp {
+				a, c = cr[i-bpp], pr[i-bpp]
+			}
+			var pred uint8
+			switch f {
+			case 1:
+				pred = a
+			case 2:
+				pred = pr[i]
+			case 3:
+				pred = uint8((int(a) + int(pr[i])) / 2)
+			case 4:
+				pred = paeth(a, pr[i], c)
+			}
+			out[i] = cr[i] - pred
+			sum += abs8(out[i])
+			if sum >= bestSum {
+				break
+			}
+		}
+		if sum < bestSum {
+			best, bestSum = out, sum
+		}
+	}
+	return best
+}
+
+// adler32Combine returns the Adler-32 checksum of the concatenation of two
+// byte sequences, given their checksums and the second one length. It is
+// ported from zlib adler32_combine.
+func adler32Combine(adler1, adler2 uint32, len2 int) uint32 {
+	const base = 65521
+	rem := uint64(len2 % base)
+	sum1 := uint64(adler1 & 0xffff)
+	sum2 := (rem * sum1) % base
+	sum1 += uint64(adler2&0xffff) + base - 1
+	sum2 += uint64(adler1>>16) + uint64(adler2>>16) + base - rem
+	if sum1 >= base {
+		sum1 -= base
+	}
+	if sum1 >= base {
+		sum1 -= base
+	}
+	if sum2 >= base<<1 {
+		sum2 -= base << 1
+	}
+	if sum2 >= base {
+		sum2 -= base
+	}
+	return uint32(sum1 | sum2<<16)
+}
+
+func WriteChunk(w io.Writer, name string, data []byte) error {
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header[:4], uint32(len(data)))
+	copy(header[4:], name)
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(data)
+	_, err := w.Write(header)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	if err != nil {
+		return err
+	}
+	return binary.Write(w, binary.BigEndian, crc.Sum32())
+}
@@ -0,0 +1,68 @@
+package imageproc
+
+import (
+	"bytes"
+	"hash/adler32"
+	"image"
+	"image/color"
+	"image/png"
+	"math/rand"
+	"testing"
+)
+
+func TestAdler32Combine(t *testing.T) {
+	data := make([]byte, 200000)
+	rand.New(rand.NewSource(1)).Read(data)
+	for _, n := range []int{0, 1, 65521, 100000, 200000} {
+		a := adler32.Checksum(data[:n])
+		b := adler32.Checksum(data[n:])
+		if adler32Combine(a, b, len(data)-n) != adler32.Checksum(data) {
+			t.Fatalf("invalid combined checksum at %d", n)
+		}
+	}
+}
+
+func TestParallelEncoder(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, opaque := range []bool{true, false} {
+		src := image.NewRGBA(image.Rect(-3, 5, 117, 98))
+		b := src.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				a := uint8(255)
+				if !opaque {
+					a = uint8(rnd.Intn(256))
+				}
+				// Smooth gradients exercise all filters
+				src.Set(x, y, color.NRGBA{uint8(x), uint8(y), uint8(x + y), a})
+			}
+		}
+		for _, level := range []png.CompressionLevel{png.NoCompression,
+			png.DefaultCompression} {
+			enc := newParallelEncoder(level, 4).(*parallelEncoder)
+			enc.minBand = 100
+			buf := &bytes.Buffer{}
+			err := enc.Encode(buf, src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dst, err := png.Decode(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dst.Bounds().Dx() != b.Dx() || dst.Bounds().Dy() != b.Dy() {
+				t.Fatalf("unexpected decoded bounds: %v", dst.Bounds())
+			}
+			db := dst.Bounds()
+			for y := 0; y < b.Dy(); y++ {
+				for x := 0; x < b.Dx(); x++ {
+					c1 := color.NRGBAModel.Convert(src.At(b.Min.X+x, b.Min.Y+y))
+					c2 := color.NRGBAModel.Convert(dst.At(db.Min.X+x, db.Min.Y+y))
+					if c1 != c2 {
+						t.Fatalf("pixel mismatch at %d,%d: %v != %v", x, y, c1, c2)
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package imageproc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+)
+
+// colorChunkNames lists the PNG chunks describing the color space of image
+// data. They must appear before the first IDAT chunk.
+var colorChunkNames = map[string]bool{
+	"cHRM": true,
+	"cICP": true,
+	"gAMA": true,
+	"iCCP": true,
+	"sRGB": true,
+}
+
+// ColorChunks returns the serialized color space chunks of PNG data, which
+// is expected to be valid.
+func ColorChunks(data []byte) ([]byte, error) {
+	chunks := []byte{}
+	for pos := len(PNGHeader); pos+8 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[pos : pos+4]))
+		name := string(data[pos+4 : pos+8])
+		end := pos + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, fmt.Errorf("png: invalid chunk length")
+		}
+		if name == "IDAT" {
+			break
+		}
+		if colorChunkNames[name] {
+			chunks = append(chunks, data[pos:end]...)
+		}
+		pos = end
+	}
+	return chunks, nil
+}
+
+// ChunkEncoder inserts serialized chunks right after the IHDR chunk of the
+// images encoded by Encoder.
+type ChunkEncoder struct {
+	Encoder Encoder
+	Chunks  []byte
+}
+
+func (e *ChunkEncoder) Encode(w io.Writer, m image.Image) error {
+	buf := &bytes.Buffer{}
+	err := e.Encoder.Encode(buf, m)
+	if err != nil {
+		return err
+	}
+	data := buf.Bytes()
+	ihdrEnd := len(PNGHeader) + 12 + 13
+	if len(data) < ihdrEnd || string(data[12:16]) != "IHDR" {
+		return fmt.Errorf("png: encoder did not start with IHDR")
+	}
+	for _, b := range [][]byte{data[:ihdrEnd], e.Chunks, data[ihdrEnd:]} {
+		_, err = w.Write(b)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package imageproc
+
+import (
+	"bytes"
+	"context"
+	"image/png"
+	"testing"
+)
+
+func TestKeepColorProfile(t *testing.T) {
+	// Insert gAMA and iCCP chunks after IHDR
+	data := encodeTestImage(t, 10, 10)
+	ihdrEnd := len(PNGHeader) + 12 + 13
+	chunks := &bytes.Buffer{}
+	err := WriteChunk(chunks, "gAMA", []byte{0, 0, 0xb1, 0x8f})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = WriteChunk(chunks, "iCCP", []byte("profile\x00\x00fake"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := append(append(append([]byte{}, data[:ihdrEnd]...),
+		chunks.Bytes()...), data[ihdrEnd:]...)
+
+	for _, keep := range []bool{false, true} {
+		for name, factory := range pngEncoders {
+			out := &bytes.Buffer{}
+			err := Process(context.Background(), out, bytes.NewReader(input),
+				&Options{
+					Padding:          5,
+					Encoder:          factory(png.DefaultCompression, 0),
+					KeepColorProfile: keep,
+				})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = png.Decode(bytes.NewReader(out.Bytes()))
+			if err != nil {
+				t.Fatalf("%s: cannot decode output: %s", name, err)
+			}
+			found, err := ColorChunks(out.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if keep && !bytes.Equal(found, chunks.Bytes()) {
+				t.Fatalf("%s: color chunks were not kept: %q", name, found)
+			} else if !keep && len(found) != 0 {
+				t.Fatalf("%s: color chunks were not stripped: %q", name, found)
+			}
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package imageproc
+
+import (
+	"image"
+	"image/color"
+)
+
+// FitSize returns the dimensions of b scaled to fit in maxSize pixels in both
+// dimensions, preserving its aspect ratio.
+func FitSize(b image.Rectangle, maxSize int) (int, int) {
+	w, h := maxSize, b.Dy()*maxSize/b.Dx()
+	if b.Dy() > b.Dx() {
+		w, h = b.Dx()*maxSize/b.Dy(), maxSize
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	return w, h
+}
+
+// Downscale returns src resized to w x h, each destination pixel averaging
+// the source pixels it covers.
+func Downscale(src image.Image, w, h int) *image.RGBA {
+	b := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0 := b.Min.Y + y*b.Dy()/h
+		y1 := b.Min.Y + (y+1)*b.Dy()/h
+		if y1 == y0 {
+			y1++
+		}
+		for x := 0; x < w; x++ {
+			x0 := b.Min.X + x*b.Dx()/w
+			x1 := b.Min.X + (x+1)*b.Dx()/w
+			if x1 == x0 {
+				x1++
+			}
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r += uint64(cr)
+					g += uint64(cg)
+					bl += uint64(cb)
+					a += uint64(ca)
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{
+				uint8(r / n >> 8),
+				uint8(g / n >> 8),
+				uint8(bl / n >> 8),
+				uint8(a / n >> 8),
+			})
+		}
+	}
+	return dst
+}
@@ -0,0 +1,24 @@
+package imageproc
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestDownscale(t *testing.T) {
+	src := image.NewRGBA(image.Rect(3, 3, 7, 5))
+	for x := 3; x < 7; x++ {
+		src.Set(x, 3, color.RGBA{0xff, 0, 0, 0xff})
+	}
+	dst := Downscale(src, 2, 1)
+	if dst.Bounds() != image.Rect(0, 0, 2, 1) {
+		t.Fatalf("unexpected bounds: %v", dst.Bounds())
+	}
+	expected := color.RGBA{0x7f, 0, 0, 0x7f}
+	for x := 0; x < 2; x++ {
+		if c := dst.RGBAAt(x, 0); c != expected {
+			t.Fatalf("expected %v at %d, got %v", expected, x, c)
+		}
+	}
+}
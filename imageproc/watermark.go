@@ -0,0 +1,153 @@
+package imageproc
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"os"
+)
+
+const (
+	// watermarkScale is the size of text watermark pixels.
+	watermarkScale = 2
+	// watermarkMargin is the distance between watermarks and image borders.
+	watermarkMargin = 6
+)
+
+// watermarkFont holds 5x7 glyphs of printable ASCII characters, starting with
+// space. Each glyph is made of 5 columns whose lowest bit is the top row.
+var watermarkFont = [95][5]byte{
+	{0x00, 0x00, 0x00, 0x00, 0x00}, {0x00, 0x00, 0x5f, 0x00, 0x00},
+	{0x00, 0x07, 0x00, 0x07, 0x00}, {0x14, 0x7f, 0x14, 0x7f, 0x14},
+	{0x24, 0x2a, 0x7f, 0x2a, 0x12}, {0x23, 0x13, 0x08, 0x64, 0x62},
+	{0x36, 0x49, 0x55, 0x22, 0x50}, {0x00, 0x05, 0x03, 0x00, 0x00},
+	{0x00, 0x1c, 0x22, 0x41, 0x00}, {0x00, 0x41, 0x22, 0x1c, 0x00},
+	{0x14, 0x08, 0x3e, 0x08, 0x14}, {0x08, 0x08, 0x3e, 0x08, 0x08},
+	{0x00, 0x50, 0x30, 0x00, 0x00}, {0x08, 0x08, 0x08, 0x08, 0x08},
+	{0x00, 0x60, 0x60, 0x00, 0x00}, {0x20, 0x10, 0x08, 0x04, 0x02},
+	{0x3e, 0x51, 0x49, 0x45, 0x3e}, {0x00, 0x42, 0x7f, 0x40, 0x00},
+	{0x42, 0x61, 0x51, 0x49, 0x46}, {0x21, 0x41, 0x45, 0x4b, 0x31},
+	{0x18, 0x14, 0x12, 0x7f, 0x10}, {0x27, 0x45, 0x45, 0x45, 0x39},
+	{0x3c, 0x4a, 0x49, 0x49, 0x30}, {0x01, 0x71, 0x09, 0x05, 0x03},
+	{0x36, 0x49, 0x49, 0x49, 0x36}, {0x06, 0x49, 0x49, 0x29, 0x1e},
+	{0x00, 0x36, 0x36, 0x00, 0x00}, {0x00, 0x56, 0x36, 0x00, 0x00},
+	{0x08, 0x14, 0x22, 0x41, 0x00}, {0x14, 0x14, 0x14, 0x14, 0x14},
+	{0x00, 0x41, 0x22, 0x14, 0x08}, {0x02, 0x01, 0x51, 0x09, 0x06},
+	{0x32, 0x49, 0x79, 0x41, 0x3e}, {0x7e, 0x11, 0x11, 0x11, 0x7e},
+	{0x7f, 0x49, 0x49, 0x49, 0x36}, {0x3e, 0x41, 0x41, 0x41, 0x22},
+	{0x7f, 0x41, 0x41, 0x22, 0x1c}, {0x7f, 0x49, 0x49, 0x49, 0x41},
+	{0x7f, 0x09, 0x09, 0x01, 0x01}, {0x3e, 0x41, 0x41, 0x51, 0x32},
+	{0x7f, 0x08, 0x08, 0x08, 0x7f}, {0x00, 0x41, 0x7f, 0x41, 0x00},
+	{0x20, 0x40, 0x41, 0x3f, 0x01}, {0x7f, 0x08, 0x14, 0x22, 0x41},
+	{0x7f, 0x40, 0x40, 0x40, 0x40}, {0x7f, 0x02, 0x04, 0x02, 0x7f},
+	{0x7f, 0x04, 0x08, 0x10, 0x7f}, {0x3e, 0x41, 0x41, 0x41, 0x3e},
+	{0x7f, 0x09, 0x09, 0x09, 0x06}, {0x3e, 0x41, 0x51, 0x21, 0x5e},
+	{0x7f, 0x09, 0x19, 0x29, 0x46}, {0x46, 0x49, 0x49, 0x49, 0x31},
+	{0x01, 0x01, 0x7f, 0x01, 0x01}, {0x3f, 0x40, 0x40, 0x40, 0x3f},
+	{0x1f, 0x20, 0x40, 0x20, 0x1f}, {0x7f, 0x20, 0x18, 0x20, 0x7f},
+	{0x63, 0x14, 0x08, 0x14, 0x63}, {0x03, 0x04, 0x78, 0x04, 0x03},
+	{0x61, 0x51, 0x49, 0x45, 0x43}, {0x00, 0x7f, 0x41, 0x41, 0x00},
+	{0x02, 0x04, 0x08, 0x10, 0x20}, {0x00, 0x41, 0x41, 0x7f, 0x00},
+	{0x04, 0x02, 0x01, 0x02, 0x04}, {0x40, 0x40, 0x40, 0x40, 0x40},
+	{0x00, 0x01, 0x02, 0x04, 0x00}, {0x20, 0x54, 0x54, 0x54, 0x78},
+	{0x7f, 0x48, 0x44, 0x44, 0x38}, {0x38, 0x44, 0x44, 0x44, 0x20},
+	{0x38, 0x44, 0x44, 0x48, 0x7f}, {0x38, 0x54, 0x54, 0x54, 0x18},
+	{0x08, 0x7e, 0x09, 0x01, 0x02}, {0x08, 0x54, 0x54, 0x54, 0x3c},
+	{0x7f, 0x08, 0x04, 0x04, 0x78}, {0x00, 0x44, 0x7d, 0x40, 0x00},
+	{0x20, 0x40, 0x44, 0x3d, 0x00}, {0x00, 0x7f, 0x10, 0x28, 0x44},
+	{0x00, 0x41, 0x7f, 0x40, 0x00}, {0x7c, 0x04, 0x18, 0x04, 0x78},
+	{0x7c, 0x08, 0x04, 0x04, 0x78}, {0x38, 0x44, 0x44, 0x44, 0x38},
+	{0x7c, 0x14, 0x14, 0x14, 0x08}, {0x08, 0x14, 0x14, 0x18, 0x7c},
+	{0x7c, 0x08, 0x04, 0x04, 0x08}, {0x48, 0x54, 0x54, 0x54, 0x20},
+	{0x04, 0x3f, 0x44, 0x40, 0x20}, {0x3c, 0x40, 0x40, 0x20, 0x7c},
+	{0x1c, 0x20, 0x40, 0x20, 0x1c}, {0x3c, 0x40, 0x30, 0x40, 0x3c},
+	{0x44, 0x28, 0x10, 0x28, 0x44}, {0x0c, 0x50, 0x50, 0x50, 0x3c},
+	{0x44, 0x64, 0x54, 0x4c, 0x44}, {0x00, 0x08, 0x36, 0x41, 0x00},
+	{0x00, 0x00, 0x7f, 0x00, 0x00}, {0x00, 0x41, 0x36, 0x08, 0x00},
+	{0x08, 0x04, 0x08, 0x10, 0x08},
+}
+
+// renderWatermarkText draws text in black on a transparent image with
+// watermarkFont, characters outside printable ASCII becoming question marks.
+func renderWatermarkText(text string) *image.NRGBA {
+	runes := []rune(text)
+	img := image.NewNRGBA(image.Rect(0, 0, (6*len(runes)-1)*watermarkScale,
+		7*watermarkScale))
+	black := image.NewUniform(color.Black)
+	for i, r := range runes {
+		if r < ' ' || r > '~' {
+			r = '?'
+		}
+		for x, column := range watermarkFont[r-' '] {
+			for y := 0; y < 7; y++ {
+				if column&(1<<uint(y)) == 0 {
+					continue
+				}
+				px := image.Rect(0, 0, watermarkScale, watermarkScale).Add(
+					image.Pt((6*i+x)*watermarkScale, y*watermarkScale))
+				draw.Draw(img, px, black, image.Point{}, draw.Src)
+			}
+		}
+	}
+	return img
+}
+
+// Watermark is an overlay stamped on saved drawings.
+type Watermark struct {
+	overlay  image.Image
+	position string
+	opacity  float64
+}
+
+// NewWatermark returns a watermark rendering text, or the PNG image at
+// imagePath if text is empty, at position with opacity between 0 and 1.
+// Positions are "top-left", "top-right", "bottom-left", "bottom-right" and
+// "center".
+func NewWatermark(text, imagePath, position string, opacity float64) (*Watermark, error) {
+	switch position {
+	case "top-left", "top-right", "bottom-left", "bottom-right", "center":
+	default:
+		return nil, fmt.Errorf("unknown watermark position: %s", position)
+	}
+	if opacity <= 0 || opacity > 1 {
+		return nil, fmt.Errorf("watermark opacity must be in ]0, 1]: %v", opacity)
+	}
+	w := &Watermark{position: position, opacity: opacity}
+	if text != "" {
+		w.overlay = renderWatermarkText(text)
+		return w, nil
+	}
+	fp, err := os.Open(imagePath)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	w.overlay, err = png.Decode(fp)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode watermark image: %s", err)
+	}
+	return w, nil
+}
+
+// Draw stamps the watermark on dst, clipped to its bounds.
+func (w *Watermark) Draw(dst draw.Image) {
+	b := dst.Bounds()
+	src := w.overlay.Bounds()
+	size := src.Size()
+	x, y := b.Max.X-size.X-watermarkMargin, b.Max.Y-size.Y-watermarkMargin
+	switch w.position {
+	case "top-left":
+		x, y = b.Min.X+watermarkMargin, b.Min.Y+watermarkMargin
+	case "top-right":
+		y = b.Min.Y + watermarkMargin
+	case "bottom-left":
+		x = b.Min.X + watermarkMargin
+	case "center":
+		x, y = b.Min.X+(b.Dx()-size.X)/2, b.Min.Y+(b.Dy()-size.Y)/2
+	}
+	mask := image.NewUniform(color.Alpha{uint8(w.opacity*255 + 0.5)})
+	draw.DrawMask(dst, image.Rectangle{image.Pt(x, y), image.Pt(x, y).Add(size)},
+		w.overlay, src.Min, mask, image.Point{}, draw.Over)
+}
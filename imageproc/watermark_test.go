@@ -0,0 +1,84 @@
+package imageproc
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWatermark(t *testing.T) {
+	// "I" is a vertical bar in the third column, from the top to the bottom
+	text := renderWatermarkText("I")
+	if b := text.Bounds(); b.Dx() != 5*watermarkScale || b.Dy() != 7*watermarkScale {
+		t.Fatalf("unexpected text bounds: %v", b)
+	}
+	if text.NRGBAAt(2*watermarkScale, 0).A != 0xff ||
+		text.NRGBAAt(2*watermarkScale, 7*watermarkScale-1).A != 0xff ||
+		text.NRGBAAt(0, 3*watermarkScale).A != 0 {
+		t.Fatal("unexpected text rendering")
+	}
+
+	newWhite := func() *image.RGBA {
+		dst := image.NewRGBA(image.Rect(-10, -10, 90, 90))
+		draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+		return dst
+	}
+	w, err := NewWatermark("I", "", "bottom-right", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := newWhite()
+	w.Draw(dst)
+	x := 90 - watermarkMargin - 5*watermarkScale + 2*watermarkScale
+	y := 90 - watermarkMargin - 1
+	if dst.RGBAAt(x, y) != (color.RGBA{0, 0, 0, 0xff}) {
+		t.Fatalf("watermark not found: %v", dst.RGBAAt(x, y))
+	}
+
+	tmpDir, err := ioutil.TempDir("", "gribouillis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	logo := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	draw.Draw(logo, logo.Bounds(), image.Black, image.Point{}, draw.Src)
+	buf := &bytes.Buffer{}
+	err = png.Encode(buf, logo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(tmpDir, "logo.png")
+	err = ioutil.WriteFile(path, buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err = NewWatermark("", path, "top-left", 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst = newWhite()
+	w.Draw(dst)
+	c := dst.RGBAAt(-10+watermarkMargin, -10+watermarkMargin)
+	if c != (color.RGBA{0x7f, 0x7f, 0x7f, 0xff}) {
+		t.Fatalf("unexpected watermarked color: %v", c)
+	}
+
+	for _, args := range [][]interface{}{
+		{"x", "", "middle", 0.5},
+		{"x", "", "center", 0.0},
+		{"x", "", "center", 1.5},
+		{"", filepath.Join(tmpDir, "missing.png"), "center", 0.5},
+	} {
+		_, err := NewWatermark(args[0].(string), args[1].(string),
+			args[2].(string), args[3].(float64))
+		if err == nil {
+			t.Fatalf("%v: expected an error", args)
+		}
+	}
+}
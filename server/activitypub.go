@@ -0,0 +1,700 @@
+package server
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	activityStreams   = "https://www.w3.org/ns/activitystreams"
+	activityPublic    = activityStreams + "#Public"
+	activityMediaType = "application/activity+json"
+	// activityMaxBody limits the size of received activities and fetched
+	// actors.
+	activityMaxBody = 256 * 1024
+	// activitySignatureAge is the maximum clock difference accepted on
+	// signed requests.
+	activitySignatureAge = time.Hour
+	// activityOutboxSize is the number of latest drawings in the outbox.
+	activityOutboxSize = 20
+)
+
+// apActor is the ActivityPub actor of the instance, a service publishing
+// saved drawings to its followers. Its RSA key, used to sign deliveries,
+// and its followers are stored in dir.
+type apActor struct {
+	baseURL  string
+	username string
+	dir      string
+	key      *rsa.PrivateKey
+	client   *http.Client
+
+	lock sync.Mutex
+	// followers maps followers actor identifiers to their inbox.
+	followers map[string]string
+}
+
+// defaultActivityPubDir returns the ActivityPub state directory used with
+// imagesDir.
+func defaultActivityPubDir(imagesDir string) string {
+	return filepath.Clean(imagesDir) + "-activitypub"
+}
+
+// openAPActor returns the actor username of the instance at baseURL, loading
+// its state from dir. A key is generated on first use.
+func openAPActor(dir, baseURL, username string) (*apActor, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	a := &apActor{
+		baseURL:   strings.TrimRight(baseURL, "/"),
+		username:  username,
+		dir:       dir,
+		client:    &http.Client{Timeout: time.Minute},
+		followers: map[string]string{},
+	}
+	keyPath := filepath.Join(dir, "key.pem")
+	data, err := ioutil.ReadFile(keyPath)
+	if os.IsNotExist(err) {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(key),
+		})
+		err = ioutil.WriteFile(keyPath, data, 0600)
+		if err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("could not decode %s", keyPath)
+	}
+	a.key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %s", keyPath, err)
+	}
+	data, err = ioutil.ReadFile(filepath.Join(dir, "followers.json"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &a.followers)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse followers: %s", err)
+		}
+	}
+	return a, nil
+}
+
+// ID returns the actor identifier.
+func (a *apActor) ID() string {
+	return a.baseURL + "/ap/actor"
+}
+
+// ObjectID returns the identifier of the note publishing drawing name.
+func (a *apActor) ObjectID(name string) string {
+	return a.baseURL + "/ap/objects/" + strings.TrimSuffix(name, ".png")
+}
+
+// Actor returns the actor document.
+func (a *apActor) Actor() interface{} {
+	der, _ := x509.MarshalPKIXPublicKey(&a.key.PublicKey)
+	id := a.ID()
+	return map[string]interface{}{
+		"@context":          []string{activityStreams, "https://w3id.org/security/v1"},
+		"id":                id,
+		"type":              "Service",
+		"preferredUsername": a.username,
+		"name":              "gribouillis",
+		"summary":           "Drawings saved on " + html.EscapeString(a.baseURL),
+		"url":               a.baseURL + "/",
+		"inbox":             a.baseURL + "/ap/inbox",
+		"outbox":            a.baseURL + "/ap/outbox",
+		"followers":         a.baseURL + "/ap/followers",
+		"publicKey": map[string]string{
+			"id":    id + "#main-key",
+			"owner": id,
+			"publicKeyPem": string(pem.EncodeToMemory(&pem.Block{
+				Type:  "PUBLIC KEY",
+				Bytes: der,
+			})),
+		},
+	}
+}
+
+// WebFinger returns the JSON resource descriptor of resource, or nil if it
+// does not designate the actor.
+func (a *apActor) WebFinger(resource string) interface{} {
+	u, err := url.Parse(a.baseURL)
+	if err != nil {
+		return nil
+	}
+	if resource != "acct:"+a.username+"@"+u.Host && resource != a.ID() {
+		return nil
+	}
+	return map[string]interface{}{
+		"subject": "acct:" + a.username + "@" + u.Host,
+		"aliases": []string{a.ID()},
+		"links": []map[string]string{{
+			"rel":  "self",
+			"type": activityMediaType,
+			"href": a.ID(),
+		}},
+	}
+}
+
+// apDrawing describes a saved drawing to publish.
+type apDrawing struct {
+	Name     string
+	ImageURL string
+	PageURL  string
+	Created  time.Time
+	Metadata *Metadata
+}
+
+// Note returns the note publishing drawing d.
+func (a *apActor) Note(d *apDrawing) map[string]interface{} {
+	title := d.Metadata.Title
+	if title == "" {
+		title = "New drawing"
+	}
+	content := html.EscapeString(title)
+	if d.Metadata.Author != "" {
+		content += " by " + html.EscapeString(d.Metadata.Author)
+	}
+	content = fmt.Sprintf(`<p>%s</p><p><a href="%s">%s</a></p>`, content,
+		html.EscapeString(d.PageURL), html.EscapeString(d.PageURL))
+	return map[string]interface{}{
+		"id":           a.ObjectID(d.Name),
+		"type":         "Note",
+		"attributedTo": a.ID(),
+		"content":      content,
+		"url":          d.PageURL,
+		"published":    d.Created.UTC().Format(time.RFC3339),
+		"to":           []string{activityPublic},
+		"cc":           []string{a.baseURL + "/ap/followers"},
+		"attachment": []map[string]string{{
+			"type":      "Image",
+			"mediaType": "image/png",
+			"url":       d.ImageURL,
+			"name":      d.Metadata.Title,
+		}},
+	}
+}
+
+// Create returns the activity creating note.
+func (a *apActor) Create(note map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"@context":  activityStreams,
+		"id":        note["id"].(string) + "/activity",
+		"type":      "Create",
+		"actor":     a.ID(),
+		"published": note["published"],
+		"to":        note["to"],
+		"cc":        note["cc"],
+		"object":    note,
+	}
+}
+
+// Outbox returns the ordered collection of the creation of drawings, newest
+// first.
+func (a *apActor) Outbox(drawings []*apDrawing) interface{} {
+	items := []interface{}{}
+	for _, d := range drawings {
+		items = append(items, a.Create(a.Note(d)))
+	}
+	return map[string]interface{}{
+		"@context":     activityStreams,
+		"id":           a.baseURL + "/ap/outbox",
+		"type":         "OrderedCollection",
+		"totalItems":   len(items),
+		"orderedItems": items,
+	}
+}
+
+// Followers returns the followers collection, without listing them.
+func (a *apActor) Followers() interface{} {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return map[string]interface{}{
+		"@context":   activityStreams,
+		"id":         a.baseURL + "/ap/followers",
+		"type":       "OrderedCollection",
+		"totalItems": len(a.followers),
+	}
+}
+
+// Inboxes returns the distinct inboxes of the followers.
+func (a *apActor) Inboxes() []string {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	seen := map[string]bool{}
+	inboxes := []string{}
+	for _, inbox := range a.followers {
+		if !seen[inbox] {
+			seen[inbox] = true
+			inboxes = append(inboxes, inbox)
+		}
+	}
+	sort.Strings(inboxes)
+	return inboxes
+}
+
+// setFollower records follower actor id with inbox, or removes it if inbox is
+// empty.
+func (a *apActor) setFollower(id, inbox string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if inbox == "" {
+		delete(a.followers, id)
+	} else {
+		a.followers[id] = inbox
+	}
+	data, err := json.Marshal(a.followers)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(a.dir, ".followers-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(a.dir, "followers.json"))
+}
+
+// signingString returns the string signed by HTTP signatures of req over
+// headers.
+func signingString(req *http.Request, headers []string) string {
+	lines := []string{}
+	for _, h := range headers {
+		switch h {
+		case "(request-target)":
+			target := req.RequestURI
+			if target == "" {
+				target = req.URL.RequestURI()
+			}
+			lines = append(lines, h+": "+strings.ToLower(req.Method)+" "+target)
+		case "host":
+			host := req.Host
+			if host == "" {
+				host = req.URL.Host
+			}
+			lines = append(lines, h+": "+host)
+		default:
+			lines = append(lines, h+": "+req.Header.Get(h))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// bodyDigest returns the Digest header value of body.
+func bodyDigest(body []byte) string {
+	h := sha256.Sum256(body)
+	return "SHA-256=" + base64.StdEncoding.EncodeToString(h[:])
+}
+
+// sign adds an HTTP signature of req, with body if not nil, to its headers.
+func (a *apActor) sign(req *http.Request, body []byte) error {
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	headers := []string{"(request-target)", "host", "date"}
+	if body != nil {
+		req.Header.Set("Digest", bodyDigest(body))
+		headers = append(headers, "digest")
+	}
+	h := sha256.Sum256([]byte(signingString(req, headers)))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, h[:])
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Signature", fmt.Sprintf(
+		`keyId="%s#main-key",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		a.ID(), strings.Join(headers, " "), base64.StdEncoding.EncodeToString(sig)))
+	return nil
+}
+
+// remoteActor is the part of remote actors documents used by the instance.
+type remoteActor struct {
+	ID        string `json:"id"`
+	Inbox     string `json:"inbox"`
+	Endpoints struct {
+		SharedInbox string `json:"sharedInbox"`
+	} `json:"endpoints"`
+	PublicKey struct {
+		ID           string `json:"id"`
+		Owner        string `json:"owner"`
+		PublicKeyPem string `json:"publicKeyPem"`
+	} `json:"publicKey"`
+}
+
+// fetchActor fetches the actor document at id with a signed request.
+func (a *apActor) fetchActor(id string) (*remoteActor, error) {
+	req, err := http.NewRequest("GET", id, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", activityMediaType)
+	err = a.sign(req, nil)
+	if err != nil {
+		return nil, err
+	}
+	rsp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != 200 {
+		return nil, fmt.Errorf("could not fetch %s: %s", id, rsp.Status)
+	}
+	actor := &remoteActor{}
+	err = json.NewDecoder(io.LimitReader(rsp.Body, activityMaxBody)).Decode(actor)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %s", id, err)
+	}
+	return actor, nil
+}
+
+// parseSignature returns the parameters of a Signature header.
+func parseSignature(s string) map[string]string {
+	params := map[string]string{}
+	for _, p := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+		if len(kv) == 2 {
+			params[kv[0]] = strings.Trim(kv[1], `"`)
+		}
+	}
+	return params
+}
+
+// verify checks the HTTP signature of req, whose body is body, and returns
+// the signing actor.
+func (a *apActor) verify(req *http.Request, body []byte) (*remoteActor, error) {
+	params := parseSignature(req.Header.Get("Signature"))
+	if params["keyId"] == "" || params["signature"] == "" {
+		return nil, fmt.Errorf("request is not signed")
+	}
+	if alg := params["algorithm"]; alg != "" && alg != "rsa-sha256" && alg != "hs2019" {
+		return nil, fmt.Errorf("unsupported signature algorithm: %s", alg)
+	}
+	headers := strings.Fields(params["headers"])
+	if len(headers) == 0 {
+		headers = []string{"date"}
+	}
+	for _, h := range []string{"(request-target)", "host", "date", "digest"} {
+		if !containsString(headers, h) {
+			return nil, fmt.Errorf("signature does not cover %s", h)
+		}
+	}
+	date, err := http.ParseTime(req.Header.Get("Date"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid date: %s", err)
+	}
+	if d := time.Since(date); d > activitySignatureAge || d < -activitySignatureAge {
+		return nil, fmt.Errorf("signature date is too far: %s", date)
+	}
+	if req.Header.Get("Digest") != bodyDigest(body) {
+		return nil, fmt.Errorf("digest does not match the body")
+	}
+	sig, err := base64.StdEncoding.DecodeString(params["signature"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature encoding")
+	}
+	actor, err := a.fetchActor(strings.SplitN(params["keyId"], "#", 2)[0])
+	if err != nil {
+		return nil, err
+	}
+	if actor.PublicKey.ID != params["keyId"] || actor.PublicKey.Owner != actor.ID {
+		return nil, fmt.Errorf("key %s does not belong to %s", params["keyId"],
+			actor.ID)
+	}
+	block, _ := pem.Decode([]byte(actor.PublicKey.PublicKeyPem))
+	if block == nil {
+		return nil, fmt.Errorf("invalid public key")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		pub, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+	key, ok := pub.(*rsa.PublicKey)
+	if err != nil || !ok {
+		return nil, fmt.Errorf("invalid public key")
+	}
+	h := sha256.Sum256([]byte(signingString(req, headers)))
+	err = rsa.VerifyPKCS1v15(key, crypto.SHA256, h[:], sig)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature")
+	}
+	return actor, nil
+}
+
+// Deliver posts activity to inbox.
+func (a *apActor) Deliver(inbox string, activity interface{}) error {
+	body, err := json.Marshal(activity)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", inbox, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", activityMediaType)
+	err = a.sign(req, body)
+	if err != nil {
+		return err
+	}
+	rsp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		data, _ := ioutil.ReadAll(io.LimitReader(rsp.Body, 1024))
+		return fmt.Errorf("could not deliver to %s: %s: %s", inbox, rsp.Status,
+			strings.TrimSpace(string(data)))
+	}
+	return nil
+}
+
+// activity is the part of received activities used by the instance.
+type activity struct {
+	ID     string          `json:"id"`
+	Type   string          `json:"type"`
+	Actor  string          `json:"actor"`
+	Object json.RawMessage `json:"object"`
+}
+
+// ServeInbox handles Follow activities, and their Undo, addressed to the
+// actor. Follows are accepted right away. Other activities are ignored.
+func (a *apActor) ServeInbox(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, activityMaxBody+1))
+	if err != nil {
+		http.Error(w, "could not read activity", http.StatusBadRequest)
+		return
+	}
+	if len(body) > activityMaxBody {
+		http.Error(w, "activity is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	act := &activity{}
+	err = json.Unmarshal(body, act)
+	if err != nil {
+		http.Error(w, "invalid activity", http.StatusBadRequest)
+		return
+	}
+	if act.Type != "Follow" && act.Type != "Undo" {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	signer, err := a.verify(r, body)
+	if err != nil {
+		slog.Warn("rejected activitypub activity", "type", act.Type,
+			"actor", act.Actor, "err", err)
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+	if signer.ID != act.Actor {
+		http.Error(w, "activity actor is not the signer", http.StatusForbidden)
+		return
+	}
+	switch act.Type {
+	case "Follow":
+		var object string
+		if json.Unmarshal(act.Object, &object) != nil || object != a.ID() {
+			http.Error(w, "unknown followed actor", http.StatusBadRequest)
+			return
+		}
+		inbox := signer.Endpoints.SharedInbox
+		if inbox == "" {
+			inbox = signer.Inbox
+		}
+		if inbox == "" {
+			http.Error(w, "follower has no inbox", http.StatusBadRequest)
+			return
+		}
+		err := a.setFollower(signer.ID, inbox)
+		if err != nil {
+			slog.Error("could not record follower", "actor", signer.ID, "err", err)
+			http.Error(w, "could not follow", 500)
+			return
+		}
+		slog.Info("followed", "actor", signer.ID)
+		err = a.Deliver(signer.Inbox, map[string]interface{}{
+			"@context": activityStreams,
+			"id":       a.ID() + "#accepts/" + url.PathEscape(act.ID),
+			"type":     "Accept",
+			"actor":    a.ID(),
+			"object":   json.RawMessage(body),
+		})
+		if err != nil {
+			slog.Warn("could not accept follow", "actor", signer.ID, "err", err)
+		}
+	case "Undo":
+		undone := &activity{}
+		json.Unmarshal(act.Object, undone)
+		if undone.Type == "Follow" {
+			err := a.setFollower(signer.ID, "")
+			if err != nil {
+				slog.Error("could not remove follower", "actor", signer.ID, "err", err)
+				http.Error(w, "could not unfollow", 500)
+				return
+			}
+			slog.Info("unfollowed", "actor", signer.ID)
+		}
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// writeActivity writes v as an ActivityPub JSON document.
+func writeActivity(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", activityMediaType)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		slog.Warn("could not write activitypub response", "err", err)
+	}
+}
+
+// setupActivityPub serves the ActivityPub actor publishing saved drawings,
+// if enabled.
+func (h *Handler) setupActivityPub() error {
+	cfg := h.cfg
+	if cfg.ActivityPubUser == "" {
+		return nil
+	}
+	if cfg.PublicURL == "" {
+		return fmt.Errorf("activitypub requires a public URL")
+	}
+	apDir := cfg.ActivityPubDir
+	if apDir == "" {
+		apDir = defaultActivityPubDir(cfg.ImagesDir)
+	}
+	ap, err := openAPActor(apDir, cfg.PublicURL, cfg.ActivityPubUser)
+	if err != nil {
+		return err
+	}
+	h.ap = ap
+	// apDrawingOf describes saved drawing name at its public locations
+	apDrawingOf := func(name string) (*apDrawing, error) {
+		st, err := os.Stat(filepath.Join(h.imgDir.Path(), name))
+		if err != nil {
+			return nil, err
+		}
+		m, err := h.meta.Get(name)
+		if err != nil {
+			return nil, err
+		}
+		base := strings.TrimRight(cfg.PublicURL, "/")
+		d := &apDrawing{
+			Name:     name,
+			ImageURL: base + imgURL + name,
+			PageURL:  base + pageURL + strings.TrimSuffix(name, ".png"),
+			Created:  st.ModTime(),
+			Metadata: m,
+		}
+		if h.imgBaseURL != nil {
+			d.ImageURL = h.imgBaseURL.ResolveReference(&url.URL{Path: name}).String()
+		}
+		return d, nil
+	}
+	// activitypub jobs argument is the drawing name and the follower
+	// inbox, separated by a space.
+	h.jobs.Handle("activitypub", func(job *Job) error {
+		var name, inbox string
+		_, err := fmt.Sscanf(job.Arg, "%s %s", &name, &inbox)
+		if err != nil {
+			return fmt.Errorf("invalid activitypub job: %q", job.Arg)
+		}
+		d, err := apDrawingOf(name)
+		if os.IsNotExist(err) {
+			// Evicted in the meantime
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return ap.Deliver(inbox, ap.Create(ap.Note(d)))
+	})
+	h.mux.HandleFunc("/.well-known/webfinger", func(w http.ResponseWriter, r *http.Request) {
+		jrd := ap.WebFinger(r.URL.Query().Get("resource"))
+		if jrd == nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/jrd+json")
+		json.NewEncoder(w).Encode(jrd)
+	})
+	h.mux.HandleFunc("/ap/actor", func(w http.ResponseWriter, r *http.Request) {
+		writeActivity(w, ap.Actor())
+	})
+	h.mux.HandleFunc("/ap/inbox", ap.ServeInbox)
+	h.mux.HandleFunc("/ap/followers", func(w http.ResponseWriter, r *http.Request) {
+		writeActivity(w, ap.Followers())
+	})
+	h.mux.HandleFunc("/ap/outbox", func(w http.ResponseWriter, r *http.Request) {
+		names := h.imgDir.List()
+		drawings := []*apDrawing{}
+		for i := len(names) - 1; i >= 0 && len(drawings) < activityOutboxSize; i-- {
+			d, err := apDrawingOf(names[i])
+			if err != nil {
+				continue
+			}
+			drawings = append(drawings, d)
+		}
+		writeActivity(w, ap.Outbox(drawings))
+	})
+	h.mux.HandleFunc("/ap/objects/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/ap/objects/") + ".png"
+		if !drawingIDRe.MatchString(strings.TrimSuffix(name, ".png")) ||
+			!containsString(h.imgDir.List(), name) {
+			http.NotFound(w, r)
+			return
+		}
+		d, err := apDrawingOf(name)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		note := ap.Note(d)
+		note["@context"] = activityStreams
+		writeActivity(w, note)
+	})
+	return nil
+}
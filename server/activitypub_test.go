@@ -0,0 +1,169 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestActivityPub(t *testing.T) {
+	cfg, cleanup := newTestConfig(t)
+	defer cleanup()
+	srv := httptest.NewUnstartedServer(nil)
+	cfg.PublicURL = "http://" + srv.Listener.Addr().String()
+	cfg.ActivityPubUser = "board"
+	h, err := NewHandler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	srv.Config.Handler = h
+	srv.Start()
+	defer srv.Close()
+
+	// The follower is another actor, verifying what it receives
+	tmpDir, err := ioutil.TempDir("", "gribouillis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	remoteSrv := httptest.NewUnstartedServer(nil)
+	remoteURL := "http://" + remoteSrv.Listener.Addr().String()
+	remote, err := openAPActor(filepath.Join(tmpDir, "remote"), remoteURL, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock := sync.Mutex{}
+	received := []activity{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ap/actor", func(w http.ResponseWriter, r *http.Request) {
+		writeActivity(w, remote.Actor())
+	})
+	mux.HandleFunc("/ap/inbox", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if _, err := remote.verify(r, body); err != nil {
+			t.Errorf("could not verify delivery: %s", err)
+			w.WriteHeader(401)
+			return
+		}
+		act := activity{}
+		json.Unmarshal(body, &act)
+		lock.Lock()
+		received = append(received, act)
+		lock.Unlock()
+		w.WriteHeader(202)
+	})
+	remoteSrv.Config.Handler = mux
+	remoteSrv.Start()
+	defer remoteSrv.Close()
+	waitFor := func(kind string) activity {
+		deadline := time.Now().Add(10 * time.Second)
+		for time.Now().Before(deadline) {
+			lock.Lock()
+			for _, act := range received {
+				if act.Type == kind {
+					lock.Unlock()
+					return act
+				}
+			}
+			lock.Unlock()
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Fatalf("no %s activity received", kind)
+		return activity{}
+	}
+
+	rsp, err := http.Get(srv.URL + "/.well-known/webfinger?resource=acct:board@" +
+		srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	jrd := struct {
+		Links []struct {
+			Href string `json:"href"`
+		} `json:"links"`
+	}{}
+	json.NewDecoder(rsp.Body).Decode(&jrd)
+	rsp.Body.Close()
+	if len(jrd.Links) != 1 || jrd.Links[0].Href != srv.URL+"/ap/actor" {
+		t.Fatalf("unexpected webfinger response: %+v", jrd)
+	}
+
+	// Unsigned activities are rejected
+	follow := map[string]string{
+		"id":     remoteURL + "/follows/1",
+		"type":   "Follow",
+		"actor":  remote.ID(),
+		"object": srv.URL + "/ap/actor",
+	}
+	data, _ := json.Marshal(follow)
+	rsp, err = http.Post(srv.URL+"/ap/inbox", activityMediaType, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != 401 {
+		t.Fatalf("expected 401 for an unsigned follow, got %s", rsp.Status)
+	}
+	err = remote.Deliver(srv.URL+"/ap/inbox", follow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor("Accept")
+
+	rsp, err = http.Post(srv.URL+"/api/v1/drawings?title=Cat", "image/png",
+		bytes.NewReader(encodeTestImage(t, 10, 10)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := saveResponse{}
+	json.NewDecoder(rsp.Body).Decode(&saved)
+	rsp.Body.Close()
+	create := waitFor("Create")
+	note := map[string]interface{}{}
+	json.Unmarshal(create.Object, &note)
+	if note["url"] != saved.PageURL ||
+		!strings.Contains(note["content"].(string), "Cat") {
+		t.Fatalf("unexpected note: %v", note)
+	}
+
+	rsp, err = http.Get(srv.URL + "/ap/outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	outbox := struct {
+		TotalItems int `json:"totalItems"`
+	}{}
+	json.NewDecoder(rsp.Body).Decode(&outbox)
+	rsp.Body.Close()
+	if outbox.TotalItems != 1 {
+		t.Fatalf("expected 1 outbox item, got %d", outbox.TotalItems)
+	}
+
+	err = remote.Deliver(srv.URL+"/ap/inbox", map[string]interface{}{
+		"id":     remoteURL + "/follows/1/undo",
+		"type":   "Undo",
+		"actor":  remote.ID(),
+		"object": follow,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp, err = http.Get(srv.URL + "/ap/followers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.NewDecoder(rsp.Body).Decode(&outbox)
+	rsp.Body.Close()
+	if outbox.TotalItems != 0 {
+		t.Fatalf("expected no follower, got %d", outbox.TotalItems)
+	}
+}
@@ -0,0 +1,326 @@
+package server
+
+import (
+	"crypto/subtle"
+	"html/template"
+	"log/slog"
+	"math"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pmezard/gribouillis/storage"
+)
+
+// adminPrefix is the path prefix of the admin API.
+const adminPrefix = "/admin"
+
+// adminDrawingInfo describes a saved drawing to administrators.
+type adminDrawingInfo struct {
+	drawingInfo
+	Prompt   string `json:"prompt,omitempty"`
+	BlurHash string `json:"blurhash,omitempty"`
+	// Deletable is true if the uploader received a delete token.
+	Deletable bool `json:"deletable"`
+}
+
+// adminDrawingsResponse is returned by the admin drawings listing endpoint.
+type adminDrawingsResponse struct {
+	Drawings []adminDrawingInfo `json:"drawings"`
+}
+
+// adminReportInfo describes a reported drawing to administrators.
+type adminReportInfo struct {
+	Name         string    `json:"name"`
+	PageURL      string    `json:"page_url"`
+	URL          string    `json:"url"`
+	Reports      int64     `json:"reports"`
+	LastReported time.Time `json:"last_reported"`
+}
+
+// adminReportsResponse is returned by the admin reports listing endpoint.
+type adminReportsResponse struct {
+	Drawings []adminReportInfo `json:"drawings"`
+}
+
+// storageStats describes the content and limits of a drawings directory.
+// Zero limits mean unlimited.
+type storageStats struct {
+	Count    int        `json:"count"`
+	Size     int64      `json:"size"`
+	MaxCount int        `json:"max_count"`
+	MaxSize  int64      `json:"max_size"`
+	Oldest   *time.Time `json:"oldest,omitempty"`
+	Newest   *time.Time `json:"newest,omitempty"`
+	// Quotas lists the usage of the prefixes with quotas.
+	Quotas []storage.PrefixStats `json:"quotas,omitempty"`
+}
+
+// adminStatsResponse is returned by the admin storage statistics endpoint.
+type adminStatsResponse struct {
+	Drawings storageStats  `json:"drawings"`
+	Archive  *storageStats `json:"archive,omitempty"`
+}
+
+// limitedDirStats returns the statistics of d.
+func limitedDirStats(d *storage.LimitedDir) storageStats {
+	files := d.Files()
+	maxSize, maxCount := d.Limits()
+	stats := storageStats{
+		Count:    len(files),
+		Size:     d.Size(),
+		MaxCount: maxCount,
+		MaxSize:  maxSize,
+		Quotas:   d.Stats(),
+	}
+	if stats.MaxCount == math.MaxInt32 {
+		stats.MaxCount = 0
+	}
+	if stats.MaxSize == math.MaxInt64 {
+		stats.MaxSize = 0
+	}
+	if len(files) > 0 {
+		oldest := files[0].ModTime.UTC()
+		newest := files[len(files)-1].ModTime.UTC()
+		stats.Oldest, stats.Newest = &oldest, &newest
+	}
+	return stats
+}
+
+// requireAdmin serves h only to requests carrying token as a bearer token,
+// if not empty, or logged in administrators of provider, if not nil.
+func requireAdmin(token string, provider *oidcProvider, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if token != "" && strings.HasPrefix(auth, "Bearer ") &&
+			subtle.ConstantTimeCompare([]byte(strings.TrimSpace(auth[len("Bearer "):])),
+				[]byte(token)) == 1 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if provider != nil {
+			if _, ok := provider.Session(r); ok {
+				h.ServeHTTP(w, r)
+				return
+			}
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer realm="gribouillis admin"`)
+		writeAPIError(w, http.StatusUnauthorized, "invalid admin token or session")
+	})
+}
+
+var adminTemplate = template.Must(template.New("admin").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Moderation - gribouillis</title>
+<style>
+body { font-family: sans-serif; max-width: 60em; margin: 1em auto; padding: 0 1em; }
+ul { list-style: none; padding: 0; display: flex; flex-wrap: wrap; gap: 1em; }
+li { width: 200px; font-size: small; }
+img { max-width: 200px; max-height: 200px; border: 1px solid #ddd; }
+</style>
+</head>
+<body>
+<form method="post" action="logout" style="float: right">{{.Email}} <button>Log out</button></form>
+<h1>Moderation</h1>
+<p id="stats"></p>
+<ul id="drawings"></ul>
+<script>
+function load() {
+  fetch("stats").then(r => r.json()).then(s => {
+    document.getElementById("stats").textContent = s.drawings.count +
+      " drawings, " + Math.round(s.drawings.size / 1024) + " KB";
+  });
+  fetch("drawings").then(r => r.json()).then(rsp => {
+    const list = document.getElementById("drawings");
+    list.textContent = "";
+    for (const d of rsp.drawings) {
+      const li = document.createElement("li");
+      const a = document.createElement("a");
+      a.href = d.page_url;
+      const img = document.createElement("img");
+      img.src = d.url;
+      img.alt = d.title || "";
+      a.appendChild(img);
+      li.appendChild(a);
+      li.appendChild(document.createElement("br"));
+      li.appendChild(document.createTextNode([d.title, d.author && "by " + d.author,
+        new Date(d.created).toLocaleString()].filter(s => s).join(", ") + " "));
+      const del = document.createElement("button");
+      del.textContent = "Delete";
+      del.onclick = () => {
+        if (!confirm("Delete this drawing?")) {
+          return;
+        }
+        fetch("drawings/" + encodeURIComponent(d.name), {method: "DELETE"}).then(load);
+      };
+      li.appendChild(del);
+      list.appendChild(li);
+    }
+  });
+}
+load();
+</script>
+</body>
+</html>
+`))
+
+// serveAdminPage serves the moderation page to logged in administrators of
+// provider, and redirects others to the login page.
+func serveAdminPage(provider *oidcProvider, w http.ResponseWriter, r *http.Request) {
+	email, ok := provider.Session(r)
+	if !ok {
+		http.Redirect(w, r, provider.path("login"), http.StatusFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	err := adminTemplate.Execute(w, struct{ Email string }{email})
+	if err != nil {
+		slog.Warn("could not render moderation page", "err", err)
+	}
+}
+
+// adminHandler returns the handler of the admin API, or nil if it is
+// disabled.
+func (h *Handler) adminHandler() (http.Handler, error) {
+	cfg := h.cfg
+	var provider *oidcProvider
+	if cfg.OIDCIssuer != "" {
+		var err error
+		provider, err = newOIDCProvider(cfg.OIDCIssuer, cfg.OIDCClientID,
+			cfg.OIDCClientSecret, cfg.PublicURL, cfg.OIDCAdmins)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.AdminToken == "" && provider == nil {
+		return nil, nil
+	}
+	adminRoutes := []*apiRoute{
+		{
+			Method:   "GET",
+			Path:     "/drawings",
+			Summary:  "List saved drawings with their metadata, newest first",
+			Response: &adminDrawingsResponse{},
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				files := h.imgDir.Files()
+				rsp := &adminDrawingsResponse{Drawings: []adminDrawingInfo{}}
+				for i := len(files) - 1; i >= 0; i-- {
+					f := files[i]
+					loc := h.locateDrawing(r, f.Name)
+					m, err := h.meta.Get(f.Name)
+					if err != nil {
+						slog.Error("could not read metadata", "name", f.Name, "err", err)
+						m = &Metadata{}
+					}
+					rsp.Drawings = append(rsp.Drawings, adminDrawingInfo{
+						drawingInfo: drawingInfo{
+							Name:    f.Name,
+							Path:    loc.ImagePath,
+							URL:     loc.ImageURL,
+							PageURL: loc.PageURL,
+							Size:    f.Size,
+							Created: f.ModTime.UTC(),
+							Title:   m.Title,
+							Author:  m.Author,
+							Room:    m.Room,
+						},
+						Prompt:    m.Prompt,
+						BlurHash:  m.BlurHash,
+						Deletable: m.DeleteTokenHash != "",
+					})
+				}
+				writeJSON(w, 200, rsp)
+			},
+		},
+		{
+			Method:  "DELETE",
+			Path:    "/drawings/{name}",
+			Summary: "Delete a drawing",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				name := path.Base(r.URL.Path)
+				if !drawingIDRe.MatchString(strings.TrimSuffix(name, ".png")) {
+					writeAPIError(w, http.StatusNotFound, "unknown drawing")
+					return
+				}
+				code, err := h.removeDrawing(h.requestLogger(r), name,
+					removalModerated)
+				if err != nil {
+					writeAPIError(w, code, err.Error())
+					return
+				}
+				w.WriteHeader(http.StatusNoContent)
+			},
+		},
+		{
+			Method:   "GET",
+			Path:     "/stats",
+			Summary:  "Describe the storage usage and limits",
+			Response: &adminStatsResponse{},
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				rsp := &adminStatsResponse{Drawings: limitedDirStats(h.imgDir)}
+				if h.archive != nil {
+					stats := limitedDirStats(h.archive)
+					rsp.Archive = &stats
+				}
+				writeJSON(w, 200, rsp)
+			},
+		},
+	}
+	adminRoutes = append(adminRoutes, h.bulkRoutes()...)
+	if h.reactions != nil {
+		adminRoutes = append(adminRoutes, &apiRoute{
+			Method:   "GET",
+			Path:     "/reports",
+			Summary:  "List the reported drawings, the most reported first",
+			Response: &adminReportsResponse{},
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				rsp := &adminReportsResponse{Drawings: []adminReportInfo{}}
+				for _, name := range h.reactions.Reported() {
+					loc := h.locateDrawing(r, name)
+					reactions := h.reactions.Get(name)
+					rsp.Drawings = append(rsp.Drawings, adminReportInfo{
+						Name:         name,
+						PageURL:      loc.PageURL,
+						URL:          loc.ImageURL,
+						Reports:      reactions.Reports,
+						LastReported: reactions.LastReported,
+					})
+				}
+				writeJSON(w, 200, rsp)
+			},
+		})
+	}
+	if h.rooms != nil {
+		adminRoutes = append(adminRoutes, &apiRoute{
+			Method:   "GET",
+			Path:     "/rooms",
+			Summary:  "Describe the shared drawing rooms and their limits",
+			Response: &adminRoomsResponse{},
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, 200, h.rooms.Stats())
+			},
+		})
+	}
+	api := requireAdmin(cfg.AdminToken, provider,
+		newAPIHandler(adminPrefix, adminRoutes))
+	if provider == nil {
+		return api, nil
+	}
+	adminMux := http.NewServeMux()
+	adminMux.HandleFunc(adminPrefix+"/login", provider.Login)
+	adminMux.HandleFunc(adminPrefix+"/oidc/callback", provider.Callback)
+	adminMux.HandleFunc(adminPrefix+"/logout", provider.Logout)
+	adminMux.HandleFunc(adminPrefix+"/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == adminPrefix+"/" {
+			serveAdminPage(provider, w, r)
+			return
+		}
+		api.ServeHTTP(w, r)
+	})
+	return adminMux, nil
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+)
+
+func TestAdminAPI(t *testing.T) {
+	cfg, cleanup := newTestConfig(t)
+	defer cleanup()
+	cfg.AdminToken = "secret"
+	cfg.Middlewares = "auth,security-headers"
+	cfg.Auth = "user:password"
+	h, err := NewHandler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	req := httptest.NewRequest("POST", "/api/v1/drawings?title=Cat",
+		bytes.NewReader(encodeTestImage(t, 10, 10)))
+	req.SetBasicAuth("user", "password")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	saved := saveResponse{}
+	err = json.Unmarshal(w.Body.Bytes(), &saved)
+	if err != nil || w.Code != 200 {
+		t.Fatalf("could not save drawing: %d, %v\n%s", w.Code, err, w.Body.String())
+	}
+	name := path.Base(saved.Path)
+
+	admin := func(method, path, token string, rsp interface{}) int {
+		t.Helper()
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if rsp != nil && w.Code == 200 {
+			err := json.Unmarshal(w.Body.Bytes(), rsp)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code
+	}
+	if code := admin("GET", "/admin/stats", "", nil); code != http.StatusUnauthorized {
+		t.Fatalf("unexpected status without token: %d", code)
+	}
+	// The admin API bypasses auth but not the security headers
+	req = httptest.NewRequest("GET", "/admin/stats", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != 200 || w.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Fatalf("admin API lacks security headers: %d %v", w.Code, w.Header())
+	}
+	if code := admin("GET", "/admin/stats", "wrong", nil); code != http.StatusUnauthorized {
+		t.Fatalf("unexpected status with invalid token: %d", code)
+	}
+
+	list := adminDrawingsResponse{}
+	admin("GET", "/admin/drawings", "secret", &list)
+	if len(list.Drawings) != 1 || list.Drawings[0].Name != name ||
+		list.Drawings[0].Title != "Cat" || !list.Drawings[0].Deletable {
+		t.Fatalf("unexpected drawings: %+v", list)
+	}
+	stats := adminStatsResponse{}
+	admin("GET", "/admin/stats", "secret", &stats)
+	if stats.Drawings.Count != 1 || stats.Drawings.Size == 0 ||
+		stats.Drawings.MaxCount != cfg.MaxCount || stats.Archive != nil {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	if code := admin("DELETE", "/admin/drawings/"+name, "secret", nil); code != 204 {
+		t.Fatalf("could not delete drawing: %d", code)
+	}
+	if code := admin("DELETE", "/admin/drawings/"+name, "secret", nil); code != 404 {
+		t.Fatalf("unexpected status deleting unknown drawing: %d", code)
+	}
+	stats = adminStatsResponse{}
+	admin("GET", "/admin/stats", "secret", &stats)
+	if stats.Drawings.Count != 0 || stats.Drawings.Oldest != nil {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
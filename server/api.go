@@ -0,0 +1,709 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pmezard/gribouillis/storage"
+)
+
+const (
+	// apiPrefix is the path prefix of programmatic endpoints, relatively to
+	// the base URL. Endpoints under a given version only get backward
+	// compatible changes, see API.md.
+	apiPrefix  = "/api/v1"
+	apiVersion = 1
+)
+
+// apiFeatures lists the optional features supported by the server. Clients
+// should check them with the capabilities endpoint before relying on them.
+var apiFeatures = []string{
+	"coloring",
+	"compose",
+	"delete",
+	"events",
+	"list",
+	"live",
+	"openapi",
+	"recolor",
+	"save",
+	"shapes",
+	"sketchbook",
+}
+
+// saveResponse is returned by save endpoints.
+type saveResponse struct {
+	Path string `json:"path"`
+	URL  string `json:"url"`
+	// PreviewPath and PreviewURL locate a downscaled rendition of the image,
+	// if previews are enabled.
+	PreviewPath string `json:"preview_path,omitempty"`
+	PreviewURL  string `json:"preview_url,omitempty"`
+	// BlurHash encodes a blurred placeholder of the image.
+	BlurHash string `json:"blurhash,omitempty"`
+	// PagePath and PageURL locate the HTML page presenting the image.
+	PagePath string `json:"page_path"`
+	PageURL  string `json:"page_url"`
+	// DeleteToken lets the uploader delete the drawing. It is not stored
+	// and cannot be retrieved later.
+	DeleteToken string `json:"delete_token"`
+	// Prompt is the prompt of the day the drawing was saved under, if the
+	// server publishes prompts.
+	Prompt string `json:"prompt,omitempty"`
+	// PublishAt is the publication time of scheduled drawings, which are
+	// hidden until then.
+	PublishAt *time.Time `json:"publish_at,omitempty"`
+	// Duplicate is set when the posted drawing was identical to a saved one,
+	// which is returned instead, without delete token.
+	Duplicate bool `json:"duplicate,omitempty"`
+}
+
+// viewsResponse reports the views of a drawing to its author.
+type viewsResponse struct {
+	Views int64 `json:"views"`
+	// LastViewed is omitted if the drawing was never viewed.
+	LastViewed *time.Time `json:"last_viewed,omitempty"`
+	// Shares counts the views through each share link, by creation time.
+	Shares []shareInfo `json:"shares,omitempty"`
+}
+
+// likesResponse is returned when liking a drawing.
+type likesResponse struct {
+	Likes int64 `json:"likes"`
+}
+
+// shareInfo reports the views of a drawing through one share link.
+type shareInfo struct {
+	Token      string     `json:"token"`
+	Label      string     `json:"label,omitempty"`
+	Created    time.Time  `json:"created"`
+	Views      int64      `json:"views"`
+	LastViewed *time.Time `json:"last_viewed,omitempty"`
+}
+
+// shareResponse is returned when creating a share link. URL and ImageURL
+// are the drawing page and image URLs counting their views in the share.
+type shareResponse struct {
+	Token    string `json:"token"`
+	Label    string `json:"label,omitempty"`
+	URL      string `json:"url"`
+	ImageURL string `json:"image_url"`
+}
+
+// drawingInfo describes a saved drawing in listings.
+type drawingInfo struct {
+	Name    string    `json:"name"`
+	Path    string    `json:"path"`
+	URL     string    `json:"url"`
+	PageURL string    `json:"page_url"`
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+	// Title, Author and Room are the drawing captions, if any.
+	Title  string `json:"title,omitempty"`
+	Author string `json:"author,omitempty"`
+	Room   string `json:"room,omitempty"`
+}
+
+// drawingsResponse is returned by the drawings listing endpoint.
+type drawingsResponse struct {
+	Drawings []drawingInfo `json:"drawings"`
+	// Next is the cursor of the next page of a limited listing, empty on the
+	// last page.
+	Next string `json:"next,omitempty"`
+}
+
+// federatedInfo describes a drawing of a federated instance.
+type federatedInfo struct {
+	// Instance is the base URL of the instance the drawing comes from.
+	Instance string `json:"instance"`
+	Name     string `json:"name"`
+	URL      string `json:"url"`
+	PageURL  string `json:"page_url,omitempty"`
+	// ThumbnailPath and ThumbnailURL locate the thumbnail cached by this
+	// instance.
+	ThumbnailPath string    `json:"thumbnail_path"`
+	ThumbnailURL  string    `json:"thumbnail_url"`
+	Created       time.Time `json:"created"`
+}
+
+// federatedResponse is returned by the federated drawings listing endpoint.
+type federatedResponse struct {
+	Drawings []federatedInfo `json:"drawings"`
+}
+
+// pendingResponse is returned when a drawing is uploaded for confirmation.
+type pendingResponse struct {
+	ID string `json:"id"`
+	// Token is the owner token required to preview, confirm or discard the
+	// drawing.
+	Token string `json:"token"`
+	// PreviewPath and PreviewURL locate the uploaded image, as it will be
+	// published, including the owner token.
+	PreviewPath string    `json:"preview_path"`
+	PreviewURL  string    `json:"preview_url"`
+	Expires     time.Time `json:"expires"`
+}
+
+// flipbookResponse describes the frames of an animated drawing.
+type flipbookResponse struct {
+	// Delay is the duration of each frame, in milliseconds.
+	Delay int `json:"delay"`
+	// Frames are the absolute paths of the frames, in order.
+	Frames []string `json:"frames"`
+	// GIF and APNG are the absolute paths of the animation.
+	GIF  string `json:"gif"`
+	APNG string `json:"apng"`
+}
+
+// liveMessage is sent to live endpoint clients. Type is "save", "eviction"
+// or "count".
+type liveMessage struct {
+	Type       string `json:"type"`
+	Name       string `json:"name,omitempty"`
+	URL        string `json:"url,omitempty"`
+	PreviewURL string `json:"preview_url,omitempty"`
+	// Count is the number of saved drawings, for count messages.
+	Count int `json:"count,omitempty"`
+}
+
+type limits struct {
+	MaxImageSize int64  `json:"max_image_size"`
+	MinImageSize int64  `json:"min_image_size"`
+	MinWidth     int    `json:"min_width"`
+	MinHeight    int    `json:"min_height"`
+	MinDelay     string `json:"min_delay"`
+	RateBurst    int    `json:"rate_burst"`
+	// MaxFrames is the maximum number of flipbook frames, if enabled.
+	MaxFrames int `json:"max_frames,omitempty"`
+}
+
+// capabilities is returned by the capabilities endpoint.
+type capabilities struct {
+	Version  int      `json:"version"`
+	Features []string `json:"features"`
+	Limits   limits   `json:"limits"`
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	return json.NewEncoder(w).Encode(v)
+}
+
+// writeAPIError writes a JSON error response, API endpoints never return
+// plain text errors.
+func writeAPIError(w http.ResponseWriter, code int, msg string) error {
+	return writeJSON(w, code, struct {
+		Error string `json:"error"`
+	}{
+		Error: msg,
+	})
+}
+
+// apiRoute describes an API endpoint. Routes are used both to dispatch
+// requests and to generate the OpenAPI specification.
+type apiRoute struct {
+	Method string
+	// Path is relative to the API prefix. Segments like "{name}" match any
+	// non-empty segment.
+	Path    string
+	Summary string
+	// Feature is the capability the endpoint belongs to, if any.
+	Feature string
+	// Request is the media type of the request body, if any.
+	Request string
+	// Response is a value of the JSON response type, or nil if the response
+	// is not described.
+	Response interface{}
+	// ResponseType overrides the default application/json response type.
+	ResponseType string
+	Handler      http.HandlerFunc
+}
+
+func (r *apiRoute) matches(path string) bool {
+	pattern := strings.Split(r.Path, "/")
+	parts := strings.Split(path, "/")
+	if len(pattern) != len(parts) {
+		return false
+	}
+	for i, p := range pattern {
+		if strings.HasPrefix(p, "{") && strings.HasSuffix(p, "}") {
+			if parts[i] == "" {
+				return false
+			}
+		} else if p != parts[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// apiHandler dispatches requests under prefix to matching routes. It returns
+// JSON errors for unknown paths or methods.
+type apiHandler struct {
+	prefix string
+	routes []*apiRoute
+}
+
+func newAPIHandler(prefix string, routes []*apiRoute) *apiHandler {
+	return &apiHandler{
+		prefix: prefix,
+		routes: routes,
+	}
+}
+
+func (h *apiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, h.prefix)
+	allowed := []string{}
+	for _, route := range h.routes {
+		if !route.matches(path) {
+			continue
+		}
+		if route.Method == r.Method ||
+			(route.Method == "GET" && r.Method == "HEAD") {
+			route.Handler(w, r)
+			return
+		}
+		allowed = append(allowed, route.Method)
+	}
+	if len(allowed) == 0 {
+		writeAPIError(w, http.StatusNotFound, "unknown API endpoint")
+		return
+	}
+	sort.Strings(allowed)
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+}
+
+// tracked returns whether name is a saved drawing.
+func (h *Handler) tracked(name string) bool {
+	return drawingIDRe.MatchString(strings.TrimSuffix(name, ".png")) &&
+		containsString(h.imgDir.List(), name)
+}
+
+// trackedDrawing returns the saved drawing name in the path of requests
+// like "/drawings/{name}/...", and whether it exists.
+func (h *Handler) trackedDrawing(r *http.Request) (string, bool) {
+	p := strings.TrimPrefix(r.URL.Path, apiPrefix+"/drawings/")
+	name := strings.SplitN(p, "/", 2)[0]
+	return name, h.tracked(name)
+}
+
+// setupAPI serves the API, the legacy save endpoint and the web application.
+func (h *Handler) setupAPI() error {
+	cfg := h.cfg
+	h.mux.HandleFunc("/save/", func(w http.ResponseWriter, r *http.Request) {
+		rsp, code, err := h.saveDrawing(r)
+		if err != nil {
+			w.WriteHeader(code)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		// Legacy endpoint, the response type is kept for older frontends
+		w.Header().Set("Content-Type", "image/png")
+		json.NewEncoder(w).Encode(rsp)
+	})
+	features := append([]string{}, apiFeatures...)
+	for _, r := range h.optional {
+		if r.Feature != "" && !containsString(features, r.Feature) {
+			features = append(features, r.Feature)
+		}
+	}
+	sort.Strings(features)
+	caps := &capabilities{
+		Version:  apiVersion,
+		Features: features,
+		Limits: limits{
+			MaxImageSize: h.opts.maxImgSize,
+			MinImageSize: h.opts.minImgSize,
+			MinWidth:     cfg.MinWidth,
+			MinHeight:    cfg.MinHeight,
+			MinDelay:     h.limiter.interval.String(),
+			RateBurst:    h.limiter.burst,
+			MaxFrames:    cfg.MaxFrames,
+		},
+	}
+	routes := []*apiRoute{
+		{
+			Method:   "GET",
+			Path:     "/capabilities",
+			Summary:  "Describe server version, features and limits",
+			Response: caps,
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, 200, caps)
+			},
+		},
+		{
+			Method:   "GET",
+			Path:     "/drawings",
+			Summary:  "List saved drawings, newest, oldest, popular or random first",
+			Feature:  "list",
+			Response: &drawingsResponse{},
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				q, err := parseListingQuery(r.URL.Query().Get)
+				if err != nil {
+					writeAPIError(w, http.StatusBadRequest, err.Error())
+					return
+				}
+				files, next := q.List(h.imgDir.Files(), func(f storage.File) int64 {
+					if h.views != nil {
+						return h.views.Get(f.Name).Views
+					}
+					return int64(f.Views)
+				})
+				rsp := &drawingsResponse{Drawings: []drawingInfo{}, Next: next}
+				for _, f := range files {
+					loc := h.locateDrawing(r, f.Name)
+					m, err := h.meta.Get(f.Name)
+					if err != nil {
+						slog.Error("could not read metadata", "name", f.Name, "err", err)
+						m = &Metadata{}
+					}
+					rsp.Drawings = append(rsp.Drawings, drawingInfo{
+						Name:    f.Name,
+						Path:    loc.ImagePath,
+						URL:     loc.ImageURL,
+						PageURL: loc.PageURL,
+						Size:    f.Size,
+						Created: f.ModTime.UTC(),
+						Title:   m.Title,
+						Author:  m.Author,
+						Room:    m.Room,
+					})
+				}
+				writeJSON(w, 200, rsp)
+			},
+		},
+		{
+			Method:  "DELETE",
+			Path:    "/drawings/{name}",
+			Summary: "Delete the drawing, given its delete token",
+			Feature: "delete",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				code, err := h.deleteDrawing(r, path.Base(r.URL.Path))
+				if err != nil {
+					writeAPIError(w, code, err.Error())
+					return
+				}
+				w.WriteHeader(http.StatusNoContent)
+			},
+		},
+		{
+			Method:  "GET",
+			Path:    "/drawings/{name}/shapes",
+			Summary: "Return the shapes of a drawing, to edit it",
+			Feature: "shapes",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				name, ok := h.trackedDrawing(r)
+				if !ok {
+					writeAPIError(w, http.StatusNotFound, "unknown drawing")
+					return
+				}
+				fp, err := os.Open(h.meta.ShapesPath(name))
+				if os.IsNotExist(err) {
+					writeAPIError(w, http.StatusNotFound, "drawing has no shapes")
+					return
+				} else if err != nil {
+					slog.Error("could not open shapes", "name", name, "err", err)
+					writeAPIError(w, 500, "could not read shapes")
+					return
+				}
+				defer fp.Close()
+				w.Header().Set("Content-Type", "application/json")
+				io.Copy(w, fp)
+			},
+		},
+		{
+			Method:       "GET",
+			Path:         "/sketchbook",
+			Summary:      "Return the drawings of an author or a room as a PDF sketchbook",
+			Feature:      "sketchbook",
+			ResponseType: "application/pdf",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				q, err := parseSketchbookQuery(r.URL.Query())
+				if err != nil {
+					writeAPIError(w, http.StatusBadRequest, err.Error())
+					return
+				}
+				type page struct {
+					name    string
+					caption string
+				}
+				pages := []page{}
+				for _, f := range h.imgDir.Files() {
+					m, err := h.meta.Get(f.Name)
+					if err != nil {
+						slog.Error("could not read metadata", "name", f.Name, "err", err)
+						continue
+					}
+					if q.Match(m, f.ModTime) {
+						pages = append(pages, page{f.Name, sketchbookCaption(m, f.ModTime)})
+					}
+				}
+				if len(pages) == 0 {
+					writeAPIError(w, http.StatusNotFound, "no matching drawing")
+					return
+				}
+				if len(pages) > sketchbookMaxPages {
+					writeAPIError(w, http.StatusUnprocessableEntity, fmt.Sprintf(
+						"more than %d drawings, narrow the date range", sketchbookMaxPages))
+					return
+				}
+				buf := &bytes.Buffer{}
+				err = writePDFPages(buf, len(pages), func(i int) (image.Image, string, error) {
+					img, err := decodePNGFile(filepath.Join(h.imgDir.Path(), pages[i].name))
+					return img, pages[i].caption, err
+				})
+				if err != nil {
+					slog.Error("could not write sketchbook", "err", err)
+					writeAPIError(w, 500, "could not write sketchbook")
+					return
+				}
+				w.Header().Set("Content-Type", "application/pdf")
+				w.Header().Set("Content-Disposition",
+					`attachment; filename="sketchbook.pdf"`)
+				buf.WriteTo(w)
+			},
+		},
+		{
+			Method:       "GET",
+			Path:         "/drawings/{name}/coloring",
+			Summary:      "Return a printable line-art version of a drawing",
+			Feature:      "coloring",
+			ResponseType: "image/png",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				name, ok := h.trackedDrawing(r)
+				if !ok {
+					writeAPIError(w, http.StatusNotFound, "unknown drawing")
+					return
+				}
+				format := r.URL.Query().Get("format")
+				if format != "" && format != "png" && format != "pdf" {
+					writeAPIError(w, http.StatusBadRequest, "invalid format")
+					return
+				}
+				threshold := coloringThreshold
+				if v := r.URL.Query().Get("threshold"); v != "" {
+					n, err := strconv.Atoi(v)
+					if err != nil || n < 1 || n > 255 {
+						writeAPIError(w, http.StatusBadRequest, "invalid threshold")
+						return
+					}
+					threshold = n
+				}
+				img, err := decodePNGFile(filepath.Join(h.imgDir.Path(), name))
+				if err != nil {
+					slog.Error("could not decode drawing", "name", name, "err", err)
+					writeAPIError(w, 500, "could not decode drawing")
+					return
+				}
+				page := coloringPage(img, float64(threshold))
+				buf := &bytes.Buffer{}
+				if format == "pdf" {
+					w.Header().Set("Content-Type", "application/pdf")
+					err = writePDF(buf, []image.Image{page})
+				} else {
+					w.Header().Set("Content-Type", "image/png")
+					err = png.Encode(buf, page)
+				}
+				if err != nil {
+					slog.Warn("could not encode coloring page", "name", name, "err", err)
+					writeAPIError(w, 500, "could not encode coloring page")
+					return
+				}
+				buf.WriteTo(w)
+			},
+		},
+		{
+			Method:       "GET",
+			Path:         "/drawings/{name}/recolor",
+			Summary:      "Return a drawing with its colors swapped or hues shifted",
+			Feature:      "recolor",
+			ResponseType: "image/png",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				name, ok := h.trackedDrawing(r)
+				if !ok {
+					writeAPIError(w, http.StatusNotFound, "unknown drawing")
+					return
+				}
+				query := r.URL.Query()
+				mapping := map[colorKey]colorKey{}
+				if v := query.Get("map"); v != "" {
+					var err error
+					mapping, err = parseColorMapping(v)
+					if err != nil {
+						writeAPIError(w, http.StatusBadRequest, err.Error())
+						return
+					}
+				}
+				hue := 0.0
+				if v := query.Get("hue"); v != "" {
+					var err error
+					hue, err = strconv.ParseFloat(v, 64)
+					if err != nil || math.IsNaN(hue) || hue < -360 || hue > 360 {
+						writeAPIError(w, http.StatusBadRequest, "invalid hue")
+						return
+					}
+				}
+				if len(mapping) == 0 && hue == 0 {
+					writeAPIError(w, http.StatusBadRequest,
+						"map or hue parameter is required")
+					return
+				}
+				img, err := decodePNGFile(filepath.Join(h.imgDir.Path(), name))
+				if err != nil {
+					slog.Error("could not decode drawing", "name", name, "err", err)
+					writeAPIError(w, 500, "could not decode drawing")
+					return
+				}
+				buf := &bytes.Buffer{}
+				err = png.Encode(buf, recolor(img, mapping, hue))
+				if err != nil {
+					slog.Warn("could not encode recolored drawing", "name", name,
+						"err", err)
+					writeAPIError(w, 500, "could not encode recolored drawing")
+					return
+				}
+				w.Header().Set("Content-Type", "image/png")
+				buf.WriteTo(w)
+			},
+		},
+		{
+			Method:   "POST",
+			Path:     "/drawings",
+			Summary:  "Save the PNG drawing posted as request body",
+			Feature:  "save",
+			Request:  "image/png",
+			Response: &saveResponse{},
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				rsp, code, err := h.saveDrawing(r)
+				if err != nil {
+					writeAPIError(w, code, err.Error())
+					return
+				}
+				writeJSON(w, 200, rsp)
+			},
+		},
+	}
+	routes = append(routes, &apiRoute{
+		Method:   "POST",
+		Path:     "/compositions",
+		Summary:  "Save a composition of saved drawings as a new drawing",
+		Feature:  "compose",
+		Request:  "application/json",
+		Response: &saveResponse{},
+		Handler: func(w http.ResponseWriter, r *http.Request) {
+			c := &composeRequest{}
+			err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(c)
+			if err != nil {
+				writeAPIError(w, http.StatusBadRequest, "invalid composition")
+				return
+			}
+			err = c.check()
+			if err != nil {
+				writeAPIError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			images := []image.Image{}
+			for _, name := range c.Drawings {
+				if !h.tracked(name) {
+					writeAPIError(w, http.StatusNotFound, "unknown drawing: "+name)
+					return
+				}
+				img, err := decodePNGFile(filepath.Join(h.imgDir.Path(), name))
+				if err != nil {
+					slog.Error("could not decode drawing", "name", name, "err", err)
+					writeAPIError(w, 500, "could not decode drawing")
+					return
+				}
+				images = append(images, img)
+			}
+			composed, err := compose(c, images)
+			if err != nil {
+				writeAPIError(w, http.StatusUnprocessableEntity, err.Error())
+				return
+			}
+			buf := &bytes.Buffer{}
+			err = png.Encode(buf, composed)
+			if err != nil {
+				slog.Error("could not encode composition", "err", err)
+				writeAPIError(w, 500, "could not encode composition")
+				return
+			}
+			// Save the composition like a posted drawing
+			saveReq := r.Clone(r.Context())
+			saveReq.Header.Set("Content-Type", "image/png")
+			saveReq.Body = ioutil.NopCloser(buf)
+			saveReq.ContentLength = int64(buf.Len())
+			rsp, code, err := h.saveDrawing(saveReq)
+			if err != nil {
+				writeAPIError(w, code, err.Error())
+				return
+			}
+			writeJSON(w, 200, rsp)
+		},
+	}, &apiRoute{
+		Method:  "GET",
+		Path:    "/live",
+		Summary: "Stream saves, evictions and drawing counts over a WebSocket",
+		Feature: "live",
+		Handler: h.live.ServeHTTP,
+	})
+	routes = append(routes, &apiRoute{
+		Method:   "GET",
+		Path:     "/events",
+		Summary:  "List saves and evictions between from and to RFC3339 times",
+		Feature:  "events",
+		Response: &eventsResponse{},
+		Handler: func(w http.ResponseWriter, r *http.Request) {
+			from, to, limit, err := parseEventsQuery(r.URL.Query().Get)
+			if err != nil {
+				writeAPIError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			list, more, err := h.events.Query(from, to, limit)
+			if err != nil {
+				slog.Error("could not query events", "err", err)
+				writeAPIError(w, 500, "could not query events")
+				return
+			}
+			writeJSON(w, 200, &eventsResponse{Events: list, More: more})
+		},
+	})
+	routes = append(routes, h.optional...)
+	routes = append(routes, openAPIRoutes(routes)...)
+	h.mux.Handle(apiPrefix+"/", newAPIHandler(apiPrefix, routes))
+	files := http.FileServer(h.web)
+	h.mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" || r.URL.Path == "/index.html" {
+			// Revalidate the application so frontend updates are picked up
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+		files.ServeHTTP(w, r)
+	}))
+	return nil
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAPIHandler(t *testing.T) {
+	called := ""
+	route := func(method, path string) *apiRoute {
+		return &apiRoute{
+			Method: method,
+			Path:   path,
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				called = method + " " + path
+			},
+		}
+	}
+	routes := []*apiRoute{
+		route("GET", "/drawings"),
+		route("POST", "/drawings"),
+		route("DELETE", "/drawings/{name}"),
+	}
+	h := newAPIHandler("/api/v1", routes)
+	check := func(method, path string, code int, wanted string) {
+		called = ""
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		if w.Code != code || called != wanted {
+			t.Fatalf("%s %s: expected %d and %q, got %d and %q", method, path,
+				code, wanted, w.Code, called)
+		}
+	}
+	check("GET", "/api/v1/drawings", 200, "GET /drawings")
+	check("HEAD", "/api/v1/drawings", 200, "GET /drawings")
+	check("POST", "/api/v1/drawings", 200, "POST /drawings")
+	check("DELETE", "/api/v1/drawings/foo.png", 200, "DELETE /drawings/{name}")
+	check("DELETE", "/api/v1/drawings/", 404, "")
+	check("PUT", "/api/v1/drawings", 405, "")
+	check("GET", "/api/v1/unknown", 404, "")
+
+	spec := openAPISpec(routes, "/api/v1")
+	paths := spec["paths"].(map[string]interface{})
+	if len(paths) != 2 {
+		t.Fatalf("expected 2 paths, got %v", paths)
+	}
+	ops := paths["/drawings"].(map[string]interface{})
+	if ops["get"] == nil || ops["post"] == nil {
+		t.Fatalf("missing /drawings operations: %v", ops)
+	}
+}
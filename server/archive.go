@@ -0,0 +1,103 @@
+package server
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/pmezard/gribouillis/storage"
+)
+
+// openArchive returns the LimitedDir of the archive store, where drawings are
+// promoted to escape the images directory eviction. Zero limits mean
+// unlimited.
+func openArchive(dir, maxSize string, maxCount int) (*storage.LimitedDir, error) {
+	size, err := humanize.ParseBytes(maxSize)
+	if err != nil {
+		return nil, err
+	}
+	if size == 0 || size > math.MaxInt64 {
+		size = math.MaxInt64
+	}
+	if maxCount <= 0 {
+		maxCount = math.MaxInt32
+	}
+	return storage.OpenLimitedDir(dir, int64(size), maxCount)
+}
+
+// archiveDrawing copies drawing name from imagesDir to archiveDir. The copy
+// is written in a temporary file first so the server never sees it partial.
+func archiveDrawing(imagesDir, archiveDir, name string) error {
+	if name == "" || strings.ContainsAny(name, "/\\") ||
+		strings.HasPrefix(name, ".") {
+		return fmt.Errorf("invalid drawing name: %q", name)
+	}
+	src, err := os.Open(filepath.Join(imagesDir, name))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	err = os.MkdirAll(archiveDir, 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(archiveDir, ".archive-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, src)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(tmp.Name(), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(archiveDir, name))
+}
+
+// ArchiveCommand promotes saved drawings to the archive store.
+func ArchiveCommand(args []string) error {
+	fs := flag.NewFlagSet("archive", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Print(`Usage: gribouillis archive [OPTIONS] NAME...
+
+Copy saved drawings, named by their file names, to the archive directory. A
+running server picks them up within -reconcile-interval and serves them in
+"archive/".
+
+`)
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	imagesDir := fs.String("images-dir", "images",
+		"directory where drawings are saved")
+	archiveDir := fs.String("archive-dir", "",
+		"directory where drawings are archived")
+	fs.Parse(args)
+	if *archiveDir == "" {
+		return fmt.Errorf("-archive-dir is required")
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("at least one drawing name expected")
+	}
+	for _, name := range fs.Args() {
+		err := archiveDrawing(*imagesDir, *archiveDir, name)
+		if err != nil {
+			return fmt.Errorf("could not archive %s: %s", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+func TestArchive(t *testing.T) {
+	cfg, cleanup := newTestConfig(t)
+	defer cleanup()
+	cfg.ArchiveDir = filepath.Join(filepath.Dir(cfg.ImagesDir), "archive")
+	cfg.ArchiveMaxSize = "0"
+	cfg.MaxCount = 1
+	h, err := NewHandler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	save := func() string {
+		rsp, err := http.Post(srv.URL+"/api/v1/drawings", "image/png",
+			bytes.NewReader(encodeTestImage(t, 10, 10)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rsp.Body.Close()
+		saved := saveResponse{}
+		err = json.NewDecoder(rsp.Body).Decode(&saved)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return path.Base(saved.Path)
+	}
+	name := save()
+	err = archiveDrawing(cfg.ImagesDir, cfg.ArchiveDir, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := archiveDrawing(cfg.ImagesDir, cfg.ArchiveDir, "../x"); err == nil {
+		t.Fatal("invalid name was accepted")
+	}
+	// Evict the drawing from the images directory
+	save()
+
+	get := func(p string) int {
+		rsp, err := http.Get(srv.URL + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp.Body.Close()
+		return rsp.StatusCode
+	}
+	if code := get("/saved/" + name); code != 404 {
+		t.Fatalf("drawing was not evicted: %d", code)
+	}
+	if code := get("/archive/" + name); code != 200 {
+		t.Fatalf("could not fetch archived drawing: %d", code)
+	}
+	entries, err := ioutil.ReadDir(cfg.ArchiveDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("unexpected archive content: %d files", len(entries))
+	}
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"strings"
+
+	"github.com/pmezard/gribouillis/imageproc"
+)
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+func encodeBase83(value, length int) string {
+	s := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		s[i] = base83Chars[value%83]
+		value /= 83
+	}
+	return string(s)
+}
+
+func srgbToLinear(v uint8) float64 {
+	f := float64(v) / 255
+	if f <= 0.04045 {
+		return f / 12.92
+	}
+	return math.Pow((f+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(f float64) int {
+	f = math.Max(0, math.Min(1, f))
+	if f <= 0.0031308 {
+		return int(f*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(f, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
+
+// blurHash returns the BlurHash of m with cx horizontal and cy vertical
+// components, between 1 and 9. Transparent pixels are flattened on white. See
+// https://blurha.sh for the format.
+func blurHash(m image.Image, cx, cy int) string {
+	// The hash only keeps low frequencies, a small image is enough
+	b := m.Bounds()
+	if b.Dx() > 32 || b.Dy() > 32 {
+		w, h := 32, b.Dy()*32/b.Dx()
+		if b.Dy() > b.Dx() {
+			w, h = b.Dx()*32/b.Dy(), 32
+		}
+		m = imageproc.Downscale(m, int(math.Max(1, float64(w))), int(math.Max(1, float64(h))))
+		b = m.Bounds()
+	}
+	width, height := b.Dx(), b.Dy()
+	white := color.NRGBA{0xff, 0xff, 0xff, 0xff}
+	linear := make([][3]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := imageproc.Flatten(m.At(b.Min.X+x, b.Min.Y+y), white)
+			linear[y*width+x] = [3]float64{
+				srgbToLinear(c.R), srgbToLinear(c.G), srgbToLinear(c.B)}
+		}
+	}
+	factors := make([][3]float64, 0, cx*cy)
+	for j := 0; j < cy; j++ {
+		for i := 0; i < cx; i++ {
+			norm := 2.0
+			if i == 0 && j == 0 {
+				norm = 1
+			}
+			f := [3]float64{}
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					basis := math.Cos(math.Pi*float64(i*x)/float64(width)) *
+						math.Cos(math.Pi*float64(j*y)/float64(height))
+					for k, v := range linear[y*width+x] {
+						f[k] += basis * v
+					}
+				}
+			}
+			scale := norm / float64(width*height)
+			factors = append(factors, [3]float64{f[0] * scale, f[1] * scale,
+				f[2] * scale})
+		}
+	}
+
+	hash := &strings.Builder{}
+	hash.WriteString(encodeBase83((cx-1)+(cy-1)*9, 1))
+	maxValue := 1.0
+	if len(factors) > 1 {
+		actualMax := 0.0
+		for _, f := range factors[1:] {
+			for _, v := range f {
+				actualMax = math.Max(actualMax, math.Abs(v))
+			}
+		}
+		quantMax := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+		maxValue = float64(quantMax+1) / 166
+		hash.WriteString(encodeBase83(quantMax, 1))
+	} else {
+		hash.WriteString(encodeBase83(0, 1))
+	}
+	dc := factors[0]
+	hash.WriteString(encodeBase83(linearToSRGB(dc[0])<<16|
+		linearToSRGB(dc[1])<<8|linearToSRGB(dc[2]), 4))
+	for _, f := range factors[1:] {
+		value := 0
+		for _, v := range f {
+			q := math.Floor(signPow(v/maxValue, 0.5)*9 + 9.5)
+			value = value*19 + int(math.Max(0, math.Min(18, q)))
+		}
+		hash.WriteString(encodeBase83(value, 2))
+	}
+	return hash.String()
+}
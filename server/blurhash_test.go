@@ -0,0 +1,38 @@
+package server
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+func TestBlurHash(t *testing.T) {
+	white := image.NewRGBA(image.Rect(0, 0, 50, 40))
+	draw.Draw(white, white.Bounds(), image.White, image.Point{}, draw.Src)
+	red := image.NewNRGBA(image.Rect(-5, 3, 7, 100))
+	draw.Draw(red, red.Bounds(), image.NewUniform(color.NRGBA{0xff, 0, 0, 0xff}),
+		image.Point{}, draw.Src)
+	tests := []struct {
+		m  image.Image
+		dc string
+	}{
+		{white, encodeBase83(0xffffff, 4)},
+		// Transparent pixels are white
+		{image.NewRGBA(image.Rect(0, 0, 10, 10)), encodeBase83(0xffffff, 4)},
+		{image.NewGray(image.Rect(0, 0, 3, 3)), "0000"},
+		{red, encodeBase83(0xff0000, 4)},
+	}
+	for i, test := range tests {
+		h := blurHash(test.m, 4, 3)
+		if len(h) != 28 || h[0] != 'L' {
+			t.Fatalf("%d: invalid hash: %s", i, h)
+		}
+		if dc := h[2:6]; dc != test.dc {
+			t.Errorf("%d: expected %s average color, got %s", i, test.dc, dc)
+		}
+	}
+	if h := blurHash(white, 1, 1); h != "00"+encodeBase83(0xffffff, 4) {
+		t.Fatalf("unexpected single component hash: %s", h)
+	}
+}
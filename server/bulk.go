@@ -0,0 +1,232 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/pmezard/gribouillis/storage"
+)
+
+// maxBulkDeletions is the number of bulk deletions whose progress is kept.
+const maxBulkDeletions = 100
+
+// bulkDeletion is an admin deletion of the drawings matching a filter, run
+// by the job queue.
+type bulkDeletion struct {
+	ID string `json:"id"`
+	// From and To bound the creation times of the deleted drawings, To
+	// excluded, and Room is their room. Unset fields match all drawings.
+	From *time.Time `json:"from,omitempty"`
+	To   *time.Time `json:"to,omitempty"`
+	Room string     `json:"room,omitempty"`
+	// Status is "queued", "running", "done" or "failed" if the job failed.
+	Status string `json:"status"`
+	// Matched counts the drawings matching the filter so far, Deleted and
+	// Failed the ones deleted or which could not be.
+	Matched  int        `json:"matched"`
+	Deleted  int        `json:"deleted"`
+	Failed   int        `json:"failed"`
+	Created  time.Time  `json:"created"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+// matches returns whether the drawing created at created in room matches
+// the filter of d.
+func (d *bulkDeletion) matches(created time.Time, room string) bool {
+	return (d.From == nil || !created.Before(*d.From)) &&
+		(d.To == nil || created.Before(*d.To)) &&
+		(d.Room == "" || room == d.Room)
+}
+
+// bulkDeletions tracks the progress of bulk deletions in memory. Queued
+// ones are also persisted in their job argument, and restarted with the
+// server.
+type bulkDeletions struct {
+	lock sync.Mutex
+	ops  []*bulkDeletion
+}
+
+// Put records d, forgetting the oldest finished deletions beyond
+// maxBulkDeletions.
+func (b *bulkDeletions) Put(d *bulkDeletion) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	ops := []*bulkDeletion{}
+	for i, op := range b.ops {
+		if op.ID == d.ID ||
+			op.Status == "done" && len(b.ops)-i >= maxBulkDeletions {
+			continue
+		}
+		ops = append(ops, op)
+	}
+	b.ops = append(ops, d)
+}
+
+// Get returns a copy of bulk deletion id, or nil.
+func (b *bulkDeletions) Get(id string) *bulkDeletion {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, op := range b.ops {
+		if op.ID == id {
+			d := *op
+			return &d
+		}
+	}
+	return nil
+}
+
+// Update calls fn with bulk deletion d, with the lock held.
+func (b *bulkDeletions) Update(d *bulkDeletion, fn func(d *bulkDeletion)) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	fn(d)
+}
+
+// parseBulkTime parses the optional RFC3339 time query parameter key of r.
+func parseBulkTime(r *http.Request, key string) (*time.Time, error) {
+	v := r.URL.Query().Get(key)
+	if v == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s time", key)
+	}
+	return &t, nil
+}
+
+// bulkDelete runs the bulk deletion job whose argument is the JSON
+// encoded deletion.
+func (h *Handler) bulkDelete(job *Job) error {
+	d := &bulkDeletion{}
+	err := json.Unmarshal([]byte(job.Arg), d)
+	if err != nil {
+		return err
+	}
+	h.bulk.Put(d)
+	h.bulk.Update(d, func(d *bulkDeletion) { d.Status = "running" })
+	log := slog.With("job", job.ID, "bulk_deletion", d.ID)
+	for _, f := range h.imgDir.Files() {
+		room := ""
+		if d.Room != "" {
+			m, err := h.meta.Get(f.Name)
+			if err != nil {
+				log.Error("could not read metadata", "name", f.Name, "err", err)
+				continue
+			}
+			room = m.Room
+		}
+		if !d.matches(f.ModTime, room) {
+			continue
+		}
+		_, err := h.removeDrawing(log, f.Name, removalModerated)
+		h.bulk.Update(d, func(d *bulkDeletion) {
+			d.Matched++
+			if err == nil {
+				d.Deleted++
+			} else if err != storage.ErrNotTracked {
+				d.Failed++
+			}
+		})
+	}
+	h.bulk.Update(d, func(d *bulkDeletion) {
+		now := time.Now().UTC()
+		d.Status = "done"
+		d.Finished = &now
+	})
+	log.Info("bulk deletion done", "deleted", d.Deleted, "failed", d.Failed)
+	return nil
+}
+
+// bulkRoutes returns the admin endpoints of bulk operations.
+func (h *Handler) bulkRoutes() []*apiRoute {
+	h.bulk = &bulkDeletions{}
+	h.jobs.Handle("bulk-delete", h.bulkDelete)
+	return []*apiRoute{
+		{
+			Method:   "POST",
+			Path:     "/bulk-deletions",
+			Summary:  "Delete the drawings matching a filter in the background",
+			Response: &bulkDeletion{},
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				d := &bulkDeletion{
+					Room:    r.URL.Query().Get("room"),
+					Status:  "queued",
+					Created: time.Now().UTC(),
+				}
+				var err error
+				d.From, err = parseBulkTime(r, "from")
+				if err == nil {
+					d.To, err = parseBulkTime(r, "to")
+				}
+				if err != nil {
+					writeAPIError(w, http.StatusBadRequest, err.Error())
+					return
+				}
+				if d.Room != "" && !roomIDRe.MatchString(d.Room) {
+					writeAPIError(w, http.StatusBadRequest, "invalid room identifier")
+					return
+				}
+				if d.From == nil && d.To == nil && d.Room == "" {
+					writeAPIError(w, http.StatusBadRequest, "a filter is required")
+					return
+				}
+				buf := make([]byte, 8)
+				_, err = rand.Read(buf)
+				if err != nil {
+					writeAPIError(w, 500, "could not queue deletion")
+					return
+				}
+				d.ID = hex.EncodeToString(buf)
+				arg, err := json.Marshal(d)
+				if err != nil {
+					writeAPIError(w, 500, "could not queue deletion")
+					return
+				}
+				h.bulk.Put(d)
+				err = h.jobs.Push("bulk-delete", string(arg), 0)
+				if err != nil {
+					slog.Error("could not queue bulk deletion", "err", err)
+					writeAPIError(w, 500, "could not queue deletion")
+					return
+				}
+				h.requestLogger(r).Info("queued bulk deletion", "id", d.ID,
+					"from", d.From, "to", d.To, "room", d.Room)
+				writeJSON(w, http.StatusAccepted, h.bulk.Get(d.ID))
+			},
+		},
+		{
+			Method:   "GET",
+			Path:     "/bulk-deletions/{id}",
+			Summary:  "Report the progress of a bulk deletion",
+			Response: &bulkDeletion{},
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				id := path.Base(r.URL.Path)
+				if d := h.bulk.Get(id); d != nil {
+					writeJSON(w, 200, d)
+					return
+				}
+				// Deletions queued before a restart are only in the jobs
+				for _, job := range h.jobs.List() {
+					d := &bulkDeletion{}
+					if job.Kind == "bulk-delete" &&
+						json.Unmarshal([]byte(job.Arg), d) == nil && d.ID == id {
+						if job.Failed {
+							d.Status = "failed"
+						}
+						writeJSON(w, 200, d)
+						return
+					}
+				}
+				writeAPIError(w, http.StatusNotFound, "unknown bulk deletion")
+			},
+		},
+	}
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestAdminBulkDelete(t *testing.T) {
+	cfg, cleanup := newTestConfig(t)
+	defer cleanup()
+	cfg.AdminToken = "secret"
+	h, err := NewHandler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	for _, room := range []string{"a", "b", "a"} {
+		req := httptest.NewRequest("POST", "/api/v1/drawings?room="+room,
+			bytes.NewReader(encodeTestImage(t, 10, 10)))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("could not save drawing: %d\n%s", w.Code, w.Body.String())
+		}
+	}
+
+	admin := func(method, path string, rsp *bulkDeletion) int {
+		t.Helper()
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code == 200 || w.Code == 202 {
+			err := json.Unmarshal(w.Body.Bytes(), rsp)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code
+	}
+	// bulkDelete deletes the drawings matching query and waits for the
+	// deletion to complete.
+	bulkDelete := func(query string) *bulkDeletion {
+		t.Helper()
+		d := &bulkDeletion{}
+		if code := admin("POST", "/admin/bulk-deletions?"+query, d); code != 202 {
+			t.Fatalf("could not queue bulk deletion: %d", code)
+		}
+		deadline := time.Now().Add(10 * time.Second)
+		for d.Status != "done" {
+			if time.Now().After(deadline) {
+				t.Fatalf("bulk deletion did not complete: %+v", d)
+			}
+			time.Sleep(10 * time.Millisecond)
+			if code := admin("GET", "/admin/bulk-deletions/"+d.ID, d); code != 200 {
+				t.Fatalf("could not get bulk deletion: %d", code)
+			}
+		}
+		return d
+	}
+
+	for _, query := range []string{"", "from=yesterday", "room=a%2F"} {
+		if code := admin("POST", "/admin/bulk-deletions?"+query, nil); code != 400 {
+			t.Fatalf("%q: expected 400, got %d", query, code)
+		}
+	}
+	past := url.QueryEscape(time.Now().Add(-time.Hour).Format(time.RFC3339))
+	if d := bulkDelete("room=a&to=" + past); d.Matched != 0 {
+		t.Fatalf("deleted older drawings: %+v", d)
+	}
+	d := bulkDelete("room=a&from=" + past)
+	if d.Matched != 2 || d.Deleted != 2 || d.Failed != 0 || d.Finished == nil {
+		t.Fatalf("unexpected bulk deletion: %+v", d)
+	}
+	names := h.imgDir.List()
+	if len(names) != 1 {
+		t.Fatalf("expected 1 drawing left, got %v", names)
+	}
+	if m, err := h.meta.Get(names[0]); err != nil || m.Room != "b" {
+		t.Fatalf("unexpected drawing left: %+v, %v", m, err)
+	}
+	if code := admin("GET", "/admin/bulk-deletions/unknown", nil); code != 404 {
+		t.Fatalf("expected 404, got %d", code)
+	}
+}
@@ -0,0 +1,279 @@
+package server
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/pmezard/gribouillis/storage"
+)
+
+// checkIssue describes an inconsistency found in an instance storage.
+type checkIssue struct {
+	Name     string
+	Problem  string
+	Repaired bool
+}
+
+// checker verifies an images directory and its jobs file, and optionally
+// repairs what it can.
+type checker struct {
+	imagesDir string
+	jobsPath  string
+	metaDir   string
+	// quarantineDir, if set, receives invalid images instead of deleting
+	// them on repair.
+	quarantineDir string
+	maxSize       int64
+	maxCount      int
+	repair        bool
+	issues        []*checkIssue
+}
+
+// report records an issue, running fix if repair is enabled.
+func (c *checker) report(name, problem string, fix func() error) {
+	issue := &checkIssue{
+		Name:    name,
+		Problem: problem,
+	}
+	if c.repair && fix != nil {
+		err := fix()
+		if err != nil {
+			issue.Problem += fmt.Sprintf(" (repair failed: %s)", err)
+		} else {
+			issue.Repaired = true
+		}
+	}
+	c.issues = append(c.issues, issue)
+}
+
+func decodePNGFile(path string) (image.Image, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	return png.Decode(fp)
+}
+
+// checkImages verifies stored files are decodable images and the directory
+// respects the size and count limits. It returns the names of valid images.
+func (c *checker) checkImages() ([]string, error) {
+	entries, err := ioutil.ReadDir(c.imagesDir)
+	if err != nil {
+		return nil, err
+	}
+	valid := []string{}
+	count, size := 0, int64(0)
+	for _, e := range entries {
+		name := e.Name()
+		path := filepath.Join(c.imagesDir, name)
+		remove := func() error {
+			return os.Remove(path)
+		}
+		if strings.HasPrefix(name, ".") {
+			if e.Mode().IsRegular() {
+				c.report(name, "temporary file leftover", remove)
+			}
+			continue
+		}
+		if !e.Mode().IsRegular() {
+			c.report(name, "not a regular file", nil)
+			continue
+		}
+		_, err := decodePNGFile(path)
+		if err != nil {
+			fix := remove
+			if c.quarantineDir != "" {
+				fix = func() error {
+					return quarantineFile(c.imagesDir, c.quarantineDir, name, time.Now())
+				}
+			}
+			c.report(name, fmt.Sprintf("invalid image: %s", err), fix)
+			continue
+		}
+		valid = append(valid, name)
+		count++
+		size += e.Size()
+	}
+	if count > c.maxCount || size > c.maxSize {
+		// Opening a LimitedDir removes the oldest files beyond limits
+		c.report(".", fmt.Sprintf("%d files, %s, exceed limits of %d files, %s",
+			count, humanize.Bytes(uint64(size)), c.maxCount,
+			humanize.Bytes(uint64(c.maxSize))), func() error {
+			d, err := storage.OpenLimitedDir(c.imagesDir, c.maxSize, c.maxCount)
+			if err == nil {
+				valid = d.List()
+			}
+			return err
+		})
+	}
+	return valid, nil
+}
+
+// checkJobs verifies the jobs file can be loaded and its jobs refer to
+// existing images.
+func (c *checker) checkJobs(images []string) error {
+	q, err := OpenJobQueue(c.jobsPath, 0)
+	if err != nil {
+		c.report(filepath.Base(c.jobsPath), err.Error(), nil)
+		return nil
+	}
+	exists := map[string]bool{}
+	for _, name := range images {
+		exists[name] = true
+	}
+	dropped := map[*Job]bool{}
+	for _, j := range q.jobs {
+		if j.Kind != "recompress" || exists[j.Arg] {
+			continue
+		}
+		j := j
+		c.report(filepath.Base(c.jobsPath), fmt.Sprintf(
+			"job %s refers to missing image %s", j.ID, j.Arg), func() error {
+			dropped[j] = true
+			return nil
+		})
+	}
+	if len(dropped) == 0 {
+		return nil
+	}
+	jobs := []*Job{}
+	for _, j := range q.jobs {
+		if !dropped[j] {
+			jobs = append(jobs, j)
+		}
+	}
+	q.jobs = jobs
+	return q.save()
+}
+
+// checkMeta verifies metadata files are readable and belong to existing
+// images.
+func (c *checker) checkMeta(images []string) error {
+	entries, err := ioutil.ReadDir(c.metaDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	exists := map[string]bool{}
+	for _, name := range images {
+		exists[name] = true
+	}
+	store := &metaStore{dir: c.metaDir}
+	for _, e := range entries {
+		path := filepath.Join(c.metaDir, e.Name())
+		remove := func() error {
+			return os.Remove(path)
+		}
+		name := strings.TrimSuffix(e.Name(), ".json")
+		if strings.HasPrefix(e.Name(), ".") || name == e.Name() {
+			c.report(e.Name(), "unexpected file in metadata directory", remove)
+		} else if !exists[name] {
+			c.report(e.Name(), fmt.Sprintf("metadata of missing image %s", name),
+				remove)
+		} else if _, err := store.Get(name); err != nil {
+			c.report(e.Name(), err.Error(), remove)
+		}
+	}
+	return nil
+}
+
+// check runs all checks and returns found issues.
+func (c *checker) check() ([]*checkIssue, error) {
+	images, err := c.checkImages()
+	if err != nil {
+		return nil, err
+	}
+	err = c.checkJobs(images)
+	if err != nil {
+		return nil, err
+	}
+	err = c.checkMeta(images)
+	if err != nil {
+		return nil, err
+	}
+	return c.issues, nil
+}
+
+// CheckCommand verifies the storage of a stopped gribouillis instance.
+func CheckCommand(args []string) error {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Print(`Usage: gribouillis check [OPTIONS]
+
+Check the storage of a gribouillis instance: stored files must be decodable
+images, their count and total size must respect the limits and background jobs
+and metadata must refer to existing images. With --repair, invalid images,
+temporary file leftovers, jobs and metadata of missing images are removed, and
+oldest images deleted until limits are met. With --quarantine-dir, invalid
+images are moved there instead of being removed. Stop the server before
+repairing.
+
+`)
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	imagesDir := fs.String("images-dir", "images",
+		"directory where drawings are saved")
+	jobsPath := fs.String("jobs", "",
+		"file persisting background jobs, defaults to images directory with a -jobs.json suffix")
+	maxSizeStr := fs.String("max-size", "50MB",
+		"maximum combined size of saved drawings")
+	maxCount := fs.Int("max-count", 500, "maximum number of saved drawings")
+	metaDir := fs.String("meta-dir", "",
+		"directory where drawings metadata are saved, defaults to images directory with a -meta suffix")
+	quarantineDir := fs.String("quarantine-dir", "",
+		"directory where invalid images are moved on repair instead of being deleted")
+	repair := fs.Bool("repair", false, "fix found problems when possible")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return fmt.Errorf("no argument expected")
+	}
+	maxSize, err := humanize.ParseBytes(*maxSizeStr)
+	if err != nil {
+		return err
+	}
+	c := &checker{
+		imagesDir:     *imagesDir,
+		jobsPath:      *jobsPath,
+		metaDir:       *metaDir,
+		quarantineDir: *quarantineDir,
+		maxSize:       int64(maxSize),
+		maxCount:      *maxCount,
+		repair:        *repair,
+	}
+	if c.jobsPath == "" {
+		c.jobsPath = defaultJobsPath(c.imagesDir)
+	}
+	if c.metaDir == "" {
+		c.metaDir = defaultMetaDir(c.imagesDir)
+	}
+	issues, err := c.check()
+	if err != nil {
+		return err
+	}
+	remaining := 0
+	for _, issue := range issues {
+		state := ""
+		if issue.Repaired {
+			state = " [repaired]"
+		} else {
+			remaining++
+		}
+		fmt.Printf("%s: %s%s\n", issue.Name, issue.Problem, state)
+	}
+	if remaining > 0 {
+		return fmt.Errorf("%d problems found", remaining)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "gribouillis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	imagesDir := filepath.Join(tmpDir, "images")
+	err = os.Mkdir(imagesDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeImage := func(name string) {
+		err := ioutil.WriteFile(filepath.Join(imagesDir, name),
+			encodeTestImage(t, 4, 4), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeImage("a.png")
+	writeImage("b.png")
+	err = ioutil.WriteFile(filepath.Join(imagesDir, "broken.png"), []byte("x"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(imagesDir, ".recompress-1"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobsPath := defaultJobsPath(imagesDir)
+	q, err := OpenJobQueue(jobsPath, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.png", "missing.png"} {
+		err = q.Push("recompress", name, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	metaDir := defaultMetaDir(imagesDir)
+	store, err := openMetaStore(metaDir, imagesDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Put("missing.png", &Metadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(repair bool) []*checkIssue {
+		c := &checker{
+			imagesDir: imagesDir,
+			jobsPath:  jobsPath,
+			metaDir:   metaDir,
+			maxSize:   1 << 20,
+			maxCount:  1,
+			repair:    repair,
+		}
+		issues, err := c.check()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return issues
+	}
+	issues := check(false)
+	if len(issues) != 5 {
+		t.Fatalf("expected 5 issues, got %d", len(issues))
+	}
+	for _, issue := range check(true) {
+		if !issue.Repaired {
+			t.Fatalf("issue not repaired: %s: %s", issue.Name, issue.Problem)
+		}
+	}
+	issues = check(false)
+	for _, issue := range issues {
+		t.Errorf("unexpected issue after repair: %s: %s", issue.Name, issue.Problem)
+	}
+	jobs, err := readJobs(jobsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) > 1 {
+		t.Fatalf("stale jobs were not removed: %+v", jobs)
+	}
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pmezard/gribouillis/storage"
+)
+
+// coldDrawing records the metadata of a drawing kept in cold storage.
+type coldDrawing struct {
+	Metadata *Metadata `json:"metadata"`
+	Created  time.Time `json:"created"`
+	Evicted  time.Time `json:"evicted"`
+}
+
+// coldStore keeps evicted drawings in dir, possibly on slower and cheaper
+// storage, for a grace period during which they are still served.
+type coldStore struct {
+	dir   string
+	grace time.Duration
+}
+
+// defaultColdDir returns the cold storage directory used with imagesDir.
+func defaultColdDir(imagesDir string) string {
+	return filepath.Clean(imagesDir) + "-cold"
+}
+
+// openColdStore returns a coldStore keeping drawings in dir for grace.
+func openColdStore(dir string, grace time.Duration) (*coldStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &coldStore{dir: dir, grace: grace}, nil
+}
+
+func (s *coldStore) metaPath(name string) string {
+	return filepath.Join(s.dir, name+".json")
+}
+
+// copyFile copies src to dst, through a temporary file in dst directory.
+// Modification time is preserved.
+func copyFile(src, dst string) error {
+	fp, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	st, err := fp.Stat()
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), ".copy-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, fp)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(tmp.Name(), 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Chtimes(tmp.Name(), st.ModTime(), st.ModTime())
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// Keep copies drawing name of imagesDir, about to be evicted, with its
+// metadata m.
+func (s *coldStore) Keep(imagesDir, name string, m *Metadata, now time.Time) error {
+	src := filepath.Join(imagesDir, name)
+	st, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	dst := filepath.Join(s.dir, name)
+	// Cold storage is usually another filesystem, linking is a bonus
+	err = os.Link(src, dst)
+	if err != nil {
+		err = copyFile(src, dst)
+		if err != nil {
+			return err
+		}
+	}
+	data, err := json.Marshal(&coldDrawing{
+		Metadata: m,
+		Created:  st.ModTime().UTC(),
+		Evicted:  now.UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.metaPath(name), data, 0644)
+}
+
+// Get returns the record of drawing name, or nil if it is not in cold
+// storage or its grace period is over.
+func (s *coldStore) Get(name string, now time.Time) (*coldDrawing, error) {
+	if strings.ContainsAny(name, "/\\") || strings.HasPrefix(name, ".") {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(s.metaPath(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	d := &coldDrawing{}
+	err = json.Unmarshal(data, d)
+	if err != nil {
+		return nil, err
+	}
+	if d.Metadata == nil {
+		d.Metadata = &Metadata{}
+	}
+	if now.After(s.Expires(d)) {
+		return nil, nil
+	}
+	return d, nil
+}
+
+// Expires returns when drawing d leaves cold storage.
+func (s *coldStore) Expires(d *coldDrawing) time.Time {
+	return d.Evicted.Add(s.grace)
+}
+
+// Expire removes drawings whose grace period is over, and leftovers.
+func (s *coldStore) Expire(now time.Time) error {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasPrefix(name, ".") {
+			if now.Sub(e.ModTime()) > storage.StaleTempAge {
+				os.Remove(filepath.Join(s.dir, name))
+			}
+			continue
+		}
+		if strings.HasSuffix(name, ".json") {
+			continue
+		}
+		d, err := s.Get(name, now)
+		if err != nil {
+			slog.Warn("could not read cold drawing", "name", name, "err", err)
+			continue
+		}
+		if d == nil {
+			os.Remove(filepath.Join(s.dir, name))
+			os.Remove(s.metaPath(name))
+		}
+	}
+	return nil
+}
+
+// Run expires drawings every interval, until ctx is done.
+func (s *coldStore) Run(ctx context.Context, interval time.Duration) {
+	for {
+		err := s.Expire(time.Now())
+		if err != nil {
+			slog.Error("could not expire cold drawings", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Fallback returns a handler serving the drawings named by request paths
+// with h, or from cold storage if h does not have them.
+func (s *coldStore) Fallback(images string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		if _, err := os.Stat(filepath.Join(images, name)); !os.IsNotExist(err) ||
+			(r.Method != "GET" && r.Method != "HEAD") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		d, err := s.Get(name, time.Now())
+		if err != nil || d == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Expires", s.Expires(d).Format(http.TimeFormat))
+		http.ServeFile(w, r, filepath.Join(s.dir, name))
+	})
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestColdStorage(t *testing.T) {
+	cfg, cleanup := newTestConfig(t)
+	defer cleanup()
+	cfg.MaxCount = 1
+	cfg.ColdGrace = "1h"
+	h, err := NewHandler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	save := func(query string) *saveResponse {
+		t.Helper()
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/drawings?"+query,
+			bytes.NewReader(encodeTestImage(t, 10, 10))))
+		saved := &saveResponse{}
+		err := json.Unmarshal(w.Body.Bytes(), saved)
+		if err != nil || w.Code != 200 {
+			t.Fatalf("could not save drawing: %d, %v", w.Code, err)
+		}
+		return saved
+	}
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+	evicted := save("title=Cat")
+	// Evicts the first drawing, the second being then deleted by its owner
+	deleted := save("")
+	req := httptest.NewRequest("DELETE", deleted.Path, nil)
+	req.Header.Set("Authorization", "Bearer "+deleted.DeleteToken)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("could not delete drawing: %d", w.Code)
+	}
+
+	w = get(evicted.Path)
+	if w.Code != 200 || w.Header().Get("Expires") == "" {
+		t.Fatalf("evicted drawing not served from cold storage: %d", w.Code)
+	}
+	w = get(evicted.PagePath)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "This drawing is archived") ||
+		!strings.Contains(w.Body.String(), "Cat") {
+		t.Fatalf("unexpected archived page: %d\n%s", w.Code, w.Body.String())
+	}
+	for _, p := range []string{deleted.Path, deleted.PagePath} {
+		if w := get(p); w.Code != 404 {
+			t.Fatalf("deleted drawing is served from %s: %d", p, w.Code)
+		}
+	}
+
+	// Grace period is over
+	coldDir := defaultColdDir(cfg.ImagesDir)
+	cold, err := openColdStore(coldDir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cold.Expire(time.Now().Add(2 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ioutil.ReadDir(coldDir)
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("cold storage was not emptied: %v, %v", entries, err)
+	}
+	if w := get(evicted.Path); w.Code != 404 {
+		t.Fatalf("expired drawing is still served: %d", w.Code)
+	}
+}
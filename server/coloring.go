@@ -0,0 +1,59 @@
+package server
+
+import (
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/pmezard/gribouillis/imageproc"
+)
+
+// coloringThreshold is the default luminance gradient, from 0 to 255, above
+// which coloring page pixels are inked.
+const coloringThreshold = 32
+
+// coloringPage returns a black on white line-art version of m, suitable for
+// printing and coloring. Pixels where the luminance gradient of m, flattened
+// on white and computed with a Sobel filter, exceeds threshold are black.
+func coloringPage(m image.Image, threshold float64) *image.Gray {
+	b := m.Bounds()
+	w, h := b.Dx(), b.Dy()
+	white := color.NRGBA{0xff, 0xff, 0xff, 0xff}
+	lum := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := imageproc.Flatten(m.At(b.Min.X+x, b.Min.Y+y), white)
+			lum[y*w+x] = 0.299*float64(c.R) + 0.587*float64(c.G) +
+				0.114*float64(c.B)
+		}
+	}
+	at := func(x, y int) float64 {
+		if x < 0 {
+			x = 0
+		} else if x >= w {
+			x = w - 1
+		}
+		if y < 0 {
+			y = 0
+		} else if y >= h {
+			y = h - 1
+		}
+		return lum[y*w+x]
+	}
+	out := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			gx := at(x+1, y-1) + 2*at(x+1, y) + at(x+1, y+1) -
+				at(x-1, y-1) - 2*at(x-1, y) - at(x-1, y+1)
+			gy := at(x-1, y+1) + 2*at(x, y+1) + at(x+1, y+1) -
+				at(x-1, y-1) - 2*at(x, y-1) - at(x+1, y-1)
+			// Kernels weights sum to 4
+			v := uint8(0xff)
+			if math.Hypot(gx, gy)/4 > threshold {
+				v = 0
+			}
+			out.Pix[y*out.Stride+x] = v
+		}
+	}
+	return out
+}
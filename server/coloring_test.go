@@ -0,0 +1,43 @@
+package server
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestColoringPage(t *testing.T) {
+	m := image.NewNRGBA(image.Rect(0, 0, 20, 20))
+	for y := 5; y < 15; y++ {
+		for x := 5; x < 15; x++ {
+			m.Set(x, y, color.NRGBA{0x20, 0x40, 0xc0, 0xff})
+		}
+	}
+	page := coloringPage(m, coloringThreshold)
+	if page.Bounds() != m.Bounds() {
+		t.Fatalf("unexpected bounds: %v", page.Bounds())
+	}
+	tests := []struct {
+		x, y int
+		ink  bool
+	}{
+		{0, 0, false},
+		{4, 10, true},
+		{5, 10, true},
+		{10, 10, false},
+		{10, 14, true},
+		{19, 19, false},
+	}
+	for _, test := range tests {
+		ink := page.GrayAt(test.x, test.y).Y == 0
+		if ink != test.ink {
+			t.Errorf("%d,%d: expected ink %v, got %v", test.x, test.y,
+				test.ink, ink)
+		}
+	}
+	// Faint changes are dropped with higher thresholds
+	page = coloringPage(m, 250)
+	if page.GrayAt(5, 10).Y == 0 {
+		t.Fatal("faint outline was inked")
+	}
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pmezard/gribouillis/client"
+)
+
+// SaveCommand uploads image files to a running server and prints their URLs.
+func SaveCommand(args []string) error {
+	fs := flag.NewFlagSet("save", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Print(`Usage: gribouillis save [OPTIONS] FILE...
+
+Upload PNG files to a gribouillis server and print the saved images URLs.
+
+`)
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	server := fs.String("server", "http://localhost:5001", "server base URL")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return fmt.Errorf("at least one file expected")
+	}
+	c := client.New(*server)
+	for _, path := range fs.Args() {
+		fp, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		d, err := c.Save(context.Background(), fp)
+		fp.Close()
+		if err != nil {
+			return fmt.Errorf("could not save %s: %s", path, err)
+		}
+		fmt.Println(d.URL)
+	}
+	return nil
+}
+
+// JobsCommand lists the pending and failed jobs of a server instance.
+func JobsCommand(args []string) error {
+	fs := flag.NewFlagSet("jobs", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Print(`Usage: gribouillis jobs [OPTIONS]
+
+List pending and failed background jobs of a gribouillis instance.
+
+`)
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	imagesDir := fs.String("images-dir", "images",
+		"directory where drawings are saved")
+	jobsPath := fs.String("jobs", "",
+		"file persisting background jobs, defaults to images directory with a -jobs.json suffix")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return fmt.Errorf("no argument expected")
+	}
+	path := *jobsPath
+	if path == "" {
+		path = defaultJobsPath(*imagesDir)
+	}
+	jobs, err := readJobs(path)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tKIND\tARG\tSTATE\tATTEMPTS\tNEXT RUN\tLAST ERROR")
+	for _, j := range jobs {
+		state := "pending"
+		if j.Failed {
+			state = "failed"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", j.ID, j.Kind, j.Arg,
+			state, j.Attempts, j.NextRun.Format(time.RFC3339), j.LastError)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+const (
+	// composeMaxDrawings is the maximum number of composed drawings.
+	composeMaxDrawings = 16
+	// composeMaxPixels bounds the composition dimensions.
+	composeMaxPixels = 32 << 20
+)
+
+// composeRequest describes a composition of stored drawings.
+type composeRequest struct {
+	// Layout is "grid", placing drawings in rows of Columns cells, or
+	// "overlay", stacking them in order.
+	Layout string `json:"layout"`
+	// Drawings are file names in saved/.
+	Drawings []string `json:"drawings"`
+	// Columns is the number of grid columns, all drawings on a single row
+	// by default.
+	Columns int `json:"columns,omitempty"`
+	// Opacity lists the opacity of each drawing, from 0 to 1, defaulting
+	// to 1.
+	Opacity []float64 `json:"opacity,omitempty"`
+}
+
+// check validates the request fields, but not the drawings names.
+func (c *composeRequest) check() error {
+	if c.Layout != "grid" && c.Layout != "overlay" {
+		return fmt.Errorf("invalid layout: %q", c.Layout)
+	}
+	if len(c.Drawings) == 0 || len(c.Drawings) > composeMaxDrawings {
+		return fmt.Errorf("from 1 to %d drawings can be composed",
+			composeMaxDrawings)
+	}
+	if c.Columns < 0 {
+		return fmt.Errorf("invalid columns: %d", c.Columns)
+	}
+	if len(c.Opacity) > len(c.Drawings) {
+		return fmt.Errorf("more opacities than drawings")
+	}
+	for _, o := range c.Opacity {
+		if !(o >= 0 && o <= 1) {
+			return fmt.Errorf("invalid opacity: %v", o)
+		}
+	}
+	return nil
+}
+
+// compose draws images on a transparent canvas as described by c. Each
+// image is centered in a cell as large as the largest images.
+func compose(c *composeRequest, images []image.Image) (*image.NRGBA, error) {
+	cellW, cellH := 0, 0
+	for _, m := range images {
+		if b := m.Bounds(); b.Dx() > cellW {
+			cellW = b.Dx()
+		}
+		if b := m.Bounds(); b.Dy() > cellH {
+			cellH = b.Dy()
+		}
+	}
+	cols, rows := 1, 1
+	if c.Layout == "grid" {
+		cols = c.Columns
+		if cols == 0 || cols > len(images) {
+			cols = len(images)
+		}
+		rows = (len(images) + cols - 1) / cols
+	}
+	if int64(cellW)*int64(cols)*int64(cellH)*int64(rows) > composeMaxPixels {
+		return nil, fmt.Errorf("composition is larger than %d pixels",
+			composeMaxPixels)
+	}
+	out := image.NewNRGBA(image.Rect(0, 0, cellW*cols, cellH*rows))
+	for i, m := range images {
+		x, y := 0, 0
+		if c.Layout == "grid" {
+			x, y = (i%cols)*cellW, (i/cols)*cellH
+		}
+		b := m.Bounds()
+		x += (cellW - b.Dx()) / 2
+		y += (cellH - b.Dy()) / 2
+		r := image.Rect(x, y, x+b.Dx(), y+b.Dy())
+		if i < len(c.Opacity) && c.Opacity[i] < 1 {
+			mask := image.NewUniform(color.Alpha16{uint16(c.Opacity[i] * 0xffff)})
+			draw.DrawMask(out, r, m, b.Min, mask, image.Point{}, draw.Over)
+		} else {
+			draw.Draw(out, r, m, b.Min, draw.Over)
+		}
+	}
+	return out, nil
+}
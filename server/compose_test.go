@@ -0,0 +1,145 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompose(t *testing.T) {
+	red := image.NewNRGBA(image.Rect(0, 0, 4, 2))
+	blue := image.NewNRGBA(image.Rect(10, 10, 12, 12))
+	for i := 0; i < len(red.Pix); i += 4 {
+		copy(red.Pix[i:], []byte{0xff, 0, 0, 0xff})
+	}
+	for i := 0; i < len(blue.Pix); i += 4 {
+		copy(blue.Pix[i:], []byte{0, 0, 0xff, 0xff})
+	}
+
+	c := &composeRequest{Layout: "grid", Drawings: []string{"a", "b", "c"},
+		Columns: 2}
+	out, err := compose(c, []image.Image{red, blue, red})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Bounds() != image.Rect(0, 0, 8, 4) {
+		t.Fatalf("unexpected grid bounds: %v", out.Bounds())
+	}
+	for _, p := range []struct {
+		x, y int
+		c    color.NRGBA
+	}{
+		{0, 0, color.NRGBA{0xff, 0, 0, 0xff}},
+		{4, 0, color.NRGBA{}},
+		{5, 0, color.NRGBA{0, 0, 0xff, 0xff}},
+		{0, 2, color.NRGBA{0xff, 0, 0, 0xff}},
+		{4, 2, color.NRGBA{}},
+	} {
+		if got := out.NRGBAAt(p.x, p.y); got != p.c {
+			t.Errorf("grid %d,%d: expected %v, got %v", p.x, p.y, p.c, got)
+		}
+	}
+
+	c = &composeRequest{Layout: "overlay", Drawings: []string{"a", "b"},
+		Opacity: []float64{1, 0.5}}
+	out, err = compose(c, []image.Image{red, blue})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Bounds() != image.Rect(0, 0, 4, 2) {
+		t.Fatalf("unexpected overlay bounds: %v", out.Bounds())
+	}
+	if got := out.NRGBAAt(0, 0); got != (color.NRGBA{0xff, 0, 0, 0xff}) {
+		t.Fatalf("unexpected uncovered color: %v", got)
+	}
+	if got := out.NRGBAAt(1, 0); got.R < 0x70 || got.R > 0x90 ||
+		got.B < 0x70 || got.B > 0x90 {
+		t.Fatalf("unexpected blended color: %v", got)
+	}
+
+	invalid := []*composeRequest{
+		{Layout: "stack", Drawings: []string{"a"}},
+		{Layout: "grid"},
+		{Layout: "grid", Drawings: make([]string, composeMaxDrawings+1)},
+		{Layout: "grid", Drawings: []string{"a"}, Columns: -1},
+		{Layout: "grid", Drawings: []string{"a"}, Opacity: []float64{1, 1}},
+		{Layout: "grid", Drawings: []string{"a"}, Opacity: []float64{2}},
+	}
+	for _, c := range invalid {
+		if err := c.check(); err == nil {
+			t.Errorf("invalid composition was accepted: %+v", c)
+		}
+	}
+}
+
+func TestComposeHandler(t *testing.T) {
+	cfg, cleanup := newTestConfig(t)
+	defer cleanup()
+	h, err := NewHandler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	post := func(body interface{}) (*http.Response, saveResponse) {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp, err := http.Post(srv.URL+"/api/v1/compositions", "application/json",
+			bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rsp.Body.Close()
+		saved := saveResponse{}
+		json.NewDecoder(rsp.Body).Decode(&saved)
+		return rsp, saved
+	}
+	names := []string{}
+	for i := 0; i < 2; i++ {
+		rsp, err := http.Post(srv.URL+"/api/v1/drawings", "image/png",
+			bytes.NewReader(encodeTestImage(t, 10, 10)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		saved := saveResponse{}
+		err = json.NewDecoder(rsp.Body).Decode(&saved)
+		rsp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, path.Base(saved.Path))
+	}
+
+	rsp, saved := post(&composeRequest{Layout: "grid", Drawings: names})
+	if rsp.StatusCode != 200 {
+		t.Fatalf("unexpected status: %d", rsp.StatusCode)
+	}
+	img, err := decodePNGFile(filepath.Join(cfg.ImagesDir, path.Base(saved.Path)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two padded 50x50 drawings, padded again
+	if b := img.Bounds(); b.Dx() != 140 || b.Dy() != 90 {
+		t.Fatalf("unexpected composition bounds: %v", b)
+	}
+
+	rsp, _ = post(&composeRequest{Layout: "grid",
+		Drawings: []string{names[0], "missing.png"}})
+	if rsp.StatusCode != 404 {
+		t.Fatalf("expected 404 for unknown drawing, got %d", rsp.StatusCode)
+	}
+	rsp, _ = post(&composeRequest{Layout: "stack", Drawings: names})
+	if rsp.StatusCode != 400 {
+		t.Fatalf("expected 400 for invalid layout, got %d", rsp.StatusCode)
+	}
+}
@@ -0,0 +1,633 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Config holds the settings of a gribouillis instance. Sizes are parsed with
+// humanize.ParseBytes and durations with time.ParseDuration.
+type Config struct {
+	BaseURL   string `json:"base_url"`
+	ImagesDir string `json:"images_dir"`
+	// PublicURL is the instance URL advertised by integrations, like chat
+	// bots.
+	PublicURL string `json:"public_url"`
+	// FilenamePattern is the stored file name pattern, without extension,
+	// see checkNamePattern.
+	FilenamePattern string `json:"filename_pattern"`
+	// ReservedNames is a comma separated list of drawing identifiers, file
+	// names without extension, never allocated.
+	ReservedNames string `json:"reserved_names"`
+	// ImageBaseURL is the public URL of the images directory, like a CDN
+	// pulling from "/saved/", used in place of the server one in returned
+	// image URLs.
+	ImageBaseURL string `json:"image_base_url"`
+	MaxImageSize string `json:"max_image_size"`
+	// MinImageSize, MinWidth and MinHeight reject smaller posted images.
+	MinImageSize string `json:"min_image_size"`
+	MinWidth     int    `json:"min_width"`
+	MinHeight    int    `json:"min_height"`
+	// RejectBlank refuses images whose ink coverage, the percentage of pixels
+	// differing from the top-left one, is not greater than MinInk.
+	RejectBlank bool    `json:"reject_blank"`
+	MinInk      float64 `json:"min_ink"`
+	// MinDelay is the delay after which a client is allowed another save,
+	// up to RateBurst saves in a row.
+	MinDelay  string `json:"min_delay"`
+	RateBurst int    `json:"rate_burst"`
+	// DedupWindow is how long uploads identical to one saved by the same
+	// client return the saved drawing, zero to disable.
+	DedupWindow string `json:"dedup_window"`
+	// ProcessTimeout bounds the image processing duration, if positive.
+	ProcessTimeout string `json:"process_timeout"`
+	// Padding is the width of the border added around saved images. Without
+	// padding, images are stored as posted.
+	Padding int `json:"padding"`
+	// PaddingColor is the color of the padding, a name accepted by
+	// imageproc.ParseColor or "#rrggbb". It defaults to white.
+	PaddingColor string `json:"padding_color"`
+	// Background is the "#rrggbb" color transparent images are flattened on,
+	// or "none" to keep transparency. Save requests may override it.
+	Background string `json:"background"`
+	// ColorProfile is "keep" to carry the color space chunks of posted images,
+	// like an ICC profile, through padding, or "strip" to drop them.
+	ColorProfile string `json:"color_profile"`
+	// WatermarkText, or the PNG image at WatermarkImage, is stamped on saved
+	// drawings at WatermarkPosition, "bottom-right" by default, with
+	// WatermarkOpacity between 0 and 1.
+	WatermarkText     string  `json:"watermark_text"`
+	WatermarkImage    string  `json:"watermark_image"`
+	WatermarkPosition string  `json:"watermark_position"`
+	WatermarkOpacity  float64 `json:"watermark_opacity"`
+	// Fsync flushes saved drawings, their metadata and the directories
+	// holding them to stable storage before saves succeed, trading throughput
+	// for durability across crashes and power losses.
+	Fsync bool `json:"fsync"`
+	// ReduceColors stores re-encoded images with at most 256 colors as
+	// grayscale or paletted PNG.
+	ReduceColors bool `json:"reduce_colors"`
+	// PNGEncoder names the implementation encoding saved images.
+	PNGEncoder string `json:"png_encoder"`
+	// PNGCompression is one of "default", "none", "speed" or "best".
+	PNGCompression string `json:"png_compression"`
+	// PNGParallelism caps the goroutines used by the parallel encoder, zero
+	// meaning GOMAXPROCS.
+	PNGParallelism int `json:"png_parallelism"`
+	// RecompressIdle enables the background recompression of stored images
+	// after this idle duration, if positive.
+	RecompressIdle string `json:"recompress_idle"`
+	// JobsPath is the file persisting background jobs, defaults to
+	// ImagesDir with a "-jobs.json" suffix.
+	JobsPath string `json:"jobs_path"`
+	// PreviewSize bounds the dimensions of the previews generated for saved
+	// images, zero disabling them. Previews are written in PreviewsDir,
+	// defaulting to ImagesDir with a "-previews" suffix.
+	PreviewSize int    `json:"preview_size"`
+	PreviewsDir string `json:"previews_dir"`
+	// ReferrerStats enables the collection of saved images views by referring
+	// domain, persisted in ReferrersPath, defaulting to ImagesDir with a
+	// "-referrers.json" suffix.
+	ReferrerStats bool   `json:"referrer_stats"`
+	ReferrersPath string `json:"referrers_path"`
+	// ImageMaxAge, if positive, lets browsers and proxies cache saved images
+	// that long without revalidating them.
+	ImageMaxAge string `json:"image_max_age"`
+	// Variants enables serving saved images as WebP or AVIF to clients
+	// accepting them, encoded by WebPCommand and AVIFCommand, and SVG
+	// renderings gzip compressed. Variants are cached in VariantsDir,
+	// defaulting to ImagesDir with a "-variants" suffix.
+	Variants    bool   `json:"variants"`
+	VariantsDir string `json:"variants_dir"`
+	WebPCommand string `json:"webp_command"`
+	AVIFCommand string `json:"avif_command"`
+	// ViewStats enables counting the views of each drawing, and recording
+	// when it was last viewed, persisted in ViewsPath, defaulting to
+	// ImagesDir with a "-views.json" suffix.
+	ViewStats bool   `json:"view_stats"`
+	ViewsPath string `json:"views_path"`
+	// Reactions enables liking and reporting drawings from their pages,
+	// counts being persisted in ReactionsPath, defaulting to ImagesDir with
+	// a "-reactions.json" suffix.
+	Reactions     bool   `json:"reactions"`
+	ReactionsPath string `json:"reactions_path"`
+	// UsagePath is the file persisting daily usage statistics, defaulting to
+	// ImagesDir with a "-usage.json" suffix.
+	UsagePath string `json:"usage_path"`
+	// EventsPath is the append-only event log, defaulting to ImagesDir with
+	// a "-events.jsonl" suffix.
+	EventsPath string `json:"events_path"`
+	// DraftTTL is the lifetime of autosaved drafts after their last update,
+	// drafts being disabled if zero. DraftsDir defaults to ImagesDir with a
+	// "-drafts" suffix and holds at most MaxDrafts of them, totalling
+	// MaxDraftsSize bytes if set.
+	DraftTTL      string `json:"draft_ttl"`
+	DraftsDir     string `json:"drafts_dir"`
+	MaxDrafts     int    `json:"max_drafts"`
+	MaxDraftsSize string `json:"max_drafts_size"`
+	// PendingTTL enables two-phase saves, where uploaded drawings wait in
+	// PendingDir, defaulting to ImagesDir with a "-pending" suffix, until
+	// confirmed or expired after PendingTTL. At most MaxPending drawings
+	// wait at once.
+	PendingTTL string `json:"pending_ttl"`
+	PendingDir string `json:"pending_dir"`
+	MaxPending int    `json:"max_pending"`
+	// PromptsPath is a file of drawing prompts, one per line, published one
+	// per day. Disabled if empty.
+	PromptsPath string `json:"prompts_path"`
+	// Rooms enables shared drawing rooms, served in "room/{id}". Turns last
+	// RoomTurnTime in turn-based rooms.
+	Rooms        bool   `json:"rooms"`
+	RoomTurnTime string `json:"room_turn_time"`
+	// RoomMaxCount bounds the number of rooms and RoomMaxClients the number
+	// of participants of a room, zero meaning unlimited. Participants may
+	// send a message every RoomMessageDelay, up to RoomMessageBurst in a row.
+	// RoomMaxSize bounds the shapes of a room and RoomMaxTotalSize those of
+	// all rooms, kept in memory, "0" meaning unlimited.
+	RoomMaxCount     int    `json:"room_max_count"`
+	RoomMaxClients   int    `json:"room_max_clients"`
+	RoomMessageDelay string `json:"room_message_delay"`
+	RoomMessageBurst int    `json:"room_message_burst"`
+	RoomMaxSize      string `json:"room_max_size"`
+	RoomMaxTotalSize string `json:"room_max_total_size"`
+	// RoomSecret signs the invites of private rooms, whose identifiers start
+	// with "p-". Private rooms are disabled if empty.
+	RoomSecret string `json:"room_secret"`
+	// RoomsPath is the file saving rooms across restarts, defaulting to
+	// ImagesDir with a "-rooms.json" suffix.
+	RoomsPath string `json:"rooms_path"`
+	// RoomInvitesPath is the file tracking the members of private rooms,
+	// defaulting to ImagesDir with a "-invites.json" suffix.
+	RoomInvitesPath string `json:"room_invites_path"`
+	// WebDir, if set, is a directory of frontend files served instead of the
+	// embedded literallycanvas ones.
+	WebDir string `json:"web_dir"`
+	// MaxSchedule enables scheduled publications, saves hidden in
+	// ScheduledDir, defaulting to ImagesDir with a "-scheduled" suffix, until
+	// a publication time at most MaxSchedule ahead.
+	MaxSchedule  string `json:"max_schedule"`
+	ScheduledDir string `json:"scheduled_dir"`
+	// MaxFrames enables flipbooks, animated drawings of at most MaxFrames
+	// frames. Frames following the first one are written in FramesDir,
+	// defaulting to ImagesDir with a "-frames" suffix.
+	MaxFrames int    `json:"max_frames"`
+	FramesDir string `json:"frames_dir"`
+	// MetaDir is the directory storing drawings metadata, defaulting to
+	// ImagesDir with a "-meta" suffix.
+	MetaDir string `json:"meta_dir"`
+	// BlurHash enables the computation of drawings BlurHash at save time.
+	BlurHash bool   `json:"blurhash"`
+	MaxSize  string `json:"max_size"`
+	MaxCount int    `json:"max_count"`
+	// MaxAge is the age after which drawings are evicted, zero to disable.
+	MaxAge string `json:"max_age"`
+	// Eviction is the order drawings are evicted in: "oldest", the default,
+	// "lru" to evict the least recently viewed or downloaded first, or
+	// "weighted" to evict the highest scoring first according to
+	// EvictionWeights.
+	Eviction string `json:"eviction"`
+	// EvictionWeights are comma separated "criterion=weight" pairs scoring
+	// drawings with the "weighted" eviction, criteria being age, size and
+	// views.
+	EvictionWeights string `json:"eviction_weights"`
+	// PrefixQuotas are comma separated "prefix:max-size:max-count" limits of
+	// the drawings whose names start with prefix, zero meaning unlimited.
+	PrefixQuotas string `json:"prefix_quotas"`
+	// RoomRetention are comma separated "room:max-age" overrides of MaxAge
+	// for the drawings saved from room, max-age being a duration or
+	// "forever" to never evict them.
+	RoomRetention string `json:"room_retention"`
+	// Storage selects where drawings are persisted: "dir", the default,
+	// keeps them in ImagesDir only, "s3" also mirrors them in S3Bucket, with
+	// S3Prefix prepended to their names. S3Endpoint defaults to the AWS one
+	// of S3Region, and the credentials to AWS_ACCESS_KEY_ID and
+	// AWS_SECRET_ACCESS_KEY environment variables.
+	Storage     string `json:"storage"`
+	S3Endpoint  string `json:"s3_endpoint"`
+	S3Region    string `json:"s3_region"`
+	S3Bucket    string `json:"s3_bucket"`
+	S3Prefix    string `json:"s3_prefix"`
+	S3AccessKey string `json:"s3_access_key"`
+	S3SecretKey string `json:"s3_secret_key"`
+	// ArchiveDir, if set, is the directory of drawings promoted with
+	// "gribouillis archive". It has its own limits, zero meaning unlimited.
+	ArchiveDir      string `json:"archive_dir"`
+	ArchiveMaxSize  string `json:"archive_max_size"`
+	ArchiveMaxCount int    `json:"archive_max_count"`
+	// ReconcileInterval is the delay between two synchronizations of the
+	// tracked images with the images directory content, zero to disable.
+	ReconcileInterval string `json:"reconcile_interval"`
+	// PreSaveHook and PostSaveHook are commands run when drawings are saved,
+	// see execHook.
+	PreSaveHook  string `json:"pre_save_hook"`
+	PostSaveHook string `json:"post_save_hook"`
+	// PreSaveHooks and PostSaveHooks are set by programs embedding the
+	// handler, and run after the command hooks.
+	PreSaveHooks  []PreSaveHook  `json:"-"`
+	PostSaveHooks []PostSaveHook `json:"-"`
+	// TrustedProxies is a comma separated list of IP addresses or networks
+	// allowed to set X-Forwarded-* headers.
+	TrustedProxies string `json:"trusted_proxies"`
+	// Middlewares is a comma separated list of middlewares wrapping the
+	// instance handler, the first one being the outermost.
+	Middlewares string `json:"middlewares"`
+	// MatrixHomeserver, MatrixToken and MatrixRoom enable the announcement of
+	// saved drawings in a Matrix room. MatrixCommands also answers "!draw"
+	// messages with PublicURL.
+	MatrixHomeserver string `json:"matrix_homeserver"`
+	MatrixToken      string `json:"matrix_token"`
+	MatrixRoom       string `json:"matrix_room"`
+	MatrixCommands   bool   `json:"matrix_commands"`
+	// IRCServer, as host:port, and IRCChannel enable the announcement of saved
+	// drawings in an IRC channel, as IRCNick.
+	IRCServer  string `json:"irc_server"`
+	IRCTLS     bool   `json:"irc_tls"`
+	IRCNick    string `json:"irc_nick"`
+	IRCChannel string `json:"irc_channel"`
+	// FederatedInstances is a comma separated list of other instances base
+	// URLs, whose latest drawings are fetched every FederationInterval and
+	// shown in a federated gallery. Their thumbnails are cached in
+	// FederatedDir, defaulting to ImagesDir with a "-federated" suffix.
+	FederatedInstances string `json:"federated_instances"`
+	FederationInterval string `json:"federation_interval"`
+	FederatedDir       string `json:"federated_dir"`
+	// ActivityPubUser enables the publication of saved drawings to Fediverse
+	// followers of an actor with this user name, served from PublicURL. Its
+	// key and followers are stored in ActivityPubDir, defaulting to
+	// ImagesDir with a "-activitypub" suffix.
+	ActivityPubUser string `json:"activitypub_user"`
+	ActivityPubDir  string `json:"activitypub_dir"`
+	// ColdGrace enables keeping evicted drawings in ColdDir, defaulting to
+	// ImagesDir with a "-cold" suffix, where they are still served for
+	// ColdGrace.
+	ColdGrace string `json:"cold_grace"`
+	ColdDir   string `json:"cold_dir"`
+	// TombstoneAge enables recording why drawings were removed in
+	// TombstonesDir, defaulting to ImagesDir with a "-tombstones" suffix, so
+	// their pages and images return a 410 explaining it for TombstoneAge.
+	TombstoneAge  string `json:"tombstone_age"`
+	TombstonesDir string `json:"tombstones_dir"`
+	// VerifyImages enables decoding the stored drawings on startup, moving
+	// corrupted ones to QuarantineDir, defaulting to ImagesDir with a
+	// "-quarantine" suffix.
+	VerifyImages  bool   `json:"verify_images"`
+	QuarantineDir string `json:"quarantine_dir"`
+	// Auth holds "user:password" credentials checked by the auth middleware,
+	// and AuthFile is an htpasswd file of users it accepts too. The
+	// middleware is enabled if either is set.
+	Auth     string `json:"auth"`
+	AuthFile string `json:"auth_file"`
+	// AdminToken enables the admin API, authenticating requests with this
+	// bearer token.
+	AdminToken string `json:"admin_token"`
+	// OIDCIssuer enables the login of administrators with this OpenID
+	// Connect provider, as client OIDCClientID authenticated with
+	// OIDCClientSecret. Only users whose email address, or "@domain", is in
+	// the comma separated OIDCAdmins are accepted. Requires PublicURL.
+	OIDCIssuer       string `json:"oidc_issuer"`
+	OIDCClientID     string `json:"oidc_client_id"`
+	OIDCClientSecret string `json:"oidc_client_secret"`
+	OIDCAdmins       string `json:"oidc_admins"`
+}
+
+// storagePaths returns the files and directories written by the instance,
+// which cannot be shared with other ones.
+func (c *Config) storagePaths() []string {
+	jobsPath := c.JobsPath
+	if jobsPath == "" {
+		jobsPath = defaultJobsPath(c.ImagesDir)
+	}
+	paths := []string{
+		filepath.Clean(c.ImagesDir),
+		filepath.Clean(jobsPath),
+	}
+	usagePath := c.UsagePath
+	if usagePath == "" {
+		usagePath = defaultUsagePath(c.ImagesDir)
+	}
+	paths = append(paths, filepath.Clean(usagePath))
+	metaDir := c.MetaDir
+	if metaDir == "" {
+		metaDir = defaultMetaDir(c.ImagesDir)
+	}
+	paths = append(paths, filepath.Clean(metaDir))
+	eventsPath := c.EventsPath
+	if eventsPath == "" {
+		eventsPath = defaultEventsPath(c.ImagesDir)
+	}
+	paths = append(paths, filepath.Clean(eventsPath))
+	if c.DraftTTL != "" && c.DraftTTL != "0" {
+		draftsDir := c.DraftsDir
+		if draftsDir == "" {
+			draftsDir = defaultDraftsDir(c.ImagesDir)
+		}
+		paths = append(paths, filepath.Clean(draftsDir))
+	}
+	if c.PendingTTL != "" && c.PendingTTL != "0" {
+		pendingDir := c.PendingDir
+		if pendingDir == "" {
+			pendingDir = defaultPendingDir(c.ImagesDir)
+		}
+		paths = append(paths, filepath.Clean(pendingDir))
+	}
+	if c.Rooms {
+		roomsPath := c.RoomsPath
+		if roomsPath == "" {
+			roomsPath = defaultRoomsPath(c.ImagesDir)
+		}
+		paths = append(paths, filepath.Clean(roomsPath))
+	}
+	if c.RoomSecret != "" {
+		invitesPath := c.RoomInvitesPath
+		if invitesPath == "" {
+			invitesPath = defaultRoomInvitesPath(c.ImagesDir)
+		}
+		paths = append(paths, filepath.Clean(invitesPath))
+	}
+	if c.MaxSchedule != "" && c.MaxSchedule != "0" {
+		scheduledDir := c.ScheduledDir
+		if scheduledDir == "" {
+			scheduledDir = defaultScheduledDir(c.ImagesDir)
+		}
+		paths = append(paths, filepath.Clean(scheduledDir))
+	}
+	if c.MaxFrames > 0 {
+		framesDir := c.FramesDir
+		if framesDir == "" {
+			framesDir = defaultFramesDir(c.ImagesDir)
+		}
+		paths = append(paths, filepath.Clean(framesDir))
+	}
+	if c.FederatedInstances != "" {
+		federatedDir := c.FederatedDir
+		if federatedDir == "" {
+			federatedDir = defaultFederatedDir(c.ImagesDir)
+		}
+		paths = append(paths, filepath.Clean(federatedDir))
+	}
+	if c.ColdGrace != "" && c.ColdGrace != "0" {
+		coldDir := c.ColdDir
+		if coldDir == "" {
+			coldDir = defaultColdDir(c.ImagesDir)
+		}
+		paths = append(paths, filepath.Clean(coldDir))
+	}
+	if c.TombstoneAge != "" && c.TombstoneAge != "0" {
+		tombstonesDir := c.TombstonesDir
+		if tombstonesDir == "" {
+			tombstonesDir = defaultTombstonesDir(c.ImagesDir)
+		}
+		paths = append(paths, filepath.Clean(tombstonesDir))
+	}
+	if c.VerifyImages {
+		quarantineDir := c.QuarantineDir
+		if quarantineDir == "" {
+			quarantineDir = defaultQuarantineDir(c.ImagesDir)
+		}
+		paths = append(paths, filepath.Clean(quarantineDir))
+	}
+	if c.ActivityPubUser != "" {
+		apDir := c.ActivityPubDir
+		if apDir == "" {
+			apDir = defaultActivityPubDir(c.ImagesDir)
+		}
+		paths = append(paths, filepath.Clean(apDir))
+	}
+	if c.ArchiveDir != "" {
+		paths = append(paths, filepath.Clean(c.ArchiveDir))
+	}
+	if c.Storage == "s3" {
+		paths = append(paths, "s3://"+c.S3Bucket+"/"+c.S3Prefix)
+	}
+	if c.ReferrerStats {
+		referrersPath := c.ReferrersPath
+		if referrersPath == "" {
+			referrersPath = defaultReferrersPath(c.ImagesDir)
+		}
+		paths = append(paths, filepath.Clean(referrersPath))
+	}
+	if c.ViewStats {
+		viewsPath := c.ViewsPath
+		if viewsPath == "" {
+			viewsPath = defaultViewsPath(c.ImagesDir)
+		}
+		paths = append(paths, filepath.Clean(viewsPath))
+	}
+	if c.Reactions {
+		reactionsPath := c.ReactionsPath
+		if reactionsPath == "" {
+			reactionsPath = defaultReactionsPath(c.ImagesDir)
+		}
+		paths = append(paths, filepath.Clean(reactionsPath))
+	}
+	if c.PreviewSize > 0 {
+		previewsDir := c.PreviewsDir
+		if previewsDir == "" {
+			previewsDir = defaultPreviewsDir(c.ImagesDir)
+		}
+		paths = append(paths, filepath.Clean(previewsDir))
+	}
+	if c.Variants {
+		variantsDir := c.VariantsDir
+		if variantsDir == "" {
+			variantsDir = defaultVariantsDir(c.ImagesDir)
+		}
+		paths = append(paths, filepath.Clean(variantsDir))
+	}
+	return paths
+}
+
+// vhostHandler dispatches requests to per-host handlers using the Host
+// header. Unknown hosts are served by the default handler.
+type vhostHandler struct {
+	hosts map[string]http.Handler
+	def   http.Handler
+}
+
+func (h *vhostHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := strings.ToLower(r.Host)
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	handler, ok := h.hosts[host]
+	if !ok {
+		handler = h.def
+	}
+	handler.ServeHTTP(w, r)
+}
+
+// galleryNameRe matches the names of galleries, served in "g/{name}/".
+var galleryNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// galleryHandler dispatches requests below "g/{name}/" to the handler of
+// gallery name. Other requests are served by the default handler.
+type galleryHandler struct {
+	// prefix is the base URL of the galleries, ending with "/g/".
+	prefix    string
+	galleries map[string]http.Handler
+	def       http.Handler
+}
+
+func (h *galleryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, h.prefix) {
+		name := strings.TrimPrefix(r.URL.Path, h.prefix)
+		rest := ""
+		if i := strings.Index(name, "/"); i >= 0 {
+			name, rest = name[:i], name[i:]
+		}
+		if handler, ok := h.galleries[name]; ok {
+			if rest == "" {
+				http.Redirect(w, r, mountPrefix(r)+r.URL.Path+"/", http.StatusMovedPermanently)
+				return
+			}
+			handler.ServeHTTP(w, r)
+			return
+		}
+	}
+	h.def.ServeHTTP(w, r)
+}
+
+// galleryConfig returns the configuration of gallery name of def instance,
+// before applying the gallery settings. The gallery is served below def base
+// and public URLs, and its storage defaults to def one suffixed with name.
+func galleryConfig(def *Config, name string) Config {
+	cfg := *def
+	cfg.BaseURL = strings.TrimRight(def.BaseURL, "/") + "/g/" + name
+	if def.PublicURL != "" {
+		cfg.PublicURL = strings.TrimRight(def.PublicURL, "/") + "/g/" + name
+	}
+	cfg.ImagesDir = filepath.Join(filepath.Clean(def.ImagesDir)+"-galleries", name)
+	if def.Storage == "s3" {
+		cfg.S3Prefix = def.S3Prefix + "g/" + name + "/"
+	}
+	return cfg
+}
+
+// loadGalleries returns a handler serving the galleries configured in raw
+// below def instance, and other requests with defHandler. owner names the
+// instance in errors. Storage paths of the galleries are registered in paths
+// and must not be used already. Gallery handlers are closed with parent.
+func loadGalleries(raw map[string]json.RawMessage, def *Config,
+	defHandler http.Handler, owner string, paths map[string]string,
+	parent *Handler) (http.Handler, error) {
+
+	if len(raw) == 0 {
+		return defHandler, nil
+	}
+	h := &galleryHandler{
+		prefix:    strings.TrimRight(def.BaseURL, "/") + "/g/",
+		galleries: map[string]http.Handler{},
+		def:       defHandler,
+	}
+	for name, data := range raw {
+		if !galleryNameRe.MatchString(name) {
+			return nil, fmt.Errorf("invalid %s gallery name: %q", owner, name)
+		}
+		cfg := galleryConfig(def, name)
+		err := json.Unmarshal(data, &cfg)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse %s gallery %s: %s", owner,
+				name, err)
+		}
+		gallery := owner + " gallery " + name
+		for _, p := range cfg.storagePaths() {
+			if other, ok := paths[p]; ok {
+				return nil, fmt.Errorf("%s and %s share the same storage path: %s",
+					gallery, other, p)
+			}
+			paths[p] = gallery
+		}
+		handler, err := NewHandler(&cfg)
+		if err != nil {
+			return nil, fmt.Errorf("could not create %s: %s", gallery, err)
+		}
+		parent.onClose(handler.Close)
+		h.galleries[name] = handler
+	}
+	return h, nil
+}
+
+// instanceConfig holds the settings of an instance in the configuration
+// file, Config ones and its galleries by name.
+type instanceConfig struct {
+	Galleries map[string]json.RawMessage `json:"galleries"`
+}
+
+// LoadConfigFile reads virtual hosts and galleries definitions from the JSON
+// configuration file at path and returns a handler serving them. Hosts
+// settings default to def ones, galleries settings to their host ones, and
+// unknown hosts are served by defHandler. The returned handler closes
+// defHandler with the ones it created.
+func LoadConfigFile(path string, def *Config, defHandler *Handler) (
+	_ *Handler, err error) {
+
+	handler := newHandler()
+	defer func() {
+		if err != nil {
+			handler.Close()
+		}
+	}()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := struct {
+		instanceConfig
+		Hosts map[string]json.RawMessage `json:"hosts"`
+	}{}
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %s", path, err)
+	}
+	paths := map[string]string{}
+	for _, p := range def.storagePaths() {
+		paths[p] = "default host"
+	}
+	galleries, err := loadGalleries(config.Galleries, def, defHandler,
+		"default host", paths, handler)
+	if err != nil {
+		return nil, err
+	}
+	h := &vhostHandler{
+		hosts: map[string]http.Handler{},
+		def:   galleries,
+	}
+	for host, raw := range config.Hosts {
+		cfg := *def
+		err := json.Unmarshal(raw, &cfg)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse %s host: %s", host, err)
+		}
+		instance := instanceConfig{}
+		err = json.Unmarshal(raw, &instance)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse %s host: %s", host, err)
+		}
+		for _, p := range cfg.storagePaths() {
+			if other, ok := paths[p]; ok {
+				return nil, fmt.Errorf("%s and %s share the same storage path: %s",
+					host, other, p)
+			}
+			paths[p] = host
+		}
+		hostHandler, err := NewHandler(&cfg)
+		if err != nil {
+			return nil, fmt.Errorf("could not create %s host: %s", host, err)
+		}
+		handler.onClose(hostHandler.Close)
+		h.hosts[strings.ToLower(host)], err = loadGalleries(instance.Galleries,
+			&cfg, hostHandler, host, paths, handler)
+		if err != nil {
+			return nil, err
+		}
+	}
+	handler.onClose(defHandler.Close)
+	handler.Handler = h
+	return handler, nil
+}
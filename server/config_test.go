@@ -0,0 +1,123 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigFileGalleries(t *testing.T) {
+	cfg, cleanup := newTestConfig(t)
+	defer cleanup()
+	def, err := NewHandler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer def.Close()
+	configPath := filepath.Join(filepath.Dir(cfg.ImagesDir), "config.json")
+	writeConfig := func(config string) {
+		err := ioutil.WriteFile(configPath, []byte(config), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(`{"galleries": {"classA": {"max_count": 1}, "classB": {}}}`)
+	h, err := LoadConfigFile(configPath, cfg, def)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	save := func(base string, size int) *saveResponse {
+		rsp, err := http.Post(srv.URL+base+"/api/v1/drawings", "image/png",
+			bytes.NewReader(encodeTestImage(t, size, size)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rsp.Body.Close()
+		if rsp.StatusCode != 200 {
+			t.Fatalf("could not save in %q: %s", base, rsp.Status)
+		}
+		saved := &saveResponse{}
+		err = json.NewDecoder(rsp.Body).Decode(saved)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return saved
+	}
+	list := func(base string) []drawingInfo {
+		rsp, err := http.Get(srv.URL + base + "/api/v1/drawings")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rsp.Body.Close()
+		drawings := &drawingsResponse{}
+		err = json.NewDecoder(rsp.Body).Decode(drawings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return drawings.Drawings
+	}
+	saved := save("/g/classA", 10)
+	if !strings.HasPrefix(saved.Path, "/g/classA/saved/") {
+		t.Fatalf("unexpected saved path: %s", saved.Path)
+	}
+	rsp, err := http.Get(srv.URL + saved.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != 200 {
+		t.Fatalf("could not fetch saved image: %s", rsp.Status)
+	}
+	save("/g/classA", 11)
+	save("/g/classB", 12)
+	save("/g/classB", 13)
+	save("", 14)
+	// Galleries evict their own drawings only
+	if n := len(list("/g/classA")); n != 1 {
+		t.Fatalf("expected 1 drawing in classA, got %d", n)
+	}
+	if n := len(list("/g/classB")); n != 2 {
+		t.Fatalf("expected 2 drawings in classB, got %d", n)
+	}
+	if n := len(list("")); n != 1 {
+		t.Fatalf("expected 1 drawing in default gallery, got %d", n)
+	}
+	for path, status := range map[string]int{
+		"/g/classA":  301,
+		"/g/classC/": 404,
+	} {
+		req, err := http.NewRequest("GET", srv.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp.Body.Close()
+		if rsp.StatusCode != status {
+			t.Fatalf("%s: expected %d, got %d", path, status, rsp.StatusCode)
+		}
+	}
+
+	for _, config := range []string{
+		`{"galleries": {"a/b": {}}}`,
+		`{"galleries": {"a": {"images_dir": "` + cfg.ImagesDir + `"}}}`,
+		`{"galleries": {"a": {"max_size": "x"}}}`,
+	} {
+		writeConfig(config)
+		_, err := LoadConfigFile(configPath, cfg, def)
+		if err == nil {
+			t.Fatalf("expected an error for %s", config)
+		}
+	}
+}
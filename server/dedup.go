@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// recentUpload is a drawing saved from an upload remembered by uploadDedup.
+type recentUpload struct {
+	dir   string
+	name  string
+	saved time.Time
+}
+
+// uploadDedup remembers the drawings saved by each client key, like an IP
+// address, by content hash of their uploads, so identical uploads within
+// window return the first drawing instead of being saved again, like when
+// double-clicking the save button. Identical uploads received while the
+// first one is being saved wait for it. It can be used concurrently.
+type uploadDedup struct {
+	window   time.Duration
+	lock     sync.Mutex
+	uploads  map[string]*recentUpload
+	inflight map[string]chan struct{}
+}
+
+func newUploadDedup(window time.Duration) *uploadDedup {
+	return &uploadDedup{
+		window:   window,
+		uploads:  map[string]*recentUpload{},
+		inflight: map[string]chan struct{}{},
+	}
+}
+
+// recent returns the name of the drawing saved in dir under upload key k
+// within the window before now, or an empty string if there is none or it is
+// gone. d.lock must be held.
+func (d *uploadDedup) recent(k, dir string, now time.Time) string {
+	u, ok := d.uploads[k]
+	if !ok || u.dir != dir || now.Sub(u.saved) > d.window {
+		return ""
+	}
+	if _, err := os.Stat(filepath.Join(dir, u.name)); err != nil {
+		return ""
+	}
+	return u.name
+}
+
+// Start returns the name of the drawing saved in dir from an upload of
+// client key with content hash within the window before now, waiting for
+// an identical upload being saved to complete. Otherwise, it registers the
+// upload as being saved and returns an empty name and a done function,
+// which must be called with the saved drawing name, or an empty string if
+// the upload failed.
+func (d *uploadDedup) Start(key, hash, dir string, now time.Time) (string, func(name string)) {
+	k := key + " " + hash
+	d.lock.Lock()
+	for {
+		if name := d.recent(k, dir, now); name != "" {
+			d.lock.Unlock()
+			return name, nil
+		}
+		done, ok := d.inflight[k]
+		if !ok {
+			break
+		}
+		d.lock.Unlock()
+		<-done
+		d.lock.Lock()
+	}
+	done := make(chan struct{})
+	d.inflight[k] = done
+	d.lock.Unlock()
+	return "", func(name string) {
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		if name != "" {
+			d.uploads[k] = &recentUpload{dir: dir, name: name, saved: time.Now()}
+		}
+		delete(d.inflight, k)
+		close(done)
+	}
+}
+
+// Prune forgets uploads older than the window at now.
+func (d *uploadDedup) Prune(now time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for k, u := range d.uploads {
+		if now.Sub(u.saved) > d.window {
+			delete(d.uploads, k)
+		}
+	}
+}
+
+// Run prunes old uploads every interval, until ctx is done.
+func (d *uploadDedup) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			d.Prune(now)
+		}
+	}
+}
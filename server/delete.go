@@ -0,0 +1,101 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pmezard/gribouillis/storage"
+)
+
+// newDeleteToken returns a random token allowing its owner to delete a
+// drawing, and its hash to store in the drawing metadata.
+func newDeleteToken() (string, string, error) {
+	buf := make([]byte, 16)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", "", err
+	}
+	token := hex.EncodeToString(buf)
+	return token, hashDeleteToken(token), nil
+}
+
+func hashDeleteToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// checkDeleteToken reports whether token matches the drawing metadata m.
+func checkDeleteToken(m *Metadata, token string) bool {
+	return checkTokenHash(m.DeleteTokenHash, token)
+}
+
+// checkTokenHash reports whether token matches hash, as returned by
+// newDeleteToken.
+func checkTokenHash(hash, token string) bool {
+	if hash == "" || token == "" {
+		return false
+	}
+	h := hashDeleteToken(token)
+	return subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1
+}
+
+// deleteToken returns the delete token of request r, passed as a bearer
+// token or a token query parameter.
+func deleteToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(auth[len("Bearer "):])
+	}
+	return r.URL.Query().Get("token")
+}
+
+// removeDrawing deletes drawing name for reason, logging it with log. The
+// caller was authorized to do so. It returns the HTTP status code to use on
+// error.
+func (h *Handler) removeDrawing(log *slog.Logger, name, reason string) (int, error) {
+	err := h.imgDir.Remove(name)
+	if err == storage.ErrNotTracked {
+		return http.StatusNotFound, fmt.Errorf("unknown drawing")
+	} else if err != nil {
+		slog.Error("could not delete drawing", "name", name, "err", err)
+		return 500, fmt.Errorf("could not delete drawing")
+	}
+	log.Info("deleted drawing", "name", name, "reason", reason)
+	if h.tombstones != nil {
+		err := h.tombstones.Put(name, reason, time.Now())
+		if err != nil {
+			slog.Error("could not write tombstone", "name", name, "err", err)
+		}
+	}
+	if err := h.events.Append(eventDeletion, name); err != nil {
+		slog.Error("could not log deletion", "name", name, "err", err)
+	}
+	h.broadcast("", &liveMessage{Type: eventDeletion, Name: name})
+	h.broadcast("count", &liveMessage{Type: "count", Count: len(h.imgDir.List())})
+	return 0, nil
+}
+
+// deleteDrawing deletes drawing name if the request has its delete
+// token. It returns the HTTP status code to use on error.
+func (h *Handler) deleteDrawing(r *http.Request, name string) (int, error) {
+	if !drawingIDRe.MatchString(strings.TrimSuffix(name, ".png")) ||
+		!containsString(h.imgDir.List(), name) {
+		return http.StatusNotFound, fmt.Errorf("unknown drawing")
+	}
+	m, err := h.meta.Get(name)
+	if err != nil {
+		slog.Error("could not read metadata", "name", name, "err", err)
+		return 500, fmt.Errorf("could not delete drawing")
+	}
+	if !checkDeleteToken(m, deleteToken(r)) {
+		return http.StatusForbidden, fmt.Errorf("invalid delete token")
+	}
+	return h.removeDrawing(h.requestLogger(r), name, removalDeleted)
+}
@@ -0,0 +1,371 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/pmezard/gribouillis/imageproc"
+)
+
+// draftIDRe matches draft identifiers. They are generated by clients and act
+// as capabilities, so they must be long enough not to be guessed.
+var draftIDRe = regexp.MustCompile(`^[A-Za-z0-9_-]{16,64}$`)
+
+var errTooManyDrafts = fmt.Errorf("too many drafts")
+
+const (
+	// draftMinDelay and draftBurst rate limit draft updates per client IP,
+	// independently of saves and well above the canvas autosave period.
+	draftMinDelay = 10 * time.Second
+	draftBurst    = 3
+)
+
+// draftStore keeps the last autosaved version of in-progress drawings, one
+// PNG file per client chosen identifier. Drafts expire ttl after their last
+// update and are never listed nor served with saved drawings. At most
+// maxCount drafts totalling maxSize bytes, if positive, are kept.
+type draftStore struct {
+	dir      string
+	ttl      time.Duration
+	maxCount int
+	maxSize  int64
+	// lock protects sizes and size, the sizes of the stored drafts by
+	// identifier and their total.
+	lock  sync.Mutex
+	sizes map[string]int64
+	size  int64
+}
+
+// defaultDraftsDir returns the drafts directory used with imagesDir.
+func defaultDraftsDir(imagesDir string) string {
+	return filepath.Clean(imagesDir) + "-drafts"
+}
+
+func openDraftStore(dir string, ttl time.Duration, maxCount int,
+	maxSize int64) (*draftStore, error) {
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &draftStore{
+		dir:      dir,
+		ttl:      ttl,
+		maxCount: maxCount,
+		maxSize:  maxSize,
+		sizes:    map[string]int64{},
+	}
+	for _, e := range entries {
+		if id, ok := draftOf(e.Name()); ok && e.Mode().IsRegular() {
+			s.sizes[id] = e.Size()
+			s.size += e.Size()
+		}
+	}
+	return s, s.Prune()
+}
+
+// draftOf returns the identifier of draft file name, or false if it is not
+// one, like temporary files.
+func draftOf(name string) (string, bool) {
+	id := strings.TrimSuffix(name, ".png")
+	return id, id != name && draftIDRe.MatchString(id)
+}
+
+func (s *draftStore) path(id string) string {
+	return filepath.Join(s.dir, id+".png")
+}
+
+// Put replaces draft id with the PNG image read from r, at most maxSize
+// bytes long. Invalid images are rejected with a *imageproc.MediaTypeError or
+// a *imageproc.RejectedImageError, and errTooManyDrafts is returned if the
+// draft does not fit in the store limits.
+func (s *draftStore) Put(id, contentType string, r io.Reader, maxSize int64) error {
+	body, err := imageproc.CheckUpload(contentType, &io.LimitedReader{R: r, N: maxSize + 1}, false)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) > maxSize {
+		return &imageproc.RejectedImageError{Reason: fmt.Sprintf(
+			"draft is larger than %d bytes", maxSize)}
+	}
+	err = imageproc.CopyPNG(ioutil.Discard, bytes.NewReader(data))
+	if err != nil {
+		return &imageproc.RejectedImageError{Reason: fmt.Sprintf("invalid PNG image: %s", err)}
+	}
+	tmp, err := ioutil.TempFile(s.dir, ".draft-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	old, ok := s.sizes[id]
+	if !ok && len(s.sizes) >= s.maxCount ||
+		s.maxSize > 0 && s.size-old+int64(len(data)) > s.maxSize {
+		return errTooManyDrafts
+	}
+	err = os.Rename(tmp.Name(), s.path(id))
+	if err != nil {
+		return err
+	}
+	s.sizes[id] = int64(len(data))
+	s.size += int64(len(data)) - old
+	return nil
+}
+
+// Open returns draft id and its information, or an os.IsNotExist error if it
+// does not exist or expired.
+func (s *draftStore) Open(id string) (*os.File, os.FileInfo, error) {
+	fp, err := os.Open(s.path(id))
+	if err != nil {
+		return nil, nil, err
+	}
+	st, err := fp.Stat()
+	if err == nil && time.Since(st.ModTime()) > s.ttl {
+		err = os.ErrNotExist
+	}
+	if err != nil {
+		fp.Close()
+		return nil, nil, err
+	}
+	return fp, st, nil
+}
+
+// Remove deletes draft id, if any.
+func (s *draftStore) Remove(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.remove(id)
+}
+
+// remove deletes draft id, if any. s.lock must be held.
+func (s *draftStore) remove(id string) error {
+	err := os.Remove(s.path(id))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.size -= s.sizes[id]
+	delete(s.sizes, id)
+	return nil
+}
+
+// Prune deletes expired drafts and leftover temporary files. The directory
+// is listed without holding the lock, expired drafts being checked again
+// before their deletion in case they were updated meanwhile.
+func (s *draftStore) Prune() error {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if time.Since(e.ModTime()) <= s.ttl {
+			continue
+		}
+		id, ok := draftOf(e.Name())
+		if !ok {
+			err := os.Remove(filepath.Join(s.dir, e.Name()))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		err := s.prune(id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prune deletes draft id if it expired.
+func (s *draftStore) prune(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	st, err := os.Stat(s.path(id))
+	if err != nil || time.Since(st.ModTime()) <= s.ttl {
+		return nil
+	}
+	return s.remove(id)
+}
+
+// Run prunes expired drafts every interval, until ctx is done.
+func (s *draftStore) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := s.Prune()
+			if err != nil {
+				slog.Error("could not prune drafts", "err", err)
+			}
+		}
+	}
+}
+
+// draftRoutes returns the API routes reading and writing drafts of at most
+// maxSize bytes. Updates are rejected unless allow accepts the request.
+func draftRoutes(drafts *draftStore, maxSize int64,
+	allow func(r *http.Request) bool) []*apiRoute {
+
+	// draftID returns the draft identifier of request path, or writes an
+	// error and returns an empty string.
+	draftID := func(w http.ResponseWriter, r *http.Request) string {
+		id := path.Base(r.URL.Path)
+		if !draftIDRe.MatchString(id) {
+			writeAPIError(w, http.StatusBadRequest, "invalid draft identifier")
+			return ""
+		}
+		return id
+	}
+	return []*apiRoute{
+		{
+			Method:  "PUT",
+			Path:    "/drafts/{id}",
+			Summary: "Replace the draft with the PNG drawing posted as request body",
+			Feature: "drafts",
+			Request: "image/png",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				id := draftID(w, r)
+				if id == "" {
+					return
+				}
+				if !allow(r) {
+					writeAPIError(w, http.StatusTooManyRequests, "rate limited")
+					return
+				}
+				err := drafts.Put(id, r.Header.Get("Content-Type"), r.Body, maxSize)
+				if _, ok := err.(*imageproc.MediaTypeError); ok {
+					writeAPIError(w, http.StatusUnsupportedMediaType, err.Error())
+				} else if _, ok := err.(*imageproc.RejectedImageError); ok {
+					writeAPIError(w, http.StatusUnprocessableEntity, err.Error())
+				} else if err == errTooManyDrafts {
+					writeAPIError(w, http.StatusServiceUnavailable, err.Error())
+				} else if err != nil {
+					slog.Error("could not save draft", "err", err)
+					writeAPIError(w, 500, "could not save draft")
+				} else {
+					w.WriteHeader(http.StatusNoContent)
+				}
+			},
+		},
+		{
+			Method:       "GET",
+			Path:         "/drafts/{id}",
+			Summary:      "Return the draft PNG drawing",
+			Feature:      "drafts",
+			ResponseType: "image/png",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				id := draftID(w, r)
+				if id == "" {
+					return
+				}
+				fp, st, err := drafts.Open(id)
+				if err != nil {
+					if os.IsNotExist(err) {
+						writeAPIError(w, http.StatusNotFound, "unknown draft")
+					} else {
+						slog.Error("could not open draft", "err", err)
+						writeAPIError(w, 500, "could not open draft")
+					}
+					return
+				}
+				defer fp.Close()
+				w.Header().Set("Content-Type", "image/png")
+				w.Header().Set("Cache-Control", "no-store")
+				http.ServeContent(w, r, "", st.ModTime(), fp)
+			},
+		},
+		{
+			Method:  "DELETE",
+			Path:    "/drafts/{id}",
+			Summary: "Delete the draft",
+			Feature: "drafts",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				id := draftID(w, r)
+				if id == "" {
+					return
+				}
+				err := drafts.Remove(id)
+				if err != nil {
+					slog.Error("could not delete draft", "err", err)
+					writeAPIError(w, 500, "could not delete draft")
+					return
+				}
+				w.WriteHeader(http.StatusNoContent)
+			},
+		},
+	}
+}
+
+// setupDrafts serves drafts, if enabled.
+func (h *Handler) setupDrafts() error {
+	cfg := h.cfg
+	draftTTL, err := time.ParseDuration(cfg.DraftTTL)
+	if err != nil {
+		return err
+	}
+	if draftTTL <= 0 {
+		return nil
+	}
+	draftsDir := cfg.DraftsDir
+	if draftsDir == "" {
+		draftsDir = defaultDraftsDir(cfg.ImagesDir)
+	}
+	maxDraftsSize := uint64(0)
+	if cfg.MaxDraftsSize != "" {
+		maxDraftsSize, err = humanize.ParseBytes(cfg.MaxDraftsSize)
+		if err != nil {
+			return err
+		}
+	}
+	drafts, err := openDraftStore(draftsDir, draftTTL, cfg.MaxDrafts,
+		int64(maxDraftsSize))
+	if err != nil {
+		return err
+	}
+	h.run(func(ctx context.Context) { drafts.Run(ctx, time.Minute) })
+	draftLimiter := newRateLimiter(draftMinDelay, draftBurst)
+	h.run(func(ctx context.Context) { draftLimiter.Run(ctx, time.Minute) })
+	h.optional = append(h.optional, draftRoutes(drafts, h.opts.maxImgSize,
+		func(r *http.Request) bool {
+			if !draftLimiter.Allow(h.proxies.clientIP(r), time.Now()) {
+				h.requestLogger(r).Warn("rate limited")
+				return false
+			}
+			return true
+		})...)
+	return nil
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pmezard/gribouillis/imageproc"
+)
+
+func TestDraftStore(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "gribouillis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	s, err := openDraftStore(tmpDir, time.Hour, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := encodeTestImage(t, 10, 10)
+	err = s.Put("a", "image/png", bytes.NewReader(data), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Replacing an existing draft is not limited by the count
+	err = s.Put("a", "image/png", bytes.NewReader(data), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Put("b", "image/png", bytes.NewReader(data), 1000)
+	if err != errTooManyDrafts {
+		t.Fatalf("expected too many drafts error, got %v", err)
+	}
+	err = s.Put("a", "image/png", bytes.NewReader(data), int64(len(data)-1))
+	if _, ok := err.(*imageproc.RejectedImageError); !ok {
+		t.Fatalf("large draft: expected rejection, got %v", err)
+	}
+	err = s.Put("a", "image/png", bytes.NewReader(data[:len(data)-4]), 1000)
+	if _, ok := err.(*imageproc.RejectedImageError); !ok {
+		t.Fatalf("truncated draft: expected rejection, got %v", err)
+	}
+
+	// Expire the draft
+	old := time.Now().Add(-2 * time.Hour)
+	err = os.Chtimes(filepath.Join(tmpDir, "a.png"), old, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Open("a"); !os.IsNotExist(err) {
+		t.Fatalf("expired draft: expected not found, got %v", err)
+	}
+	err = s.Prune()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ioutil.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expired draft was not pruned: %d entries", len(entries))
+	}
+
+	// Drafts are limited in total size, replaced ones not counting
+	s, err = openDraftStore(tmpDir, time.Hour, 10, int64(2*len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "a", "b"} {
+		err = s.Put(id, "image/png", bytes.NewReader(data), 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = s.Put("c", "image/png", bytes.NewReader(data), 1000)
+	if err != errTooManyDrafts {
+		t.Fatalf("expected too many drafts error, got %v", err)
+	}
+	err = s.Remove("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Put("c", "image/png", bytes.NewReader(data), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDraftsAPI(t *testing.T) {
+	cfg, cleanup := newTestConfig(t)
+	defer cleanup()
+	cfg.DraftTTL = "1h"
+	cfg.MaxDrafts = 10
+	h, err := NewHandler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	do := func(method, id string, body []byte) (int, []byte) {
+		req, err := http.NewRequest(method, srv.URL+"/api/v1/drafts/"+id,
+			bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rsp.Body.Close()
+		data, err := ioutil.ReadAll(rsp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rsp.StatusCode, data
+	}
+	id := "0123456789abcdef"
+	data := encodeTestImage(t, 10, 10)
+	if code, _ := do("GET", id, nil); code != 404 {
+		t.Fatalf("missing draft: expected 404, got %d", code)
+	}
+	if code, _ := do("PUT", "short", data); code != 400 {
+		t.Fatalf("short identifier: expected 400, got %d", code)
+	}
+	if code, _ := do("PUT", id, []byte("not a PNG")); code != 415 {
+		t.Fatalf("invalid draft: expected 415, got %d", code)
+	}
+	if code, _ := do("PUT", id, data); code != 204 {
+		t.Fatalf("could not save draft: %d", code)
+	}
+	code, got := do("GET", id, nil)
+	if code != 200 || !bytes.Equal(got, data) {
+		t.Fatalf("could not fetch draft: %d", code)
+	}
+	if code, _ := do("DELETE", id, nil); code != 204 {
+		t.Fatalf("could not delete draft: %d", code)
+	}
+	if code, _ := do("GET", id, nil); code != 404 {
+		t.Fatalf("deleted draft: expected 404, got %d", code)
+	}
+	// Updates are rate limited
+	if code, _ := do("PUT", id, data); code != 204 {
+		t.Fatalf("could not save draft: %d", code)
+	}
+	if code, _ := do("PUT", id, data); code != 429 {
+		t.Fatalf("expected a rate limited update, got %d", code)
+	}
+	entries, err := ioutil.ReadDir(cfg.ImagesDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("drafts were saved as drawings")
+	}
+}
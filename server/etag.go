@@ -0,0 +1,93 @@
+package server
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cachedETag is the ETag of a file with a given size and modification time.
+type cachedETag struct {
+	size    int64
+	modTime time.Time
+	etag    string
+}
+
+// etagCache computes strong ETags of the files of dir from their content
+// hash. They are cached until the file size or modification time changes,
+// like when drawings are recompressed. It can be used concurrently.
+type etagCache struct {
+	dir   string
+	lock  sync.Mutex
+	etags map[string]*cachedETag
+}
+
+func newETagCache(dir string) *etagCache {
+	return &etagCache{
+		dir:   dir,
+		etags: map[string]*cachedETag{},
+	}
+}
+
+// ETag returns the quoted ETag of the file name.
+func (c *etagCache) ETag(name string) (string, error) {
+	fp, err := os.Open(filepath.Join(c.dir, name))
+	if err != nil {
+		return "", err
+	}
+	defer fp.Close()
+	st, err := fp.Stat()
+	if err != nil {
+		return "", err
+	}
+	c.lock.Lock()
+	e, ok := c.etags[name]
+	c.lock.Unlock()
+	if ok && e.size == st.Size() && e.modTime.Equal(st.ModTime()) {
+		return e.etag, nil
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, fp)
+	if err != nil {
+		return "", err
+	}
+	e = &cachedETag{
+		size:    st.Size(),
+		modTime: st.ModTime(),
+		etag:    fmt.Sprintf(`"%x"`, h.Sum(nil)[:16]),
+	}
+	c.lock.Lock()
+	c.etags[name] = e
+	c.lock.Unlock()
+	return e.etag, nil
+}
+
+// Remove forgets the ETag of the file name.
+func (c *etagCache) Remove(name string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.etags, name)
+}
+
+// Handler returns a handler setting the ETag of the files named by GET and
+// HEAD request paths before serving them with h, which must honor
+// conditional requests like http.FileServer.
+func (c *etagCache) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		if (r.Method == "GET" || r.Method == "HEAD") &&
+			!strings.ContainsAny(name, "/\\") && !strings.HasPrefix(name, ".") &&
+			name != "" {
+			if etag, err := c.ETag(name); err == nil {
+				w.Header().Set("ETag", etag)
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
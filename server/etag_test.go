@@ -0,0 +1,67 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestETag(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "gribouillis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "a.png")
+	err = ioutil.WriteFile(path, encodeTestImage(t, 4, 4), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newETagCache(tmpDir)
+	srv := httptest.NewServer(c.Handler(http.FileServer(http.Dir(tmpDir))))
+	defer srv.Close()
+
+	get := func(name, etag string) (int, string) {
+		req, err := http.NewRequest("GET", srv.URL+"/"+name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp.Body.Close()
+		return rsp.StatusCode, rsp.Header.Get("ETag")
+	}
+	code, etag := get("a.png", "")
+	if code != 200 || len(etag) != 34 {
+		t.Fatalf("unexpected response: %d, %q", code, etag)
+	}
+	if code, _ := get("a.png", etag); code != http.StatusNotModified {
+		t.Fatalf("expected a 304, got %d", code)
+	}
+	// Replaced files get a new ETag
+	err = ioutil.WriteFile(path, encodeTestImage(t, 5, 5), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	err = os.Chtimes(path, later, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, changed := get("a.png", etag)
+	if code != 200 || changed == etag || changed == "" {
+		t.Fatalf("unexpected response to a changed file: %d, %q", code, changed)
+	}
+	if code, etag := get("missing.png", ""); code != 404 || etag != "" {
+		t.Fatalf("unexpected response to a missing file: %d, %q", code, etag)
+	}
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Event types recorded in the event log.
+const (
+	eventSave     = "save"
+	eventEviction = "eviction"
+	eventDeletion = "deletion"
+)
+
+// maxEvents is the maximum number of events returned by a query.
+const maxEvents = 1000
+
+// Event is a change of the saved drawings.
+type Event struct {
+	// ID increases with each event, starting at 1.
+	ID   int64     `json:"id"`
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+	// Name is the drawing file name.
+	Name string `json:"name"`
+}
+
+// eventLog appends events to a file, one JSON object per line, so consumers
+// can catch up with changes they missed.
+type eventLog struct {
+	path   string
+	lock   sync.Mutex
+	fp     *os.File
+	lastID int64
+}
+
+// defaultEventsPath returns the event log used with imagesDir.
+func defaultEventsPath(imagesDir string) string {
+	return filepath.Clean(imagesDir) + "-events.jsonl"
+}
+
+// scanEvents calls fn with the events stored in path until it returns false.
+// It returns the size of the complete lines read. Malformed lines are
+// skipped, and an incomplete last one, interrupted by a crash, ignored.
+func scanEvents(path string, fn func(e *Event) bool) (int64, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer fp.Close()
+	r := bufio.NewReader(fp)
+	size := int64(0)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return size, nil
+		} else if err != nil {
+			return size, err
+		}
+		size += int64(len(line))
+		e := &Event{}
+		if json.Unmarshal(line, e) != nil {
+			continue
+		}
+		if !fn(e) {
+			return size, nil
+		}
+	}
+}
+
+// openEventLog opens the event log in path, creating it if necessary.
+func openEventLog(path string) (*eventLog, error) {
+	l := &eventLog{path: path}
+	size, err := scanEvents(path, func(e *Event) bool {
+		if e.ID > l.lastID {
+			l.lastID = e.ID
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	l.fp, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	// Drop the incomplete last line, if any, not to corrupt the next event
+	err = l.fp.Truncate(size)
+	if err != nil {
+		l.fp.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Close closes the log file, events cannot be appended anymore.
+func (l *eventLog) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.fp.Close()
+}
+
+// Append records an event of type typ about drawing name.
+func (l *eventLog) Append(typ, name string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	e := &Event{
+		ID:   l.lastID + 1,
+		Time: time.Now().UTC(),
+		Type: typ,
+		Name: name,
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = l.fp.Write(append(data, '\n'))
+	if err != nil {
+		return err
+	}
+	l.lastID = e.ID
+	return nil
+}
+
+// RecordEviction logs the eviction of drawing name.
+func (l *eventLog) RecordEviction(name string) {
+	err := l.Append(eventEviction, name)
+	if err != nil {
+		slog.Error("could not log eviction", "name", name, "err", err)
+	}
+}
+
+// Query returns at most limit events with from <= time < to, and whether
+// more of them matched.
+func (l *eventLog) Query(from, to time.Time, limit int) ([]Event, bool, error) {
+	events := []Event{}
+	more := false
+	_, err := scanEvents(l.path, func(e *Event) bool {
+		if e.Time.Before(from) || !e.Time.Before(to) {
+			return true
+		}
+		if len(events) >= limit {
+			more = true
+			return false
+		}
+		events = append(events, *e)
+		return true
+	})
+	return events, more, err
+}
+
+// eventsResponse is returned by the events endpoint.
+type eventsResponse struct {
+	Events []Event `json:"events"`
+	// More is true if the query matched more events than returned.
+	More bool `json:"more"`
+}
+
+// parseEventsQuery parses the time range and limit of an events query. The
+// range defaults to everything up to now.
+func parseEventsQuery(get func(string) string) (time.Time, time.Time, int, error) {
+	from := time.Time{}
+	to := time.Now().Add(time.Second)
+	limit := maxEvents
+	var err error
+	if s := get("from"); s != "" {
+		from, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			return from, to, 0, fmt.Errorf("invalid from: %s", err)
+		}
+	}
+	if s := get("to"); s != "" {
+		to, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			return from, to, 0, fmt.Errorf("invalid to: %s", err)
+		}
+	}
+	if s := get("limit"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit <= 0 || limit > maxEvents {
+			return from, to, 0, fmt.Errorf("limit must be between 1 and %d",
+				maxEvents)
+		}
+	}
+	return from, to, limit, nil
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEventLog(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "gribouillis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "events.jsonl")
+	l, err := openEventLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		err := l.Append(eventSave, fmt.Sprintf("%d.png", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.fp.Close()
+
+	// Simulate a write interrupted by a crash
+	fp, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp.Write([]byte(`{"id":4,"ti`))
+	fp.Close()
+
+	l, err = openEventLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.fp.Close()
+	l.RecordEviction("0.png")
+	events, more, err := l.Query(time.Time{}, time.Now().Add(time.Hour), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if more || len(events) != 4 {
+		t.Fatalf("unexpected events: %+v, %v", events, more)
+	}
+	last := events[3]
+	if last.ID != 4 || last.Type != eventEviction || last.Name != "0.png" {
+		t.Fatalf("unexpected last event: %+v", last)
+	}
+	events, more, err = l.Query(events[1].Time, time.Now().Add(time.Hour), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !more || len(events) != 1 || events[0].ID != 2 {
+		t.Fatalf("unexpected limited events: %+v, %v", events, more)
+	}
+}
+
+func TestEventsAPI(t *testing.T) {
+	cfg, cleanup := newTestConfig(t)
+	defer cleanup()
+	cfg.MaxCount = 1
+	h, err := NewHandler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	start := time.Now().Add(-time.Second)
+	for i := 0; i < 2; i++ {
+		rsp, err := http.Post(srv.URL+"/api/v1/drawings", "image/png",
+			bytes.NewReader(encodeTestImage(t, 10, 10)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp.Body.Close()
+	}
+	get := func(query string) (*eventsResponse, int) {
+		rsp, err := http.Get(srv.URL + "/api/v1/events?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rsp.Body.Close()
+		res := &eventsResponse{}
+		json.NewDecoder(rsp.Body).Decode(res)
+		return res, rsp.StatusCode
+	}
+	q := url.Values{}
+	q.Set("from", start.Format(time.RFC3339))
+	res, code := get(q.Encode())
+	if code != 200 {
+		t.Fatalf("could not list events: %d", code)
+	}
+	types := []string{}
+	for _, e := range res.Events {
+		types = append(types, e.Type)
+	}
+	if fmt.Sprint(types) != "[save eviction save]" {
+		t.Fatalf("unexpected events: %+v", res.Events)
+	}
+	for _, query := range []string{"from=yesterday", "limit=0", "limit=5x"} {
+		if _, code := get(query); code != 400 {
+			t.Errorf("%s: expected 400, got %d", query, code)
+		}
+	}
+}
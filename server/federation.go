@@ -0,0 +1,434 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pmezard/gribouillis/imageproc"
+)
+
+const (
+	// federationMaxDrawings is the number of latest drawings fetched from
+	// each federated instance.
+	federationMaxDrawings = 20
+	// federationThumbSize bounds the dimensions of cached thumbnails, in
+	// pixels.
+	federationThumbSize = 200
+	// federationMaxImageSize limits the size of downloaded remote images.
+	federationMaxImageSize = 10 << 20
+	// federationIndex is the file caching the merged listing.
+	federationIndex = "index.json"
+)
+
+// federatedDrawing is a drawing of another instance.
+type federatedDrawing struct {
+	// Instance is the base URL of the instance the drawing comes from.
+	Instance string    `json:"instance"`
+	Name     string    `json:"name"`
+	URL      string    `json:"url"`
+	PageURL  string    `json:"page_url"`
+	Created  time.Time `json:"created"`
+	// Thumbnail is the file name of the cached thumbnail.
+	Thumbnail string `json:"thumbnail"`
+}
+
+// federation periodically fetches the latest drawings of other gribouillis
+// instances through their API, and caches their thumbnails in dir.
+type federation struct {
+	peers  []*url.URL
+	dir    string
+	client *http.Client
+	enc    imageproc.Encoder
+
+	lock     sync.Mutex
+	drawings []federatedDrawing
+}
+
+// defaultFederatedDir returns the federated thumbnails directory used with
+// imagesDir.
+func defaultFederatedDir(imagesDir string) string {
+	return filepath.Clean(imagesDir) + "-federated"
+}
+
+// parsePeers parses a comma separated list of instances base URLs.
+func parsePeers(s string) ([]*url.URL, error) {
+	peers := []*url.URL{}
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		u, err := url.Parse(p)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf("invalid federated instance URL: %s", p)
+		}
+		if !strings.HasSuffix(u.Path, "/") {
+			u.Path += "/"
+		}
+		peers = append(peers, u)
+	}
+	return peers, nil
+}
+
+// openFederation returns a federation of peers caching thumbnails in dir.
+// The listing cached by a previous run is restored.
+func openFederation(dir string, peers []*url.URL) (*federation, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	f := &federation{
+		peers:  peers,
+		dir:    dir,
+		client: &http.Client{Timeout: time.Minute},
+		enc: &png.Encoder{
+			CompressionLevel: png.BestCompression,
+		},
+		drawings: []federatedDrawing{},
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, federationIndex))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &f.drawings)
+		if err != nil {
+			slog.Warn("could not read federated drawings index", "err", err)
+		}
+	}
+	return f, nil
+}
+
+// thumbnailName returns the cached thumbnail name of drawing name of peer.
+func thumbnailName(peer *url.URL, name string) string {
+	h := sha256.Sum256([]byte(peer.String()))
+	return hex.EncodeToString(h[:8]) + "-" + name
+}
+
+// get fetches u and returns the response if successful.
+func (f *federation) get(u string) (*http.Response, error) {
+	rsp, err := f.client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode != 200 {
+		rsp.Body.Close()
+		return nil, fmt.Errorf("could not fetch %s: %s", u, rsp.Status)
+	}
+	return rsp, nil
+}
+
+// fetchThumbnail downloads the PNG image at u and writes its thumbnail as
+// name.
+func (f *federation) fetchThumbnail(u, name string) error {
+	rsp, err := f.get(u)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(rsp.Body, federationMaxImageSize+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > federationMaxImageSize {
+		return fmt.Errorf("image is larger than %d bytes", federationMaxImageSize)
+	}
+	cfg, err := png.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if cfg.Width*cfg.Height > composeMaxPixels {
+		return fmt.Errorf("image is too large: %dx%d", cfg.Width, cfg.Height)
+	}
+	m, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	b := m.Bounds()
+	if b.Empty() {
+		return fmt.Errorf("image is empty")
+	}
+	var thumb image.Image = m
+	if b.Dx() > federationThumbSize || b.Dy() > federationThumbSize {
+		w, h := imageproc.FitSize(b, federationThumbSize)
+		thumb = imageproc.Downscale(m, w, h)
+	}
+	tmp, err := ioutil.TempFile(f.dir, ".thumbnail-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	err = f.enc.Encode(tmp, thumb)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(f.dir, name))
+}
+
+// fetchPeer returns the latest drawings of peer, fetching the missing
+// thumbnails.
+func (f *federation) fetchPeer(peer *url.URL) ([]federatedDrawing, error) {
+	listURL := peer.ResolveReference(&url.URL{Path: "api/v1/drawings"})
+	rsp, err := f.get(listURL.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	listing := drawingsResponse{}
+	err = json.NewDecoder(io.LimitReader(rsp.Body, 1<<20)).Decode(&listing)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %s", listURL, err)
+	}
+	drawings := []federatedDrawing{}
+	for _, d := range listing.Drawings {
+		if len(drawings) >= federationMaxDrawings {
+			break
+		}
+		if !drawingIDRe.MatchString(strings.TrimSuffix(d.Name, ".png")) {
+			continue
+		}
+		imgURL, err := listURL.Parse(d.URL)
+		if err != nil {
+			continue
+		}
+		thumb := thumbnailName(peer, d.Name)
+		_, err = os.Stat(filepath.Join(f.dir, thumb))
+		if os.IsNotExist(err) {
+			err = f.fetchThumbnail(imgURL.String(), thumb)
+		}
+		if err != nil {
+			slog.Warn("could not cache thumbnail", "url", imgURL.String(), "err", err)
+			continue
+		}
+		drawings = append(drawings, federatedDrawing{
+			Instance:  peer.String(),
+			Name:      d.Name,
+			URL:       imgURL.String(),
+			PageURL:   d.PageURL,
+			Created:   d.Created,
+			Thumbnail: thumb,
+		})
+	}
+	return drawings, nil
+}
+
+// Update fetches the latest drawings of all instances. Instances which cannot
+// be reached keep their previous drawings. Unused thumbnails are removed.
+func (f *federation) Update() error {
+	previous := f.Drawings()
+	drawings := []federatedDrawing{}
+	for _, peer := range f.peers {
+		fetched, err := f.fetchPeer(peer)
+		if err != nil {
+			slog.Warn("could not fetch federated drawings", "instance", peer.String(),
+				"err", err)
+			for _, d := range previous {
+				if d.Instance == peer.String() {
+					drawings = append(drawings, d)
+				}
+			}
+			continue
+		}
+		drawings = append(drawings, fetched...)
+	}
+	sort.SliceStable(drawings, func(i, j int) bool {
+		return drawings[i].Created.After(drawings[j].Created)
+	})
+	f.lock.Lock()
+	f.drawings = drawings
+	f.lock.Unlock()
+
+	used := map[string]bool{federationIndex: true}
+	for _, d := range drawings {
+		used[d.Thumbnail] = true
+	}
+	entries, err := ioutil.ReadDir(f.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !used[e.Name()] {
+			os.Remove(filepath.Join(f.dir, e.Name()))
+		}
+	}
+	data, err := json.Marshal(drawings)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(f.dir, federationIndex), data, 0644)
+}
+
+// Drawings returns the federated drawings, newest first.
+func (f *federation) Drawings() []federatedDrawing {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]federatedDrawing{}, f.drawings...)
+}
+
+// Run updates the federated drawings now and every interval, until ctx is
+// done.
+func (f *federation) Run(ctx context.Context, interval time.Duration) {
+	for {
+		err := f.Update()
+		if err != nil {
+			slog.Error("could not update federated drawings", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// ServeThumbnail serves the thumbnail named by the request path.
+func (f *federation) ServeThumbnail(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	if !strings.HasSuffix(name, ".png") || strings.ContainsAny(name, "/\\") ||
+		strings.HasPrefix(name, ".") {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFile(w, r, filepath.Join(f.dir, name))
+}
+
+var federatedTemplate = template.Must(template.New("federated").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Federated gallery - gribouillis</title>
+<style>
+body { font-family: sans-serif; max-width: 60em; margin: 1em auto; padding: 0 1em; }
+ul { list-style: none; padding: 0; display: flex; flex-wrap: wrap; gap: 1em; }
+li { width: 200px; font-size: small; }
+img { max-width: 200px; max-height: 200px; border: 1px solid #ddd; }
+</style>
+</head>
+<body>
+<h1>Federated gallery</h1>
+<p>Latest drawings of other instances. <a href="{{.Base}}/">Draw your own</a></p>
+<ul>
+{{range .Drawings}}<li><a href="{{if .PageURL}}{{.PageURL}}{{else}}{{.URL}}{{end}}"><img src="{{$.Base}}/federated/thumbnails/{{.Thumbnail}}" alt=""></a><br>From <a href="{{.Instance}}">{{.Host}}</a>, <time datetime="{{.Created.Format "2006-01-02T15:04:05Z07:00"}}">{{.Created.Format "January 2, 2006"}}</time></li>
+{{end}}</ul>
+</body>
+</html>
+`))
+
+// federatedPageData is the federated gallery page template data.
+type federatedPageData struct {
+	Base     string
+	Drawings []federatedPageDrawing
+}
+
+type federatedPageDrawing struct {
+	federatedDrawing
+	// Host is the host name of the instance, to attribute the drawing.
+	Host string
+}
+
+// ServePage serves the federated gallery, linking to pages below base.
+func (f *federation) ServePage(w http.ResponseWriter, r *http.Request, base string) {
+	data := &federatedPageData{Base: base}
+	for _, d := range f.Drawings() {
+		host := d.Instance
+		if u, err := url.Parse(d.Instance); err == nil {
+			host = u.Host
+		}
+		data.Drawings = append(data.Drawings, federatedPageDrawing{d, host})
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := federatedTemplate.Execute(w, data)
+	if err != nil {
+		slog.Warn("could not render federated gallery", "err", err)
+	}
+}
+
+// setupFederation serves the drawings of federated instances, if enabled.
+func (h *Handler) setupFederation() error {
+	cfg := h.cfg
+	if cfg.FederatedInstances == "" {
+		return nil
+	}
+	peers, err := parsePeers(cfg.FederatedInstances)
+	if err != nil {
+		return err
+	}
+	interval, err := time.ParseDuration(cfg.FederationInterval)
+	if err != nil {
+		return err
+	}
+	if interval <= 0 {
+		return fmt.Errorf("federation interval must be positive")
+	}
+	federatedDir := cfg.FederatedDir
+	if federatedDir == "" {
+		federatedDir = defaultFederatedDir(cfg.ImagesDir)
+	}
+	fed, err := openFederation(federatedDir, peers)
+	if err != nil {
+		return err
+	}
+	h.run(func(ctx context.Context) { fed.Run(ctx, interval) })
+	thumbnailsURL := "/federated/thumbnails/"
+	h.mux.Handle(thumbnailsURL, http.StripPrefix(thumbnailsURL,
+		http.HandlerFunc(fed.ServeThumbnail)))
+	h.mux.HandleFunc("/federated/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/federated/" {
+			http.NotFound(w, r)
+			return
+		}
+		fed.ServePage(w, r, mountPrefix(r))
+	})
+	h.optional = append(h.optional, &apiRoute{
+		Method:   "GET",
+		Path:     "/federated",
+		Summary:  "List the latest drawings of federated instances, newest first",
+		Feature:  "federation",
+		Response: &federatedResponse{},
+		Handler: func(w http.ResponseWriter, r *http.Request) {
+			u := h.proxies.baseURL(r)
+			u.Path += mountPrefix(r) + thumbnailsURL
+			rsp := &federatedResponse{Drawings: []federatedInfo{}}
+			for _, d := range fed.Drawings() {
+				rsp.Drawings = append(rsp.Drawings, federatedInfo{
+					Instance:      d.Instance,
+					Name:          d.Name,
+					URL:           d.URL,
+					PageURL:       d.PageURL,
+					ThumbnailPath: u.Path + d.Thumbnail,
+					ThumbnailURL:  u.String() + d.Thumbnail,
+					Created:       d.Created,
+				})
+			}
+			writeJSON(w, 200, rsp)
+		},
+	})
+	return nil
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFederation(t *testing.T) {
+	cfg, cleanup := newTestConfig(t)
+	defer cleanup()
+	h, err := NewHandler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	peer := httptest.NewServer(h)
+	defer peer.Close()
+	for _, size := range [][2]int{{300, 100}, {10, 10}} {
+		rsp, err := http.Post(peer.URL+"/api/v1/drawings", "image/png",
+			bytes.NewReader(encodeTestImage(t, size[0], size[1])))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp.Body.Close()
+		if rsp.StatusCode != 200 {
+			t.Fatalf("could not save drawing: %s", rsp.Status)
+		}
+	}
+
+	tmpDir, err := ioutil.TempDir("", "gribouillis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	peers, err := parsePeers(" " + peer.URL + ", ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(tmpDir, "federated")
+	fed, err := openFederation(dir, peers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fed.Update()
+	if err != nil {
+		t.Fatal(err)
+	}
+	drawings := fed.Drawings()
+	if len(drawings) != 2 || drawings[0].Instance != peer.URL+"/" {
+		t.Fatalf("unexpected federated drawings: %+v", drawings)
+	}
+	for _, d := range drawings {
+		m, err := decodePNGFile(filepath.Join(dir, d.Thumbnail))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := m.Bounds()
+		if b.Dx() > federationThumbSize || b.Dy() > federationThumbSize {
+			t.Fatalf("thumbnail is too large: %v", b)
+		}
+	}
+
+	// Unreachable instances keep their drawings, also after a restart
+	peer.Close()
+	fed, err = openFederation(dir, peers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fed.Update()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(fed.Drawings()); n != 2 {
+		t.Fatalf("expected 2 cached drawings, got %d", n)
+	}
+	w := httptest.NewRecorder()
+	fed.ServePage(w, httptest.NewRequest("GET", "/federated/", nil), "")
+	u, _ := url.Parse(peer.URL)
+	if !strings.Contains(w.Body.String(), "From <a href=\""+peer.URL+"/\">"+u.Host) {
+		t.Fatalf("drawings are not attributed:\n%s", w.Body.String())
+	}
+
+	if _, err := parsePeers("ftp://example.com"); err == nil {
+		t.Fatal("invalid instance URL was accepted")
+	}
+}
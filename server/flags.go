@@ -0,0 +1,243 @@
+package server
+
+import "flag"
+
+// RegisterFlags defines the command line flags setting cfg fields in fs, and
+// sets these fields to the flags defaults.
+func (cfg *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&cfg.BaseURL, "base-url", "", "web server base URL")
+	fs.StringVar(&cfg.ImagesDir, "images-dir", "images",
+		"directory where drawings are saved")
+	fs.StringVar(&cfg.WebDir, "web-dir", "",
+		"directory of frontend files served instead of the embedded ones")
+	fs.StringVar(&cfg.PublicURL, "public-url", "",
+		"public URL of the canvas, advertised by chat integrations")
+	fs.StringVar(&cfg.FilenamePattern, "filename-pattern", "{id}",
+		"saved images file name pattern, see usage")
+	fs.StringVar(&cfg.ReservedNames, "reserved-names", defaultReservedNames,
+		"comma separated list of drawing identifiers never allocated")
+	fs.StringVar(&cfg.ImageBaseURL, "image-base-url", "",
+		"public URL of saved images, like a CDN serving the saved/ subpath, defaults to the server one")
+	fs.StringVar(&cfg.MaxImageSize, "max-image-size", "10MB", "maximum image size")
+	fs.StringVar(&cfg.MinImageSize, "min-image-size", "0",
+		"minimum size of posted images, smaller ones are rejected")
+	fs.IntVar(&cfg.MinWidth, "min-width", 0,
+		"minimum width of posted images, in pixels")
+	fs.IntVar(&cfg.MinHeight, "min-height", 0,
+		"minimum height of posted images, in pixels")
+	fs.StringVar(&cfg.MinDelay, "min-delay", "5s",
+		"minimum delay between two records of a client, on average")
+	fs.IntVar(&cfg.RateBurst, "rate-burst", 1,
+		"number of records a client can make in a row, ignoring -min-delay")
+	fs.StringVar(&cfg.DedupWindow, "dedup-window", "0",
+		"how long identical uploads of a client return the first saved drawing, zero disabling it")
+	fs.StringVar(&cfg.ProcessTimeout, "process-timeout", "30s",
+		"maximum duration of image decoding, padding and encoding, 0 to disable")
+	fs.BoolVar(&cfg.RejectBlank, "reject-blank", false,
+		"reject blank images, see -min-ink")
+	fs.Float64Var(&cfg.MinInk, "min-ink", 0,
+		"percentage of pixels differing from the background below which images are blank, 0 for uniform images only")
+	fs.StringVar(&cfg.Background, "background", "none",
+		"color like #ffffff transparent images are flattened on, or none to keep transparency")
+	fs.IntVar(&cfg.Padding, "padding", 20,
+		"width of the border added to saved images, 0 to store them as is")
+	fs.StringVar(&cfg.PaddingColor, "padding-color", "white",
+		"color of the border added to saved images, a name like white or black, or like #ffffff")
+	fs.StringVar(&cfg.ColorProfile, "color-profile", "keep",
+		"keep or strip color profiles of padded images")
+	fs.StringVar(&cfg.WatermarkText, "watermark-text", "",
+		"text stamped on saved drawings, like the instance URL")
+	fs.StringVar(&cfg.WatermarkImage, "watermark-image", "",
+		"PNG image stamped on saved drawings, instead of -watermark-text")
+	fs.StringVar(&cfg.WatermarkPosition, "watermark-position", "bottom-right",
+		"position of the watermark: top-left, top-right, bottom-left, bottom-right or center")
+	fs.Float64Var(&cfg.WatermarkOpacity, "watermark-opacity", 0.5,
+		"opacity of the watermark, between 0 and 1")
+	fs.BoolVar(&cfg.Fsync, "fsync", false,
+		"flush saved drawings and their metadata to disk before acknowledging saves")
+	fs.BoolVar(&cfg.ReduceColors, "reduce-colors", false,
+		"store padded or recompressed images with at most 256 colors as grayscale or paletted PNG")
+	fs.StringVar(&cfg.PNGEncoder, "png-encoder", "stdlib",
+		"PNG encoder: stdlib, or parallel to compress large images on several cores")
+	fs.StringVar(&cfg.PNGCompression, "png-compression", "default",
+		"PNG compression level: default, none, speed or best")
+	fs.IntVar(&cfg.PNGParallelism, "png-parallelism", 0,
+		"maximum number of cores used by the parallel PNG encoder, 0 for all")
+	fs.StringVar(&cfg.RecompressIdle, "recompress-idle", "0",
+		"recompress stored images with the best compression level after this idle duration, 0 to disable")
+	fs.StringVar(&cfg.JobsPath, "jobs", "",
+		"file persisting background jobs, defaults to images directory with a -jobs.json suffix")
+	fs.IntVar(&cfg.PreviewSize, "preview-size", 400,
+		"maximum width and height of saved images previews, 0 to disable them")
+	fs.StringVar(&cfg.PreviewsDir, "previews-dir", "",
+		"directory where previews are saved, defaults to images directory with a -previews suffix")
+	fs.BoolVar(&cfg.ReferrerStats, "referrer-stats", false,
+		"count saved images views by referring domain")
+	fs.StringVar(&cfg.ReferrersPath, "referrers", "",
+		"file persisting referrer statistics, defaults to images directory with a -referrers.json suffix")
+	fs.StringVar(&cfg.ImageMaxAge, "image-max-age", "0",
+		"how long browsers and proxies may cache saved images without revalidating them, 0 to disable")
+	fs.BoolVar(&cfg.Variants, "variants", false,
+		"serve saved images as WebP or AVIF to clients accepting them, and SVG renderings compressed")
+	fs.StringVar(&cfg.VariantsDir, "variants-dir", "",
+		"directory where image variants are cached, defaults to images directory with a -variants suffix")
+	fs.StringVar(&cfg.WebPCommand, "webp-command", "cwebp -quiet -lossless {in} -o {out}",
+		"command encoding a PNG image {in} to WebP {out}, empty to disable")
+	fs.StringVar(&cfg.AVIFCommand, "avif-command", "avifenc --lossless {in} {out}",
+		"command encoding a PNG image {in} to AVIF {out}, empty to disable")
+	fs.BoolVar(&cfg.ViewStats, "view-stats", false,
+		"count the views of each drawing, for their authors")
+	fs.StringVar(&cfg.ViewsPath, "views", "",
+		"file persisting view statistics, defaults to images directory with a -views.json suffix")
+	fs.BoolVar(&cfg.Reactions, "reactions", false,
+		"let visitors like drawings and report them to the moderators")
+	fs.StringVar(&cfg.ReactionsPath, "reactions-state", "",
+		"file persisting likes and reports, defaults to images directory with a -reactions.json suffix")
+	fs.StringVar(&cfg.UsagePath, "usage", "",
+		"file persisting usage statistics, defaults to images directory with a -usage.json suffix")
+	fs.StringVar(&cfg.EventsPath, "events", "",
+		"file logging saves and evictions, defaults to images directory with a -events.jsonl suffix")
+	fs.StringVar(&cfg.DraftTTL, "draft-ttl", "0",
+		"lifetime of autosaved drafts after their last update, 0 disables drafts")
+	fs.StringVar(&cfg.DraftsDir, "drafts-dir", "",
+		"directory where drafts are saved, defaults to images directory with a -drafts suffix")
+	fs.IntVar(&cfg.MaxDrafts, "max-drafts", 1000, "maximum number of drafts")
+	fs.StringVar(&cfg.MaxDraftsSize, "max-drafts-size", "100MB",
+		"maximum total size of drafts, 0 means unlimited")
+	fs.StringVar(&cfg.PendingTTL, "pending-ttl", "0",
+		"lifetime of uploaded drawings waiting for confirmation, 0 disables two-phase saves")
+	fs.StringVar(&cfg.PendingDir, "pending-dir", "",
+		"directory of drawings waiting for confirmation, defaults to images directory with a -pending suffix")
+	fs.IntVar(&cfg.MaxPending, "max-pending", 100, "maximum number of drawings waiting for confirmation")
+	fs.StringVar(&cfg.PromptsPath, "prompts", "",
+		"file of drawing prompts, one per line, published one per day")
+	fs.BoolVar(&cfg.Rooms, "rooms", false,
+		"enable shared drawing rooms in room/{id}")
+	fs.StringVar(&cfg.RoomTurnTime, "room-turn-time", "1m",
+		"duration of a turn in turn-based rooms")
+	fs.IntVar(&cfg.RoomMaxCount, "room-max-count", 100,
+		"maximum number of rooms, idle ones included, zero for unlimited")
+	fs.IntVar(&cfg.RoomMaxClients, "room-max-clients", 50,
+		"maximum number of participants of a room, zero for unlimited")
+	fs.StringVar(&cfg.RoomMessageDelay, "room-message-delay", "50ms",
+		"minimum delay between two messages of a room participant, on average")
+	fs.IntVar(&cfg.RoomMessageBurst, "room-message-burst", 100,
+		"number of messages a room participant can send in a row, ignoring -room-message-delay")
+	fs.StringVar(&cfg.RoomMaxSize, "room-max-size", "16MB",
+		"maximum size of the shapes of a room, 0 for unlimited")
+	fs.StringVar(&cfg.RoomMaxTotalSize, "room-max-total-size", "256MB",
+		"maximum size of the shapes of all rooms, 0 for unlimited")
+	fs.StringVar(&cfg.RoomSecret, "room-secret", "",
+		"secret signing private rooms invites, defaults to GRIBOUILLIS_ROOM_SECRET environment variable")
+	fs.StringVar(&cfg.RoomsPath, "rooms-state", "",
+		"file saving rooms across restarts, defaults to images directory with a -rooms.json suffix")
+	fs.StringVar(&cfg.RoomInvitesPath, "room-invites-state", "",
+		"file tracking private rooms members, defaults to images directory with a -invites.json suffix")
+	fs.StringVar(&cfg.MaxSchedule, "max-schedule", "0",
+		"how far ahead drawings publication can be scheduled, zero disabling scheduling")
+	fs.StringVar(&cfg.ScheduledDir, "scheduled-dir", "",
+		"directory of drawings waiting for their publication time, defaults to images directory with a -scheduled suffix")
+	fs.IntVar(&cfg.MaxFrames, "max-frames", 0,
+		"maximum number of flipbook frames, zero disabling flipbooks")
+	fs.StringVar(&cfg.FramesDir, "frames-dir", "",
+		"directory where flipbook frames are saved, defaults to images directory with a -frames suffix")
+	fs.StringVar(&cfg.MetaDir, "meta-dir", "",
+		"directory where drawings metadata are saved, defaults to images directory with a -meta suffix")
+	fs.BoolVar(&cfg.BlurHash, "blurhash", true,
+		"compute saved images BlurHash, returned to clients to render placeholders")
+	fs.StringVar(&cfg.MaxSize, "max-size", "50MB",
+		"maximum combined size of saved drawings")
+	fs.IntVar(&cfg.MaxCount, "max-count", 500, "maximum number of saved drawings")
+	fs.StringVar(&cfg.MaxAge, "max-age", "0",
+		"age after which saved drawings are evicted, like 720h, 0 to disable")
+	fs.StringVar(&cfg.Eviction, "eviction", "oldest",
+		"eviction order of saved drawings: oldest, lru for least recently viewed first, or weighted")
+	fs.StringVar(&cfg.EvictionWeights, "eviction-weights", "age=1,size=1,views=1",
+		"comma separated criterion=weight scores of -eviction weighted, criteria being age, size and views")
+	fs.StringVar(&cfg.PrefixQuotas, "prefix-quotas", "",
+		"comma separated prefix:max-size:max-count limits of saved drawings whose names start with prefix, like photo-:100MB:0")
+	fs.StringVar(&cfg.RoomRetention, "room-retention", "",
+		"comma separated room:max-age overrides of -max-age for drawings saved from room, max-age being a duration or forever, like event:forever,scratch:24h")
+	fs.StringVar(&cfg.Storage, "storage", "dir",
+		"where drawings are persisted: dir or s3")
+	fs.StringVar(&cfg.S3Endpoint, "s3-endpoint", "",
+		"URL of the S3 compatible service, defaults to the AWS one of -s3-region")
+	fs.StringVar(&cfg.S3Region, "s3-region", "us-east-1", "S3 region")
+	fs.StringVar(&cfg.S3Bucket, "s3-bucket", "", "S3 bucket mirroring drawings")
+	fs.StringVar(&cfg.S3Prefix, "s3-prefix", "",
+		"prefix of drawings names in the S3 bucket")
+	fs.StringVar(&cfg.ArchiveDir, "archive-dir", "",
+		"directory of archived drawings, served in archive/, disabled if empty")
+	fs.StringVar(&cfg.ArchiveMaxSize, "archive-max-size", "0",
+		"maximum size of archived drawings, 0 for unlimited")
+	fs.IntVar(&cfg.ArchiveMaxCount, "archive-max-count", 0,
+		"maximum number of archived drawings, 0 for unlimited")
+	fs.StringVar(&cfg.ReconcileInterval, "reconcile-interval", "10m",
+		"delay between two rescans of the images directory, 0 to disable")
+	fs.StringVar(&cfg.PreSaveHook, "pre-save-hook", "",
+		"command accepting, rejecting or captioning drawings before they are published")
+	fs.StringVar(&cfg.PostSaveHook, "post-save-hook", "",
+		"command run in the background after drawings are published")
+	fs.StringVar(&cfg.TrustedProxies, "trusted-proxies", "",
+		"comma separated addresses or networks of proxies allowed to set X-Forwarded-* headers")
+	fs.StringVar(&cfg.Middlewares, "middlewares", "logging,limits,security-headers",
+		"comma separated list of middlewares wrapping handlers, outermost first")
+	fs.StringVar(&cfg.MatrixHomeserver, "matrix-homeserver", "",
+		"Matrix homeserver URL, like https://matrix.org")
+	fs.StringVar(&cfg.MatrixToken, "matrix-token", "",
+		"access token of the Matrix account announcing drawings, defaults to GRIBOUILLIS_MATRIX_TOKEN environment variable")
+	fs.StringVar(&cfg.MatrixRoom, "matrix-room", "",
+		"identifier of the Matrix room where drawings are announced")
+	fs.BoolVar(&cfg.MatrixCommands, "matrix-commands", false,
+		"answer !draw messages in the Matrix room with -public-url")
+	fs.StringVar(&cfg.IRCServer, "irc-server", "",
+		"IRC server where drawings are announced, as host:port")
+	fs.BoolVar(&cfg.IRCTLS, "irc-tls", true, "connect to the IRC server with TLS")
+	fs.StringVar(&cfg.IRCNick, "irc-nick", "gribouillis", "IRC bot nickname")
+	fs.StringVar(&cfg.IRCChannel, "irc-channel", "",
+		"IRC channel where drawings are announced")
+	fs.StringVar(&cfg.FederatedInstances, "federate", "",
+		"comma separated base URLs of instances shown in the federated gallery")
+	fs.StringVar(&cfg.FederationInterval, "federation-interval", "15m",
+		"delay between fetches of federated instances drawings")
+	fs.StringVar(&cfg.FederatedDir, "federated-dir", "",
+		"directory of federated drawings thumbnails, defaults to images directory with a -federated suffix")
+	fs.StringVar(&cfg.ActivityPubUser, "activitypub-user", "",
+		"user name of the ActivityPub actor publishing drawings, requires -public-url")
+	fs.StringVar(&cfg.ActivityPubDir, "activitypub-dir", "",
+		"directory of the ActivityPub key and followers, defaults to images directory with a -activitypub suffix")
+	fs.StringVar(&cfg.ColdGrace, "cold-grace", "0",
+		"how long evicted drawings are still served from cold storage, zero disabling it")
+	fs.StringVar(&cfg.ColdDir, "cold-dir", "",
+		"cold storage directory of evicted drawings, defaults to images directory with a -cold suffix")
+	fs.StringVar(&cfg.TombstoneAge, "tombstone-age", "0",
+		"how long removed drawings return a 410 explaining their removal, zero disabling it")
+	fs.StringVar(&cfg.TombstonesDir, "tombstones-dir", "",
+		"directory of removed drawings tombstones, defaults to images directory with a -tombstones suffix")
+	fs.BoolVar(&cfg.VerifyImages, "verify-images", false,
+		"decode stored drawings on startup and quarantine corrupted ones")
+	fs.StringVar(&cfg.QuarantineDir, "quarantine-dir", "",
+		"directory of corrupted drawings, defaults to images directory with a -quarantine suffix")
+	fs.StringVar(&cfg.Auth, "auth", "",
+		"user:password credentials required by the auth middleware, defaults to GRIBOUILLIS_AUTH environment variable")
+	fs.StringVar(&cfg.AuthFile, "auth-file", "",
+		"htpasswd file of users accepted by the auth middleware")
+	fs.StringVar(&cfg.AdminToken, "admin-token", "",
+		"bearer token of the admin API, disabled if empty, defaults to GRIBOUILLIS_ADMIN_TOKEN environment variable")
+	fs.StringVar(&cfg.OIDCIssuer, "oidc-issuer", "",
+		"OpenID Connect provider URL logging administrators in, requires -public-url")
+	fs.StringVar(&cfg.OIDCClientID, "oidc-client-id", "",
+		"OpenID Connect client identifier")
+	fs.StringVar(&cfg.OIDCClientSecret, "oidc-client-secret", "",
+		"OpenID Connect client secret, defaults to GRIBOUILLIS_OIDC_CLIENT_SECRET environment variable")
+	fs.StringVar(&cfg.OIDCAdmins, "oidc-admins", "",
+		"comma separated email addresses or @domains of administrators")
+}
+
+// DefaultConfig returns a configuration set to the command line defaults,
+// for programs embedding the handler returned by NewHandler.
+func DefaultConfig() *Config {
+	cfg := &Config{}
+	cfg.RegisterFlags(flag.NewFlagSet("gribouillis", flag.ContinueOnError))
+	return cfg
+}
@@ -0,0 +1,619 @@
+package server
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pmezard/gribouillis/imageproc"
+)
+
+const (
+	// flipbookDelay is the default duration of flipbook frames, in
+	// milliseconds, flipbookMaxDelay the longest accepted one.
+	flipbookDelay    = 100
+	flipbookMaxDelay = 10000
+)
+
+// flipbook describes the frames of an animated drawing. The first frame is
+// the drawing itself.
+type flipbook struct {
+	// Frames is the number of frames, including the first one.
+	Frames int `json:"frames"`
+	// Delay is the duration of each frame, in milliseconds.
+	Delay int `json:"delay"`
+}
+
+// flipbookStore keeps the frames following the first one of animated
+// drawings, and their GIF and APNG renditions, in a directory per drawing.
+// Frames are not accounted in the images directory limits but are removed
+// with their drawing.
+type flipbookStore struct {
+	dir string
+	// images is the directory of drawings, holding the first frames.
+	images string
+}
+
+// newFlipbookStore returns a flipbookStore of drawings stored in images
+// directory, writing frames in dir. Frames of missing drawings, and
+// abandoned uploads, are removed.
+func newFlipbookStore(dir, images string) (*flipbookStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		_, err := os.Stat(filepath.Join(images, e.Name()+".png"))
+		if strings.HasPrefix(e.Name(), ".") || os.IsNotExist(err) {
+			os.RemoveAll(filepath.Join(dir, e.Name()))
+		}
+	}
+	return &flipbookStore{
+		dir:    dir,
+		images: images,
+	}, nil
+}
+
+// defaultFramesDir returns the frames directory used with imagesDir.
+func defaultFramesDir(imagesDir string) string {
+	return filepath.Clean(imagesDir) + "-frames"
+}
+
+// path returns the directory of drawing name frames.
+func (s *flipbookStore) path(name string) string {
+	return filepath.Join(s.dir, strings.TrimSuffix(name, ".png"))
+}
+
+// Stage returns a temporary directory where uploaded frames are written
+// before being committed.
+func (s *flipbookStore) Stage() (string, error) {
+	return ioutil.TempDir(s.dir, ".flipbook-")
+}
+
+// Commit renders the animation of drawing name, whose following frames are
+// the files of staging, in order, and moves them in the store. Frames must
+// have the dimensions of the drawing.
+func (s *flipbookStore) Commit(staging, name string, frames []string,
+	delay int) error {
+
+	first, err := decodePNGFile(filepath.Join(s.images, name))
+	if err != nil {
+		return err
+	}
+	images := []image.Image{first}
+	for i, f := range frames {
+		path := filepath.Join(staging, strconv.Itoa(i+1)+".png")
+		err := os.Rename(filepath.Join(staging, f), path)
+		if err != nil {
+			return err
+		}
+		m, err := decodePNGFile(path)
+		if err != nil {
+			return err
+		}
+		if m.Bounds().Size() != first.Bounds().Size() {
+			return &imageproc.RejectedImageError{Reason: fmt.Sprintf(
+				"frame %d is %dx%d, not %dx%d", i+1, m.Bounds().Dx(),
+				m.Bounds().Dy(), first.Bounds().Dx(), first.Bounds().Dy())}
+		}
+		images = append(images, m)
+	}
+	write := func(file string, encode func(w io.Writer) error) error {
+		buf := &bytes.Buffer{}
+		err := encode(buf)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(filepath.Join(staging, file), buf.Bytes(), 0644)
+	}
+	err = write("animation.gif", func(w io.Writer) error {
+		return encodeGIF(w, images, delay)
+	})
+	if err != nil {
+		return err
+	}
+	err = write("animation.png", func(w io.Writer) error {
+		return encodeAPNG(w, images, delay)
+	})
+	if err != nil {
+		return err
+	}
+	err = write("flipbook.json", func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(&flipbook{
+			Frames: len(images),
+			Delay:  delay,
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return os.Rename(staging, s.path(name))
+}
+
+// Get returns the flipbook of drawing name, or an error satisfying
+// os.IsNotExist if it is not animated.
+func (s *flipbookStore) Get(name string) (*flipbook, error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.path(name), "flipbook.json"))
+	if err != nil {
+		return nil, err
+	}
+	fb := &flipbook{}
+	err = json.Unmarshal(data, fb)
+	return fb, err
+}
+
+// FramePath returns the file of frame i of drawing name.
+func (s *flipbookStore) FramePath(name string, i int) string {
+	if i == 0 {
+		return filepath.Join(s.images, name)
+	}
+	return filepath.Join(s.path(name), strconv.Itoa(i)+".png")
+}
+
+// AnimationPath returns the animation of drawing name in format, "gif" or
+// "apng".
+func (s *flipbookStore) AnimationPath(name, format string) string {
+	if format == "apng" {
+		return filepath.Join(s.path(name), "animation.png")
+	}
+	return filepath.Join(s.path(name), "animation.gif")
+}
+
+// Remove deletes the frames of drawing name, if any.
+func (s *flipbookStore) Remove(name string) {
+	os.RemoveAll(s.path(name))
+}
+
+const (
+	// onionOpacity is the default opacity of the frame preceding an onion
+	// skinned one, onionMaxDepth the maximum number of previous frames.
+	onionOpacity  = 0.3
+	onionMaxDepth = 5
+)
+
+// onionSkin returns current drawn over the previous frames, the most recent
+// last, the k-th frame before current being faded to opacity/k. current may
+// be nil to render only the previous frames, as the background of the next
+// one.
+func onionSkin(previous []image.Image, current image.Image,
+	opacity float64) (*image.NRGBA, error) {
+
+	c := &composeRequest{Layout: "overlay"}
+	images := []image.Image{}
+	for i, m := range previous {
+		c.Drawings = append(c.Drawings, "")
+		c.Opacity = append(c.Opacity, opacity/float64(len(previous)-i))
+		images = append(images, m)
+	}
+	if current != nil {
+		c.Drawings = append(c.Drawings, "")
+		c.Opacity = append(c.Opacity, 1)
+		images = append(images, current)
+	}
+	return compose(c, images)
+}
+
+// encodeGIF writes images as a looping GIF animation, showing each one for
+// delay milliseconds. Colors are flattened on white and mapped to the web
+// safe palette, mostly transparent pixels being kept transparent.
+func encodeGIF(w io.Writer, images []image.Image, delay int) error {
+	pal := append(color.Palette{color.Transparent}, palette.WebSafe...)
+	white := color.NRGBA{0xff, 0xff, 0xff, 0xff}
+	anim := &gif.GIF{}
+	for _, m := range images {
+		b := m.Bounds()
+		p := image.NewPaletted(image.Rect(0, 0, b.Dx(), b.Dy()), pal)
+		for y := 0; y < b.Dy(); y++ {
+			for x := 0; x < b.Dx(); x++ {
+				c := m.At(b.Min.X+x, b.Min.Y+y)
+				if _, _, _, a := c.RGBA(); a < 0x8000 {
+					continue
+				}
+				p.Pix[y*p.Stride+x] = uint8(pal.Index(imageproc.Flatten(c, white)))
+			}
+		}
+		anim.Image = append(anim.Image, p)
+		// GIF delays are in hundredths of second
+		anim.Delay = append(anim.Delay, (delay+5)/10)
+		anim.Disposal = append(anim.Disposal, gif.DisposalBackground)
+	}
+	return gif.EncodeAll(w, anim)
+}
+
+// apngFrameData returns the deflated, filtered, 8 bits RGBA rows of m.
+func apngFrameData(m image.Image) ([]byte, error) {
+	b := m.Bounds()
+	n := 1 + 4*b.Dx()
+	cr, pr := make([]byte, n), make([]byte, n)
+	scratch := [4][]byte{}
+	for i := range scratch {
+		scratch[i] = make([]byte, n)
+	}
+	buf := &bytes.Buffer{}
+	z := zlib.NewWriter(buf)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		imageproc.ReadRow(m, 4, y, cr[1:])
+		_, err := z.Write(imageproc.FilterRow(cr, pr, 4, &scratch))
+		if err != nil {
+			return nil, err
+		}
+		cr, pr = pr, cr
+	}
+	err := z.Close()
+	return buf.Bytes(), err
+}
+
+// encodeAPNG writes images, which must have the same dimensions, as a
+// looping animated PNG showing each one for delay milliseconds. Viewers
+// without APNG support display the first one.
+func encodeAPNG(w io.Writer, images []image.Image, delay int) error {
+	b := images[0].Bounds()
+	_, err := io.WriteString(w, imageproc.PNGHeader)
+	if err != nil {
+		return err
+	}
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], uint32(b.Dx()))
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(b.Dy()))
+	// 8 bits RGBA, default compression, filtering and no interlacing
+	ihdr[8], ihdr[9] = 8, 6
+	err = imageproc.WriteChunk(w, "IHDR", ihdr)
+	if err != nil {
+		return err
+	}
+	actl := make([]byte, 8)
+	binary.BigEndian.PutUint32(actl[0:], uint32(len(images)))
+	err = imageproc.WriteChunk(w, "acTL", actl)
+	if err != nil {
+		return err
+	}
+	seq := uint32(0)
+	for i, m := range images {
+		fctl := make([]byte, 26)
+		binary.BigEndian.PutUint32(fctl[0:], seq)
+		binary.BigEndian.PutUint32(fctl[4:], uint32(b.Dx()))
+		binary.BigEndian.PutUint32(fctl[8:], uint32(b.Dy()))
+		binary.BigEndian.PutUint16(fctl[20:], uint16(delay))
+		binary.BigEndian.PutUint16(fctl[22:], 1000)
+		// Clear the frame to transparent before the next one
+		fctl[24] = 1
+		seq++
+		err := imageproc.WriteChunk(w, "fcTL", fctl)
+		if err != nil {
+			return err
+		}
+		data, err := apngFrameData(m)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			err = imageproc.WriteChunk(w, "IDAT", data)
+		} else {
+			fdat := make([]byte, 4, 4+len(data))
+			binary.BigEndian.PutUint32(fdat, seq)
+			seq++
+			err = imageproc.WriteChunk(w, "fdAT", append(fdat, data...))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return imageproc.WriteChunk(w, "IEND", nil)
+}
+
+// setupFlipbooks saves and serves animated drawings, if enabled.
+func (h *Handler) setupFlipbooks() error {
+	cfg := h.cfg
+	if cfg.MaxFrames <= 0 {
+		return nil
+	}
+	framesDir := cfg.FramesDir
+	if framesDir == "" {
+		framesDir = defaultFramesDir(cfg.ImagesDir)
+	}
+	flipbooks, err := newFlipbookStore(framesDir, h.imgDir.Path())
+	if err != nil {
+		return err
+	}
+	h.imgDir.OnRemove(flipbooks.Remove)
+	// saveFlipbook applies the rate limit and saves the frames posted as
+	// "frame" parts of a multipart body, the first one as the drawing.
+	// It returns the HTTP status code to use on error.
+	saveFlipbook := func(r *http.Request) (*saveResponse, int, error) {
+		m, code, err := h.parseCaptions(r)
+		if err != nil {
+			return nil, code, err
+		}
+		delay := flipbookDelay
+		if v := r.URL.Query().Get("delay"); v != "" {
+			delay, err = strconv.Atoi(v)
+			if err != nil || delay < 1 || delay > flipbookMaxDelay {
+				return nil, http.StatusBadRequest, fmt.Errorf(
+					"delay must be between 1 and %d", flipbookMaxDelay)
+			}
+		}
+		mr, err := r.MultipartReader()
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		ip := h.proxies.clientIP(r)
+		if !h.limiter.Allow(ip, time.Now()) {
+			h.requestLogger(r).Warn("rate limited")
+			return nil, 429, fmt.Errorf("rate limited")
+		}
+		staging, err := flipbooks.Stage()
+		if err != nil {
+			return nil, 500, err
+		}
+		defer os.RemoveAll(staging)
+		name := ""
+		frames := []string{}
+		// fail removes the drawing of uploads failing after its first
+		// frame was stored.
+		fail := func(code int, err error) (*saveResponse, int, error) {
+			if name != "" {
+				os.Remove(filepath.Join(h.imgDir.Path(), name))
+				flipbooks.Remove(name)
+			}
+			return nil, code, err
+		}
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fail(http.StatusBadRequest, err)
+			}
+			if part.FormName() != "frame" {
+				continue
+			}
+			if name != "" && len(frames)+1 >= cfg.MaxFrames {
+				return fail(http.StatusBadRequest, fmt.Errorf(
+					"flipbooks have at most %d frames", cfg.MaxFrames))
+			}
+			fr := r.Clone(r.Context())
+			fr.Header.Set("Content-Type", part.Header.Get("Content-Type"))
+			fr.Body = ioutil.NopCloser(part)
+			// Only the first frame is the drawing checked by
+			// pre-save hooks
+			dir, check := staging, (*Metadata)(nil)
+			if name == "" {
+				dir, check = h.imgDir.Path(), m
+			}
+			n, code, err := h.store(fr, dir, check)
+			if err != nil {
+				return fail(code, err)
+			}
+			if name == "" {
+				name = n
+			} else {
+				frames = append(frames, n)
+			}
+		}
+		if name == "" {
+			return nil, http.StatusBadRequest, fmt.Errorf("missing frame part")
+		}
+		err = flipbooks.Commit(staging, name, frames, delay)
+		if e, ok := err.(*imageproc.RejectedImageError); ok {
+			h.requestLogger(r).Warn("save rejected", "reason", e.Reason)
+			return fail(http.StatusUnprocessableEntity, err)
+		} else if err != nil {
+			slog.Error("could not write frames", "name", name, "err", err)
+			return fail(500, fmt.Errorf("could not save frames"))
+		}
+		rsp, err := h.publish(r, name, m)
+		if err != nil {
+			h.requestLogger(r).Error("could not save drawing", "err", err)
+			h.meta.Remove(name)
+			return fail(500, fmt.Errorf("could not save image: %s", err))
+		}
+		return rsp, 200, nil
+	}
+	// flipbookOf returns the flipbook of the drawing in request path.
+	flipbookOf := func(w http.ResponseWriter, r *http.Request) (
+		string, *flipbook, bool) {
+
+		name, ok := h.trackedDrawing(r)
+		if !ok {
+			writeAPIError(w, http.StatusNotFound, "unknown drawing")
+			return "", nil, false
+		}
+		fb, err := flipbooks.Get(name)
+		if os.IsNotExist(err) {
+			writeAPIError(w, http.StatusNotFound, "drawing is not animated")
+			return "", nil, false
+		} else if err != nil {
+			slog.Error("could not read flipbook", "name", name, "err", err)
+			writeAPIError(w, 500, "could not read flipbook")
+			return "", nil, false
+		}
+		return name, fb, true
+	}
+	h.optional = append(h.optional, &apiRoute{
+		Method:   "POST",
+		Path:     "/flipbooks",
+		Summary:  "Save the PNG frames posted as multipart parts as an animation",
+		Feature:  "flipbook",
+		Request:  "multipart/form-data",
+		Response: &saveResponse{},
+		Handler: func(w http.ResponseWriter, r *http.Request) {
+			rsp, code, err := saveFlipbook(r)
+			if err != nil {
+				writeAPIError(w, code, err.Error())
+				return
+			}
+			writeJSON(w, 200, rsp)
+		},
+	}, &apiRoute{
+		Method:   "GET",
+		Path:     "/drawings/{name}/frames",
+		Summary:  "Describe the frames of an animated drawing",
+		Feature:  "flipbook",
+		Response: &flipbookResponse{},
+		Handler: func(w http.ResponseWriter, r *http.Request) {
+			name, fb, ok := flipbookOf(w, r)
+			if !ok {
+				return
+			}
+			rsp := &flipbookResponse{Delay: fb.Delay}
+			base := mountPrefix(r) + apiPrefix + "/drawings/" + name
+			for i := 0; i < fb.Frames; i++ {
+				rsp.Frames = append(rsp.Frames,
+					base+"/frames/"+strconv.Itoa(i))
+			}
+			rsp.GIF = base + "/animation?format=gif"
+			rsp.APNG = base + "/animation?format=apng"
+			writeJSON(w, 200, rsp)
+		},
+	}, &apiRoute{
+		Method:       "GET",
+		Path:         "/drawings/{name}/frames/{index}",
+		Summary:      "Return a frame of an animated drawing",
+		Feature:      "flipbook",
+		ResponseType: "image/png",
+		Handler: func(w http.ResponseWriter, r *http.Request) {
+			name, fb, ok := flipbookOf(w, r)
+			if !ok {
+				return
+			}
+			i, err := strconv.Atoi(path.Base(r.URL.Path))
+			if err != nil || i < 0 || i >= fb.Frames {
+				writeAPIError(w, http.StatusNotFound, "unknown frame")
+				return
+			}
+			w.Header().Set("Content-Type", "image/png")
+			http.ServeFile(w, r, flipbooks.FramePath(name, i))
+		},
+	}, &apiRoute{
+		Method:       "GET",
+		Path:         "/drawings/{name}/frames/{index}/onion",
+		Summary:      "Return a frame over its faded previous frames",
+		Feature:      "flipbook",
+		ResponseType: "image/png",
+		Handler: func(w http.ResponseWriter, r *http.Request) {
+			name, fb, ok := flipbookOf(w, r)
+			if !ok {
+				return
+			}
+			// The index after the last frame renders the background
+			// of the next one
+			i, err := strconv.Atoi(path.Base(path.Dir(r.URL.Path)))
+			if err != nil || i < 0 || i > fb.Frames {
+				writeAPIError(w, http.StatusNotFound, "unknown frame")
+				return
+			}
+			query := r.URL.Query()
+			opacity := onionOpacity
+			if v := query.Get("opacity"); v != "" {
+				opacity, err = strconv.ParseFloat(v, 64)
+				if err != nil || !(opacity > 0 && opacity <= 1) {
+					writeAPIError(w, http.StatusBadRequest, "invalid opacity")
+					return
+				}
+			}
+			depth := 1
+			if v := query.Get("depth"); v != "" {
+				depth, err = strconv.Atoi(v)
+				if err != nil || depth < 1 || depth > onionMaxDepth {
+					writeAPIError(w, http.StatusBadRequest, "invalid depth")
+					return
+				}
+			}
+			if depth > i {
+				depth = i
+			}
+			if depth == 0 {
+				// The first frame has no previous one
+				w.Header().Set("Content-Type", "image/png")
+				http.ServeFile(w, r, flipbooks.FramePath(name, i))
+				return
+			}
+			decode := func(i int) (image.Image, bool) {
+				m, err := decodePNGFile(flipbooks.FramePath(name, i))
+				if err != nil {
+					slog.Error("could not decode frame", "name", name, "frame", i,
+						"err", err)
+					writeAPIError(w, 500, "could not decode frame")
+					return nil, false
+				}
+				return m, true
+			}
+			previous := []image.Image{}
+			for j := i - depth; j < i; j++ {
+				m, ok := decode(j)
+				if !ok {
+					return
+				}
+				previous = append(previous, m)
+			}
+			var current image.Image
+			if i < fb.Frames {
+				current, ok = decode(i)
+				if !ok {
+					return
+				}
+			}
+			skin, err := onionSkin(previous, current, opacity)
+			if err != nil {
+				slog.Error("could not render onion skin", "name", name, "err", err)
+				writeAPIError(w, 500, "could not render onion skin")
+				return
+			}
+			buf := &bytes.Buffer{}
+			err = png.Encode(buf, skin)
+			if err != nil {
+				slog.Warn("could not encode onion skin", "name", name, "err", err)
+				writeAPIError(w, 500, "could not encode onion skin")
+				return
+			}
+			w.Header().Set("Content-Type", "image/png")
+			buf.WriteTo(w)
+		},
+	}, &apiRoute{
+		Method:       "GET",
+		Path:         "/drawings/{name}/animation",
+		Summary:      "Return an animated drawing as GIF or APNG",
+		Feature:      "flipbook",
+		ResponseType: "image/gif",
+		Handler: func(w http.ResponseWriter, r *http.Request) {
+			name, _, ok := flipbookOf(w, r)
+			if !ok {
+				return
+			}
+			format := r.URL.Query().Get("format")
+			switch format {
+			case "", "gif":
+				w.Header().Set("Content-Type", "image/gif")
+			case "apng":
+				w.Header().Set("Content-Type", "image/apng")
+			default:
+				writeAPIError(w, http.StatusBadRequest, "invalid format")
+				return
+			}
+			http.ServeFile(w, r, flipbooks.AnimationPath(name, format))
+		},
+	})
+	return nil
+}
@@ -0,0 +1,248 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFlipbookEncoders(t *testing.T) {
+	images := []image.Image{}
+	for _, c := range []color.NRGBA{{0xff, 0, 0, 0xff}, {0, 0, 0xff, 0x80}} {
+		m := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+		for i := 0; i < len(m.Pix); i += 4 {
+			copy(m.Pix[i:], []byte{c.R, c.G, c.B, c.A})
+		}
+		images = append(images, m)
+	}
+
+	buf := &bytes.Buffer{}
+	err := encodeAPNG(buf, images, 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Decoders without APNG support see the first frame
+	first, err := png.Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Bounds() != images[0].Bounds() {
+		t.Fatalf("unexpected bounds: %v", first.Bounds())
+	}
+	if c := color.NRGBAModel.Convert(first.At(2, 1)); c != (color.NRGBA{0xff, 0, 0, 0xff}) {
+		t.Fatalf("unexpected first frame color: %v", c)
+	}
+	for _, chunk := range []string{"acTL", "fcTL", "fdAT"} {
+		if !bytes.Contains(buf.Bytes(), []byte(chunk)) {
+			t.Fatalf("%s chunk is missing", chunk)
+		}
+	}
+
+	buf.Reset()
+	err = encodeGIF(buf, images, 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	anim, err := gif.DecodeAll(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(anim.Image) != 2 || anim.Delay[0] != 25 {
+		t.Fatalf("unexpected animation: %d frames, delays %v", len(anim.Image),
+			anim.Delay)
+	}
+	if c := anim.Image[0].At(0, 0); c != color.Color(color.RGBA{0xff, 0, 0, 0xff}) {
+		t.Fatalf("unexpected first frame color: %v", c)
+	}
+	// Half transparent blue is flattened on white
+	if _, _, _, a := anim.Image[1].At(0, 0).RGBA(); a != 0xffff {
+		t.Fatalf("half transparent pixel was dropped")
+	}
+}
+
+func TestOnionSkin(t *testing.T) {
+	frame := func(c color.NRGBA) image.Image {
+		m := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+		m.SetNRGBA(0, 0, c)
+		return m
+	}
+	red := frame(color.NRGBA{0xff, 0, 0, 0xff})
+	blue := frame(color.NRGBA{0, 0, 0xff, 0xff})
+	current := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	current.SetNRGBA(1, 0, color.NRGBA{0, 0xff, 0, 0xff})
+
+	skin, err := onionSkin([]image.Image{red, blue}, current, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Blue at 0.5 over red at 0.25
+	if c := skin.NRGBAAt(0, 0); c.A < 0x9a || c.A > 0xa2 || c.B <= c.R {
+		t.Fatalf("unexpected faded color: %v", c)
+	}
+	if c := skin.NRGBAAt(1, 0); c != (color.NRGBA{0, 0xff, 0, 0xff}) {
+		t.Fatalf("unexpected current color: %v", c)
+	}
+	// Background of the next frame
+	skin, err = onionSkin([]image.Image{red}, nil, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := skin.NRGBAAt(0, 0); c.R != 0xff || c.A < 0x7f || c.A > 0x80 {
+		t.Fatalf("unexpected faded color: %v", c)
+	}
+}
+
+func TestFlipbookHandler(t *testing.T) {
+	cfg, cleanup := newTestConfig(t)
+	defer cleanup()
+	cfg.MaxFrames = 3
+	h, err := NewHandler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	post := func(frames ...[]byte) (int, saveResponse) {
+		buf := &bytes.Buffer{}
+		w := multipart.NewWriter(buf)
+		for _, data := range frames {
+			hdr := textproto.MIMEHeader{}
+			hdr.Set("Content-Disposition", `form-data; name="frame"; filename="blob"`)
+			hdr.Set("Content-Type", "image/png")
+			part, err := w.CreatePart(hdr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			part.Write(data)
+		}
+		w.Close()
+		rsp, err := http.Post(srv.URL+"/api/v1/flipbooks?delay=200",
+			w.FormDataContentType(), buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rsp.Body.Close()
+		saved := saveResponse{}
+		json.NewDecoder(rsp.Body).Decode(&saved)
+		return rsp.StatusCode, saved
+	}
+	get := func(u string) (int, []byte) {
+		rsp, err := http.Get(srv.URL + u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rsp.Body.Close()
+		data, err := ioutil.ReadAll(rsp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rsp.StatusCode, data
+	}
+
+	frame := encodeTestImage(t, 10, 10)
+	code, saved := post(frame, frame)
+	if code != 200 {
+		t.Fatalf("unexpected status: %d", code)
+	}
+	name := path.Base(saved.Path)
+	code, data := get("/api/v1/drawings/" + name + "/frames")
+	if code != 200 {
+		t.Fatalf("unexpected status: %d", code)
+	}
+	fb := flipbookResponse{}
+	err = json.Unmarshal(data, &fb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fb.Delay != 200 || len(fb.Frames) != 2 {
+		t.Fatalf("unexpected flipbook: %+v", fb)
+	}
+	for _, u := range []string{fb.Frames[1], fb.GIF, fb.APNG} {
+		if code, _ := get(u); code != 200 {
+			t.Fatalf("%s: unexpected status: %d", u, code)
+		}
+	}
+	if code, _ := get("/api/v1/drawings/" + name + "/frames/2"); code != 404 {
+		t.Fatalf("expected 404 for unknown frame, got %d", code)
+	}
+	onion := "/api/v1/drawings/" + name + "/frames/"
+	for u, expected := range map[string]int{
+		onion + "0/onion":           200,
+		onion + "1/onion?depth=3":   200,
+		onion + "2/onion":           200,
+		onion + "3/onion":           404,
+		onion + "1/onion?opacity=0": 400,
+		onion + "1/onion?depth=9":   400,
+	} {
+		if code, _ := get(u); code != expected {
+			t.Fatalf("%s: expected %d, got %d", u, expected, code)
+		}
+	}
+
+	// Frames are limited and must have the same dimensions
+	if code, _ := post(frame, frame, frame, frame); code != 400 {
+		t.Fatalf("expected 400 for too many frames, got %d", code)
+	}
+	if code, _ := post(frame, encodeTestImage(t, 20, 10)); code != 422 {
+		t.Fatalf("expected 422 for mismatched frames, got %d", code)
+	}
+	entries, err := ioutil.ReadDir(cfg.ImagesDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("rejected flipbooks were kept: %d images", len(entries))
+	}
+
+	// Single frame drawings are not animated
+	rsp, err := http.Post(srv.URL+"/api/v1/drawings", "image/png",
+		bytes.NewReader(frame))
+	if err != nil {
+		t.Fatal(err)
+	}
+	still := saveResponse{}
+	err = json.NewDecoder(rsp.Body).Decode(&still)
+	rsp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ = get("/api/v1/drawings/" + path.Base(still.Path) + "/frames")
+	if code != 404 {
+		t.Fatalf("expected 404 for still drawing, got %d", code)
+	}
+	if code, _ := get(fb.GIF[:len(fb.GIF)-3] + "bmp"); code != 400 {
+		t.Fatalf("expected 400 for invalid format, got %d", code)
+	}
+
+	// Frames are removed with their drawing
+	req, err := http.NewRequest("DELETE", srv.URL+saved.Path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+saved.DeleteToken)
+	rsp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	_, err = os.Stat(filepath.Join(defaultFramesDir(cfg.ImagesDir),
+		strings.TrimSuffix(name, ".png")))
+	if !os.IsNotExist(err) {
+		t.Fatalf("frames were not removed: %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// trustedProxies lists the networks whose X-Forwarded-* headers are honored.
+type trustedProxies []*net.IPNet
+
+// parseTrustedProxies parses a comma separated list of IP addresses or CIDR
+// networks.
+func parseTrustedProxies(s string) (trustedProxies, error) {
+	proxies := trustedProxies{}
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid proxy address: %s", p)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			p = fmt.Sprintf("%s/%d", p, bits)
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, err
+		}
+		proxies = append(proxies, n)
+	}
+	return proxies, nil
+}
+
+func (t trustedProxies) trusts(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range t {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// firstValue returns the first element of a comma separated header value, as
+// set by a chain of proxies.
+func firstValue(h http.Header, key string) string {
+	v := strings.Split(h.Get(key), ",")[0]
+	return strings.TrimSpace(v)
+}
+
+// baseURL returns the URL the request was sent to, up to the path prefix
+// stripped by the proxy, if any. X-Forwarded-Proto, X-Forwarded-Host and
+// X-Forwarded-Prefix are only honored if the request comes from a trusted
+// proxy.
+func (t trustedProxies) baseURL(r *http.Request) *url.URL {
+	u := &url.URL{
+		Scheme: "http",
+		Host:   r.Host,
+	}
+	if r.TLS != nil {
+		u.Scheme = "https"
+	}
+	if !t.trusts(r.RemoteAddr) {
+		return u
+	}
+	if proto := firstValue(r.Header, "X-Forwarded-Proto"); proto != "" {
+		u.Scheme = proto
+	}
+	if host := firstValue(r.Header, "X-Forwarded-Host"); host != "" {
+		u.Host = host
+	}
+	u.Path = strings.TrimRight(firstValue(r.Header, "X-Forwarded-Prefix"), "/")
+	return u
+}
+
+// clientIP returns the address of the client which sent the request. If it
+// comes from trusted proxies, X-Forwarded-For is walked backward to the first
+// untrusted address.
+func (t trustedProxies) clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !t.trusts(ip) {
+		return ip
+	}
+	forwarded := []string{}
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(v, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(addr) == nil {
+			break
+		}
+		ip = addr
+		if !t.trusts(ip) {
+			break
+		}
+	}
+	return ip
+}
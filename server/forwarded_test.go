@@ -0,0 +1,57 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestForwardedBaseURL(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(remoteAddr, wanted string) {
+		r, err := http.NewRequest("POST", "http://localhost:5001/save/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("X-Forwarded-Proto", "https")
+		r.Header.Set("X-Forwarded-Host", "example.com, proxy.local")
+		r.Header.Set("X-Forwarded-Prefix", "/draw/")
+		u := proxies.baseURL(r)
+		if u.String() != wanted {
+			t.Fatalf("expected %s for %s, got %s", wanted, remoteAddr, u)
+		}
+	}
+	check("10.1.2.3:1234", "https://example.com/draw")
+	check("192.168.1.1:1234", "https://example.com/draw")
+	check("192.168.1.2:1234", "http://localhost:5001")
+	check("127.0.0.1:1234", "http://localhost:5001")
+}
+
+func TestForwardedClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(remoteAddr, forwarded, wanted string) {
+		r, err := http.NewRequest("POST", "http://localhost:5001/save/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.RemoteAddr = remoteAddr
+		if forwarded != "" {
+			r.Header.Set("X-Forwarded-For", forwarded)
+		}
+		if ip := proxies.clientIP(r); ip != wanted {
+			t.Fatalf("expected %s for %s, %q, got %s", wanted, remoteAddr,
+				forwarded, ip)
+		}
+	}
+	check("1.2.3.4:1234", "5.6.7.8", "1.2.3.4")
+	check("10.0.0.1:1234", "", "10.0.0.1")
+	check("10.0.0.1:1234", "5.6.7.8", "5.6.7.8")
+	check("10.0.0.1:1234", "9.9.9.9, 5.6.7.8, 10.0.0.2", "5.6.7.8")
+	check("10.0.0.1:1234", "garbage, 10.0.0.2", "10.0.0.2")
+}
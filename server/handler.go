@@ -0,0 +1,754 @@
+// Package server implements the gribouillis HTTP server and its commands.
+// NewHandler returns the handler serving the canvas and API, which can be
+// embedded in other programs, configured by Config.
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/pmezard/gribouillis/storage"
+)
+
+// mountPrefix returns the path prefix stripped from the request URL by
+// enclosing handlers, like http.StripPrefix.
+func mountPrefix(r *http.Request) string {
+	u, err := url.ParseRequestURI(r.RequestURI)
+	if err != nil || !strings.HasSuffix(u.Path, r.URL.Path) {
+		return ""
+	}
+	return strings.TrimRight(u.Path[:len(u.Path)-len(r.URL.Path)], "/")
+}
+
+// reconcile synchronizes dir with its directory content every interval,
+// until ctx is done.
+func reconcile(ctx context.Context, dir *storage.LimitedDir, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		res, err := dir.Reconcile()
+		if err != nil {
+			slog.Error("could not reconcile", "dir", dir.Path(), "err", err)
+			continue
+		}
+		for _, name := range res.Adopted {
+			slog.Info("reconcile: adopted untracked file", "name", name)
+		}
+		for _, name := range res.Dropped {
+			slog.Info("reconcile: dropped missing file", "name", name)
+		}
+		for _, name := range res.Resized {
+			slog.Info("reconcile: updated file size", "name", name)
+		}
+	}
+}
+
+// setPrefixQuotas applies the comma separated "prefix:max-size:max-count"
+// quotas of s to dir.
+func setPrefixQuotas(dir *storage.LimitedDir, s string) error {
+	for _, quota := range strings.Split(s, ",") {
+		quota = strings.TrimSpace(quota)
+		if quota == "" {
+			continue
+		}
+		parts := strings.Split(quota, ":")
+		if len(parts) != 3 {
+			return fmt.Errorf("invalid prefix quota, expected prefix:max-size:max-count: %q", quota)
+		}
+		maxSize, err := humanize.ParseBytes(parts[1])
+		if err != nil || maxSize > math.MaxInt64 {
+			return fmt.Errorf("invalid prefix quota size: %q", quota)
+		}
+		maxCount, err := strconv.Atoi(parts[2])
+		if err != nil || maxCount < 0 {
+			return fmt.Errorf("invalid prefix quota count: %q", quota)
+		}
+		err = dir.SetQuota(parts[0], int64(maxSize), maxCount)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseRoomRetention returns the retention overrides of the comma separated
+// "room:max-age" pairs of s, max-age being a duration or "forever".
+func parseRoomRetention(s string) (map[string]storage.Retention, error) {
+	overrides := map[string]storage.Retention{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.Split(pair, ":")
+		if len(parts) != 2 || !roomIDRe.MatchString(parts[0]) {
+			return nil, fmt.Errorf("invalid room retention, expected room:max-age: %q", pair)
+		}
+		if parts[1] == "forever" {
+			overrides[parts[0]] = storage.Retention{Keep: true}
+			continue
+		}
+		maxAge, err := time.ParseDuration(parts[1])
+		if err != nil || maxAge <= 0 {
+			return nil, fmt.Errorf("invalid room retention age: %q", pair)
+		}
+		overrides[parts[0]] = storage.Retention{MaxAge: maxAge}
+	}
+	return overrides, nil
+}
+
+// parseEvictionWeights returns the WeightedScorer of the comma separated
+// "criterion=weight" pairs of s, criteria being age, size and views. Omitted
+// criteria weigh zero.
+func parseEvictionWeights(s string) (storage.Scorer, error) {
+	weights := map[string]float64{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid eviction weight, expected criterion=weight: %q", pair)
+		}
+		switch parts[0] {
+		case "age", "size", "views":
+		default:
+			return nil, fmt.Errorf("unknown eviction criterion: %q", parts[0])
+		}
+		w, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || w < 0 || math.IsInf(w, 0) || math.IsNaN(w) {
+			return nil, fmt.Errorf("invalid eviction weight: %q", pair)
+		}
+		weights[parts[0]] = w
+	}
+	return storage.WeightedScorer(weights["age"], weights["size"], weights["views"]), nil
+}
+
+// Handler serves a gribouillis instance and owns its background tasks, like
+// evictions, statistics saving or jobs processing. Close stops them.
+type Handler struct {
+	http.Handler
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	// closers are called by Close, in order, once background tasks returned.
+	closers []func()
+	once    sync.Once
+
+	// The fields below are set by NewHandler features setup, those of
+	// disabled features are left nil.
+	cfg        *Config
+	mux        *http.ServeMux
+	web        http.FileSystem
+	opts       *saveOptions
+	proxies    trustedProxies
+	limiter    *rateLimiter
+	dedup      *uploadDedup
+	imgBaseURL *url.URL
+	backend    storage.Storage
+	imgDir     *storage.LimitedDir
+	// nameDirs lists the directories where drawing names must be unique
+	nameDirs       []string
+	archive        *storage.LimitedDir
+	pv             *previewer
+	variants       *variantCache
+	jobs           *JobQueue
+	bulk           *bulkDeletions
+	rc             *recompressor
+	recompressIdle time.Duration
+	// announcers lists the job kinds announcing saved drawings URLs
+	announcers   []string
+	usage        *usageStats
+	events       *eventLog
+	live         *hub
+	meta         *metaStore
+	cold         *coldStore
+	tombstones   *tombstoneStore
+	preHooks     []PreSaveHook
+	postHooks    []PostSaveHook
+	views        *viewStats
+	reactions    *reactionStore
+	ap           *apActor
+	dailyPrompts prompts
+	invites      *roomInvites
+	rooms        *roomRegistry
+	scheduled    *scheduleStore
+	maxSchedule  time.Duration
+	// optional lists the routes of features enabled by configuration
+	optional []*apiRoute
+}
+
+// Paths of the images, archived images, previews and drawing pages, relative
+// to the handler root.
+const (
+	imgURL     = "/saved/"
+	archiveURL = "/archive/"
+	previewURL = "/previews/"
+	pageURL    = "/d/"
+)
+
+// NewHandler returns a Handler serving a gribouillis instance configured with
+// cfg, under cfg.BaseURL. To mount it in another server, leave BaseURL
+// empty and wrap the handler with http.StripPrefix, generated URLs account for
+// the stripped prefix. Close stops its background tasks once done serving.
+func NewHandler(cfg *Config) (_ *Handler, err error) {
+	h := newHandler()
+	h.cfg = cfg
+	h.mux = http.NewServeMux()
+	defer func() {
+		if err != nil {
+			h.Close()
+		}
+	}()
+	h.web, err = webFiles(cfg.WebDir)
+	if err != nil {
+		return nil, err
+	}
+	// Features are set up in order, using the state set up before them, and
+	// append their API routes to h.optional
+	for _, setup := range []func() error{
+		h.setupSaving,
+		h.setupStorage,
+		h.setupJobs,
+		h.setupEvents,
+		h.setupMetadata,
+		h.setupHooks,
+		h.setupImages,
+		h.setupActivityPub,
+		h.setupDrafts,
+		h.setupViews,
+		h.setupReactions,
+		h.setupPrompts,
+		h.setupRooms,
+		h.setupFlipbooks,
+		h.setupPending,
+		h.setupFederation,
+		h.setupSchedule,
+		h.setupAPI,
+	} {
+		err := setup()
+		if err != nil {
+			return nil, err
+		}
+	}
+	admin, err := h.adminHandler()
+	if err != nil {
+		return nil, err
+	}
+
+	var root http.Handler = h.mux
+	baseURL := strings.TrimRight(cfg.BaseURL, "/")
+	if baseURL != "" {
+		prefixed := http.NewServeMux()
+		prefixed.Handle(baseURL+"/", http.StripPrefix(baseURL, h.mux))
+		root = prefixed
+	}
+	root, err = buildMiddlewares(cfg, root)
+	if err != nil {
+		return nil, err
+	}
+	// Probes bypass middlewares, so they need no credentials, are not rate
+	// limited and do not fill the access log. The admin API checks its own
+	// bearer token or session, which the auth middleware would reject, so
+	// it is only logged and given security headers.
+	bypass := http.NewServeMux()
+	bypass.HandleFunc(baseURL+"/healthz", serveHealthz)
+	bypass.Handle(baseURL+"/readyz", &readiness{dir: cfg.ImagesDir, web: h.web})
+	if admin != nil {
+		admin, err = buildAdminMiddlewares(cfg, admin)
+		if err != nil {
+			return nil, err
+		}
+		bypass.Handle(baseURL+adminPrefix+"/", http.StripPrefix(baseURL, admin))
+	}
+	bypass.Handle("/", root)
+	h.Handler = bypass
+	return h, nil
+}
+
+// requestLogger returns a logger annotated with the method, path and client
+// IP of r.
+func (h *Handler) requestLogger(r *http.Request) *slog.Logger {
+	return slog.With("method", r.Method, "path", r.URL.Path,
+		"ip", h.proxies.clientIP(r))
+}
+
+// setupStorage opens the images directory and the directories derived from
+// it, like the archive, previews and variants.
+func (h *Handler) setupStorage() error {
+	cfg := h.cfg
+	maxSize, err := humanize.ParseBytes(cfg.MaxSize)
+	if err != nil {
+		return err
+	}
+	if cfg.ImageBaseURL != "" {
+		h.imgBaseURL, err = url.Parse(cfg.ImageBaseURL)
+		if err != nil {
+			return err
+		}
+		if !h.imgBaseURL.IsAbs() {
+			return fmt.Errorf("image base URL must be absolute: %s",
+				cfg.ImageBaseURL)
+		}
+		if !strings.HasSuffix(h.imgBaseURL.Path, "/") {
+			h.imgBaseURL.Path += "/"
+		}
+	}
+	if cfg.VerifyImages {
+		quarantineDir := cfg.QuarantineDir
+		if quarantineDir == "" {
+			quarantineDir = defaultQuarantineDir(cfg.ImagesDir)
+		}
+		_, err := quarantineCorrupted(cfg.ImagesDir, quarantineDir)
+		if err != nil {
+			return err
+		}
+	}
+	h.backend, err = openStorage(cfg)
+	if err != nil {
+		return err
+	}
+	h.imgDir, err = storage.OpenLimitedStorage(h.backend, int64(maxSize), cfg.MaxCount)
+	if err != nil {
+		return err
+	}
+	reconcileInterval, err := time.ParseDuration(cfg.ReconcileInterval)
+	if err != nil {
+		return err
+	}
+	if reconcileInterval > 0 {
+		h.run(func(ctx context.Context) { reconcile(ctx, h.imgDir, reconcileInterval) })
+	}
+	reserved := parseReservedNames(cfg.ReservedNames)
+	// nameDirs lists the directories where drawing names must be unique
+	h.nameDirs = []string{h.imgDir.Path()}
+	h.opts.taken = func(name string) bool {
+		if reserved[strings.ToLower(strings.TrimSuffix(name, ".png"))] {
+			return true
+		}
+		for _, dir := range h.nameDirs {
+			if _, err := os.Lstat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+				return true
+			}
+		}
+		return false
+	}
+	if cfg.ArchiveDir != "" {
+		if filepath.Clean(cfg.ArchiveDir) == filepath.Clean(cfg.ImagesDir) {
+			return fmt.Errorf("archive and images directories must differ")
+		}
+		h.archive, err = openArchive(cfg.ArchiveDir, cfg.ArchiveMaxSize,
+			cfg.ArchiveMaxCount)
+		if err != nil {
+			return err
+		}
+		if reconcileInterval > 0 {
+			h.run(func(ctx context.Context) { reconcile(ctx, h.archive, reconcileInterval) })
+		}
+		h.nameDirs = append(h.nameDirs, h.archive.Path())
+	}
+	if cfg.PreviewSize > 0 {
+		previewsDir := cfg.PreviewsDir
+		if previewsDir == "" {
+			previewsDir = defaultPreviewsDir(cfg.ImagesDir)
+		}
+		h.pv, err = newPreviewer(previewsDir, h.imgDir.Path(), cfg.PreviewSize)
+		if err != nil {
+			return err
+		}
+		h.imgDir.OnRemove(h.pv.Remove)
+	}
+	if cfg.Variants {
+		variantsDir := cfg.VariantsDir
+		if variantsDir == "" {
+			variantsDir = defaultVariantsDir(cfg.ImagesDir)
+		}
+		h.variants, err = newVariantCache(variantsDir, h.imgDir.Path(), map[string]string{
+			"image/webp": cfg.WebPCommand,
+			"image/avif": cfg.AVIFCommand,
+		})
+		if err != nil {
+			return err
+		}
+		h.imgDir.OnRemove(h.variants.Remove)
+	}
+	return nil
+}
+
+// setupJobs opens the job queue and registers the recompression and
+// announcement jobs.
+func (h *Handler) setupJobs() error {
+	cfg := h.cfg
+	recompressIdle, err := time.ParseDuration(cfg.RecompressIdle)
+	if err != nil {
+		return err
+	}
+	h.recompressIdle = recompressIdle
+	jobsPath := cfg.JobsPath
+	if jobsPath == "" {
+		jobsPath = defaultJobsPath(cfg.ImagesDir)
+	}
+	h.jobs, err = OpenJobQueue(jobsPath, 5)
+	if err != nil {
+		return err
+	}
+	if h.recompressIdle > 0 {
+		h.rc = newRecompressor(h.imgDir, h.recompressIdle, cfg.ReduceColors)
+		h.jobs.Handle("recompress", h.rc.Job)
+		for _, name := range h.imgDir.List() {
+			err := h.jobs.Push("recompress", name, h.recompressIdle)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	// announcers lists the job kinds announcing saved drawings URLs
+	h.announcers = []string{}
+	if cfg.MatrixRoom != "" {
+		if cfg.MatrixHomeserver == "" || cfg.MatrixToken == "" {
+			return fmt.Errorf("matrix room requires a homeserver and a token")
+		}
+		bot := newMatrixBot(cfg.MatrixHomeserver, cfg.MatrixToken, cfg.MatrixRoom)
+		h.jobs.Handle("matrix", bot.Job)
+		h.announcers = append(h.announcers, "matrix")
+		if cfg.MatrixCommands {
+			if cfg.PublicURL == "" {
+				return fmt.Errorf("matrix commands require a public URL")
+			}
+			h.run(func(ctx context.Context) { bot.RunCommands(ctx, cfg.PublicURL) })
+		}
+	}
+	if cfg.IRCChannel != "" {
+		if cfg.IRCServer == "" || cfg.IRCNick == "" {
+			return fmt.Errorf("irc channel requires a server and a nickname")
+		}
+		bot := newIRCBot(cfg.IRCServer, cfg.IRCTLS, cfg.IRCNick, cfg.IRCChannel)
+		h.jobs.Handle("irc", bot.Job)
+		h.announcers = append(h.announcers, "irc")
+		h.run(bot.Run)
+	}
+	h.run(h.jobs.Run)
+	h.onClose(h.jobs.Stop)
+	return nil
+}
+
+// setupEvents opens the usage statistics and the events log, and sets up
+// the live endpoint hub.
+func (h *Handler) setupEvents() error {
+	cfg := h.cfg
+	usagePath := cfg.UsagePath
+	if usagePath == "" {
+		usagePath = defaultUsagePath(cfg.ImagesDir)
+	}
+	usage, err := openUsageStats(usagePath)
+	if err != nil {
+		return err
+	}
+	h.usage = usage
+	h.imgDir.OnEvict(h.usage.RecordEviction)
+	h.run(func(ctx context.Context) { h.usage.Run(ctx, time.Minute) })
+	eventsPath := cfg.EventsPath
+	if eventsPath == "" {
+		eventsPath = defaultEventsPath(cfg.ImagesDir)
+	}
+	h.events, err = openEventLog(eventsPath)
+	if err != nil {
+		return err
+	}
+	h.imgDir.OnEvict(h.events.RecordEviction)
+	h.onClose(func() { h.events.Close() })
+	h.live = newHub()
+	h.onClose(h.live.Close)
+	h.imgDir.OnEvict(func(name string) {
+		h.broadcast("", &liveMessage{Type: eventEviction, Name: name})
+	})
+	return nil
+}
+
+// broadcast sends m to live endpoint clients, coalescing messages with
+// the same non-empty key.
+func (h *Handler) broadcast(key string, m *liveMessage) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		slog.Error("could not encode live message", "err", err)
+		return
+	}
+	h.live.Broadcast(key, data)
+}
+
+// setupMetadata opens the metadata store and the stores of removed
+// drawings, cold storage and tombstones.
+func (h *Handler) setupMetadata() error {
+	cfg := h.cfg
+	metaDir := cfg.MetaDir
+	if metaDir == "" {
+		metaDir = defaultMetaDir(cfg.ImagesDir)
+	}
+	meta, err := openMetaStore(metaDir, h.imgDir.Path())
+	if err != nil {
+		return err
+	}
+	h.meta = meta
+	h.meta.fsync = cfg.Fsync
+	h.imgDir.OnRemove(h.meta.Remove)
+	if cfg.ColdGrace != "" && cfg.ColdGrace != "0" {
+		grace, err := time.ParseDuration(cfg.ColdGrace)
+		if err != nil {
+			return err
+		}
+		coldDir := cfg.ColdDir
+		if coldDir == "" {
+			coldDir = defaultColdDir(cfg.ImagesDir)
+		}
+		h.cold, err = openColdStore(coldDir, grace)
+		if err != nil {
+			return err
+		}
+		h.imgDir.OnEvicting(func(name string) {
+			m, err := h.meta.Get(name)
+			if err != nil {
+				slog.Warn("could not read metadata", "name", name, "err", err)
+				m = &Metadata{}
+			}
+			// Nobody can delete the drawing anymore
+			m.DeleteTokenHash = ""
+			err = h.cold.Keep(h.imgDir.Path(), name, m, time.Now())
+			if err != nil {
+				slog.Error("could not keep evicted drawing", "name", name, "err", err)
+			}
+		})
+		h.nameDirs = append(h.nameDirs, h.cold.dir)
+		h.run(func(ctx context.Context) { h.cold.Run(ctx, time.Minute) })
+	}
+	if cfg.TombstoneAge != "" && cfg.TombstoneAge != "0" {
+		age, err := time.ParseDuration(cfg.TombstoneAge)
+		if err != nil {
+			return err
+		}
+		tombstonesDir := cfg.TombstonesDir
+		if tombstonesDir == "" {
+			tombstonesDir = defaultTombstonesDir(cfg.ImagesDir)
+		}
+		h.tombstones, err = openTombstoneStore(tombstonesDir, age)
+		if err != nil {
+			return err
+		}
+		h.imgDir.OnEvict(func(name string) {
+			err := h.tombstones.Put(name, removalEvicted, time.Now())
+			if err != nil {
+				slog.Error("could not write tombstone", "name", name, "err", err)
+			}
+		})
+		taken := h.opts.taken
+		h.opts.taken = func(name string) bool {
+			return taken(name) || h.tombstones.Taken(name)
+		}
+		h.run(func(ctx context.Context) { h.tombstones.Run(ctx, time.Minute) })
+	}
+	return nil
+}
+
+// setupImages serves saved drawings, their previews and pages, and sets the
+// images directory eviction policy.
+func (h *Handler) setupImages() error {
+	cfg := h.cfg
+	etags := newETagCache(h.imgDir.Path())
+	h.imgDir.OnRemove(etags.Remove)
+	var imgHandler http.Handler = http.FileServer(http.Dir(h.imgDir.Path()))
+	if remote, ok := h.backend.(storage.Remote); ok {
+		imgHandler = remoteFallback(remote, h.imgDir.Path(), imgHandler)
+	}
+	if h.variants != nil {
+		imgHandler = h.variants.Handler(imgHandler)
+	}
+	imgHandler = etags.Handler(imgHandler)
+	if h.tombstones != nil {
+		imgHandler = h.tombstones.Gone(h.imgDir.Path(), imgHandler)
+	}
+	if h.cold != nil {
+		imgHandler = h.cold.Fallback(h.imgDir.Path(), imgHandler)
+	}
+	var pvHandler http.Handler = h.pv
+	if cfg.ReferrerStats {
+		referrersPath := cfg.ReferrersPath
+		if referrersPath == "" {
+			referrersPath = defaultReferrersPath(cfg.ImagesDir)
+		}
+		referrers, err := openReferrerStats(referrersPath)
+		if err != nil {
+			return err
+		}
+		h.imgDir.OnRemove(referrers.Remove)
+		h.run(func(ctx context.Context) { referrers.Run(ctx, time.Minute) })
+		imgHandler = referrers.Handler(imgHandler)
+		if h.pv != nil {
+			pvHandler = referrers.Handler(h.pv)
+		}
+	}
+	if cfg.ViewStats {
+		viewsPath := cfg.ViewsPath
+		if viewsPath == "" {
+			viewsPath = defaultViewsPath(cfg.ImagesDir)
+		}
+		views, err := openViewStats(viewsPath)
+		if err != nil {
+			return err
+		}
+		h.views = views
+		h.imgDir.OnRemove(h.views.Remove)
+		h.run(func(ctx context.Context) { h.views.Run(ctx, time.Minute) })
+	}
+	if cfg.Reactions {
+		reactionsPath := cfg.ReactionsPath
+		if reactionsPath == "" {
+			reactionsPath = defaultReactionsPath(cfg.ImagesDir)
+		}
+		reactions, err := openReactionStore(reactionsPath)
+		if err != nil {
+			return err
+		}
+		h.reactions = reactions
+		h.imgDir.OnRemove(h.reactions.Remove)
+		h.run(func(ctx context.Context) { h.reactions.Run(ctx, time.Minute) })
+	}
+	// Expire drawings once removal hooks are registered
+	switch cfg.Eviction {
+	case "", "oldest":
+	case "lru":
+		h.imgDir.SetLRU(true)
+	case "weighted":
+		scorer, err := parseEvictionWeights(cfg.EvictionWeights)
+		if err != nil {
+			return err
+		}
+		err = h.imgDir.SetScorer(scorer)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown eviction policy: %s", cfg.Eviction)
+	}
+	err := setPrefixQuotas(h.imgDir, cfg.PrefixQuotas)
+	if err != nil {
+		return err
+	}
+	retention, err := parseRoomRetention(cfg.RoomRetention)
+	if err != nil {
+		return err
+	}
+	if len(retention) > 0 {
+		// Saved drawings are added with their room, their metadata being
+		// written after
+		err = h.imgDir.SetRetention(func(name string) string {
+			m, err := h.meta.Get(name)
+			if err != nil {
+				slog.Warn("could not read metadata", "name", name, "err", err)
+				return ""
+			}
+			return m.Room
+		}, retention)
+		if err != nil {
+			return err
+		}
+	}
+	expiring := len(retention) > 0
+	if cfg.MaxAge != "" && cfg.MaxAge != "0" {
+		maxAge, err := time.ParseDuration(cfg.MaxAge)
+		if err != nil {
+			return err
+		}
+		err = h.imgDir.SetMaxAge(maxAge)
+		if err != nil {
+			return err
+		}
+		expiring = true
+	}
+	if expiring {
+		h.run(func(ctx context.Context) { h.imgDir.Run(ctx, time.Minute) })
+	}
+	var imageMaxAge time.Duration
+	if cfg.ImageMaxAge != "" && cfg.ImageMaxAge != "0" {
+		var err error
+		imageMaxAge, err = time.ParseDuration(cfg.ImageMaxAge)
+		if err != nil {
+			return err
+		}
+	}
+	savedHandler := imgHandler
+	imgHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "DELETE" {
+			name := strings.TrimPrefix(r.URL.Path, "/")
+			if strings.HasSuffix(name, ".svg") {
+				h.serveSVG(w, r, strings.TrimSuffix(name, ".svg"))
+				return
+			}
+			if r.Method == "GET" {
+				h.viewed(name, r.URL.Query().Get("share"))
+			}
+			if imageMaxAge > 0 && (r.Method == "GET" || r.Method == "HEAD") &&
+				drawingIDRe.MatchString(strings.TrimSuffix(name, ".png")) {
+				// Drawings are never modified, only recompressed, but
+				// evicted ones are served from cold storage for a while
+				if _, err := os.Stat(filepath.Join(h.imgDir.Path(), name)); err == nil {
+					w.Header().Set("Cache-Control", fmt.Sprintf(
+						"public, max-age=%d, immutable", int64(imageMaxAge/time.Second)))
+				}
+			}
+			savedHandler.ServeHTTP(w, r)
+			return
+		}
+		code, err := h.deleteDrawing(r, strings.TrimPrefix(r.URL.Path, "/"))
+		if err != nil {
+			http.Error(w, err.Error(), code)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	h.mux.Handle(imgURL, http.StripPrefix(imgURL, imgHandler))
+	if h.archive != nil {
+		h.mux.Handle(archiveURL, http.StripPrefix(archiveURL,
+			http.FileServer(http.Dir(h.archive.Path()))))
+	}
+	if h.pv != nil {
+		h.mux.Handle(previewURL, http.StripPrefix(previewURL, pvHandler))
+	}
+	h.mux.Handle(pageURL, &drawingPage{
+		prefix:     pageURL,
+		images:     h.imgDir.Path(),
+		meta:       h.meta,
+		cold:       h.cold,
+		tombstones: h.tombstones,
+		locate:     h.locateDrawing,
+		touch:      h.viewed,
+		reactions:  h.reactions,
+		svg:        h.meta.SVGPath,
+	})
+	return nil
+}
+
+// viewed records a view of drawing name through share link share, if
+// any, ignored if it is not saved.
+func (h *Handler) viewed(name, share string) {
+	h.imgDir.Touch(name)
+	if h.views != nil && containsString(h.imgDir.List(), name) {
+		h.views.Record(name, share, time.Now())
+	}
+}
@@ -0,0 +1,702 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func encodeTestImage(t *testing.T, w, h int) []byte {
+	buf := &bytes.Buffer{}
+	err := png.Encode(buf, image.NewRGBA(image.Rect(0, 0, w, h)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func newTestConfig(t *testing.T) (*Config, func()) {
+	tmpDir, err := ioutil.TempDir("", "gribouillis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{
+		ImagesDir:      filepath.Join(tmpDir, "images"),
+		MaxImageSize:   "10MB",
+		MinImageSize:   "0",
+		MinDelay:       "0s",
+		ProcessTimeout: "30s",
+		Padding:        20,
+		Background:     "none",
+		ColorProfile:   "keep",
+		RecompressIdle: "0",
+		PNGEncoder:     "stdlib",
+		PNGCompression: "default",
+		MaxSize:        "50MB",
+		MaxCount:       500,
+
+		ReconcileInterval: "0",
+		DraftTTL:          "0",
+		PendingTTL:        "0",
+	}
+	return cfg, func() {
+		os.RemoveAll(tmpDir)
+	}
+}
+
+func TestParseEvictionWeights(t *testing.T) {
+	_, err := parseEvictionWeights("age=1, size=2, views=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"age", "likes=1", "size=-1", "views=x"} {
+		_, err := parseEvictionWeights(s)
+		if err == nil {
+			t.Fatalf("%q: expected an error", s)
+		}
+	}
+}
+
+func TestRoomRetention(t *testing.T) {
+	for _, s := range []string{"a", "a:", "a/b:1h", "a:-1h", "a:always"} {
+		_, err := parseRoomRetention(s)
+		if err == nil {
+			t.Fatalf("%q: expected an error", s)
+		}
+	}
+	cfg, cleanup := newTestConfig(t)
+	defer cleanup()
+	cfg.MaxCount = 2
+	cfg.RoomRetention = "event:forever, scratch:24h"
+	h, err := NewHandler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	names := []string{}
+	for _, room := range []string{"event", "scratch", "", ""} {
+		req := httptest.NewRequest("POST", "/api/v1/drawings?room="+room,
+			bytes.NewReader(encodeTestImage(t, 10, 10)))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		saved := saveResponse{}
+		err := json.Unmarshal(w.Body.Bytes(), &saved)
+		if err != nil || w.Code != 200 {
+			t.Fatalf("could not save drawing: %d, %v", w.Code, err)
+		}
+		names = append(names, path.Base(saved.Path))
+	}
+	// The event drawing is kept despite the count limit
+	if list := h.imgDir.List(); fmt.Sprint(list) != fmt.Sprint([]string{names[0], names[3]}) {
+		t.Fatalf("unexpected drawings: %v, saved %v", list, names)
+	}
+}
+
+func TestRejectBlank(t *testing.T) {
+	cfg, cleanup := newTestConfig(t)
+	defer cleanup()
+	cfg.RejectBlank = true
+	h, err := NewHandler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	// Test images are blank
+	rsp, err := http.Post(srv.URL+"/api/v1/drawings", "image/png",
+		bytes.NewReader(encodeTestImage(t, 10, 10)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("expected blank image rejection, got %s", rsp.Status)
+	}
+}
+
+func TestMountedHandler(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "gribouillis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	cfg := DefaultConfig()
+	cfg.ImagesDir = filepath.Join(tmpDir, "images")
+	h, err := NewHandler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	mux := http.NewServeMux()
+	mux.Handle("/draw/", http.StripPrefix("/draw", h))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	rsp, err := http.Post(srv.URL+"/draw/api/v1/drawings", "image/png",
+		bytes.NewReader(encodeTestImage(t, 10, 10)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+	saved := saveResponse{}
+	err = json.NewDecoder(rsp.Body).Decode(&saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(saved.Path, "/draw/saved/") ||
+		saved.URL != srv.URL+saved.Path {
+		t.Fatalf("unexpected saved image location: %+v", saved)
+	}
+	rsp, err = http.Get(saved.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != 200 {
+		t.Fatalf("could not fetch saved image: %s", rsp.Status)
+	}
+}
+
+func TestSaveRejectsNonPNG(t *testing.T) {
+	cfg, cleanup := newTestConfig(t)
+	defer cleanup()
+	h, err := NewHandler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	src := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	jpegData, gifData := &bytes.Buffer{}, &bytes.Buffer{}
+	err = jpeg.Encode(jpegData, src, nil)
+	if err == nil {
+		err = gif.Encode(gifData, src, nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		contentType string
+		body        []byte
+		status      int
+	}{
+		{"image/png", encodeTestImage(t, 4, 4), 200},
+		{"", encodeTestImage(t, 4, 4), 200},
+		{"image/jpeg", encodeTestImage(t, 4, 4), 415},
+		{"image/png", []byte("<html><body>hello</body></html>"), 415},
+		{"image/png", nil, 415},
+		{"image/jpeg", jpegData.Bytes(), 200},
+		{"", gifData.Bytes(), 200},
+		{"image/gif", jpegData.Bytes(), 415},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("POST", srv.URL+"/api/v1/drawings",
+			bytes.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.contentType != "" {
+			req.Header.Set("Content-Type", test.contentType)
+		}
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp.Body.Close()
+		if rsp.StatusCode != test.status {
+			t.Errorf("%q with %q: expected %d, got %d", test.contentType,
+				test.body, test.status, rsp.StatusCode)
+		}
+	}
+	entries, err := ioutil.ReadDir(cfg.ImagesDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 {
+		t.Fatalf("expected 4 saved images, got %d", len(entries))
+	}
+	// Converted images are stored as padded PNG
+	for _, e := range entries {
+		data, err := ioutil.ReadFile(filepath.Join(cfg.ImagesDir, e.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := 4 + 2*cfg.Padding
+		m, err := png.DecodeConfig(bytes.NewReader(data))
+		if err != nil || m.Width != size || m.Height != size {
+			t.Fatalf("%s is not a %dx%d PNG: %v, %v", e.Name(), size, size, m, err)
+		}
+	}
+}
+
+func TestSaveMinimums(t *testing.T) {
+	cfg, cleanup := newTestConfig(t)
+	defer cleanup()
+	cfg.MinWidth = 2
+	cfg.MinHeight = 3
+	cfg.MinImageSize = fmt.Sprintf("%dB", len(encodeTestImage(t, 200, 200)))
+	h, err := NewHandler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	tests := []struct {
+		width, height int
+		status        int
+	}{
+		{1, 1, 422},
+		{10, 2, 422},
+		{4, 4, 422},
+		{200, 200, 200},
+	}
+	for _, test := range tests {
+		rsp, err := http.Post(srv.URL+"/api/v1/drawings", "image/png",
+			bytes.NewReader(encodeTestImage(t, test.width, test.height)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp.Body.Close()
+		if rsp.StatusCode != test.status {
+			t.Errorf("%dx%d: expected %d, got %d", test.width, test.height,
+				test.status, rsp.StatusCode)
+		}
+	}
+}
+
+func TestImageBaseURL(t *testing.T) {
+	cfg, cleanup := newTestConfig(t)
+	defer cleanup()
+	cfg.ImageBaseURL = "https://cdn.example.com/drawings"
+	h, err := NewHandler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	rsp, err := http.Post(srv.URL+"/api/v1/drawings", "image/png",
+		bytes.NewReader(encodeTestImage(t, 10, 10)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+	saved := saveResponse{}
+	err = json.NewDecoder(rsp.Body).Decode(&saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := path.Base(saved.Path)
+	if saved.Path != "/saved/"+name ||
+		saved.URL != "https://cdn.example.com/drawings/"+name {
+		t.Fatalf("unexpected saved image location: %+v", saved)
+	}
+}
+
+func TestListDrawings(t *testing.T) {
+	cfg, cleanup := newTestConfig(t)
+	defer cleanup()
+	cfg.MaxCount = 2
+	h, err := NewHandler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	saved := []string{}
+	for i := 0; i < 3; i++ {
+		rsp, err := http.Post(srv.URL+"/api/v1/drawings", "image/png",
+			bytes.NewReader(encodeTestImage(t, 10, 10)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := saveResponse{}
+		err = json.NewDecoder(rsp.Body).Decode(&s)
+		rsp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		saved = append(saved, s.URL)
+	}
+	rsp, err := http.Get(srv.URL + "/api/v1/drawings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+	list := drawingsResponse{}
+	err = json.NewDecoder(rsp.Body).Decode(&list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Drawings) != 2 || list.Drawings[0].URL != saved[2] ||
+		list.Drawings[1].URL != saved[1] {
+		t.Fatalf("unexpected drawings: %+v", list.Drawings)
+	}
+	d := list.Drawings[0]
+	if d.Path != "/saved/"+d.Name || d.Size == 0 || d.Created.IsZero() {
+		t.Fatalf("unexpected drawing: %+v", d)
+	}
+}
+
+func TestDeleteDrawing(t *testing.T) {
+	cfg, cleanup := newTestConfig(t)
+	defer cleanup()
+	h, err := NewHandler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	rsp, err := http.Post(srv.URL+"/api/v1/drawings", "image/png",
+		bytes.NewReader(encodeTestImage(t, 10, 10)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := saveResponse{}
+	err = json.NewDecoder(rsp.Body).Decode(&saved)
+	rsp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.DeleteToken == "" {
+		t.Fatalf("no delete token: %+v", saved)
+	}
+	name := path.Base(saved.Path)
+
+	del := func(u, token string) int {
+		req, err := http.NewRequest("DELETE", u, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp.Body.Close()
+		return rsp.StatusCode
+	}
+	apiURL := srv.URL + "/api/v1/drawings/" + name
+	if code := del(apiURL, ""); code != 403 {
+		t.Fatalf("expected 403 without token, got %d", code)
+	}
+	if code := del(apiURL, "wrong"); code != 403 {
+		t.Fatalf("expected 403 with wrong token, got %d", code)
+	}
+	if code := del(saved.URL, saved.DeleteToken); code != 204 {
+		t.Fatalf("expected 204, got %d", code)
+	}
+	_, err = os.Stat(filepath.Join(cfg.ImagesDir, name))
+	if !os.IsNotExist(err) {
+		t.Fatalf("drawing was not deleted: %v", err)
+	}
+	if code := del(apiURL, saved.DeleteToken); code != 404 {
+		t.Fatalf("expected 404 after deletion, got %d", code)
+	}
+}
+
+func TestSaveDuplicates(t *testing.T) {
+	cfg, cleanup := newTestConfig(t)
+	defer cleanup()
+	cfg.FilenamePattern = "{hash}"
+	h, err := NewHandler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	post := func(size int) *saveResponse {
+		rsp, err := http.Post(srv.URL+"/api/v1/drawings", "image/png",
+			bytes.NewReader(encodeTestImage(t, size, size)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rsp.Body.Close()
+		if rsp.StatusCode != 200 {
+			t.Fatalf("could not save drawing: %s", rsp.Status)
+		}
+		saved := &saveResponse{}
+		err = json.NewDecoder(rsp.Body).Decode(saved)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return saved
+	}
+	first := post(10)
+	if first.Duplicate || first.DeleteToken == "" ||
+		!regexp.MustCompile(`/saved/[0-9a-f]{32}\.png$`).MatchString(first.Path) {
+		t.Fatalf("unexpected first save: %+v", first)
+	}
+	again := post(10)
+	if !again.Duplicate || again.DeleteToken != "" || again.Path != first.Path {
+		t.Fatalf("unexpected duplicate save: %+v", again)
+	}
+	other := post(12)
+	if other.Duplicate || other.Path == first.Path {
+		t.Fatalf("unexpected other save: %+v", other)
+	}
+	entries, err := ioutil.ReadDir(cfg.ImagesDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 files, got %d", len(entries))
+	}
+}
+
+func TestSaveDedupWindow(t *testing.T) {
+	cfg, cleanup := newTestConfig(t)
+	defer cleanup()
+	cfg.DedupWindow = "1m"
+	cfg.MinDelay = "1h"
+	h, err := NewHandler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	post := func(size int) (int, *saveResponse) {
+		rsp, err := http.Post(srv.URL+"/api/v1/drawings", "image/png",
+			bytes.NewReader(encodeTestImage(t, size, size)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rsp.Body.Close()
+		saved := &saveResponse{}
+		if rsp.StatusCode == 200 {
+			err = json.NewDecoder(rsp.Body).Decode(saved)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rsp.StatusCode, saved
+	}
+	code, first := post(10)
+	if code != 200 || first.Duplicate {
+		t.Fatalf("unexpected first save: %d, %+v", code, first)
+	}
+	// Identical uploads do not spend rate limit tokens
+	code, again := post(10)
+	if code != 200 || !again.Duplicate || again.DeleteToken != "" ||
+		again.Path != first.Path {
+		t.Fatalf("unexpected duplicate save: %d, %+v", code, again)
+	}
+	code, _ = post(12)
+	if code != 429 {
+		t.Fatalf("expected a rate limited save, got %d", code)
+	}
+}
+
+func TestSaveDedupConcurrent(t *testing.T) {
+	cfg, cleanup := newTestConfig(t)
+	defer cleanup()
+	cfg.DedupWindow = "1m"
+	cfg.MinDelay = "1h"
+	h, err := NewHandler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	// Concurrent identical uploads are saved once, the others waiting for
+	// it instead of being rate limited
+	data := encodeTestImage(t, 10, 10)
+	results := make(chan *saveResponse, 4)
+	for i := 0; i < cap(results); i++ {
+		go func() {
+			saved := &saveResponse{}
+			rsp, err := http.Post(srv.URL+"/api/v1/drawings", "image/png",
+				bytes.NewReader(data))
+			if err != nil {
+				results <- saved
+				return
+			}
+			defer rsp.Body.Close()
+			if rsp.StatusCode == 200 {
+				json.NewDecoder(rsp.Body).Decode(saved)
+			}
+			results <- saved
+		}()
+	}
+	path, first := "", 0
+	for i := 0; i < cap(results); i++ {
+		saved := <-results
+		if saved.Path == "" || path != "" && saved.Path != path {
+			t.Fatalf("unexpected concurrent save: %+v", saved)
+		}
+		path = saved.Path
+		if !saved.Duplicate {
+			first++
+		}
+	}
+	if first != 1 {
+		t.Fatalf("expected a single saved drawing, got %d", first)
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	cfg, cleanup := newTestConfig(t)
+	defer cleanup()
+	cfg.ImageMaxAge = "24h"
+	h, err := NewHandler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	rsp, err := http.Post(srv.URL+"/api/v1/drawings", "image/png",
+		bytes.NewReader(encodeTestImage(t, 10, 10)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := saveResponse{}
+	err = json.NewDecoder(rsp.Body).Decode(&saved)
+	rsp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for u, expected := range map[string]string{
+		saved.URL:                      "public, max-age=86400, immutable",
+		srv.URL + "/saved/missing.png": "",
+		srv.URL + "/":                  "no-cache",
+	} {
+		rsp, err := http.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp.Body.Close()
+		if cc := rsp.Header.Get("Cache-Control"); cc != expected {
+			t.Errorf("%s: unexpected Cache-Control: %q", u, cc)
+		}
+	}
+}
+
+func TestSaveShapes(t *testing.T) {
+	cfg, cleanup := newTestConfig(t)
+	defer cleanup()
+	// Durable writes of drawings and shapes behave the same
+	cfg.Fsync = true
+	h, err := NewHandler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	post := func(shapes string) *http.Response {
+		buf := &bytes.Buffer{}
+		w := multipart.NewWriter(buf)
+		if shapes != "" {
+			w.WriteField("shapes", shapes)
+		}
+		hdr := textproto.MIMEHeader{}
+		hdr.Set("Content-Disposition", `form-data; name="image"; filename="blob"`)
+		hdr.Set("Content-Type", "image/png")
+		part, err := w.CreatePart(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(encodeTestImage(t, 10, 10))
+		w.Close()
+		rsp, err := http.Post(srv.URL+"/api/v1/drawings", w.FormDataContentType(), buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rsp
+	}
+	getShapes := func(name string) (int, string) {
+		rsp, err := http.Get(srv.URL + "/api/v1/drawings/" + name + "/shapes")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rsp.Body.Close()
+		data, err := ioutil.ReadAll(rsp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rsp.StatusCode, string(data)
+	}
+
+	rsp := post(`{"shapes":[]}`)
+	saved := saveResponse{}
+	err = json.NewDecoder(rsp.Body).Decode(&saved)
+	rsp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, data := getShapes(path.Base(saved.Path))
+	if code != 200 || data != `{"shapes":[]}` {
+		t.Fatalf("unexpected shapes: %d %s", code, data)
+	}
+	rsp, err = http.Get(srv.URL + saved.Path + ".svg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != 200 || rsp.Header.Get("Content-Type") != "image/svg+xml" {
+		t.Fatalf("unexpected SVG response: %d %s", rsp.StatusCode,
+			rsp.Header.Get("Content-Type"))
+	}
+
+	rsp = post("")
+	saved = saveResponse{}
+	err = json.NewDecoder(rsp.Body).Decode(&saved)
+	rsp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := getShapes(path.Base(saved.Path)); code != 404 {
+		t.Fatalf("expected 404 without shapes, got %d", code)
+	}
+	rsp, err = http.Get(srv.URL + saved.Path + ".svg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != 404 {
+		t.Fatalf("expected 404 SVG without shapes, got %d", rsp.StatusCode)
+	}
+
+	rsp = post(`{"shapes":`)
+	rsp.Body.Close()
+	if rsp.StatusCode != 400 {
+		t.Fatalf("expected 400 with invalid shapes, got %d", rsp.StatusCode)
+	}
+}
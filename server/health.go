@@ -0,0 +1,64 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+// readyAssets lists the frontend files required to draw.
+var readyAssets = []string{
+	"index.html",
+	"js/literallycanvas.js",
+	"css/literallycanvas.css",
+}
+
+// serveHealthz reports the process is alive.
+func serveHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintln(w, "ok")
+}
+
+// readiness checks the service can accept drawings: the images directory is
+// writable and the frontend assets are present.
+type readiness struct {
+	dir string
+	web http.FileSystem
+}
+
+// Check returns an error describing the first failed check, if any.
+func (c *readiness) Check() error {
+	f, err := ioutil.TempFile(c.dir, ".readyz-")
+	if err != nil {
+		return fmt.Errorf("images directory is not writable: %s", err)
+	}
+	err = f.Close()
+	os.Remove(f.Name())
+	if err != nil {
+		return fmt.Errorf("images directory is not writable: %s", err)
+	}
+	for _, name := range readyAssets {
+		a, err := c.web.Open("/" + name)
+		if err != nil {
+			return fmt.Errorf("frontend asset is missing: %s", name)
+		}
+		a.Close()
+	}
+	return nil
+}
+
+func (c *readiness) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	err := c.Check()
+	if err != nil {
+		slog.Warn("service is not ready", "err", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "not ready: %s\n", err)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHealthProbes(t *testing.T) {
+	cfg, cleanup := newTestConfig(t)
+	defer cleanup()
+	cfg.Middlewares = "auth"
+	cfg.Auth = "user:password"
+	webDir := filepath.Join(filepath.Dir(cfg.ImagesDir), "web")
+	for _, name := range readyAssets {
+		path := filepath.Join(webDir, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(path, []byte(name), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg.WebDir = webDir
+	h, err := NewHandler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	check := func(path string, status int) string {
+		t.Helper()
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != status {
+			t.Fatalf("unexpected %s status: %d\n%s", path, w.Code, w.Body.String())
+		}
+		return w.Body.String()
+	}
+	// Probes do not require credentials
+	check("/healthz", 200)
+	check("/readyz", 200)
+	check("/", http.StatusUnauthorized)
+
+	err = os.Remove(filepath.Join(webDir, "js", "literallycanvas.js"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := check("/readyz", http.StatusServiceUnavailable)
+	if !strings.Contains(body, "js/literallycanvas.js") {
+		t.Fatalf("missing asset not reported: %s", body)
+	}
+	check("/healthz", 200)
+
+	entries, err := ioutil.ReadDir(cfg.ImagesDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("readiness check left files: %v", entries)
+	}
+}
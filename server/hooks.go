@@ -0,0 +1,191 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// hookTimeout bounds the execution of exec hooks.
+const hookTimeout = 10 * time.Second
+
+// SaveInfo describes a drawing being saved to hooks.
+type SaveInfo struct {
+	// Name is the drawing file name and Path its location on disk.
+	Name string
+	Path string
+	// ClientIP is the address of the uploading client, empty for
+	// asynchronous hooks.
+	ClientIP string
+	// Metadata may be altered by pre-save hooks.
+	Metadata *Metadata
+}
+
+// PreSaveHook is called with drawings written on disk but not published yet,
+// in hidden temporary files or outside the images directory. Returning an error rejects the drawing, the error message being returned
+// to the client.
+type PreSaveHook interface {
+	PreSave(ctx context.Context, info *SaveInfo) error
+}
+
+// PostSaveHook is called after drawings are published, from background jobs
+// retried on failure.
+type PostSaveHook interface {
+	PostSave(ctx context.Context, info *SaveInfo) error
+}
+
+// hookRejection is returned when a pre-save hook rejects a drawing.
+type hookRejection struct {
+	reason string
+}
+
+func (e *hookRejection) Error() string {
+	return "drawing rejected: " + e.reason
+}
+
+// execHook runs an external command with the drawing described in
+// GRIBOUILLIS_* environment variables.
+type execHook struct {
+	command string
+}
+
+func (h *execHook) run(ctx context.Context, info *SaveInfo) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, hookTimeout)
+	defer cancel()
+	path, err := filepath.Abs(info.Path)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx, h.command)
+	cmd.Env = append(os.Environ(),
+		"GRIBOUILLIS_NAME="+info.Name,
+		"GRIBOUILLIS_PATH="+path,
+		"GRIBOUILLIS_CLIENT_IP="+info.ClientIP,
+		"GRIBOUILLIS_TITLE="+info.Metadata.Title,
+		"GRIBOUILLIS_AUTHOR="+info.Metadata.Author,
+	)
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err = cmd.Run()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if i := strings.LastIndex(msg, "\n"); i >= 0 {
+			msg = msg[i+1:]
+		}
+		if msg == "" {
+			msg = err.Error()
+		}
+		return nil, fmt.Errorf("%s", msg)
+	}
+	return stdout.Bytes(), nil
+}
+
+// PreSave rejects the drawing if the command fails, with the last line of
+// its standard error as reason. A JSON object printed on the standard output
+// replaces the drawing title and author.
+func (h *execHook) PreSave(ctx context.Context, info *SaveInfo) error {
+	out, err := h.run(ctx, info)
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(out)) == 0 {
+		return nil
+	}
+	m := struct {
+		Title  *string `json:"title"`
+		Author *string `json:"author"`
+	}{}
+	err = json.Unmarshal(out, &m)
+	if err != nil {
+		return fmt.Errorf("invalid hook output: %s", err)
+	}
+	for _, f := range []struct {
+		key string
+		src *string
+		dst *string
+	}{{"title", m.Title, &info.Metadata.Title},
+		{"author", m.Author, &info.Metadata.Author}} {
+		if f.src == nil {
+			continue
+		}
+		v, err := parseCaption(f.key, *f.src)
+		if err != nil {
+			return fmt.Errorf("invalid hook output: %s", err)
+		}
+		*f.dst = v
+	}
+	return nil
+}
+
+// PostSave runs the command, failing if it does.
+func (h *execHook) PostSave(ctx context.Context, info *SaveInfo) error {
+	_, err := h.run(ctx, info)
+	return err
+}
+
+// setupHooks registers the pre-save and post-save hooks, and the job
+// running the latter.
+func (h *Handler) setupHooks() error {
+	cfg := h.cfg
+	h.preHooks = cfg.PreSaveHooks
+	if cfg.PreSaveHook != "" {
+		h.preHooks = append([]PreSaveHook{&execHook{cfg.PreSaveHook}}, h.preHooks...)
+	}
+	h.postHooks = cfg.PostSaveHooks
+	if cfg.PostSaveHook != "" {
+		h.postHooks = append([]PostSaveHook{&execHook{cfg.PostSaveHook}},
+			h.postHooks...)
+	}
+	// post-save jobs argument is the hook index and the drawing name,
+	// separated by a space.
+	h.jobs.Handle("post-save", func(job *Job) error {
+		var i int
+		var name string
+		_, err := fmt.Sscanf(job.Arg, "%d %s", &i, &name)
+		if err != nil || i < 0 || i >= len(h.postHooks) {
+			return fmt.Errorf("invalid post-save job: %q", job.Arg)
+		}
+		path := filepath.Join(h.imgDir.Path(), name)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			// Evicted in the meantime
+			return nil
+		}
+		m, err := h.meta.Get(name)
+		if err != nil {
+			return err
+		}
+		return h.postHooks[i].PostSave(context.Background(), &SaveInfo{
+			Name:     name,
+			Path:     path,
+			Metadata: m,
+		})
+	})
+	return nil
+}
+
+// preSave runs pre-save hooks on drawing name written at path, which is
+// not published yet.
+func (h *Handler) preSave(r *http.Request, name, path string, m *Metadata) error {
+	info := &SaveInfo{
+		Name:     name,
+		Path:     path,
+		ClientIP: h.proxies.clientIP(r),
+		Metadata: m,
+	}
+	for _, hook := range h.preHooks {
+		err := hook.PreSave(r.Context(), info)
+		if err != nil {
+			return &hookRejection{err.Error()}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testHook struct {
+	saved chan *SaveInfo
+	// path is the last drawing checked by PreSave
+	path string
+}
+
+func (h *testHook) PreSave(ctx context.Context, info *SaveInfo) error {
+	h.path = info.Path
+	if info.Metadata.Title == "bad" {
+		return fmt.Errorf("bad title")
+	}
+	info.Metadata.Author = strings.ToUpper(info.Metadata.Author)
+	return nil
+}
+
+func (h *testHook) PostSave(ctx context.Context, info *SaveInfo) error {
+	h.saved <- info
+	return nil
+}
+
+func TestSaveHooks(t *testing.T) {
+	cfg, cleanup := newTestConfig(t)
+	defer cleanup()
+	hook := &testHook{saved: make(chan *SaveInfo, 1)}
+	cfg.PreSaveHooks = []PreSaveHook{hook}
+	cfg.PostSaveHooks = []PostSaveHook{hook}
+	h, err := NewHandler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	post := func(query string) (*http.Response, saveResponse) {
+		rsp, err := http.Post(srv.URL+"/api/v1/drawings?"+query, "image/png",
+			bytes.NewReader(encodeTestImage(t, 10, 10)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rsp.Body.Close()
+		saved := saveResponse{}
+		json.NewDecoder(rsp.Body).Decode(&saved)
+		return rsp, saved
+	}
+	if rsp, _ := post("title=bad"); rsp.StatusCode != 422 {
+		t.Fatalf("expected rejection, got %s", rsp.Status)
+	}
+	entries, err := ioutil.ReadDir(cfg.ImagesDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("rejected drawing was kept")
+	}
+	rsp, saved := post("title=good&author=ann")
+	if rsp.StatusCode != 200 {
+		t.Fatalf("could not save drawing: %s", rsp.Status)
+	}
+	// Hooks check drawings before they are in the images directory
+	if !strings.HasPrefix(filepath.Base(hook.path), ".") {
+		t.Fatalf("hook checked a public file: %s", hook.path)
+	}
+	select {
+	case info := <-hook.saved:
+		if "/saved/"+info.Name != saved.Path || info.Metadata.Author != "ANN" {
+			t.Fatalf("unexpected post-save info: %+v, %+v", info, info.Metadata)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("post-save hook was not called")
+	}
+}
+
+// gateHook is a pre-save hook returning the errors sent on results, after
+// reporting its calls on calls.
+type gateHook struct {
+	calls   chan string
+	results chan error
+}
+
+func (h *gateHook) PreSave(ctx context.Context, info *SaveInfo) error {
+	h.calls <- info.Name
+	return <-h.results
+}
+
+func TestSaveDedupRejected(t *testing.T) {
+	cfg, cleanup := newTestConfig(t)
+	defer cleanup()
+	cfg.DedupWindow = "1m"
+	hook := &gateHook{calls: make(chan string), results: make(chan error)}
+	cfg.PreSaveHooks = []PreSaveHook{hook}
+	h, err := NewHandler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	data := encodeTestImage(t, 10, 10)
+	results := make(chan *saveResponse, 2)
+	post := func() {
+		saved := &saveResponse{}
+		rsp, err := http.Post(srv.URL+"/api/v1/drawings", "image/png",
+			bytes.NewReader(data))
+		if err == nil {
+			defer rsp.Body.Close()
+			if rsp.StatusCode == 200 {
+				json.NewDecoder(rsp.Body).Decode(saved)
+			}
+		}
+		results <- saved
+	}
+	// An identical upload waiting for a rejected one is saved on its own
+	// instead of pointing to the rejected drawing
+	go post()
+	<-hook.calls
+	go post()
+	time.Sleep(100 * time.Millisecond)
+	hook.results <- fmt.Errorf("rejected")
+	if saved := <-results; saved.Path != "" {
+		t.Fatalf("rejected drawing was saved: %+v", saved)
+	}
+	<-hook.calls
+	hook.results <- nil
+	if saved := <-results; saved.Path == "" || saved.Duplicate {
+		t.Fatalf("unexpected save: %+v", saved)
+	}
+}
+
+func TestExecHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hook scripts require a shell")
+	}
+	tmpDir, err := ioutil.TempDir("", "gribouillis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	script := filepath.Join(tmpDir, "hook.sh")
+	err = ioutil.WriteFile(script, []byte(`#!/bin/sh
+if [ "$GRIBOUILLIS_TITLE" = "bad" ]; then
+	echo "some noise" >&2
+	echo "no bad titles from $GRIBOUILLIS_CLIENT_IP" >&2
+	exit 1
+fi
+echo "{\"title\": \"$GRIBOUILLIS_NAME\"}"
+`), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &execHook{command: script}
+	info := &SaveInfo{
+		Name:     "a.png",
+		Path:     "a.png",
+		ClientIP: "1.2.3.4",
+		Metadata: &Metadata{Title: "bad", Author: "ann"},
+	}
+	err = h.PreSave(context.Background(), info)
+	if err == nil || err.Error() != "no bad titles from 1.2.3.4" {
+		t.Fatalf("unexpected rejection: %v", err)
+	}
+	info.Metadata.Title = "good"
+	err = h.PreSave(context.Background(), info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Metadata.Title != "a.png" || info.Metadata.Author != "ann" {
+		t.Fatalf("unexpected metadata: %+v", info.Metadata)
+	}
+}
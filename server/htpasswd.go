@@ -0,0 +1,187 @@
+package server
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// htpasswd checks credentials against an Apache htpasswd file, reloaded
+// when modified. Only bcrypt ("htpasswd -B"), MD5 ("htpasswd -m") and SHA1
+// ("htpasswd -s") hashes are supported.
+type htpasswd struct {
+	path string
+
+	lock    sync.Mutex
+	modTime time.Time
+	users   map[string]string
+}
+
+// parseHtpasswd parses htpasswd file lines, like "user:hash".
+func parseHtpasswd(path string) (map[string]string, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	users := map[string]string{}
+	scanner := bufio.NewScanner(fp)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("%s:%d: expected user:hash", path, n)
+		}
+		hash := parts[1]
+		if isBcrypt(hash) {
+			if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid bcrypt hash: %s", path, n, err)
+			}
+		} else if !strings.HasPrefix(hash, "$apr1$") && !strings.HasPrefix(hash, "{SHA}") {
+			return nil, fmt.Errorf("%s:%d: unsupported password hash, use bcrypt, MD5 or SHA1",
+				path, n)
+		}
+		users[parts[0]] = hash
+	}
+	return users, scanner.Err()
+}
+
+// isBcrypt reports whether hash is a bcrypt hash, like "$2y$05$...".
+func isBcrypt(hash string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$"} {
+		if strings.HasPrefix(hash, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// openHtpasswd loads the htpasswd file at path.
+func openHtpasswd(path string) (*htpasswd, error) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	users, err := parseHtpasswd(path)
+	if err != nil {
+		return nil, err
+	}
+	return &htpasswd{
+		path:    path,
+		modTime: st.ModTime(),
+		users:   users,
+	}, nil
+}
+
+// reload reloads the file if it was modified. Invalid files are ignored.
+func (h *htpasswd) reload() {
+	st, err := os.Stat(h.path)
+	if err != nil || st.ModTime().Equal(h.modTime) {
+		return
+	}
+	users, err := parseHtpasswd(h.path)
+	if err != nil {
+		slog.Error("could not reload htpasswd file", "err", err)
+		return
+	}
+	h.modTime = st.ModTime()
+	h.users = users
+}
+
+// Check reports whether password is the one of user.
+func (h *htpasswd) Check(user, password string) bool {
+	h.lock.Lock()
+	h.reload()
+	hash, ok := h.users[user]
+	h.lock.Unlock()
+	if !ok {
+		return false
+	}
+	if isBcrypt(hash) {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+	expected := ""
+	switch {
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		expected = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt := strings.SplitN(hash[len("$apr1$"):], "$", 2)[0]
+		expected = apr1(password, salt)
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(hash)) == 1
+}
+
+// apr1 returns the Apache MD5 crypt hash of password with salt.
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+	alt := md5.Sum([]byte(password + salt + password))
+	d := md5.New()
+	d.Write(pw)
+	d.Write([]byte(magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			d.Write(alt[:])
+		} else {
+			d.Write(alt[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			d.Write([]byte{0})
+		} else {
+			d.Write(pw[:1])
+		}
+	}
+	final := d.Sum(nil)
+	for i := 0; i < 1000; i++ {
+		d := md5.New()
+		if i&1 != 0 {
+			d.Write(pw)
+		} else {
+			d.Write(final)
+		}
+		if i%3 != 0 {
+			d.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			d.Write(pw)
+		}
+		if i&1 != 0 {
+			d.Write(final)
+		} else {
+			d.Write(pw)
+		}
+		final = d.Sum(nil)
+	}
+	out := []byte(magic + salt + "$")
+	to64 := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out = append(out, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, i := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		to64(uint32(final[i[0]])<<16|uint32(final[i[1]])<<8|uint32(final[i[2]]), 4)
+	}
+	to64(uint32(final[11]), 2)
+	return string(out)
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAPR1(t *testing.T) {
+	// openssl passwd -apr1 -salt abcdefgh secret
+	expected := "$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/"
+	if h := apr1("secret", "abcdefgh"); h != expected {
+		t.Fatalf("unexpected hash: %s != %s", h, expected)
+	}
+}
+
+func TestHtpasswd(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "gribouillis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "htpasswd")
+	write := func(data string, modTime time.Time) {
+		err := ioutil.WriteFile(path, []byte(data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Chtimes(path, modTime, modTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	// Hash of "secret", as written by htpasswd -B -C 5
+	write("# users\nalice:$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/\n"+
+		"bob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"+
+		"dave:$2y$05$bMDmexqLW/cztEidABYwBuORUTzBkkmYfEpdGWQKr8qrlmioM6i6q\n",
+		now.Add(-time.Hour))
+	h, err := openHtpasswd(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		user, password string
+		ok             bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "wrong", false},
+		{"bob", "secret", true},
+		{"dave", "secret", true},
+		{"dave", "wrong", false},
+		{"carol", "secret", false},
+	} {
+		if ok := h.Check(c.user, c.password); ok != c.ok {
+			t.Fatalf("%s:%s: expected %v, got %v", c.user, c.password, c.ok, ok)
+		}
+	}
+
+	// Modified files are reloaded, unless invalid
+	write("carol:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n", now)
+	if !h.Check("carol", "secret") || h.Check("alice", "secret") {
+		t.Fatal("htpasswd file was not reloaded")
+	}
+	write("dave:$2y$05$invalid\n", now.Add(time.Hour))
+	if !h.Check("carol", "secret") {
+		t.Fatal("invalid htpasswd file was loaded")
+	}
+	_, err = openHtpasswd(path)
+	if err == nil {
+		t.Fatal("invalid bcrypt hash was accepted")
+	}
+}
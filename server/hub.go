@@ -0,0 +1,195 @@
+package server
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// hubMaxQueue is the number of messages queued for a client before it is
+	// considered stalled and disconnected.
+	hubMaxQueue = 64
+	// hubWriteTimeout bounds the time spent writing one message to a client.
+	hubWriteTimeout = 10 * time.Second
+	// hubPingInterval is the delay between keepalive pings.
+	hubPingInterval = 30 * time.Second
+)
+
+// hubMessage is a message broadcast to hub clients. Queued messages sharing
+// a non-empty Key are coalesced, only the last one being sent.
+type hubMessage struct {
+	Key  string
+	Data []byte
+}
+
+// hubClient is a WebSocket connection with its own send queue, drained by a
+// dedicated goroutine, so a slow client never blocks broadcasts.
+type hubClient struct {
+	conn *websocket.Conn
+	lock sync.Mutex
+	// queue is nil once the client is closed
+	queue  []hubMessage
+	wake   chan struct{}
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newHubClient(conn *websocket.Conn) *hubClient {
+	return &hubClient{
+		conn:   conn,
+		wake:   make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+}
+
+// push queues m, replacing a pending message with the same key. It returns
+// false if the queue is full.
+func (c *hubClient) push(m hubMessage) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if m.Key != "" {
+		for i, q := range c.queue {
+			if q.Key == m.Key {
+				c.queue[i] = m
+				return true
+			}
+		}
+	}
+	if len(c.queue) >= hubMaxQueue {
+		return false
+	}
+	c.queue = append(c.queue, m)
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+func (c *hubClient) close() {
+	c.once.Do(func() {
+		close(c.closed)
+		c.conn.Close()
+	})
+}
+
+// closeWith sends a close message with code and text, then closes the
+// client.
+func (c *hubClient) closeWith(code int, text string) {
+	c.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, text), time.Now().Add(hubWriteTimeout))
+	c.close()
+}
+
+// writeLoop sends queued messages and keepalive pings until the client is
+// closed or a write fails.
+func (c *hubClient) writeLoop() {
+	defer c.close()
+	ping := time.NewTicker(hubPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ping.C:
+			err := c.conn.WriteControl(websocket.PingMessage, nil,
+				time.Now().Add(hubWriteTimeout))
+			if err != nil {
+				return
+			}
+		case <-c.wake:
+			c.lock.Lock()
+			queue := c.queue
+			c.queue = nil
+			c.lock.Unlock()
+			for _, m := range queue {
+				c.conn.SetWriteDeadline(time.Now().Add(hubWriteTimeout))
+				err := c.conn.WriteMessage(websocket.TextMessage, m.Data)
+				if err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// hub broadcasts messages to WebSocket clients. Clients whose queue
+// overflows, or which take too long to accept a message, are disconnected.
+type hub struct {
+	upgrader websocket.Upgrader
+	lock     sync.Mutex
+	clients  map[*hubClient]bool
+}
+
+func newHub() *hub {
+	return &hub{
+		upgrader: websocket.Upgrader{
+			// Broadcast data is public, any page may display it
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+		clients: map[*hubClient]bool{},
+	}
+}
+
+// Broadcast queues data for all clients, without blocking. Queued messages
+// with the same non-empty key are coalesced.
+func (h *hub) Broadcast(key string, data []byte) {
+	m := hubMessage{Key: key, Data: data}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for c := range h.clients {
+		if !c.push(m) {
+			delete(h.clients, c)
+			c.close()
+		}
+	}
+}
+
+// Close disconnects all clients, telling them the server is restarting.
+func (h *hub) Close() {
+	h.lock.Lock()
+	clients := h.clients
+	h.clients = map[*hubClient]bool{}
+	h.lock.Unlock()
+	for c := range clients {
+		c.closeWith(websocket.CloseServiceRestart, "server restarting")
+	}
+}
+
+// Count returns the number of connected clients.
+func (h *hub) Count() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return len(h.clients)
+}
+
+// ServeHTTP upgrades the request to a WebSocket connection and registers it
+// until it is closed. Messages sent by clients are ignored.
+func (h *hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader already replied
+		return
+	}
+	c := newHubClient(conn)
+	h.lock.Lock()
+	h.clients[c] = true
+	h.lock.Unlock()
+	defer func() {
+		h.lock.Lock()
+		delete(h.clients, c)
+		h.lock.Unlock()
+		c.close()
+	}()
+	go c.writeLoop()
+	conn.SetReadLimit(4096)
+	for {
+		_, _, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+	}
+}
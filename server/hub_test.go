@@ -0,0 +1,131 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestHubClientQueue(t *testing.T) {
+	c := &hubClient{wake: make(chan struct{}, 1)}
+	c.push(hubMessage{Key: "count", Data: []byte("1")})
+	c.push(hubMessage{Data: []byte("a")})
+	c.push(hubMessage{Key: "count", Data: []byte("2")})
+	if len(c.queue) != 2 || string(c.queue[0].Data) != "2" {
+		t.Fatalf("keyed messages were not coalesced: %q", c.queue)
+	}
+	for i := len(c.queue); i < hubMaxQueue; i++ {
+		if !c.push(hubMessage{Data: []byte("x")}) {
+			t.Fatalf("queue overflowed at %d messages", i)
+		}
+	}
+	if c.push(hubMessage{Data: []byte("x")}) {
+		t.Fatal("full queue accepted a message")
+	}
+	if !c.push(hubMessage{Key: "count", Data: []byte("3")}) {
+		t.Fatal("full queue did not coalesce a keyed message")
+	}
+}
+
+func dialTestHub(t *testing.T, url string) *websocket.Conn {
+	url = "ws" + strings.TrimPrefix(url, "http")
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func waitHubCount(t *testing.T, h *hub, n int) {
+	deadline := time.Now().Add(10 * time.Second)
+	for h.Count() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d clients, got %d", n, h.Count())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHubEvictsStalledClients(t *testing.T) {
+	h := newHub()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	stalled := dialTestHub(t, srv.URL)
+	defer stalled.Close()
+	active := dialTestHub(t, srv.URL)
+	defer active.Close()
+	waitHubCount(t, h, 2)
+
+	received := make(chan int, 1)
+	go func() {
+		n := 0
+		for {
+			_, _, err := active.ReadMessage()
+			if err != nil {
+				break
+			}
+			n++
+		}
+		received <- n
+	}()
+	data := bytes.Repeat([]byte("x"), 1<<20)
+	for i := 0; i < 2*hubMaxQueue && h.Count() == 2; i++ {
+		h.Broadcast("", data)
+		time.Sleep(time.Millisecond)
+	}
+	waitHubCount(t, h, 1)
+	h.Broadcast("", []byte("last"))
+	active.SetReadDeadline(time.Now().Add(time.Second))
+	if n := <-received; n == 0 {
+		t.Fatal("active client did not receive messages")
+	}
+}
+
+func TestLiveAPI(t *testing.T) {
+	cfg, cleanup := newTestConfig(t)
+	defer cleanup()
+	h, err := NewHandler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	conn := dialTestHub(t, srv.URL+"/api/v1/live")
+	defer conn.Close()
+	// Let the server register the client before saving
+	time.Sleep(50 * time.Millisecond)
+	rsp, err := http.Post(srv.URL+"/api/v1/drawings", "image/png",
+		bytes.NewReader(encodeTestImage(t, 10, 10)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := saveResponse{}
+	err = json.NewDecoder(rsp.Body).Decode(&saved)
+	rsp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, expected := range []liveMessage{
+		{Type: "save", Name: saved.Path[len("/saved/"):], URL: saved.URL},
+		{Type: "count", Count: 1},
+	} {
+		m := liveMessage{}
+		err := conn.ReadJSON(&m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m != expected {
+			t.Fatalf("expected %+v, got %+v", expected, m)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+)
+
+// importer recreates drawings of another instance, or of a static export, in
+// an images directory, along with their captions.
+type importer struct {
+	imagesDir string
+	meta      *metaStore
+	maxSize   int64
+	client    *http.Client
+	// token is sent as a bearer token to remote instances.
+	token string
+}
+
+// importSource lists the drawings of a source and opens their images.
+type importSource struct {
+	drawings []drawingInfo
+	open     func(d drawingInfo) (io.ReadCloser, error)
+}
+
+// get fetches u, authenticating with the token if u is on the host of base.
+func (im *importer) get(base *url.URL, u *url.URL) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	// Images may be served by another host, like a CDN, which must not
+	// see the token.
+	if im.token != "" && u.Scheme == base.Scheme && u.Host == base.Host {
+		req.Header.Set("Authorization", "Bearer "+im.token)
+	}
+	rsp, err := im.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode != 200 {
+		rsp.Body.Close()
+		return nil, fmt.Errorf("could not fetch %s: %s", u, rsp.Status)
+	}
+	return rsp.Body, nil
+}
+
+// remoteSource returns the drawings listed by the API of the instance at
+// base URL.
+func (im *importer) remoteSource(base *url.URL) (*importSource, error) {
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+	listURL := base.ResolveReference(&url.URL{Path: "api/v1/drawings"})
+	body, err := im.get(base, listURL)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	listing := &drawingsResponse{}
+	err = json.NewDecoder(io.LimitReader(body, 16<<20)).Decode(listing)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %s", listURL, err)
+	}
+	return &importSource{
+		drawings: listing.Drawings,
+		open: func(d drawingInfo) (io.ReadCloser, error) {
+			u, err := listURL.Parse(d.URL)
+			if err != nil {
+				return nil, err
+			}
+			return im.get(base, u)
+		},
+	}, nil
+}
+
+// dirSource returns the drawings of the static site exported in dir.
+func dirSource(dir string) (*importSource, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, siteListing))
+	if err != nil {
+		return nil, err
+	}
+	listing := &drawingsResponse{}
+	err = json.Unmarshal(data, listing)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %s", siteListing, err)
+	}
+	return &importSource{
+		drawings: listing.Drawings,
+		open: func(d drawingInfo) (io.ReadCloser, error) {
+			return os.Open(filepath.Join(dir, "images", d.Name))
+		},
+	}, nil
+}
+
+// Import copies drawing d of source in the images directory and returns its
+// local name. Drawings already imported are skipped and an empty name
+// returned. Drawings whose name is taken by another one are renamed.
+func (im *importer) Import(source *importSource, d drawingInfo) (string, error) {
+	id := strings.TrimSuffix(d.Name, ".png")
+	if !strings.HasSuffix(d.Name, ".png") || !drawingIDRe.MatchString(id) {
+		return "", fmt.Errorf("invalid drawing name: %q", d.Name)
+	}
+	rc, err := source.open(d)
+	if err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(rc, im.maxSize+1))
+	rc.Close()
+	if err != nil {
+		return "", err
+	}
+	if int64(len(data)) > im.maxSize {
+		return "", fmt.Errorf("image is larger than %d bytes", im.maxSize)
+	}
+	_, err = png.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempFile(im.imagesDir, ".import-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		return "", err
+	}
+	err = os.Chmod(tmp.Name(), 0644)
+	if err != nil {
+		return "", err
+	}
+	if !d.Created.IsZero() {
+		err = os.Chtimes(tmp.Name(), d.Created, d.Created)
+		if err != nil {
+			return "", err
+		}
+	}
+	name := d.Name
+	for i := 0; ; i++ {
+		if i >= 10 {
+			return "", fmt.Errorf("could not find a free file name")
+		}
+		path := filepath.Join(im.imagesDir, name)
+		existing, err := ioutil.ReadFile(path)
+		if err == nil && bytes.Equal(existing, data) {
+			return "", nil
+		}
+		if err == nil || !os.IsNotExist(err) {
+			name, err = drawingName("{id}", time.Now(), "")
+			if err != nil {
+				return "", err
+			}
+			continue
+		}
+		// Linking fails instead of replacing files saved meanwhile
+		err = os.Link(tmp.Name(), path)
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) {
+			return "", err
+		}
+	}
+	m := &Metadata{Title: d.Title, Author: d.Author, Room: d.Room}
+	if *m != (Metadata{}) {
+		err = im.meta.Put(name, m)
+		if err != nil {
+			return "", err
+		}
+	}
+	return name, nil
+}
+
+// ImportCommand imports the drawings of another instance or static export.
+func ImportCommand(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Print(`Usage: gribouillis import [OPTIONS] SOURCE
+
+Import drawings and their captions, to merge two boards. SOURCE is either the
+directory of a site written by "gribouillis export-site", or the base URL of
+another gribouillis instance, whose drawings are listed with its API. -token,
+defaulting to GRIBOUILLIS_TOKEN environment variable, is sent as a bearer
+token to the remote instance.
+
+Drawings keep their names and creation times, unless their names are taken,
+and those already imported are skipped. A running server picks them up within
+-reconcile-interval, evicting the oldest drawings if limits are exceeded.
+
+`)
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	imagesDir := fs.String("images-dir", "images",
+		"directory where drawings are saved")
+	metaDir := fs.String("meta-dir", "",
+		"directory where drawings metadata are saved, defaults to images directory with a -meta suffix")
+	maxSizeStr := fs.String("max-image-size", "10MB",
+		"maximum size of imported images")
+	token := fs.String("token", "",
+		"bearer token authenticating to the remote instance")
+	fs.Parse(args)
+	if *token == "" {
+		// Not the flag default, which usage would print
+		*token = os.Getenv("GRIBOUILLIS_TOKEN")
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("one source expected")
+	}
+	maxSize, err := humanize.ParseBytes(*maxSizeStr)
+	if err != nil {
+		return err
+	}
+	if *metaDir == "" {
+		*metaDir = defaultMetaDir(*imagesDir)
+	}
+	for _, dir := range []string{*imagesDir, *metaDir} {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return err
+		}
+	}
+	im := &importer{
+		imagesDir: *imagesDir,
+		meta:      &metaStore{dir: *metaDir},
+		maxSize:   int64(maxSize),
+		client:    &http.Client{Timeout: time.Minute},
+		token:     *token,
+	}
+	var source *importSource
+	arg := fs.Arg(0)
+	if strings.HasPrefix(arg, "http://") || strings.HasPrefix(arg, "https://") {
+		base, err := url.Parse(arg)
+		if err != nil {
+			return err
+		}
+		source, err = im.remoteSource(base)
+		if err != nil {
+			return err
+		}
+	} else {
+		source, err = dirSource(arg)
+		if err != nil {
+			return err
+		}
+	}
+	imported, skipped, failed := 0, 0, 0
+	for _, d := range source.drawings {
+		name, err := im.Import(source, d)
+		switch {
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "could not import %s: %s\n", d.Name, err)
+			failed++
+		case name == "":
+			skipped++
+		default:
+			fmt.Println(name)
+			imported++
+		}
+	}
+	fmt.Fprintf(os.Stderr, "imported %d drawings, skipped %d already imported\n",
+		imported, skipped)
+	if failed > 0 {
+		return fmt.Errorf("could not import %d drawings", failed)
+	}
+	return nil
+}
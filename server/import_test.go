@@ -0,0 +1,147 @@
+package server
+
+import (
+	"encoding/json"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestImportFromExport(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "gribouillis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	srcDir := filepath.Join(tmpDir, "src")
+	srcMeta, err := openMetaStore(defaultMetaDir(srcDir), srcDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstDir := filepath.Join(tmpDir, "dst")
+	dstMeta, err := openMetaStore(defaultMetaDir(dstDir), dstDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{srcDir, dstDir} {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	created := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for _, name := range []string{"a.png", "b.png"} {
+		path := filepath.Join(srcDir, name)
+		err := ioutil.WriteFile(path, encodeTestImage(t, 10, 10), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Chtimes(path, created, created)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = srcMeta.Put("a.png", &Metadata{Title: "Cat", Author: "Alice", Room: "party"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The local b.png is another drawing
+	err = ioutil.WriteFile(filepath.Join(dstDir, "b.png"), encodeTestImage(t, 20, 20), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	siteDir := filepath.Join(tmpDir, "site")
+	e := &siteExporter{imagesDir: srcDir, meta: srcMeta, enc: &png.Encoder{}}
+	_, err = e.Export(siteDir, created)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	im := &importer{imagesDir: dstDir, meta: dstMeta, maxSize: 1 << 20}
+	source, err := dirSource(siteDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]string{}
+	for _, d := range source.drawings {
+		name, err := im.Import(source, d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names[d.Name] = name
+	}
+	if names["a.png"] != "a.png" || names["b.png"] == "" || names["b.png"] == "b.png" {
+		t.Fatalf("unexpected imported names: %v", names)
+	}
+	st, err := os.Stat(filepath.Join(dstDir, "a.png"))
+	if err != nil || !st.ModTime().Equal(created) {
+		t.Fatalf("unexpected imported drawing: %v, %v", st, err)
+	}
+	m, err := dstMeta.Get("a.png")
+	if err != nil || *m != (Metadata{Title: "Cat", Author: "Alice", Room: "party"}) {
+		t.Fatalf("unexpected imported metadata: %+v, %v", m, err)
+	}
+
+	// Importing again skips known drawings
+	name, err := im.Import(source, source.drawings[0])
+	if err != nil || name != "" {
+		t.Fatalf("drawing imported twice: %q, %v", name, err)
+	}
+}
+
+func TestImportFromInstance(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "gribouillis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	image := encodeTestImage(t, 10, 10)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/draw/api/v1/drawings", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(&drawingsResponse{Drawings: []drawingInfo{
+			{Name: "a.png", URL: "/draw/saved/a.png", Title: "Cat"},
+		}})
+	})
+	mux.HandleFunc("/draw/saved/a.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(image)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	im := &importer{
+		imagesDir: tmpDir,
+		meta:      &metaStore{dir: tmpDir},
+		maxSize:   1 << 20,
+		client:    srv.Client(),
+		token:     "secret",
+	}
+	base, err := url.Parse(srv.URL + "/draw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, err := im.remoteSource(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(source.drawings) != 1 {
+		t.Fatalf("unexpected drawings: %+v", source.drawings)
+	}
+	name, err := im.Import(source, source.drawings[0])
+	if err != nil || name != "a.png" {
+		t.Fatalf("unexpected import result: %q, %v", name, err)
+	}
+	m, err := im.meta.Get("a.png")
+	if err != nil || m.Title != "Cat" {
+		t.Fatalf("unexpected imported metadata: %+v, %v", m, err)
+	}
+}
@@ -0,0 +1,314 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// privateRoomPrefix starts the identifiers of private rooms, which can only
+// be joined, and saved from, by their members.
+const privateRoomPrefix = "p-"
+
+// roomMemberCookie prefixes the names of the cookies holding the member
+// sessions of private rooms, followed by the room identifier.
+const roomMemberCookie = "gribouillis_room_"
+
+// privateRoomTTL is how long private rooms are remembered after they were
+// last used.
+const privateRoomTTL = 30 * 24 * time.Hour
+
+var (
+	errInvalidInvite = errors.New("invalid room invite")
+	errNotMember     = errors.New("not a member of the room")
+	errUnknownRoom   = errors.New("unknown private room")
+)
+
+// privateRoom is the membership of a private room, as saved by
+// roomInvites.
+type privateRoom struct {
+	// Generation changes the invite token, when the invite is revoked.
+	Generation int `json:"generation"`
+	// OwnerHash is the hash of the token allowing to revoke the invite.
+	OwnerHash string `json:"owner_hash"`
+	// Members holds the hashes of the session tokens of the members.
+	Members map[string]bool `json:"members"`
+	// Used is the last time the room was created or accessed.
+	Used time.Time `json:"used"`
+}
+
+// roomInvites tracks the members of private rooms. Invite tokens are signed
+// with secret and redeemed for member sessions, kept in a cookie. A nil
+// *roomInvites accepts all rooms, private rooms being disabled.
+type roomInvites struct {
+	secret []byte
+	path   string
+	lock   sync.Mutex
+	rooms  map[string]*privateRoom
+}
+
+// defaultRoomInvitesPath returns the private rooms file used with imagesDir.
+func defaultRoomInvitesPath(imagesDir string) string {
+	return filepath.Clean(imagesDir) + "-invites.json"
+}
+
+// openRoomInvites returns invites signed with secret, whose private rooms
+// are saved in path.
+func openRoomInvites(secret, path string) (*roomInvites, error) {
+	v := &roomInvites{
+		secret: []byte(secret),
+		path:   path,
+		rooms:  map[string]*privateRoom{},
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return v, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, &v.rooms)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %s", path, err)
+	}
+	return v, nil
+}
+
+// token returns the invite token of room id at generation.
+func (v *roomInvites) token(id string, generation int) string {
+	h := hmac.New(sha256.New, v.secret)
+	fmt.Fprintf(h, "room-invite=%s/%d", id, generation)
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// save writes the private rooms in v.path, forgetting the ones unused since
+// privateRoomTTL. It must be called with the lock held.
+func (v *roomInvites) save(now time.Time) error {
+	for id, p := range v.rooms {
+		if now.Sub(p.Used) > privateRoomTTL {
+			delete(v.rooms, id)
+		}
+	}
+	data, err := json.Marshal(v.rooms)
+	if err != nil {
+		return err
+	}
+	tmp := v.path + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, v.path)
+}
+
+// Save writes the private rooms, with their last use.
+func (v *roomInvites) Save() error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.save(time.Now())
+}
+
+// Create registers a private room with a random identifier and returns it
+// with its invite and owner tokens.
+func (v *roomInvites) Create(now time.Time) (string, string, string, error) {
+	buf := make([]byte, 12)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", "", "", err
+	}
+	id := privateRoomPrefix + hex.EncodeToString(buf)
+	owner, hash, err := newDeleteToken()
+	if err != nil {
+		return "", "", "", err
+	}
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.rooms[id] = &privateRoom{
+		OwnerHash: hash,
+		Members:   map[string]bool{},
+		Used:      now,
+	}
+	err = v.save(now)
+	if err != nil {
+		delete(v.rooms, id)
+		return "", "", "", err
+	}
+	return id, v.token(id, 0), owner, nil
+}
+
+// Redeem returns a new member session token of private room id, if invite
+// is its current invite token.
+func (v *roomInvites) Redeem(id, invite string, now time.Time) (string, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	p := v.rooms[id]
+	if p == nil || !hmac.Equal([]byte(invite), []byte(v.token(id, p.Generation))) {
+		return "", errInvalidInvite
+	}
+	session, hash, err := newDeleteToken()
+	if err != nil {
+		return "", err
+	}
+	p.Members[hash] = true
+	p.Used = now
+	err = v.save(now)
+	if err != nil {
+		delete(p.Members, hash)
+		return "", err
+	}
+	return session, nil
+}
+
+// Revoke replaces the invite of private room id, given its owner token,
+// and removes all its members. It returns the new invite token.
+func (v *roomInvites) Revoke(id, owner string, now time.Time) (string, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	p := v.rooms[id]
+	if p == nil {
+		return "", errUnknownRoom
+	}
+	if !checkTokenHash(p.OwnerHash, owner) {
+		return "", errInvalidInvite
+	}
+	generation, members := p.Generation, p.Members
+	p.Generation++
+	p.Members = map[string]bool{}
+	p.Used = now
+	err := v.save(now)
+	if err != nil {
+		p.Generation, p.Members = generation, members
+		return "", err
+	}
+	return v.token(id, p.Generation), nil
+}
+
+// Check returns errNotMember if id is a private room and r does not carry
+// one of its member sessions.
+func (v *roomInvites) Check(id string, r *http.Request) error {
+	if v == nil || !strings.HasPrefix(id, privateRoomPrefix) {
+		return nil
+	}
+	c, err := r.Cookie(roomMemberCookie + id)
+	if err != nil {
+		return errNotMember
+	}
+	hash := hashDeleteToken(c.Value)
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	p := v.rooms[id]
+	if p == nil || !p.Members[hash] {
+		return errNotMember
+	}
+	p.Used = time.Now()
+	return nil
+}
+
+// inviteResponse is returned when creating a private room or revoking its
+// invite.
+type inviteResponse struct {
+	ID     string `json:"id"`
+	Invite string `json:"invite"`
+	// Path is the path of the room page, with the invite token.
+	Path string `json:"path"`
+	// OwnerToken allows revoking the invite. It is only returned when
+	// creating the room.
+	OwnerToken string `json:"owner_token,omitempty"`
+}
+
+// serveNewRoom creates a private room with a random identifier and returns
+// its invite.
+func (v *roomInvites) serveNewRoom(w http.ResponseWriter, r *http.Request) {
+	id, invite, owner, err := v.Create(time.Now())
+	if err != nil {
+		writeAPIError(w, 500, "could not create room")
+		return
+	}
+	writeJSON(w, 200, &inviteResponse{
+		ID:         id,
+		Invite:     invite,
+		Path:       mountPrefix(r) + "/room/" + id + "?invite=" + invite,
+		OwnerToken: owner,
+	})
+}
+
+// redeemInvites wraps the room pages handler next, turning the "invite"
+// parameter of private room pages into a member session cookie, before
+// redirecting to the page without it.
+func (h *Handler) redeemInvites(next http.Handler) http.Handler {
+	if h.invites == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/room/")
+		invite := r.URL.Query().Get("invite")
+		if invite == "" || !strings.HasPrefix(id, privateRoomPrefix) ||
+			!roomIDRe.MatchString(id) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		session, err := h.invites.Redeem(id, invite, time.Now())
+		if err == errInvalidInvite {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		} else if err != nil {
+			h.requestLogger(r).Error("could not redeem room invite", "err", err)
+			http.Error(w, "could not join room", 500)
+			return
+		}
+		prefix := mountPrefix(r)
+		http.SetCookie(w, &http.Cookie{
+			Name:     roomMemberCookie + id,
+			Value:    session,
+			Path:     prefix + "/",
+			MaxAge:   int(privateRoomTTL / time.Second),
+			Secure:   h.proxies.baseURL(r).Scheme == "https",
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+		query := r.URL.Query()
+		query.Del("invite")
+		u := url.URL{Path: prefix + r.URL.Path, RawQuery: query.Encode()}
+		http.Redirect(w, r, u.String(), http.StatusSeeOther)
+	})
+}
+
+// revokeInvite replaces the invite of a private room, given its owner
+// token, and disconnects its participants.
+func (h *Handler) revokeInvite(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, apiPrefix+"/rooms/")
+	id = strings.TrimSuffix(id, "/revoke")
+	invite, err := h.invites.Revoke(id, deleteToken(r), time.Now())
+	if err == errUnknownRoom {
+		writeAPIError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err == errInvalidInvite {
+		writeAPIError(w, http.StatusForbidden, "invalid token")
+		return
+	} else if err != nil {
+		h.requestLogger(r).Error("could not revoke room invite", "err", err)
+		writeAPIError(w, 500, "could not revoke invite")
+		return
+	}
+	h.rooms.disconnect(id, websocket.ClosePolicyViolation, "invite revoked")
+	writeJSON(w, 200, &inviteResponse{
+		ID:     id,
+		Invite: invite,
+		Path:   mountPrefix(r) + "/room/" + id + "?invite=" + invite,
+	})
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRoomInvites(t *testing.T) {
+	cfg, cleanup := newTestConfig(t)
+	defer cleanup()
+	cfg.Rooms = true
+	cfg.RoomTurnTime = "1m"
+	cfg.RoomMessageDelay = "0s"
+	cfg.RoomMaxSize = "0"
+	cfg.RoomMaxTotalSize = "0"
+	cfg.RoomSecret = "secret"
+	h, err := NewHandler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	post := func(path, token string) (int, *inviteResponse) {
+		req, err := http.NewRequest("POST", srv.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rsp.Body.Close()
+		invite := &inviteResponse{}
+		if rsp.StatusCode == 200 {
+			err = json.NewDecoder(rsp.Body).Decode(invite)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rsp.StatusCode, invite
+	}
+	_, invite := post("/api/v1/rooms", "")
+	if !strings.HasPrefix(invite.ID, privateRoomPrefix) || invite.OwnerToken == "" ||
+		invite.Path != "/room/"+invite.ID+"?invite="+invite.Invite {
+		t.Fatalf("unexpected invite: %+v", invite)
+	}
+
+	// redeem opens the room page with the invite, returning the member
+	// session cookie
+	noRedirect := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	redeem := func(invite string) (int, *http.Cookie) {
+		rsp, err := noRedirect.Get(srv.URL + "/room/" + invite + "&watch=1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp.Body.Close()
+		id := strings.SplitN(invite, "?", 2)[0]
+		if rsp.StatusCode == 303 && rsp.Header.Get("Location") != "/room/"+id+"?watch=1" {
+			t.Fatalf("unexpected redirection: %s", rsp.Header.Get("Location"))
+		}
+		for _, c := range rsp.Cookies() {
+			if c.Name == roomMemberCookie+id {
+				return rsp.StatusCode, c
+			}
+		}
+		return rsp.StatusCode, nil
+	}
+	if code, _ := redeem(invite.ID + "?invite=x"); code != 403 {
+		t.Fatalf("expected 403 with an invalid invite, got %d", code)
+	}
+	code, session := redeem(invite.ID + "?invite=" + invite.Invite)
+	if code != 303 || session == nil {
+		t.Fatalf("could not redeem invite: %d", code)
+	}
+
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/api/v1/rooms/" + invite.ID
+	join := func(cookie string) (*websocket.Conn, int) {
+		header := http.Header{}
+		if cookie != "" {
+			header.Set("Cookie", roomMemberCookie+invite.ID+"="+cookie)
+		}
+		conn, rsp, err := websocket.DefaultDialer.Dial(wsURL, header)
+		if err != nil {
+			if rsp == nil {
+				t.Fatal(err)
+			}
+			return nil, rsp.StatusCode
+		}
+		return conn, 101
+	}
+	for _, cookie := range []string{"", "x"} {
+		if _, code := join(cookie); code != 403 {
+			t.Fatalf("%q: expected 403, got %d", cookie, code)
+		}
+	}
+	member, _ := join(session.Value)
+	if member == nil {
+		t.Fatal("member could not join")
+	}
+	defer member.Close()
+	if m := readRoomMessage(t, member); m.Type != "state" {
+		t.Fatalf("unexpected message: %+v", m)
+	}
+	// Public rooms need no invite
+	public := dialTestHub(t, srv.URL+"/api/v1/rooms/abc")
+	defer public.Close()
+	readRoomMessage(t, public)
+
+	save := func(query, cookie string) int {
+		req, err := http.NewRequest("POST", srv.URL+"/api/v1/drawings"+query,
+			bytes.NewReader(encodeTestImage(t, 10, 10)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "image/png")
+		if cookie != "" {
+			req.Header.Set("Cookie", roomMemberCookie+invite.ID+"="+cookie)
+		}
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp.Body.Close()
+		return rsp.StatusCode
+	}
+	if code := save("?room="+invite.ID+"&invite="+invite.Invite, ""); code != 403 {
+		t.Fatalf("expected 403, got %d", code)
+	}
+	if code := save("?room="+invite.ID, session.Value); code != 200 {
+		t.Fatalf("could not save in private room: %d", code)
+	}
+	if code := save("?room=abc", ""); code != 200 {
+		t.Fatalf("could not save in public room: %d", code)
+	}
+
+	// Revoking the invite disconnects and removes the members
+	revokePath := "/api/v1/rooms/" + invite.ID + "/revoke"
+	if code, _ := post(revokePath, "x"); code != 403 {
+		t.Fatalf("expected 403 without the owner token, got %d", code)
+	}
+	if code, _ := post("/api/v1/rooms/p-abc/revoke", invite.OwnerToken); code != 404 {
+		t.Fatalf("expected 404 for an unknown room, got %d", code)
+	}
+	code, revoked := post(revokePath, invite.OwnerToken)
+	if code != 200 || revoked.Invite == invite.Invite {
+		t.Fatalf("could not revoke invite: %d, %+v", code, revoked)
+	}
+	member.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		_, _, err := member.ReadMessage()
+		if websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+			break
+		} else if err != nil {
+			t.Fatalf("unexpected disconnection: %v", err)
+		}
+	}
+	if _, code := join(session.Value); code != 403 {
+		t.Fatalf("revoked member: expected 403, got %d", code)
+	}
+	if code := save("?room="+invite.ID, session.Value); code != 403 {
+		t.Fatalf("revoked member: expected 403, got %d", code)
+	}
+	if code, _ := redeem(invite.ID + "?invite=" + invite.Invite); code != 403 {
+		t.Fatalf("revoked invite: expected 403, got %d", code)
+	}
+	if code, _ := redeem(invite.ID + "?invite=" + revoked.Invite); code != 303 {
+		t.Fatalf("could not redeem new invite: %d", code)
+	}
+
+	// Members survive restarts
+	h.Close()
+	invites, err := openRoomInvites(cfg.RoomSecret, defaultRoomInvitesPath(cfg.ImagesDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := invites.rooms[invite.ID]; p == nil || p.Generation != 1 || len(p.Members) != 1 {
+		t.Fatalf("unexpected saved room: %+v", p)
+	}
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errIRCDisconnected = errors.New("not connected to IRC channel")
+
+// ircBot is a minimal IRC client announcing saved drawings in a channel. It
+// reconnects when the connection is lost. Announcements made while
+// disconnected fail, to be retried by the job queue.
+type ircBot struct {
+	addr    string
+	useTLS  bool
+	nick    string
+	channel string
+	lock    sync.Mutex
+	// conn is set once the channel is joined
+	conn net.Conn
+}
+
+func newIRCBot(addr string, useTLS bool, nick, channel string) *ircBot {
+	return &ircBot{
+		addr:    addr,
+		useTLS:  useTLS,
+		nick:    nick,
+		channel: channel,
+	}
+}
+
+// parseIRCLine splits an IRC message into its prefix nickname, command and
+// parameters, the trailing one included.
+func parseIRCLine(line string) (string, string, []string) {
+	line = strings.TrimRight(line, "\r\n")
+	nick := ""
+	if strings.HasPrefix(line, ":") {
+		i := strings.Index(line, " ")
+		if i < 0 {
+			return "", "", nil
+		}
+		nick = line[1:i]
+		if j := strings.Index(nick, "!"); j >= 0 {
+			nick = nick[:j]
+		}
+		line = line[i+1:]
+	}
+	trailing := ""
+	hasTrailing := false
+	if i := strings.Index(line, " :"); i >= 0 {
+		trailing = line[i+2:]
+		hasTrailing = true
+		line = line[:i]
+	}
+	params := strings.Fields(line)
+	if len(params) == 0 {
+		return nick, "", nil
+	}
+	if hasTrailing {
+		params = append(params, trailing)
+	}
+	return nick, strings.ToUpper(params[0]), params[1:]
+}
+
+func writeIRC(conn net.Conn, format string, args ...interface{}) error {
+	conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	_, err := fmt.Fprintf(conn, format+"\r\n", args...)
+	return err
+}
+
+// session connects to the server, joins the channel and answers pings until
+// the connection fails or ctx is done.
+func (b *ircBot) session(ctx context.Context) error {
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	var conn net.Conn
+	var err error
+	if b.useTLS {
+		conn, err = (&tls.Dialer{NetDialer: dialer}).DialContext(ctx, "tcp", b.addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", b.addr)
+	}
+	if err != nil {
+		return err
+	}
+	// Closing the connection interrupts the blocked read
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	defer func() {
+		b.lock.Lock()
+		b.conn = nil
+		b.lock.Unlock()
+		conn.Close()
+	}()
+	nick := b.nick
+	err = writeIRC(conn, "NICK %s", nick)
+	if err != nil {
+		return err
+	}
+	err = writeIRC(conn, "USER %s 0 * :gribouillis", b.nick)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(10 * time.Minute))
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		from, cmd, params := parseIRCLine(line)
+		switch cmd {
+		case "PING":
+			b.lock.Lock()
+			err = writeIRC(conn, "PONG :%s", strings.Join(params, " "))
+			b.lock.Unlock()
+		case "001":
+			err = writeIRC(conn, "JOIN %s", b.channel)
+		case "433":
+			// Nickname in use
+			nick += "_"
+			err = writeIRC(conn, "NICK %s", nick)
+		case "JOIN":
+			if from == nick && len(params) > 0 &&
+				strings.EqualFold(params[0], b.channel) {
+				b.lock.Lock()
+				b.conn = conn
+				b.lock.Unlock()
+			}
+		case "ERROR":
+			return fmt.Errorf("irc: %s", strings.Join(params, " "))
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Run keeps the bot connected, until ctx is done.
+func (b *ircBot) Run(ctx context.Context) {
+	for {
+		err := b.session(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Warn("irc connection lost", "addr", b.addr, "err", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(30 * time.Second):
+		}
+	}
+}
+
+// Send posts text in the channel.
+func (b *ircBot) Send(text string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.conn == nil {
+		return errIRCDisconnected
+	}
+	text = strings.NewReplacer("\r", " ", "\n", " ").Replace(text)
+	return writeIRC(b.conn, "PRIVMSG %s :%s", b.channel, text)
+}
+
+// Job announces the drawing whose URL is the job argument.
+func (b *ircBot) Job(job *Job) error {
+	return b.Send("New drawing: " + job.Arg)
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseIRCLine(t *testing.T) {
+	tests := []struct {
+		line   string
+		nick   string
+		cmd    string
+		params []string
+	}{
+		{"PING :irc.example.com\r\n", "", "PING", []string{"irc.example.com"}},
+		{":bot!u@host JOIN #draw\r\n", "bot", "JOIN", []string{"#draw"}},
+		{":srv 001 bot :Welcome here", "srv", "001", []string{"bot", "Welcome here"}},
+		{":srv", "", "", nil},
+	}
+	for _, test := range tests {
+		nick, cmd, params := parseIRCLine(test.line)
+		if nick != test.nick || cmd != test.cmd ||
+			!reflect.DeepEqual(params, test.params) {
+			t.Errorf("%q: unexpected result: %q, %q, %q", test.line, nick, cmd,
+				params)
+		}
+	}
+}
+
+func TestIRCBot(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	received := make(chan string, 10)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimSpace(line)
+			switch {
+			case line == "NICK bot":
+				fmt.Fprintf(conn, ":srv 433 * bot :Nickname is already in use\r\n")
+			case line == "NICK bot_":
+				fmt.Fprintf(conn, "PING :token\r\n")
+				fmt.Fprintf(conn, ":srv 001 bot_ :Welcome\r\n")
+			case line == "JOIN #draw":
+				fmt.Fprintf(conn, ":bot_!u@host JOIN :#draw\r\n")
+			default:
+				received <- line
+			}
+		}
+	}()
+
+	b := newIRCBot(l.Addr().String(), false, "bot", "#draw")
+	if err := b.Job(&Job{Arg: "http://x"}); err != errIRCDisconnected {
+		t.Fatalf("expected disconnected error, got %v", err)
+	}
+	go b.session(context.Background())
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err = b.Job(&Job{Arg: "http://example.com/saved/a.png"})
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("bot did not join the channel: %s", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	expected := []string{
+		"USER bot 0 * :gribouillis",
+		"PONG :token",
+		"PRIVMSG #draw :New drawing: http://example.com/saved/a.png",
+	}
+	for _, e := range expected {
+		select {
+		case line := <-received:
+			if line != e {
+				t.Fatalf("expected %q, got %q", e, line)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %q", e)
+		}
+	}
+}
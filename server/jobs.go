@@ -0,0 +1,267 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// errPostponed is returned by job handlers to run the job again later without
+// counting a failed attempt.
+var errPostponed = errors.New("job postponed")
+
+// Job is a unit of background work.
+type Job struct {
+	ID   string `json:"id"`
+	Kind string `json:"kind"`
+	// Arg is the job argument, like a file name.
+	Arg       string    `json:"arg"`
+	Attempts  int       `json:"attempts"`
+	NextRun   time.Time `json:"next_run"`
+	LastError string    `json:"last_error,omitempty"`
+	Failed    bool      `json:"failed"`
+}
+
+// JobHandler executes a job.
+type JobHandler func(job *Job) error
+
+// JobQueue runs jobs in a background goroutine, retrying failed ones with an
+// exponential backoff. Jobs are persisted in a JSON file so pending ones
+// survive restarts. Jobs failing maxAttempts times are kept, marked as failed,
+// for inspection.
+type JobQueue struct {
+	path        string
+	maxAttempts int
+	lock        sync.Mutex
+	handlers    map[string]JobHandler
+	jobs        []*Job
+	wake        chan struct{}
+	// running is held while a job runs. stopped is set by Stop and
+	// protected by lock.
+	running sync.Mutex
+	stopped bool
+}
+
+const (
+	jobRetryDelay    = 10 * time.Second
+	jobMaxRetryDelay = time.Hour
+	maxFailedJobs    = 100
+)
+
+func readJobs(path string) ([]*Job, error) {
+	jobs := []*Job{}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return jobs, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, &jobs)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %s", path, err)
+	}
+	return jobs, nil
+}
+
+// OpenJobQueue returns a JobQueue persisted in path, loading its jobs if it
+// exists. Call Run to start processing them.
+func OpenJobQueue(path string, maxAttempts int) (*JobQueue, error) {
+	jobs, err := readJobs(path)
+	if err != nil {
+		return nil, err
+	}
+	return &JobQueue{
+		path:        path,
+		maxAttempts: maxAttempts,
+		handlers:    map[string]JobHandler{},
+		jobs:        jobs,
+		wake:        make(chan struct{}, 1),
+	}, nil
+}
+
+// Handle registers the handler of kind jobs.
+func (q *JobQueue) Handle(kind string, h JobHandler) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.handlers[kind] = h
+}
+
+func (q *JobQueue) save() error {
+	data, err := json.MarshalIndent(q.jobs, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := q.path + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.path)
+}
+
+// Push enqueues a job to be run after delay. Pushing a job with the same kind
+// and argument as a pending one is a no-op.
+func (q *JobQueue) Push(kind, arg string, delay time.Duration) error {
+	buf := make([]byte, 8)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return err
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for _, j := range q.jobs {
+		if !j.Failed && j.Kind == kind && j.Arg == arg {
+			return nil
+		}
+	}
+	q.jobs = append(q.jobs, &Job{
+		ID:      fmt.Sprintf("%x", buf),
+		Kind:    kind,
+		Arg:     arg,
+		NextRun: time.Now().Add(delay),
+	})
+	err = q.save()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return err
+}
+
+// List returns a copy of queued and failed jobs.
+func (q *JobQueue) List() []Job {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	jobs := []Job{}
+	for _, j := range q.jobs {
+		jobs = append(jobs, *j)
+	}
+	return jobs
+}
+
+// next returns the pending job to run first and its handler, or nil and the
+// delay until the next job.
+func (q *JobQueue) next() (*Job, JobHandler, time.Duration) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	var first *Job
+	for _, j := range q.jobs {
+		if j.Failed || q.handlers[j.Kind] == nil {
+			continue
+		}
+		if first == nil || j.NextRun.Before(first.NextRun) {
+			first = j
+		}
+	}
+	if first == nil {
+		return nil, nil, time.Hour
+	}
+	if delay := time.Until(first.NextRun); delay > 0 {
+		return nil, nil, delay
+	}
+	return first, q.handlers[first.Kind], 0
+}
+
+// done updates job after it ran and returned err.
+func (q *JobQueue) done(job *Job, err error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	switch {
+	case err == nil:
+		for i, j := range q.jobs {
+			if j == job {
+				q.jobs = append(q.jobs[:i], q.jobs[i+1:]...)
+				break
+			}
+		}
+	case err == errPostponed:
+		job.NextRun = time.Now().Add(jobRetryDelay)
+	default:
+		job.Attempts++
+		job.LastError = err.Error()
+		delay := jobRetryDelay << uint(job.Attempts-1)
+		if delay > jobMaxRetryDelay || delay <= 0 {
+			delay = jobMaxRetryDelay
+		}
+		job.NextRun = time.Now().Add(delay)
+		if job.Attempts >= q.maxAttempts {
+			slog.Warn("job failed", "id", job.ID, "kind", job.Kind, "arg", job.Arg,
+				"attempts", job.Attempts, "err", err)
+			job.Failed = true
+			q.dropFailed()
+		}
+	}
+	err = q.save()
+	if err != nil {
+		slog.Error("could not save jobs", "err", err)
+	}
+}
+
+// dropFailed forgets the oldest failed jobs beyond maxFailedJobs.
+func (q *JobQueue) dropFailed() {
+	failed := 0
+	for _, j := range q.jobs {
+		if j.Failed {
+			failed++
+		}
+	}
+	jobs := []*Job{}
+	for _, j := range q.jobs {
+		if j.Failed && failed > maxFailedJobs {
+			failed--
+			continue
+		}
+		jobs = append(jobs, j)
+	}
+	q.jobs = jobs
+}
+
+// Run processes jobs one at a time, until ctx is done or Stop is called.
+func (q *JobQueue) Run(ctx context.Context) {
+	for {
+		job, handler, delay := q.next()
+		if job == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			case <-q.wake:
+			}
+			continue
+		}
+		q.running.Lock()
+		q.lock.Lock()
+		stopped := q.stopped
+		q.lock.Unlock()
+		if stopped || ctx.Err() != nil {
+			q.running.Unlock()
+			return
+		}
+		q.done(job, handler(job))
+		q.running.Unlock()
+	}
+}
+
+// Stop prevents other jobs from being started and waits for the running one,
+// if any, to complete. Pending jobs are run again once reopened.
+func (q *JobQueue) Stop() {
+	q.lock.Lock()
+	q.stopped = true
+	q.lock.Unlock()
+	q.running.Lock()
+	q.running.Unlock()
+}
+
+// defaultJobsPath returns the jobs file used with imagesDir.
+func defaultJobsPath(imagesDir string) string {
+	return filepath.Clean(imagesDir) + "-jobs.json"
+}
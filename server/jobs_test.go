@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJobQueue(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "gribouillis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "jobs.json")
+
+	q, err := OpenJobQueue(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := 0
+	q.Handle("test", func(job *Job) error {
+		calls++
+		if job.Arg == "fail" {
+			return fmt.Errorf("failed")
+		}
+		return nil
+	})
+	for _, arg := range []string{"ok", "fail", "ok"} {
+		err = q.Push("test", arg, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(q.List()); n != 2 {
+		t.Fatalf("duplicate job was queued, got %d jobs", n)
+	}
+
+	// Jobs survive restarts
+	q, err = OpenJobQueue(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Handle("test", func(job *Job) error {
+		calls++
+		if job.Arg == "fail" {
+			return fmt.Errorf("failed")
+		}
+		return nil
+	})
+	runNext := func() {
+		job, handler, _ := q.next()
+		if job == nil {
+			t.Fatal("no job ready")
+		}
+		q.done(job, handler(job))
+	}
+	runNext()
+	runNext()
+	jobs := q.List()
+	if len(jobs) != 1 || jobs[0].Arg != "fail" || jobs[0].Attempts != 1 ||
+		jobs[0].Failed {
+		t.Fatalf("unexpected jobs: %+v", jobs)
+	}
+	// Force the retry
+	q.jobs[0].NextRun = q.jobs[0].NextRun.Add(-jobRetryDelay)
+	runNext()
+	jobs = q.List()
+	if len(jobs) != 1 || !jobs[0].Failed || jobs[0].LastError != "failed" {
+		t.Fatalf("unexpected jobs: %+v", jobs)
+	}
+	if job, _, _ := q.next(); job != nil {
+		t.Fatalf("failed job is still scheduled: %+v", job)
+	}
+	if calls != 3 {
+		t.Fatalf("expected 3 calls, got %d", calls)
+	}
+}
+
+func TestJobQueueStop(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "gribouillis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	q, err := OpenJobQueue(filepath.Join(tmpDir, "jobs.json"), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	q.Handle("test", func(job *Job) error {
+		close(started)
+		<-release
+		return nil
+	})
+	for _, arg := range []string{"first", "second"} {
+		err = q.Push("test", arg, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ran := make(chan struct{})
+	go func() {
+		q.Run(context.Background())
+		close(ran)
+	}()
+	<-started
+	stopped := make(chan struct{})
+	go func() {
+		q.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("stop did not wait for the running job")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-stopped
+	<-ran
+	jobs := q.List()
+	if len(jobs) != 1 || jobs[0].Arg != "second" {
+		t.Fatalf("unexpected jobs: %+v", jobs)
+	}
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+
+	"github.com/pmezard/gribouillis/storage"
+)
+
+// maxListingLimit is the largest number of drawings returned by a paginated
+// listing.
+const maxListingLimit = 1000
+
+// listingSorts are the orderings of drawings listings.
+var listingSorts = map[string]bool{
+	"newest":  true,
+	"oldest":  true,
+	"popular": true,
+	"random":  true,
+}
+
+// listingKey positions a drawing in a listing. Drawings are listed by
+// increasing Rank, then Time, then Name, so the key of the last drawing of a
+// page is also the cursor of the next one: pages stay consistent while
+// drawings are saved or evicted.
+type listingKey struct {
+	Rank int64  `json:"r,omitempty"`
+	Time int64  `json:"t,omitempty"`
+	Name string `json:"n"`
+}
+
+func (k listingKey) less(o listingKey) bool {
+	if k.Rank != o.Rank {
+		return k.Rank < o.Rank
+	}
+	if k.Time != o.Time {
+		return k.Time < o.Time
+	}
+	return k.Name < o.Name
+}
+
+// listingCursor is the opaque cursor of a listing page. It carries the
+// ordering and seed of the first page so clients only have to pass it back.
+type listingCursor struct {
+	Sort string     `json:"s"`
+	Seed string     `json:"seed,omitempty"`
+	Key  listingKey `json:"k"`
+}
+
+func (c *listingCursor) String() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func parseListingCursor(s string) (*listingCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	c := &listingCursor{}
+	err = json.Unmarshal(data, c)
+	if err != nil || !listingSorts[c.Sort] {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return c, nil
+}
+
+// listingQuery is a parsed drawings listing query.
+type listingQuery struct {
+	Sort string
+	// Seed shuffles the random ordering, the same seed giving the same order.
+	Seed string
+	// Limit is the maximum number of returned drawings, zero meaning all of
+	// them.
+	Limit int
+	// After is the key of the last drawing of the previous page, if any.
+	After *listingKey
+}
+
+// parseListingQuery parses the sort, seed, limit and cursor parameters of a
+// listing query. Drawings are listed newest first by default. Random
+// listings without a seed get a fresh one, kept in their cursors.
+func parseListingQuery(get func(string) string) (*listingQuery, error) {
+	q := &listingQuery{
+		Sort: get("sort"),
+		Seed: get("seed"),
+	}
+	if s := get("cursor"); s != "" {
+		c, err := parseListingCursor(s)
+		if err != nil {
+			return nil, err
+		}
+		if q.Sort != "" && q.Sort != c.Sort || q.Seed != "" && q.Seed != c.Seed {
+			return nil, fmt.Errorf("sort and seed must match the cursor")
+		}
+		q.Sort = c.Sort
+		q.Seed = c.Seed
+		q.After = &c.Key
+	}
+	if q.Sort == "" {
+		q.Sort = "newest"
+	}
+	if !listingSorts[q.Sort] {
+		return nil, fmt.Errorf("sort must be newest, oldest, popular or random")
+	}
+	if q.Sort != "random" {
+		q.Seed = ""
+	} else if q.Seed == "" {
+		buf := make([]byte, 8)
+		_, err := rand.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		q.Seed = hex.EncodeToString(buf)
+	}
+	if s := get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit <= 0 || limit > maxListingLimit {
+			return nil, fmt.Errorf("limit must be between 1 and %d",
+				maxListingLimit)
+		}
+		q.Limit = limit
+	}
+	return q, nil
+}
+
+// key returns the position of file f, viewed views times, in the query
+// ordering. Popular drawings are the most viewed ones, newest first on ties.
+func (q *listingQuery) key(f storage.File, views int64) listingKey {
+	t := f.ModTime.UnixNano()
+	switch q.Sort {
+	case "oldest":
+		return listingKey{Time: t, Name: f.Name}
+	case "popular":
+		return listingKey{Rank: -views, Time: -t, Name: f.Name}
+	case "random":
+		h := fnv.New64a()
+		h.Write([]byte(q.Seed + "/" + f.Name))
+		return listingKey{Rank: int64(h.Sum64()), Name: f.Name}
+	}
+	return listingKey{Time: -t, Name: f.Name}
+}
+
+// List returns the page of files selected by the query, given their views,
+// and the cursor of the next page, empty if it is the last one.
+func (q *listingQuery) List(files []storage.File, views func(f storage.File) int64) ([]storage.File, string) {
+	keys := make([]listingKey, 0, len(files))
+	page := make([]storage.File, 0, len(files))
+	for _, f := range files {
+		k := q.key(f, views(f))
+		if q.After != nil && !q.After.less(k) {
+			continue
+		}
+		keys = append(keys, k)
+		page = append(page, f)
+	}
+	sort.Sort(&keyedFiles{keys, page})
+	if q.Limit <= 0 || len(page) <= q.Limit {
+		return page, ""
+	}
+	c := &listingCursor{Sort: q.Sort, Seed: q.Seed, Key: keys[q.Limit-1]}
+	return page[:q.Limit], c.String()
+}
+
+// keyedFiles sorts files by listing keys.
+type keyedFiles struct {
+	keys  []listingKey
+	files []storage.File
+}
+
+func (s *keyedFiles) Len() int           { return len(s.keys) }
+func (s *keyedFiles) Less(i, j int) bool { return s.keys[i].less(s.keys[j]) }
+func (s *keyedFiles) Swap(i, j int) {
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+	s.files[i], s.files[j] = s.files[j], s.files[i]
+}
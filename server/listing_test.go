@@ -0,0 +1,121 @@
+package server
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pmezard/gribouillis/storage"
+)
+
+func TestListingQuery(t *testing.T) {
+	now := time.Now()
+	files := []storage.File{}
+	for i := 0; i < 5; i++ {
+		files = append(files, storage.File{
+			Name:    fmt.Sprintf("%d.png", i),
+			ModTime: now.Add(time.Duration(i) * time.Minute),
+			Views:   i % 3,
+		})
+	}
+	views := func(f storage.File) int64 { return int64(f.Views) }
+	names := func(files []storage.File) string {
+		s := []string{}
+		for _, f := range files {
+			s = append(s, strings.TrimSuffix(f.Name, ".png"))
+		}
+		return strings.Join(s, ",")
+	}
+	query := func(params map[string]string) *listingQuery {
+		q, err := parseListingQuery(func(k string) string { return params[k] })
+		if err != nil {
+			t.Fatal(err)
+		}
+		return q
+	}
+	// paginate lists all pages of limit 2 and returns their names.
+	paginate := func(files []storage.File, params map[string]string) string {
+		params["limit"] = "2"
+		all := []storage.File{}
+		for {
+			page, next := query(params).List(files, views)
+			all = append(all, page...)
+			if next == "" {
+				return names(all)
+			}
+			params = map[string]string{"limit": "2", "cursor": next}
+		}
+	}
+	for sort, expected := range map[string]string{
+		"":        "4,3,2,1,0",
+		"newest":  "4,3,2,1,0",
+		"oldest":  "0,1,2,3,4",
+		"popular": "2,4,1,3,0",
+	} {
+		page, next := query(map[string]string{"sort": sort}).List(files, views)
+		if names(page) != expected || next != "" {
+			t.Fatalf("%q: unexpected listing: %s", sort, names(page))
+		}
+		if s := paginate(files, map[string]string{"sort": sort}); s != expected {
+			t.Fatalf("%q: unexpected pages: %s", sort, s)
+		}
+	}
+
+	// Random orderings are shuffled by their seed
+	random := map[string]string{"sort": "random", "seed": "a"}
+	page, _ := query(random).List(files, views)
+	shuffled := names(page)
+	if s := paginate(files, map[string]string{"sort": "random", "seed": "a"}); s != shuffled {
+		t.Fatalf("unexpected random pages: %s != %s", s, shuffled)
+	}
+	differs := false
+	for i := 0; i < 10 && !differs; i++ {
+		page, _ = query(map[string]string{
+			"sort": "random", "seed": fmt.Sprint(i),
+		}).List(files, views)
+		differs = names(page) != shuffled
+	}
+	if !differs {
+		t.Fatal("seed does not change random ordering")
+	}
+
+	// Saving and evicting drawings between pages does not repeat or skip
+	// the others
+	q := query(map[string]string{"sort": "newest", "limit": "2"})
+	page, next := q.List(files, views)
+	if names(page) != "4,3" {
+		t.Fatalf("unexpected first page: %s", names(page))
+	}
+	changed := append([]storage.File{{Name: "5.png", ModTime: now.Add(time.Hour)}},
+		files[:2]...)
+	changed = append(changed, files[3:]...)
+	q = query(map[string]string{"cursor": next, "limit": "2"})
+	page, next = q.List(changed, views)
+	if names(page) != "1,0" || next != "" {
+		t.Fatalf("unexpected second page: %s", names(page))
+	}
+
+	_, next = query(map[string]string{"sort": "oldest", "limit": "1"}).List(files, views)
+	for _, params := range []map[string]string{
+		{"sort": "best"},
+		{"limit": "0"},
+		{"limit": "1001"},
+		{"limit": "x"},
+		{"cursor": "!"},
+		{"cursor": next, "sort": "newest"},
+	} {
+		_, err := parseListingQuery(func(k string) string { return params[k] })
+		if err == nil {
+			t.Fatalf("%v: expected an error", params)
+		}
+	}
+	if q := query(map[string]string{"sort": "random"}); q.Seed == "" {
+		t.Fatal("random listing has no seed")
+	}
+	if !reflect.DeepEqual(query(map[string]string{"cursor": next}).After,
+		&listingKey{Time: files[0].ModTime.UnixNano(), Name: "0.png"}) {
+		t.Fatal("unexpected cursor")
+	}
+}
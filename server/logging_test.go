@@ -0,0 +1,34 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+)
+
+func TestLogHandler(t *testing.T) {
+	buf := &bytes.Buffer{}
+	h, err := NewLogHandler(buf, "warn", "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(h)
+	logger.Info("hidden")
+	logger.Warn("save rejected", "ip", "192.0.2.1", "bytes", 12)
+	record := map[string]interface{}{}
+	err = json.Unmarshal(buf.Bytes(), &record)
+	if err != nil {
+		t.Fatalf("could not parse %q: %s", buf.String(), err)
+	}
+	if record["msg"] != "save rejected" || record["level"] != "WARN" ||
+		record["ip"] != "192.0.2.1" || record["bytes"] != 12.0 {
+		t.Fatalf("unexpected record: %v", record)
+	}
+
+	for _, args := range [][2]string{{"verbose", "text"}, {"info", "xml"}} {
+		if _, err := NewLogHandler(buf, args[0], args[1]); err == nil {
+			t.Fatalf("%v was accepted", args)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// matrixBot announces saved drawings in a Matrix room, using the
+// client-server API with the access token of an account joined to it. It can
+// also answer "!draw" messages with the instance URL.
+type matrixBot struct {
+	homeserver string
+	token      string
+	room       string
+	client     *http.Client
+}
+
+func newMatrixBot(homeserver, token, room string) *matrixBot {
+	return &matrixBot{
+		homeserver: strings.TrimRight(homeserver, "/"),
+		token:      token,
+		room:       room,
+		client:     &http.Client{Timeout: time.Minute},
+	}
+}
+
+// do sends a request with JSON body in, if not nil, and decodes the JSON
+// response in out, if not nil.
+func (b *matrixBot) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, b.homeserver+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+b.token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	rsp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != 200 {
+		data, _ := ioutil.ReadAll(io.LimitReader(rsp.Body, 1024))
+		return fmt.Errorf("matrix: %s %s: %s: %s", method, path, rsp.Status,
+			strings.TrimSpace(string(data)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(rsp.Body).Decode(out)
+}
+
+// Send posts a text message in the room.
+func (b *matrixBot) Send(text string) error {
+	txn := make([]byte, 8)
+	_, err := rand.Read(txn)
+	if err != nil {
+		return err
+	}
+	path := fmt.Sprintf("/_matrix/client/v3/rooms/%s/send/m.room.message/%x",
+		url.PathEscape(b.room), txn)
+	return b.do(context.Background(), "PUT", path, map[string]string{
+		"msgtype": "m.text",
+		"body":    text,
+	}, nil)
+}
+
+// Job announces the drawing whose URL is the job argument.
+func (b *matrixBot) Job(job *Job) error {
+	return b.Send("New drawing: " + job.Arg)
+}
+
+type matrixSync struct {
+	NextBatch string `json:"next_batch"`
+	Rooms     struct {
+		Join map[string]struct {
+			Timeline struct {
+				Events []struct {
+					Type    string `json:"type"`
+					Content struct {
+						Body string `json:"body"`
+					} `json:"content"`
+				} `json:"events"`
+			} `json:"timeline"`
+		} `json:"join"`
+	} `json:"rooms"`
+}
+
+// sync waits for new events after since and returns the next batch token and
+// the room text messages. A first sync, with an empty since, returns no
+// message.
+func (b *matrixBot) sync(ctx context.Context, since string) (string, []string, error) {
+	q := url.Values{}
+	q.Set("timeout", "30000")
+	if since != "" {
+		q.Set("since", since)
+	} else {
+		q.Set("filter", `{"room":{"timeline":{"limit":1}}}`)
+	}
+	rsp := &matrixSync{}
+	err := b.do(ctx, "GET", "/_matrix/client/v3/sync?"+q.Encode(), nil, rsp)
+	if err != nil {
+		return "", nil, err
+	}
+	messages := []string{}
+	if since == "" {
+		return rsp.NextBatch, messages, nil
+	}
+	for _, e := range rsp.Rooms.Join[b.room].Timeline.Events {
+		if e.Type == "m.room.message" {
+			messages = append(messages, e.Content.Body)
+		}
+	}
+	return rsp.NextBatch, messages, nil
+}
+
+// RunCommands answers "!draw" messages with instanceURL, until ctx is done.
+func (b *matrixBot) RunCommands(ctx context.Context, instanceURL string) {
+	since := ""
+	for ctx.Err() == nil {
+		next, messages, err := b.sync(ctx, since)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Warn("could not sync matrix room", "err", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Minute):
+			}
+			continue
+		}
+		since = next
+		for _, m := range messages {
+			if strings.TrimSpace(m) != "!draw" {
+				continue
+			}
+			err := b.Send("Draw at " + instanceURL)
+			if err != nil {
+				slog.Warn("could not answer matrix command", "err", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestMatrixBot(t *testing.T) {
+	lock := sync.Mutex{}
+	sent := []string{}
+	syncs := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(401)
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		switch {
+		case r.Method == "PUT" && strings.HasPrefix(r.URL.EscapedPath(),
+			"/_matrix/client/v3/rooms/%21room:example.com/send/m.room.message/"):
+			msg := map[string]string{}
+			json.NewDecoder(r.Body).Decode(&msg)
+			sent = append(sent, msg["body"])
+			w.Write([]byte(`{"event_id":"$1"}`))
+		case r.Method == "GET" && r.URL.Path == "/_matrix/client/v3/sync":
+			syncs++
+			w.Write([]byte(`{"next_batch":"b` + r.URL.Query().Get("since") +
+				`","rooms":{"join":{"!room:example.com":{"timeline":{"events":[
+				{"type":"m.room.message","content":{"body":"!draw"}},
+				{"type":"m.room.message","content":{"body":"hello"}}]}}}}}`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer srv.Close()
+
+	b := newMatrixBot(srv.URL+"/", "token", "!room:example.com")
+	err := b.Job(&Job{Arg: "https://example.com/saved/a.png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	since, messages, err := b.sync(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if since != "b" || len(messages) != 0 {
+		t.Fatalf("initial sync should skip history: %q, %q", since, messages)
+	}
+	since, messages, err = b.sync(context.Background(), since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if since != "bb" || strings.Join(messages, ",") != "!draw,hello" {
+		t.Fatalf("unexpected sync result: %q, %q", since, messages)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(sent) != 1 || sent[0] != "New drawing: https://example.com/saved/a.png" {
+		t.Fatalf("unexpected sent messages: %q", sent)
+	}
+
+	b.token = "invalid"
+	if err := b.Send("x"); err == nil {
+		t.Fatal("expected an authentication error")
+	}
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Metadata holds information about a saved drawing.
+type Metadata struct {
+	// BlurHash is a compact representation of the drawing, decoded by clients
+	// into a blurred placeholder.
+	BlurHash string `json:"blurhash,omitempty"`
+	// Title and Author are optional captions set when saving the drawing.
+	Title  string `json:"title,omitempty"`
+	Author string `json:"author,omitempty"`
+	// Room is the shared room the drawing was saved from.
+	Room string `json:"room,omitempty"`
+	// Prompt is the prompt of the day the drawing was saved under.
+	Prompt string `json:"prompt,omitempty"`
+	// DeleteTokenHash is the SHA-256 hash of the token returned to the
+	// uploader to delete the drawing.
+	DeleteTokenHash string `json:"delete_token_hash,omitempty"`
+}
+
+// metaStore persists drawings metadata as JSON files named after the
+// drawings, in a directory of their own.
+type metaStore struct {
+	dir string
+	// fsync flushes written files and dir to stable storage.
+	fsync bool
+}
+
+// defaultMetaDir returns the metadata directory used with imagesDir.
+func defaultMetaDir(imagesDir string) string {
+	return filepath.Clean(imagesDir) + "-meta"
+}
+
+// openMetaStore returns a metaStore writing in dir. Metadata, shapes and SVG of
+// drawings missing from images directory, and temporary files, are removed.
+func openMetaStore(dir, images string) (*metaStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		name := strings.TrimSuffix(e.Name(), ".json")
+		name = strings.TrimSuffix(name, ".svg")
+		name = strings.TrimSuffix(name, ".shapes")
+		_, err := os.Stat(filepath.Join(images, name))
+		if strings.HasPrefix(e.Name(), ".") || os.IsNotExist(err) {
+			os.Remove(filepath.Join(dir, e.Name()))
+		}
+	}
+	return &metaStore{dir: dir}, nil
+}
+
+func (s *metaStore) path(name string) string {
+	return filepath.Join(s.dir, name+".json")
+}
+
+// Get returns the metadata of drawing name, empty if it has none.
+func (s *metaStore) Get(name string) (*Metadata, error) {
+	m := &Metadata{}
+	data, err := ioutil.ReadFile(s.path(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return m, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, m)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s metadata: %s", name, err)
+	}
+	return m, nil
+}
+
+// Put replaces the metadata of drawing name.
+func (s *metaStore) Put(name string, m *Metadata) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return s.write(s.path(name), data)
+}
+
+// write atomically replaces path content with data, durably if fsync is
+// set.
+func (s *metaStore) write(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(s.dir, ".meta-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil && s.fsync {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), path)
+	if err != nil || !s.fsync {
+		return err
+	}
+	return syncDir(s.dir)
+}
+
+// ShapesPath returns the path of the editable shapes of drawing name.
+func (s *metaStore) ShapesPath(name string) string {
+	return filepath.Join(s.dir, name+".shapes.json")
+}
+
+// PutShapes stores data, the JSON serialization of the LiterallyCanvas
+// drawing name, so it can be reopened in the editor.
+func (s *metaStore) PutShapes(name string, data []byte) error {
+	return s.write(s.ShapesPath(name), data)
+}
+
+// SVGPath returns the path of the SVG rendering of drawing name shapes.
+func (s *metaStore) SVGPath(name string) string {
+	return filepath.Join(s.dir, name+".svg")
+}
+
+// PutSVG stores data, the SVG rendering of drawing name shapes.
+func (s *metaStore) PutSVG(name string, data []byte) error {
+	return s.write(s.SVGPath(name), data)
+}
+
+// Remove deletes the metadata, shapes and SVG rendering of drawing name, if
+// any.
+func (s *metaStore) Remove(name string) {
+	os.Remove(s.path(name))
+	os.Remove(s.ShapesPath(name))
+	os.Remove(s.SVGPath(name))
+}
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// Middleware wraps an http.Handler, to alter requests or responses.
+type Middleware func(http.Handler) http.Handler
+
+// MiddlewareFactory builds a middleware from an instance configuration.
+type MiddlewareFactory func(cfg *Config) (Middleware, error)
+
+var (
+	middlewaresLock sync.Mutex
+	middlewares     = map[string]MiddlewareFactory{
+		"logging":          newLoggingMiddleware,
+		"limits":           newLimitsMiddleware,
+		"auth":             newAuthMiddleware,
+		"security-headers": newSecurityHeadersMiddleware,
+	}
+)
+
+// RegisterMiddleware makes a middleware available under name to the
+// Config.Middlewares list. It is meant to be called by embedders before
+// NewHandler to plug their own middlewares.
+func RegisterMiddleware(name string, factory MiddlewareFactory) {
+	middlewaresLock.Lock()
+	defer middlewaresLock.Unlock()
+	middlewares[name] = factory
+}
+
+// middlewareNames returns the middlewares listed in cfg.Middlewares. If
+// credentials are configured, the auth one is added after logging, or first,
+// when not listed, so they always protect the instance.
+func middlewareNames(cfg *Config) []string {
+	names := strings.Split(cfg.Middlewares, ",")
+	if cfg.Auth == "" && cfg.AuthFile == "" {
+		return names
+	}
+	at := 0
+	for i, name := range names {
+		switch strings.TrimSpace(name) {
+		case "auth":
+			return names
+		case "logging":
+			at = i + 1
+		}
+	}
+	return append(names[:at:at], append([]string{"auth"}, names[at:]...)...)
+}
+
+// adminMiddlewares are the middlewares also wrapping the admin API when
+// listed. The others, like auth or limits, do not apply to it as it checks
+// its own credentials.
+var adminMiddlewares = map[string]bool{
+	"logging":          true,
+	"security-headers": true,
+}
+
+// buildMiddlewares wraps h with the middlewares listed in cfg.Middlewares, the
+// first one being the outermost.
+func buildMiddlewares(cfg *Config, h http.Handler) (http.Handler, error) {
+	return wrapMiddlewares(cfg, middlewareNames(cfg), h)
+}
+
+// buildAdminMiddlewares wraps the admin API h with the middlewares listed in
+// cfg.Middlewares which are adminMiddlewares, in the same order.
+func buildAdminMiddlewares(cfg *Config, h http.Handler) (http.Handler, error) {
+	names := []string{}
+	for _, name := range strings.Split(cfg.Middlewares, ",") {
+		if adminMiddlewares[strings.TrimSpace(name)] {
+			names = append(names, name)
+		}
+	}
+	return wrapMiddlewares(cfg, names, h)
+}
+
+// wrapMiddlewares wraps h with the middlewares names, the first one being the
+// outermost.
+func wrapMiddlewares(cfg *Config, names []string, h http.Handler) (http.Handler, error) {
+	for i := len(names) - 1; i >= 0; i-- {
+		name := strings.TrimSpace(names[i])
+		if name == "" {
+			continue
+		}
+		middlewaresLock.Lock()
+		factory, ok := middlewares[name]
+		middlewaresLock.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("unknown middleware: %s", name)
+		}
+		m, err := factory(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("could not create %s middleware: %s", name, err)
+		}
+		h = m(h)
+	}
+	return h, nil
+}
+
+// statusWriter records the status code and body size written by a handler.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = 200
+	}
+	n, err := w.ResponseWriter.Write(data)
+	w.size += int64(n)
+	return n, err
+}
+
+// Flush lets streaming handlers flush through the writer.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets WebSocket handlers take over the connection, recording it as a
+// protocol switch.
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("connection cannot be hijacked")
+	}
+	conn, rw, err := h.Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// newLoggingMiddleware logs an access record per request, with its method,
+// path, status code, response size, duration and client address.
+func newLoggingMiddleware(cfg *Config) (Middleware, error) {
+	proxies, err := parseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			sw := &statusWriter{ResponseWriter: w}
+			h.ServeHTTP(sw, r)
+			status := sw.status
+			if status == 0 {
+				status = 200
+			}
+			slog.Info("request", "method", r.Method, "path", r.URL.Path,
+				"status", status, "bytes", sw.size, "duration", time.Since(start),
+				"ip", proxies.clientIP(r), "remote_addr", r.RemoteAddr)
+		})
+	}, nil
+}
+
+// newLimitsMiddleware rejects request bodies larger than the maximum image
+// size.
+func newLimitsMiddleware(cfg *Config) (Middleware, error) {
+	maxImgSize, err := humanize.ParseBytes(cfg.MaxImageSize)
+	if err != nil {
+		return nil, err
+	}
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > int64(maxImgSize) {
+				http.Error(w, "request body too large",
+					http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, int64(maxImgSize))
+			h.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+// newAuthMiddleware requires HTTP basic authentication with cfg.Auth
+// "user:password" credentials.
+func newAuthMiddleware(cfg *Config) (Middleware, error) {
+	if cfg.Auth == "" && cfg.AuthFile == "" {
+		return nil, fmt.Errorf("auth credentials or file are required")
+	}
+	if cfg.Auth != "" && !strings.Contains(cfg.Auth, ":") {
+		return nil, fmt.Errorf("auth credentials must be like user:password")
+	}
+	var users *htpasswd
+	if cfg.AuthFile != "" {
+		var err error
+		users, err = openHtpasswd(cfg.AuthFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// valid reports whether credentials match -auth or -auth-file
+	valid := func(user, password string) bool {
+		if cfg.Auth != "" && subtle.ConstantTimeCompare([]byte(user+":"+password),
+			[]byte(cfg.Auth)) == 1 {
+			return true
+		}
+		return users != nil && users.Check(user, password)
+	}
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, password, ok := r.BasicAuth()
+			if !ok || !valid(user, password) {
+				w.Header().Set("WWW-Authenticate", `Basic realm="gribouillis"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+func newSecurityHeadersMiddleware(cfg *Config) (Middleware, error) {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header := w.Header()
+			header.Set("X-Content-Type-Options", "nosniff")
+			header.Set("X-Frame-Options", "SAMEORIGIN")
+			header.Set("Referrer-Policy", "same-origin")
+			h.ServeHTTP(w, r)
+		})
+	}, nil
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMiddlewares(t *testing.T) {
+	trace := ""
+	tracer := func(name string) MiddlewareFactory {
+		return func(cfg *Config) (Middleware, error) {
+			return func(h http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					trace += name
+					h.ServeHTTP(w, r)
+				})
+			}, nil
+		}
+	}
+	RegisterMiddleware("test-a", tracer("a"))
+	RegisterMiddleware("test-b", tracer("b"))
+	cfg := &Config{
+		Middlewares: "test-b, auth,test-a",
+		Auth:        "user:secret",
+	}
+	h, err := buildMiddlewares(cfg, http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			trace += "h"
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(user, password string, code int, wanted string) {
+		trace = ""
+		r := httptest.NewRequest("GET", "/", nil)
+		r.SetBasicAuth(user, password)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != code || trace != wanted {
+			t.Fatalf("expected %d and %q, got %d and %q", code, wanted, w.Code,
+				trace)
+		}
+	}
+	check("user", "secret", 200, "bah")
+	check("user", "wrong", 401, "b")
+
+	// Credentials enable the auth middleware when not listed
+	cfg.Middlewares = "test-b,logging,test-a"
+	names := middlewareNames(cfg)
+	if len(names) != 4 || names[2] != "auth" || names[3] != "test-a" {
+		t.Fatalf("unexpected middlewares: %q", names)
+	}
+	cfg.Middlewares = "test-b"
+	if names := middlewareNames(cfg); len(names) != 2 || names[0] != "auth" {
+		t.Fatalf("unexpected middlewares: %q", names)
+	}
+
+	// The admin API keeps logging and security headers only
+	cfg.Middlewares = "test-b,logging,auth,security-headers"
+	trace = ""
+	admin, err := buildAdminMiddlewares(cfg, http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			trace += "h"
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("GET", "/admin/stats", nil))
+	if w.Code != 200 || trace != "h" || w.Header().Get("X-Frame-Options") == "" {
+		t.Fatalf("unexpected admin middlewares: %d %q %v", w.Code, trace, w.Header())
+	}
+
+	cfg.Middlewares = "unknown"
+	_, err = buildMiddlewares(cfg, h)
+	if err == nil {
+		t.Fatal("unknown middleware did not fail")
+	}
+}
+
+func TestLoggingMiddleware(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logHandler, err := NewLogHandler(buf, "info", "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Restore the log package output, redirected by slog.SetDefault
+	logger, out, flags := slog.Default(), log.Writer(), log.Flags()
+	defer func() {
+		slog.SetDefault(logger)
+		log.SetOutput(out)
+		log.SetFlags(flags)
+	}()
+	slog.SetDefault(slog.New(logHandler))
+
+	m, err := newLoggingMiddleware(&Config{TrustedProxies: "192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := m(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("hello"))
+	}))
+	r := httptest.NewRequest("GET", "/saved/a.png", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.7")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	record := map[string]interface{}{}
+	err = json.Unmarshal(buf.Bytes(), &record)
+	if err != nil {
+		t.Fatalf("could not parse %q: %s", buf.String(), err)
+	}
+	if record["method"] != "GET" || record["path"] != "/saved/a.png" ||
+		record["status"] != 418.0 || record["bytes"] != 5.0 ||
+		record["ip"] != "198.51.100.7" || record["remote_addr"] != "192.0.2.1:1234" {
+		t.Fatalf("unexpected access record: %v", record)
+	}
+	if _, ok := record["duration"]; !ok {
+		t.Fatal("duration is missing")
+	}
+}
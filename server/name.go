@@ -0,0 +1,149 @@
+package server
+
+import (
+	"crypto/rand"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// drawingIDRe matches drawing identifiers, their file names without the
+// ".png" extension.
+var drawingIDRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// namePatternRe matches the tokens of file name patterns.
+var namePatternRe = regexp.MustCompile(`\{[a-z0-9]+\}`)
+
+// checkNamePattern validates a stored file name pattern. Patterns combine
+// letters, digits, "-", "_" and the following tokens:
+//
+//   - {date}: UTC save date, as YYYYMMDD.
+//   - {time}: UTC save time, as HHMMSS.
+//   - {id}: 32 random hexadecimal digits.
+//   - {short}: 8 random hexadecimal digits.
+//   - {ulid}: ULID, sorting by creation time.
+//   - {uuid7}: UUIDv7, sorting by creation time.
+//   - {hash}: 32 hexadecimal digits of the SHA-256 of the stored image.
+//
+// They must contain {id}, {short}, {ulid}, {uuid7} or {hash} to generate
+// distinct names.
+func checkNamePattern(pattern string) error {
+	random := false
+	for _, t := range namePatternRe.FindAllString(pattern, -1) {
+		switch t {
+		case "{id}", "{short}", "{ulid}", "{uuid7}", "{hash}":
+			random = true
+		case "{date}", "{time}":
+		default:
+			return fmt.Errorf("unknown file name pattern token: %s", t)
+		}
+	}
+	if !random {
+		return fmt.Errorf(
+			"file name pattern must contain {id}, {short}, {ulid}, {uuid7} or {hash}: %s",
+			pattern)
+	}
+	literal := namePatternRe.ReplaceAllString(pattern, "x")
+	if !drawingIDRe.MatchString(literal) {
+		return fmt.Errorf("invalid file name pattern: %s", pattern)
+	}
+	return nil
+}
+
+// defaultReservedNames lists drawing identifiers never allocated, as they
+// may clash with current or future routes.
+const defaultReservedNames = "admin,api,archive,d,drafts,g,pending,previews,room,saved"
+
+// parseReservedNames parses a comma separated list of reserved drawing
+// identifiers, compared case insensitively.
+func parseReservedNames(s string) map[string]bool {
+	reserved := map[string]bool{}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "" {
+			reserved[name] = true
+		}
+	}
+	return reserved
+}
+
+// crockford is the ULID base32 alphabet.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newULID returns a ULID made of now milliseconds and random bits.
+func newULID(now time.Time, random []byte) string {
+	// 48 bits timestamp followed by 80 random bits, encoded 5 bits at a
+	// time from the most significant ones, after 2 padding bits.
+	data := make([]byte, 16)
+	ms := uint64(now.UnixNano() / int64(time.Millisecond))
+	for i := 0; i < 6; i++ {
+		data[i] = byte(ms >> uint(40-8*i))
+	}
+	copy(data[6:], random[:10])
+	buf := make([]byte, 26)
+	for i := range buf {
+		// Bit offset of the character in the 130 bits padded value
+		bit := 5*i - 2
+		v := 0
+		for j := 0; j < 5; j++ {
+			b := bit + j
+			v <<= 1
+			if b >= 0 && data[b/8]&(0x80>>uint(b%8)) != 0 {
+				v |= 1
+			}
+		}
+		buf[i] = crockford[v]
+	}
+	return string(buf)
+}
+
+// newUUIDv7 returns a UUIDv7 made of now milliseconds and random bits.
+func newUUIDv7(now time.Time, random []byte) string {
+	data := make([]byte, 16)
+	ms := uint64(now.UnixNano() / int64(time.Millisecond))
+	for i := 0; i < 6; i++ {
+		data[i] = byte(ms >> uint(40-8*i))
+	}
+	copy(data[6:], random[:10])
+	data[6] = 0x70 | data[6]&0x0f
+	data[8] = 0x80 | data[8]&0x3f
+	return fmt.Sprintf("%x-%x-%x-%x-%x", data[:4], data[4:6], data[6:8],
+		data[8:10], data[10:])
+}
+
+// contentAddressed reports whether pattern names drawings after their
+// content, without random tokens, so identical drawings get the same name,
+// unless saved at different {date} or {time}.
+func contentAddressed(pattern string) bool {
+	if !strings.Contains(pattern, "{hash}") {
+		return false
+	}
+	for _, t := range []string{"{id}", "{short}", "{ulid}", "{uuid7}"} {
+		if strings.Contains(pattern, t) {
+			return false
+		}
+	}
+	return true
+}
+
+// drawingName returns a new drawing file name following pattern, saved at
+// now with content hash, in hexadecimal.
+func drawingName(pattern string, now time.Time, hash string) (string, error) {
+	buf := make([]byte, 16)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	id := fmt.Sprintf("%x", buf)
+	r := strings.NewReplacer(
+		"{date}", now.UTC().Format("20060102"),
+		"{time}", now.UTC().Format("150405"),
+		"{id}", id,
+		"{short}", id[:8],
+		"{ulid}", newULID(now, buf),
+		"{uuid7}", newUUIDv7(now, buf),
+		"{hash}", hash,
+	)
+	return r.Replace(pattern) + ".png", nil
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestNamePattern(t *testing.T) {
+	for _, p := range []string{"{id}", "{date}-{time}-{short}", "draw_{id}",
+		"{ulid}", "{uuid7}", "{hash}"} {
+		if err := checkNamePattern(p); err != nil {
+			t.Errorf("%q: unexpected error: %s", p, err)
+		}
+	}
+	for _, p := range []string{"", "{date}", "{room}-{id}", "../{id}",
+		".{id}", "{id}.jpg", "a b{id}"} {
+		if err := checkNamePattern(p); err == nil {
+			t.Errorf("%q: invalid pattern was accepted", p)
+		}
+	}
+
+	now := time.Date(2024, 3, 1, 15, 4, 5, 0, time.FixedZone("", 3600))
+	name, err := drawingName("{date}-{time}-{short}", now, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^20240301-140405-[0-9a-f]{8}\.png$`).MatchString(name) {
+		t.Fatalf("unexpected name: %s", name)
+	}
+	name, err = drawingName("{id}", now, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^[0-9a-f]{32}\.png$`).MatchString(name) {
+		t.Fatalf("unexpected name: %s", name)
+	}
+	name, err = drawingName("{date}-{hash}", now, "0123abcd")
+	if err != nil || name != "20240301-0123abcd.png" {
+		t.Fatalf("unexpected name: %s, %v", name, err)
+	}
+	if !contentAddressed("{date}-{hash}") || contentAddressed("{hash}-{short}") ||
+		contentAddressed("{id}") {
+		t.Fatal("unexpected content addressed patterns")
+	}
+}
+
+func TestSortableIdentifiers(t *testing.T) {
+	random := make([]byte, 16)
+	for i := range random {
+		random[i] = 0xff
+	}
+	// Reference ULID from the specification examples
+	now := time.Unix(1469918176, 385*int64(time.Millisecond))
+	if id := newULID(now, random); id != "01ARYZ6S41ZZZZZZZZZZZZZZZZ" {
+		t.Fatalf("unexpected ULID: %s", id)
+	}
+	id := newUUIDv7(now, random)
+	if !regexp.MustCompile(`^01563df3-6481-7fff-bfff-ffffffffffff$`).MatchString(id) {
+		t.Fatalf("unexpected UUIDv7: %s", id)
+	}
+
+	zero := make([]byte, 16)
+	earlier, later := now, now.Add(time.Millisecond)
+	if newULID(earlier, random) >= newULID(later, zero) ||
+		newUUIDv7(earlier, random) >= newUUIDv7(later, zero) {
+		t.Fatal("identifiers do not sort by creation time")
+	}
+}
+
+func TestSaveSkipsTakenNames(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "gribouillis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	refused := []string{}
+	opts := &saveOptions{
+		maxImgSize:  1 << 20,
+		namePattern: "{id}",
+		taken: func(name string) bool {
+			if len(refused) < 3 {
+				refused = append(refused, name)
+				return true
+			}
+			return false
+		},
+	}
+	post := func() (string, error) {
+		r := httptest.NewRequest("POST", "/api/v1/drawings",
+			bytes.NewReader(encodeTestImage(t, 10, 10)))
+		return save(tmpDir, opts, r)
+	}
+	name, err := post()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refused) != 3 || name == refused[2] {
+		t.Fatalf("taken names were not skipped: %s, %q", name, refused)
+	}
+	opts.taken = func(name string) bool { return true }
+	if _, err := post(); err == nil {
+		t.Fatal("expected an error when no name is free")
+	}
+	entries, err := ioutil.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 file, got %d", len(entries))
+	}
+}
+
+func TestReservedNames(t *testing.T) {
+	reserved := parseReservedNames(" Admin, api,,")
+	if len(reserved) != 2 || !reserved["admin"] || !reserved["api"] {
+		t.Fatalf("unexpected reserved names: %v", reserved)
+	}
+}
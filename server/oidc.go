@@ -0,0 +1,503 @@
+package server
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// oidcSessionCookie holds the signed session of logged in
+	// administrators, and oidcLoginCookie the state of a login in progress.
+	oidcSessionCookie = "gribouillis_admin"
+	oidcLoginCookie   = "gribouillis_login"
+	// oidcSessionTTL is the lifetime of administrators sessions.
+	oidcSessionTTL = 12 * time.Hour
+	// oidcLoginTTL bounds the time spent on the provider login page.
+	oidcLoginTTL = 10 * time.Minute
+)
+
+// oidcDiscovery is the subset of the provider configuration document used by
+// the authorization code flow.
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcLogin is the state of a login in progress, kept in a signed cookie.
+type oidcLogin struct {
+	State    string    `json:"state"`
+	Nonce    string    `json:"nonce"`
+	Verifier string    `json:"verifier"`
+	Expires  time.Time `json:"expires"`
+}
+
+// oidcSession identifies a logged in administrator, kept in a signed cookie.
+type oidcSession struct {
+	Email   string    `json:"email"`
+	Expires time.Time `json:"expires"`
+}
+
+// oidcClaims are the ID token claims checked at login.
+type oidcClaims struct {
+	Issuer        string          `json:"iss"`
+	Audience      json.RawMessage `json:"aud"`
+	Expires       int64           `json:"exp"`
+	Nonce         string          `json:"nonce"`
+	Email         string          `json:"email"`
+	EmailVerified *bool           `json:"email_verified"`
+}
+
+// oidcProvider logs administrators in with an OpenID Connect provider,
+// using the authorization code flow with PKCE. Only administrators whose
+// email address is listed in admins, or belongs to a listed "@domain", are
+// accepted. The provider configuration and keys are fetched on first use.
+type oidcProvider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	// base is the public URL of the instance, where the admin pages live
+	base   *url.URL
+	admins []string
+	client *http.Client
+	// key signs the session cookies
+	key []byte
+
+	lock      sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]*rsa.PublicKey
+}
+
+// newOIDCProvider returns a provider for issuer, whose users listed in the
+// comma separated admins can administrate the instance at publicURL.
+func newOIDCProvider(issuer, clientID, clientSecret, publicURL, admins string) (*oidcProvider, error) {
+	if clientID == "" || clientSecret == "" {
+		return nil, fmt.Errorf("OpenID Connect requires a client identifier and secret")
+	}
+	base, err := url.Parse(strings.TrimRight(publicURL, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme != "http" && base.Scheme != "https" || base.Host == "" {
+		return nil, fmt.Errorf("OpenID Connect requires a public URL")
+	}
+	p := &oidcProvider{
+		issuer:       strings.TrimRight(issuer, "/"),
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		base:         base,
+		client:       &http.Client{Timeout: 30 * time.Second},
+	}
+	for _, a := range strings.Split(admins, ",") {
+		a = strings.ToLower(strings.TrimSpace(a))
+		if a != "" {
+			p.admins = append(p.admins, a)
+		}
+	}
+	if len(p.admins) == 0 {
+		return nil, fmt.Errorf("OpenID Connect requires administrators emails or domains")
+	}
+	// Sessions survive restarts and are shared by instances with the same
+	// client secret.
+	h := hmac.New(sha256.New, []byte(clientSecret))
+	h.Write([]byte("gribouillis admin session " + clientID))
+	p.key = h.Sum(nil)
+	return p, nil
+}
+
+// path returns the public path of admin page name.
+func (p *oidcProvider) path(name string) string {
+	return p.base.Path + adminPrefix + "/" + name
+}
+
+// redirectURL returns the URL the provider redirects to after login.
+func (p *oidcProvider) redirectURL() string {
+	return p.base.String() + adminPrefix + "/oidc/callback"
+}
+
+// getJSON fetches u and decodes its JSON content in v.
+func (p *oidcProvider) getJSON(u string, v interface{}) error {
+	rsp, err := p.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != 200 {
+		return fmt.Errorf("could not fetch %s: %s", u, rsp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(rsp.Body, 1<<20)).Decode(v)
+}
+
+// discover returns the provider configuration, fetching it once.
+func (p *oidcProvider) discover() (*oidcDiscovery, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	d := &oidcDiscovery{}
+	err := p.getJSON(p.issuer+"/.well-known/openid-configuration", d)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimRight(d.Issuer, "/") != p.issuer {
+		return nil, fmt.Errorf("provider issuer %q does not match %q", d.Issuer, p.issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, fmt.Errorf("incomplete provider configuration")
+	}
+	p.discovery = d
+	return d, nil
+}
+
+// publicKey returns the provider RSA key kid, refetching the key set if it
+// is unknown, as providers rotate them.
+func (p *oidcProvider) publicKey(d *oidcDiscovery, kid string) (*rsa.PublicKey, error) {
+	p.lock.Lock()
+	key, ok := p.keys[kid]
+	p.lock.Unlock()
+	if ok {
+		return key, nil
+	}
+	set := struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}{}
+	err := p.getJSON(d.JWKSURI, &set)
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) > 4 {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	p.lock.Lock()
+	p.keys = keys
+	p.lock.Unlock()
+	key, ok = keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown provider key: %q", kid)
+	}
+	return key, nil
+}
+
+// verifyIDToken checks the signature and claims of ID token raw and returns
+// its claims. Only RS256 signatures are supported.
+func (p *oidcProvider) verifyIDToken(d *oidcDiscovery, raw, nonce string, now time.Time) (*oidcClaims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed ID token")
+	}
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err == nil {
+		err = json.Unmarshal(data, &header)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("malformed ID token header")
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported ID token algorithm: %q", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed ID token signature")
+	}
+	key, err := p.publicKey(d, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	err = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token signature")
+	}
+	claims := &oidcClaims{}
+	data, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err == nil {
+		err = json.Unmarshal(data, claims)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("malformed ID token claims")
+	}
+	if strings.TrimRight(claims.Issuer, "/") != p.issuer {
+		return nil, fmt.Errorf("unexpected ID token issuer: %q", claims.Issuer)
+	}
+	audiences := []string{}
+	if json.Unmarshal(claims.Audience, &audiences) != nil {
+		audiences = []string{""}
+		json.Unmarshal(claims.Audience, &audiences[0])
+	}
+	if !containsString(audiences, p.clientID) {
+		return nil, fmt.Errorf("ID token is not meant for this client")
+	}
+	// Allow for some clock skew
+	if now.After(time.Unix(claims.Expires, 0).Add(time.Minute)) {
+		return nil, fmt.Errorf("ID token expired")
+	}
+	if !hmac.Equal([]byte(claims.Nonce), []byte(nonce)) {
+		return nil, fmt.Errorf("invalid ID token nonce")
+	}
+	if claims.EmailVerified != nil && !*claims.EmailVerified {
+		return nil, fmt.Errorf("email address is not verified")
+	}
+	return claims, nil
+}
+
+// allowed reports whether the user with email is an administrator.
+func (p *oidcProvider) allowed(email string) bool {
+	email = strings.ToLower(email)
+	at := strings.LastIndex(email, "@")
+	if at <= 0 {
+		return false
+	}
+	for _, a := range p.admins {
+		if a == email || strings.HasPrefix(a, "@") && a == email[at:] {
+			return true
+		}
+	}
+	return false
+}
+
+// setCookie sets cookie name to v, signed, until expires.
+func (p *oidcProvider) setCookie(w http.ResponseWriter, name string, v interface{}, expires time.Time) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	h := hmac.New(sha256.New, p.key)
+	h.Write([]byte(name + "=" + payload))
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    payload + "." + base64.RawURLEncoding.EncodeToString(h.Sum(nil)),
+		Path:     p.path(""),
+		Expires:  expires,
+		Secure:   p.base.Scheme == "https",
+		HttpOnly: true,
+		// Lax cookies come back from the provider redirection but not
+		// with cross-site API calls.
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// readCookie decodes cookie name of r in v, if its signature is valid.
+func (p *oidcProvider) readCookie(r *http.Request, name string, v interface{}) bool {
+	c, err := r.Cookie(name)
+	if err != nil {
+		return false
+	}
+	parts := strings.Split(c.Value, ".")
+	if len(parts) != 2 {
+		return false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	h := hmac.New(sha256.New, p.key)
+	h.Write([]byte(name + "=" + parts[0]))
+	if !hmac.Equal(sig, h.Sum(nil)) {
+		return false
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	return err == nil && json.Unmarshal(data, v) == nil
+}
+
+// clearCookie removes cookie name.
+func (p *oidcProvider) clearCookie(w http.ResponseWriter, name string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Path:     p.path(""),
+		MaxAge:   -1,
+		Secure:   p.base.Scheme == "https",
+		HttpOnly: true,
+	})
+}
+
+// Session returns the email of the administrator logged in with r, if any.
+func (p *oidcProvider) Session(r *http.Request) (string, bool) {
+	s := &oidcSession{}
+	if !p.readCookie(r, oidcSessionCookie, s) || time.Now().After(s.Expires) {
+		return "", false
+	}
+	return s.Email, true
+}
+
+// randomString returns a random URL safe string.
+func randomString() (string, error) {
+	buf := make([]byte, 24)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// Login redirects to the provider login page.
+func (p *oidcProvider) Login(w http.ResponseWriter, r *http.Request) {
+	d, err := p.discover()
+	if err != nil {
+		slog.Error("could not discover OpenID provider", "err", err)
+		http.Error(w, "identity provider is unavailable", http.StatusBadGateway)
+		return
+	}
+	login := &oidcLogin{Expires: time.Now().Add(oidcLoginTTL)}
+	for _, s := range []*string{&login.State, &login.Nonce, &login.Verifier} {
+		*s, err = randomString()
+		if err != nil {
+			http.Error(w, "could not start login", 500)
+			return
+		}
+	}
+	err = p.setCookie(w, oidcLoginCookie, login, login.Expires)
+	if err != nil {
+		http.Error(w, "could not start login", 500)
+		return
+	}
+	challenge := sha256.Sum256([]byte(login.Verifier))
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", p.clientID)
+	q.Set("redirect_uri", p.redirectURL())
+	q.Set("scope", "openid email")
+	q.Set("state", login.State)
+	q.Set("nonce", login.Nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, d.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+}
+
+// exchange trades the authorization code for an ID token.
+func (p *oidcProvider) exchange(d *oidcDiscovery, code, verifier string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.redirectURL())
+	form.Set("code_verifier", verifier)
+	req, err := http.NewRequest("POST", d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.clientID), url.QueryEscape(p.clientSecret))
+	rsp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != 200 {
+		return "", fmt.Errorf("token request failed: %s", rsp.Status)
+	}
+	tokens := struct {
+		IDToken string `json:"id_token"`
+	}{}
+	err = json.NewDecoder(io.LimitReader(rsp.Body, 1<<20)).Decode(&tokens)
+	if err != nil {
+		return "", err
+	}
+	if tokens.IDToken == "" {
+		return "", fmt.Errorf("token response has no ID token")
+	}
+	return tokens.IDToken, nil
+}
+
+// Callback completes the login, when the provider redirects back, and opens
+// a session if the user is an administrator.
+func (p *oidcProvider) Callback(w http.ResponseWriter, r *http.Request) {
+	login := &oidcLogin{}
+	q := r.URL.Query()
+	if !p.readCookie(r, oidcLoginCookie, login) || time.Now().After(login.Expires) ||
+		!hmac.Equal([]byte(q.Get("state")), []byte(login.State)) {
+		http.Error(w, "invalid or expired login, try again", http.StatusBadRequest)
+		return
+	}
+	p.clearCookie(w, oidcLoginCookie)
+	if e := q.Get("error"); e != "" {
+		http.Error(w, "login failed: "+e, http.StatusForbidden)
+		return
+	}
+	d, err := p.discover()
+	if err != nil {
+		slog.Error("could not discover OpenID provider", "err", err)
+		http.Error(w, "identity provider is unavailable", http.StatusBadGateway)
+		return
+	}
+	raw, err := p.exchange(d, q.Get("code"), login.Verifier)
+	if err != nil {
+		slog.Warn("could not exchange authorization code", "err", err)
+		http.Error(w, "login failed", http.StatusBadGateway)
+		return
+	}
+	claims, err := p.verifyIDToken(d, raw, login.Nonce, time.Now())
+	if err != nil {
+		slog.Warn("invalid ID token", "err", err)
+		http.Error(w, "login failed", http.StatusForbidden)
+		return
+	}
+	if !p.allowed(claims.Email) {
+		slog.Warn("refused admin login", "email", claims.Email)
+		http.Error(w, "you are not an administrator", http.StatusForbidden)
+		return
+	}
+	s := &oidcSession{Email: claims.Email, Expires: time.Now().Add(oidcSessionTTL)}
+	err = p.setCookie(w, oidcSessionCookie, s, s.Expires)
+	if err != nil {
+		http.Error(w, "could not open session", 500)
+		return
+	}
+	slog.Info("admin logged in", "email", claims.Email)
+	http.Redirect(w, r, p.path(""), http.StatusFound)
+}
+
+// Logout closes the session.
+func (p *oidcProvider) Logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p.clearCookie(w, oidcSessionCookie)
+	http.Redirect(w, r, p.base.String()+"/", http.StatusSeeOther)
+}
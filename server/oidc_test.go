@@ -0,0 +1,183 @@
+package server
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeOIDC is an OpenID Connect provider logging in email with the code it
+// issues.
+type fakeOIDC struct {
+	t     *testing.T
+	url   string
+	key   *rsa.PrivateKey
+	email string
+	// nonces maps issued codes to their login nonce and PKCE challenge
+	nonces     map[string]string
+	challenges map[string]string
+}
+
+func (f *fakeOIDC) idToken(nonce string) string {
+	enc := base64.RawURLEncoding
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "k1"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":            f.url,
+		"aud":            []string{"gribouillis"},
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"nonce":          nonce,
+		"email":          f.email,
+		"email_verified": true,
+	})
+	signed := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, f.key, crypto.SHA256, digest[:])
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return signed + "." + enc.EncodeToString(sig)
+}
+
+func (f *fakeOIDC) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/.well-known/openid-configuration":
+		json.NewEncoder(w).Encode(&oidcDiscovery{
+			Issuer:                f.url,
+			AuthorizationEndpoint: f.url + "/authorize",
+			TokenEndpoint:         f.url + "/token",
+			JWKSURI:               f.url + "/keys",
+		})
+	case "/keys":
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kid": "k1",
+				"kty": "RSA",
+				"n":   base64.RawURLEncoding.EncodeToString(f.key.N.Bytes()),
+				"e": base64.RawURLEncoding.EncodeToString(
+					big.NewInt(int64(f.key.E)).Bytes()),
+			}},
+		})
+	case "/token":
+		id, secret, _ := r.BasicAuth()
+		code := r.FormValue("code")
+		challenge := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if id != "gribouillis" || secret != "secret" || f.nonces[code] == "" ||
+			base64.RawURLEncoding.EncodeToString(challenge[:]) != f.challenges[code] {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": f.idToken(f.nonces[code])})
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+func TestOIDCLogin(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := &fakeOIDC{
+		t:          t,
+		key:        key,
+		nonces:     map[string]string{},
+		challenges: map[string]string{},
+	}
+	idp := httptest.NewServer(provider)
+	defer idp.Close()
+	provider.url = idp.URL
+
+	cfg, cleanup := newTestConfig(t)
+	defer cleanup()
+	cfg.PublicURL = "http://draw.example.com/draw"
+	cfg.BaseURL = "/draw"
+	cfg.OIDCIssuer = idp.URL
+	cfg.OIDCClientID = "gribouillis"
+	cfg.OIDCClientSecret = "secret"
+	cfg.OIDCAdmins = "bob@example.com,@school.example"
+	h, err := NewHandler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	serve := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	// login runs the login flow as email and returns the session cookie,
+	// if any, and the callback status code.
+	login := func(email string) (*http.Cookie, int) {
+		t.Helper()
+		provider.email = email
+		w := serve(httptest.NewRequest("GET", "/draw/admin/", nil))
+		if w.Code != http.StatusFound || w.Header().Get("Location") != "/draw/admin/login" {
+			t.Fatalf("anonymous users are not sent to login: %d", w.Code)
+		}
+		w = serve(httptest.NewRequest("GET", "/draw/admin/login", nil))
+		auth, err := url.Parse(w.Header().Get("Location"))
+		if err != nil || !strings.HasPrefix(auth.String(), idp.URL+"/authorize?") {
+			t.Fatalf("unexpected login redirection: %s", auth)
+		}
+		q := auth.Query()
+		if q.Get("redirect_uri") != "http://draw.example.com/draw/admin/oidc/callback" {
+			t.Fatalf("unexpected redirect URI: %s", q.Get("redirect_uri"))
+		}
+		provider.nonces["code-"+email] = q.Get("nonce")
+		provider.challenges["code-"+email] = q.Get("code_challenge")
+		r := httptest.NewRequest("GET", "/draw/admin/oidc/callback?code=code-"+email+
+			"&state="+url.QueryEscape(q.Get("state")), nil)
+		for _, c := range w.Result().Cookies() {
+			r.AddCookie(c)
+		}
+		w = serve(r)
+		for _, c := range w.Result().Cookies() {
+			if c.Name == oidcSessionCookie {
+				return c, w.Code
+			}
+		}
+		return nil, w.Code
+	}
+	if c, code := login("mallory@example.com"); c != nil || code != http.StatusForbidden {
+		t.Fatalf("non administrator logged in: %d", code)
+	}
+	session, code := login("alice@school.example")
+	if session == nil || code != http.StatusFound || session.Path != "/draw/admin/" {
+		t.Fatalf("administrator could not log in: %d, %v", code, session)
+	}
+
+	r := httptest.NewRequest("GET", "/draw/admin/stats", nil)
+	if w := serve(r); w.Code != http.StatusUnauthorized {
+		t.Fatalf("admin API is not protected: %d", w.Code)
+	}
+	r.AddCookie(session)
+	if w := serve(r); w.Code != 200 {
+		t.Fatalf("administrator cannot use the admin API: %d", w.Code)
+	}
+	r = httptest.NewRequest("GET", "/draw/admin/", nil)
+	r.AddCookie(session)
+	if w := serve(r); w.Code != 200 || !strings.Contains(w.Body.String(), "alice@school.example") {
+		t.Fatalf("unexpected moderation page: %d\n%s", w.Code, w.Body.String())
+	}
+	forged := *session
+	forged.Value = strings.Replace(forged.Value, "a", "b", 1)
+	r = httptest.NewRequest("GET", "/draw/admin/stats", nil)
+	r.AddCookie(&forged)
+	if w := serve(r); w.Code != http.StatusUnauthorized {
+		t.Fatalf("forged session was accepted: %d", w.Code)
+	}
+	// Drawing stays anonymous
+	if w := serve(httptest.NewRequest("GET", "/draw/", nil)); w.Code != 200 {
+		t.Fatalf("frontend requires login: %d", w.Code)
+	}
+}
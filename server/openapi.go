@@ -0,0 +1,235 @@
+package server
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// jsonSchema returns the JSON schema of values of type t, as serialized by
+// encoding/json.
+func jsonSchema(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return jsonSchema(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{
+			"type":  "array",
+			"items": jsonSchema(t.Elem()),
+		}
+	case reflect.Map:
+		return map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": jsonSchema(t.Elem()),
+		}
+	case reflect.Struct:
+		if t.String() == "time.Time" {
+			return map[string]interface{}{"type": "string", "format": "date-time"}
+		}
+		props := map[string]interface{}{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			name := f.Name
+			tag := strings.Split(f.Tag.Get("json"), ",")
+			if tag[0] == "-" {
+				continue
+			}
+			if tag[0] != "" {
+				name = tag[0]
+			}
+			props[name] = jsonSchema(f.Type)
+		}
+		return map[string]interface{}{
+			"type":       "object",
+			"properties": props,
+		}
+	}
+	return map[string]interface{}{}
+}
+
+// openAPISpec returns the OpenAPI 3 specification of routes, served under
+// apiURL.
+func openAPISpec(routes []*apiRoute, apiURL string) map[string]interface{} {
+	errorResponse := map[string]interface{}{
+		"description": "Error",
+		"content": map[string]interface{}{
+			"application/json": map[string]interface{}{
+				"schema": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"error": map[string]interface{}{"type": "string"},
+					},
+				},
+			},
+		},
+	}
+	paths := map[string]interface{}{}
+	for _, route := range routes {
+		content := map[string]interface{}{}
+		responseType := route.ResponseType
+		if responseType == "" {
+			responseType = "application/json"
+		}
+		if route.Response != nil {
+			content[responseType] = map[string]interface{}{
+				"schema": jsonSchema(reflect.TypeOf(route.Response)),
+			}
+		} else {
+			content[responseType] = map[string]interface{}{}
+		}
+		op := map[string]interface{}{
+			"summary": route.Summary,
+			"responses": map[string]interface{}{
+				"200": map[string]interface{}{
+					"description": "Success",
+					"content":     content,
+				},
+				"default": errorResponse,
+			},
+		}
+		if route.Feature != "" {
+			op["tags"] = []string{route.Feature}
+		}
+		if route.Request != "" {
+			op["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					route.Request: map[string]interface{}{},
+				},
+			}
+		}
+		params := []interface{}{}
+		for _, p := range strings.Split(route.Path, "/") {
+			if strings.HasPrefix(p, "{") && strings.HasSuffix(p, "}") {
+				params = append(params, map[string]interface{}{
+					"name":     p[1 : len(p)-1],
+					"in":       "path",
+					"required": true,
+					"schema":   map[string]interface{}{"type": "string"},
+				})
+			}
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+		item, ok := paths[route.Path].(map[string]interface{})
+		if !ok {
+			item = map[string]interface{}{}
+			paths[route.Path] = item
+		}
+		item[strings.ToLower(route.Method)] = op
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "gribouillis",
+			"version": "1",
+		},
+		"servers": []interface{}{
+			map[string]interface{}{"url": apiURL},
+		},
+		"paths": paths,
+	}
+}
+
+// openAPIRoutes returns the routes serving the OpenAPI specification of
+// routes and an explorer page to browse and call them.
+func openAPIRoutes(routes []*apiRoute) []*apiRoute {
+	specRoute := &apiRoute{
+		Method:  "GET",
+		Path:    "/openapi.json",
+		Summary: "OpenAPI specification of this API",
+		Feature: "openapi",
+	}
+	explorerRoute := &apiRoute{
+		Method:       "GET",
+		Path:         "/explorer",
+		Summary:      "Interactive API explorer",
+		Feature:      "openapi",
+		ResponseType: "text/html",
+		Handler: func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte(explorerPage))
+		},
+	}
+	all := append(append([]*apiRoute{}, routes...), specRoute, explorerRoute)
+	specRoute.Handler = func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, 200, openAPISpec(all, mountPrefix(r)+apiPrefix))
+	}
+	return []*apiRoute{specRoute, explorerRoute}
+}
+
+// explorerPage lists the endpoints of openapi.json and lets the user call
+// them from the browser.
+const explorerPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>gribouillis API explorer</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+.route { border: 1px solid #ccc; margin: 1em 0; padding: 0.5em 1em; }
+.method { font-weight: bold; display: inline-block; width: 5em; }
+pre { background: #f4f4f4; padding: 0.5em; overflow: auto; }
+</style>
+</head>
+<body>
+<h1>gribouillis API explorer</h1>
+<div id="routes"></div>
+<script>
+fetch('openapi.json').then(function(rsp) { return rsp.json(); }).then(function(spec) {
+  var base = spec.servers[0].url;
+  var root = document.getElementById('routes');
+  Object.keys(spec.paths).sort().forEach(function(path) {
+    Object.keys(spec.paths[path]).forEach(function(method) {
+      var op = spec.paths[path][method];
+      var div = document.createElement('div');
+      div.className = 'route';
+      div.innerHTML = '<div><span class="method"></span><code></code></div>' +
+        '<p></p><form><input type="text" size="60"> <button>Send</button></form>' +
+        '<pre hidden></pre>';
+      div.querySelector('.method').textContent = method.toUpperCase();
+      div.querySelector('code').textContent = path;
+      div.querySelector('p').textContent = op.summary;
+      var input = div.querySelector('input');
+      input.value = path;
+      var body = null;
+      if (op.requestBody) {
+        body = document.createElement('input');
+        body.type = 'file';
+        input.after(body);
+      }
+      var out = div.querySelector('pre');
+      div.querySelector('form').onsubmit = function(e) {
+        e.preventDefault();
+        var init = {method: method.toUpperCase()};
+        if (body && body.files.length) {
+          init.body = body.files[0];
+        }
+        fetch(base + input.value, init).then(function(rsp) {
+          return rsp.text().then(function(text) {
+            out.hidden = false;
+            out.textContent = rsp.status + ' ' + rsp.statusText + '\n\n' + text;
+          });
+        });
+      };
+      root.appendChild(div);
+    });
+  });
+});
+</script>
+</body>
+</html>
+`
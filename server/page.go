@@ -0,0 +1,245 @@
+package server
+
+import (
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// maxTitleLength is the maximum length in characters of drawings titles and
+// author names.
+const maxTitleLength = 100
+
+// parseCaption validates a drawing title or author name passed as query
+// parameter key.
+func parseCaption(key, s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if !utf8.ValidString(s) {
+		return "", fmt.Errorf("%s is not valid UTF-8", key)
+	}
+	if utf8.RuneCountInString(s) > maxTitleLength {
+		return "", fmt.Errorf("%s is longer than %d characters", key,
+			maxTitleLength)
+	}
+	for _, c := range s {
+		if c < ' ' || c == 0x7f {
+			return "", fmt.Errorf("%s contains control characters", key)
+		}
+	}
+	return s, nil
+}
+
+var drawingTemplate = template.Must(template.New("drawing").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{if .Title}}{{.Title}}{{else}}Drawing{{end}} - gribouillis</title>
+<meta property="og:type" content="website">
+<meta property="og:title" content="{{if .Title}}{{.Title}}{{else}}Drawing{{end}}">
+<meta property="og:image" content="{{.ImageURL}}">
+<style>
+body { font-family: sans-serif; max-width: 60em; margin: 1em auto; padding: 0 1em; }
+img { max-width: 100%; border: 1px solid #ddd; }
+textarea { width: 100%; font-family: monospace; }
+</style>
+</head>
+<body>
+<h1>{{if .Title}}{{.Title}}{{else}}Drawing{{end}}</h1>
+{{if not .ArchivedUntil.IsZero}}<p><strong>This drawing is archived</strong> and will be removed on <time datetime="{{.ArchivedUntil.Format "2006-01-02T15:04:05Z07:00"}}">{{.ArchivedUntil.Format "January 2, 2006"}}</time>.</p>
+{{end}}<p>{{if .Author}}By {{.Author}}, {{end}}<time datetime="{{.Date.Format "2006-01-02T15:04:05Z07:00"}}">{{.Date.Format "January 2, 2006 15:04"}}</time></p>
+<p><a href="{{.ImageURL}}"><img src="{{.DisplayURL}}" alt="{{.Title}}"></a></p>
+<p><a href="{{.ImagePath}}" download="{{.Name}}">Download</a>{{if .SVGPath}} - <a href="{{.SVGPath}}" download="{{.Name}}.svg">Download as SVG</a>{{end}}{{if .Static}} - <a href="{{.Base}}/index.html">Gallery</a>{{else}}{{if .Author}} - <a href="{{.Base}}/api/v1/sketchbook?author={{.Author}}">Sketchbook of {{.Author}}</a>{{end}}{{if .Room}} - <a href="{{.Base}}/api/v1/sketchbook?room={{.Room}}">Room sketchbook</a>{{end}} - <a href="{{.Base}}/">Draw your own</a>{{end}}</p>
+{{if .Reactions}}<p><button data-action="{{.Base}}/api/v1/drawings/{{.Name}}/like">Like ({{.Likes}})</button> <button data-action="{{.Base}}/api/v1/drawings/{{.Name}}/report" data-confirm="Report this drawing to the moderators?">Report</button></p>
+<script>
+for (const b of document.querySelectorAll("button[data-action]")) {
+  b.onclick = () => {
+    if (b.dataset.confirm && !confirm(b.dataset.confirm)) {
+      return;
+    }
+    b.disabled = true;
+    fetch(b.dataset.action, {method: "POST"}).then(r => {
+      if (!r.ok) {
+        throw new Error(r.statusText);
+      }
+      return r.status == 204 ? {} : r.json();
+    }).then(rsp => {
+      b.textContent = rsp.likes ? "Liked (" + rsp.likes + ")" : "Reported";
+    }, () => {
+      b.disabled = false;
+    });
+  };
+}
+</script>
+{{end}}{{if .PageURL}}<h2>Embed</h2>
+<p>HTML</p>
+<textarea readonly rows="2">&lt;a href="{{.PageURL}}"&gt;&lt;img src="{{.ImageURL}}" alt="{{.Title}}"&gt;&lt;/a&gt;</textarea>
+<p>Markdown</p>
+<textarea readonly rows="2">[![{{.Title}}]({{.ImageURL}})]({{.PageURL}})</textarea>
+{{end}}</body>
+</html>
+`))
+
+// drawingPageData is rendered by drawingTemplate.
+type drawingPageData struct {
+	Name      string
+	Title     string
+	Author    string
+	Room      string
+	Date      time.Time
+	Base      string
+	PageURL   string
+	ImagePath string
+	ImageURL  string
+	// SVGPath locates the SVG rendering of the drawing, if any.
+	SVGPath    string
+	DisplayURL string
+	// ArchivedUntil is set for evicted drawings served from cold storage
+	// until then.
+	ArchivedUntil time.Time
+	// Static is set for pages of exported static sites, which cannot link to
+	// the server.
+	Static bool
+	// Reactions is set to present the like and report buttons, with the
+	// number of likes.
+	Reactions bool
+	Likes     int64
+}
+
+// drawingLocator returns the page, image and displayed image locations of
+// drawing name, for request r.
+type drawingLocator func(r *http.Request, name string) *drawingPageData
+
+// drawingPage serves HTML pages presenting saved drawings, at <prefix><id>
+// where id is the image file name without extension. The prefix is not
+// stripped so the locator sees the same mount prefix as other handlers.
+type drawingPage struct {
+	prefix string
+	images string
+	meta   *metaStore
+	// cold, if set, holds evicted drawings still presented during their
+	// grace period.
+	cold *coldStore
+	// tombstones, if set, explain why removed drawings are gone.
+	tombstones *tombstoneStore
+	locate     drawingLocator
+	// touch, if set, is called with the names of presented drawings and
+	// the share token they were presented with.
+	touch func(name, share string)
+	// svg, if set, returns the path of the SVG rendering of a drawing.
+	svg func(name string) string
+	// reactions, if set, lets visitors like and report presented drawings.
+	reactions *reactionStore
+}
+
+func (p *drawingPage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, p.prefix)
+	if !drawingIDRe.MatchString(id) {
+		http.NotFound(w, r)
+		return
+	}
+	name := id + ".png"
+	data := p.locate(r, name)
+	st, err := os.Stat(filepath.Join(p.images, name))
+	if err == nil && st.Mode().IsRegular() {
+		m, err := p.meta.Get(name)
+		if err != nil {
+			slog.Error("could not read metadata", "name", name, "err", err)
+			m = &Metadata{}
+		}
+		data.Title = m.Title
+		data.Author = m.Author
+		data.Room = m.Room
+		data.Date = st.ModTime().UTC()
+		if p.touch != nil {
+			p.touch(name, r.URL.Query().Get("share"))
+		}
+		if p.svg != nil {
+			if _, err := os.Stat(p.svg(name)); err == nil {
+				data.SVGPath = data.ImagePath + ".svg"
+			}
+		}
+		if p.reactions != nil {
+			data.Reactions = true
+			data.Likes = p.reactions.Get(name).Likes
+		}
+	} else {
+		var d *coldDrawing
+		if p.cold != nil {
+			d, err = p.cold.Get(name, time.Now())
+			if err != nil {
+				slog.Error("could not read cold drawing", "name", name, "err", err)
+			}
+		}
+		if d == nil {
+			p.serveGone(w, r, name, data.Base)
+			return
+		}
+		data.Title = d.Metadata.Title
+		data.Author = d.Metadata.Author
+		data.Room = d.Metadata.Room
+		data.Date = d.Created
+		data.ArchivedUntil = p.cold.Expires(d).UTC()
+		// Previews went with the drawing
+		data.DisplayURL = data.ImageURL
+	}
+	data.Name = name
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = drawingTemplate.Execute(w, data)
+	if err != nil {
+		slog.Warn("could not render page", "name", name, "err", err)
+	}
+}
+
+// serveGone replies to requests of missing drawing name with its tombstone,
+// if any, or a 404.
+func (p *drawingPage) serveGone(w http.ResponseWriter, r *http.Request, name, base string) {
+	var t *tombstone
+	if p.tombstones != nil {
+		var err error
+		t, err = p.tombstones.Get(name, time.Now())
+		if err != nil {
+			slog.Error("could not read tombstone", "name", name, "err", err)
+		}
+	}
+	if t == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusGone)
+	err := tombstoneTemplate.Execute(w, &tombstonePageData{Base: base, Tombstone: t})
+	if err != nil {
+		slog.Warn("could not render page", "name", name, "err", err)
+	}
+}
+
+// locateDrawing returns the public locations of drawing name
+func (h *Handler) locateDrawing(r *http.Request, name string) *drawingPageData {
+	u := h.proxies.baseURL(r)
+	u.Path += mountPrefix(r)
+	base := u.Path
+	d := &drawingPageData{
+		Base:      base,
+		ImagePath: base + imgURL + name,
+	}
+	u.Path = base + pageURL + strings.TrimSuffix(name, ".png")
+	d.PageURL = u.String()
+	u.Path = d.ImagePath
+	d.ImageURL = u.String()
+	if h.imgBaseURL != nil {
+		d.ImageURL = h.imgBaseURL.ResolveReference(&url.URL{Path: name}).String()
+	}
+	d.DisplayURL = d.ImageURL
+	if h.pv != nil {
+		d.DisplayURL = base + previewURL + name
+	}
+	return d
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestDrawingPage(t *testing.T) {
+	cfg, cleanup := newTestConfig(t)
+	defer cleanup()
+	cfg.FilenamePattern = "{date}-{short}"
+	h, err := NewHandler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	post := func(title string) (*saveResponse, int) {
+		q := url.Values{}
+		q.Set("title", title)
+		q.Set("author", "Ann")
+		rsp, err := http.Post(srv.URL+"/api/v1/drawings?"+q.Encode(), "image/png",
+			bytes.NewReader(encodeTestImage(t, 10, 10)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rsp.Body.Close()
+		saved := &saveResponse{}
+		json.NewDecoder(rsp.Body).Decode(saved)
+		return saved, rsp.StatusCode
+	}
+	if _, code := post(strings.Repeat("x", maxTitleLength+1)); code != 400 {
+		t.Fatalf("long title: expected 400, got %d", code)
+	}
+	saved, code := post("<b>Cat</b>")
+	if code != 200 {
+		t.Fatalf("could not save drawing: %d", code)
+	}
+	if !strings.HasPrefix(saved.PagePath, "/d/") ||
+		saved.PageURL != srv.URL+saved.PagePath {
+		t.Fatalf("unexpected page location: %+v", saved)
+	}
+
+	rsp, err := http.Get(saved.PageURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+	data, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp.StatusCode != 200 {
+		t.Fatalf("could not fetch page: %s", rsp.Status)
+	}
+	page := string(data)
+	for _, s := range []string{
+		"<h1>&lt;b&gt;Cat&lt;/b&gt;</h1>",
+		"By Ann,",
+		`<img src="` + saved.URL + `"`,
+		`href="` + saved.Path + `" download=`,
+	} {
+		if !strings.Contains(page, s) {
+			t.Errorf("page does not contain %q:\n%s", s, page)
+		}
+	}
+
+	for _, p := range []string{"/d/", "/d/missing", "/d/.hidden", "/d/x.png"} {
+		rsp, err := http.Get(srv.URL + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp.Body.Close()
+		if rsp.StatusCode != 404 {
+			t.Errorf("%s: expected 404, got %d", p, rsp.StatusCode)
+		}
+	}
+}
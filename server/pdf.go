@@ -0,0 +1,187 @@
+package server
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"strings"
+
+	"github.com/pmezard/gribouillis/imageproc"
+)
+
+const (
+	// pdfPageWidth and pdfPageHeight are the dimensions of A4 pages, in
+	// points.
+	pdfPageWidth  = 595
+	pdfPageHeight = 842
+	// pdfMargin is the blank space around images, in points.
+	pdfMargin = 36
+	// pdfCaptionHeight is the space reserved below captioned images, and
+	// pdfCaptionSize the captions font size, in points.
+	pdfCaptionHeight = 24
+	pdfCaptionSize   = 10
+)
+
+// pdfWriter writes numbered PDF objects and records their offsets for the
+// cross-reference table.
+type pdfWriter struct {
+	buf     bytes.Buffer
+	offsets []int
+}
+
+// add writes object body, which must be the next object number, and
+// optionally a stream.
+func (w *pdfWriter) add(body string, stream []byte) {
+	w.offsets = append(w.offsets, w.buf.Len())
+	fmt.Fprintf(&w.buf, "%d 0 obj\n%s\n", len(w.offsets), body)
+	if stream != nil {
+		w.buf.WriteString("stream\n")
+		w.buf.Write(stream)
+		w.buf.WriteString("\nendstream\n")
+	}
+	w.buf.WriteString("endobj\n")
+}
+
+// pdfImage returns the PDF color space and deflated samples of m. Gray
+// images are kept gray, others are flattened on white.
+func pdfImage(m image.Image) (string, []byte, error) {
+	b := m.Bounds()
+	gray, isGray := m.(*image.Gray)
+	data := &bytes.Buffer{}
+	z := zlib.NewWriter(data)
+	row := []byte{}
+	white := color.NRGBA{0xff, 0xff, 0xff, 0xff}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row = row[:0]
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if isGray {
+				row = append(row, gray.GrayAt(x, y).Y)
+			} else {
+				c := imageproc.Flatten(m.At(x, y), white)
+				row = append(row, c.R, c.G, c.B)
+			}
+		}
+		_, err := z.Write(row)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	err := z.Close()
+	if err != nil {
+		return "", nil, err
+	}
+	if isGray {
+		return "/DeviceGray", data.Bytes(), nil
+	}
+	return "/DeviceRGB", data.Bytes(), nil
+}
+
+// writePDF writes a PDF document with one A4 page per image, each image
+// being scaled to fit the page margins and centered.
+func writePDF(out io.Writer, images []image.Image) error {
+	return writePDFPages(out, len(images), func(i int) (image.Image, string, error) {
+		return images[i], "", nil
+	})
+}
+
+// pdfString returns s as a PDF literal string in WinAnsi encoding, characters
+// outside Latin-1 being replaced with question marks.
+func pdfString(s string) string {
+	b := &strings.Builder{}
+	b.WriteByte('(')
+	for _, c := range s {
+		switch {
+		case c == '\\' || c == '(' || c == ')':
+			b.WriteByte('\\')
+			b.WriteRune(c)
+		case c < ' ' || c > 0xff || (c >= 0x7f && c < 0xa0):
+			b.WriteByte('?')
+		default:
+			b.WriteByte(byte(c))
+		}
+	}
+	b.WriteByte(')')
+	return b.String()
+}
+
+// writePDFPages writes a PDF document of n A4 pages. page returns the image
+// of page i, scaled to fit the page margins and centered, and its caption,
+// written below it if not empty. Pages are requested in order, so only one
+// image needs to be decoded at a time.
+func writePDFPages(out io.Writer, n int, page func(i int) (image.Image, string, error)) error {
+	w := &pdfWriter{}
+	w.buf.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	w.add("<< /Type /Catalog /Pages 2 0 R >>", nil)
+	kids := ""
+	for i := 0; i < n; i++ {
+		// Pages, contents and images objects follow the page tree
+		kids += fmt.Sprintf("%d 0 R ", 3+3*i)
+	}
+	w.add(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", kids, n), nil)
+	// The caption font, if any, follows the pages
+	font := 3 + 3*n
+	captioned := false
+	for i := 0; i < n; i++ {
+		m, caption, err := page(i)
+		if err != nil {
+			return err
+		}
+		b := m.Bounds()
+		if b.Empty() {
+			return fmt.Errorf("cannot write empty image")
+		}
+		bottom := float64(pdfMargin)
+		if caption != "" {
+			bottom += pdfCaptionHeight
+		}
+		sx := float64(pdfPageWidth-2*pdfMargin) / float64(b.Dx())
+		sy := (float64(pdfPageHeight-pdfMargin) - bottom) / float64(b.Dy())
+		scale := sx
+		if sy < scale {
+			scale = sy
+		}
+		width := float64(b.Dx()) * scale
+		height := float64(b.Dy()) * scale
+		obj := 3 + 3*i
+		resources := fmt.Sprintf("/XObject << /Im0 %d 0 R >>", obj+2)
+		if caption != "" {
+			captioned = true
+			resources += fmt.Sprintf(" /Font << /F1 %d 0 R >>", font)
+		}
+		w.add(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] "+
+			"/Resources << %s >> /Contents %d 0 R >>",
+			pdfPageWidth, pdfPageHeight, resources, obj+1), nil)
+		content := fmt.Sprintf("q %.2f 0 0 %.2f %.2f %.2f cm /Im0 Do Q",
+			width, height, (pdfPageWidth-width)/2,
+			bottom+(float64(pdfPageHeight-pdfMargin)-bottom-height)/2)
+		if caption != "" {
+			content += fmt.Sprintf(" BT /F1 %d Tf %d %d Td %s Tj ET",
+				pdfCaptionSize, pdfMargin, pdfMargin, pdfString(caption))
+		}
+		w.add(fmt.Sprintf("<< /Length %d >>", len(content)), []byte(content))
+		colorSpace, data, err := pdfImage(m)
+		if err != nil {
+			return err
+		}
+		w.add(fmt.Sprintf("<< /Type /XObject /Subtype /Image /Width %d "+
+			"/Height %d /ColorSpace %s /BitsPerComponent 8 "+
+			"/Filter /FlateDecode /Length %d >>", b.Dx(), b.Dy(), colorSpace,
+			len(data)), data)
+	}
+	if captioned {
+		w.add("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica "+
+			"/Encoding /WinAnsiEncoding >>", nil)
+	}
+	xref := w.buf.Len()
+	fmt.Fprintf(&w.buf, "xref\n0 %d\n0000000000 65535 f \n", len(w.offsets)+1)
+	for _, offset := range w.offsets {
+		fmt.Fprintf(&w.buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&w.buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n",
+		len(w.offsets)+1, xref)
+	_, err := w.buf.WriteTo(out)
+	return err
+}
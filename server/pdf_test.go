@@ -0,0 +1,52 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestWritePDF(t *testing.T) {
+	buf := &bytes.Buffer{}
+	images := []image.Image{
+		image.NewGray(image.Rect(0, 0, 10, 20)),
+		image.NewNRGBA(image.Rect(0, 0, 30, 10)),
+	}
+	err := writePDF(buf, images)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := buf.String()
+	if !strings.HasPrefix(data, "%PDF-1.4\n") || !strings.HasSuffix(data, "%%EOF\n") {
+		t.Fatalf("invalid PDF envelope: %q", data)
+	}
+	if strings.Count(data, "/Type /Page ") != 2 ||
+		!strings.Contains(data, "/ColorSpace /DeviceGray") ||
+		!strings.Contains(data, "/ColorSpace /DeviceRGB") {
+		t.Fatal("pages or images are missing")
+	}
+	// Cross-reference entries must point to their objects
+	m := regexp.MustCompile(`startxref\n(\d+)\n`).FindStringSubmatch(data)
+	if m == nil {
+		t.Fatal("startxref is missing")
+	}
+	xref, _ := strconv.Atoi(m[1])
+	if !strings.HasPrefix(data[xref:], "xref\n0 9\n") {
+		t.Fatalf("startxref does not point to the xref table: %q", data[xref:xref+20])
+	}
+	entries := strings.Split(data[xref:], "\n")[3:11]
+	for i, e := range entries {
+		offset, err := strconv.Atoi(e[:10])
+		if err != nil {
+			t.Fatal(err)
+		}
+		obj := fmt.Sprintf("%d 0 obj\n", i+1)
+		if !strings.HasPrefix(data[offset:], obj) {
+			t.Fatalf("object %d not found at offset %d", i+1, offset)
+		}
+	}
+}
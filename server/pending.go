@@ -0,0 +1,369 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pmezard/gribouillis/storage"
+)
+
+var errTooManyPending = fmt.Errorf("too many pending drawings")
+
+// pendingStore holds uploaded drawings waiting for their author confirmation
+// before being published. Unconfirmed drawings expire after ttl, and at most
+// maxCount of them are kept. Each drawing is stored with the hash of its owner
+// token, in a ".token" file, required to access it.
+type pendingStore struct {
+	dir      string
+	ttl      time.Duration
+	maxCount int
+	// lock serializes admissions to enforce maxCount
+	lock sync.Mutex
+}
+
+// defaultPendingDir returns the pending drawings directory used with
+// imagesDir.
+func defaultPendingDir(imagesDir string) string {
+	return filepath.Clean(imagesDir) + "-pending"
+}
+
+func openPendingStore(dir string, ttl time.Duration, maxCount int) (*pendingStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	s := &pendingStore{
+		dir:      dir,
+		ttl:      ttl,
+		maxCount: maxCount,
+	}
+	return s, s.Prune()
+}
+
+func (s *pendingStore) tokenPath(id string) string {
+	return filepath.Join(s.dir, id+".token")
+}
+
+// Admit checks the just uploaded drawing id fits in maxCount with the other
+// unexpired drawings, and records tokenHash, the hash of its owner token.
+// Otherwise, it is removed and errTooManyPending returned.
+func (s *pendingStore) Admit(id, tokenHash string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	files, err := storage.ListFiles(s.dir)
+	if err != nil {
+		return err
+	}
+	n := 0
+	for _, f := range files {
+		if strings.HasSuffix(f.Name, ".png") && time.Since(f.ModTime) <= s.ttl {
+			n++
+		}
+	}
+	if n > s.maxCount {
+		err = s.Remove(id)
+		if err != nil {
+			return err
+		}
+		return errTooManyPending
+	}
+	return ioutil.WriteFile(s.tokenPath(id), []byte(tokenHash), 0644)
+}
+
+// Owned reports whether token is the owner token of pending drawing id.
+func (s *pendingStore) Owned(id, token string) bool {
+	if !drawingIDRe.MatchString(id) {
+		return false
+	}
+	hash, err := ioutil.ReadFile(s.tokenPath(id))
+	if err != nil {
+		return false
+	}
+	return checkTokenHash(string(hash), token)
+}
+
+// Path returns the path of pending drawing id, or an os.IsNotExist error if
+// it does not exist or expired.
+func (s *pendingStore) Path(id string) (string, error) {
+	if !drawingIDRe.MatchString(id) {
+		return "", os.ErrNotExist
+	}
+	path := filepath.Join(s.dir, id+".png")
+	st, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if time.Since(st.ModTime()) > s.ttl {
+		return "", os.ErrNotExist
+	}
+	return path, nil
+}
+
+// Expires returns the expiration time of pending drawing id.
+func (s *pendingStore) Expires(id string) (time.Time, error) {
+	path, err := s.Path(id)
+	if err != nil {
+		return time.Time{}, err
+	}
+	st, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return st.ModTime().Add(s.ttl), nil
+}
+
+// Publish moves pending drawing id to dir, under its file name, and returns
+// this name.
+func (s *pendingStore) Publish(id, dir string) (string, error) {
+	path, err := s.Path(id)
+	if err != nil {
+		return "", err
+	}
+	name := filepath.Base(path)
+	dst := filepath.Join(dir, name)
+	// Link fails instead of replacing a drawing with the same name
+	err = os.Link(path, dst)
+	if err != nil {
+		return "", err
+	}
+	err = os.Remove(path)
+	if err != nil {
+		return "", err
+	}
+	err = os.Remove(s.tokenPath(id))
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	// Date the drawing from its publication
+	now := time.Now()
+	return name, os.Chtimes(dst, now, now)
+}
+
+// Remove discards pending drawing id, if any.
+func (s *pendingStore) Remove(id string) error {
+	if !drawingIDRe.MatchString(id) {
+		return nil
+	}
+	for _, path := range []string{filepath.Join(s.dir, id+".png"), s.tokenPath(id)} {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Prune deletes expired drawings and their token files.
+func (s *pendingStore) Prune() error {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if time.Since(e.ModTime()) > s.ttl {
+			err := os.Remove(filepath.Join(s.dir, e.Name()))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Run prunes expired drawings every interval, until ctx is done.
+func (s *pendingStore) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := s.Prune()
+			if err != nil {
+				slog.Error("could not prune pending drawings", "err", err)
+			}
+		}
+	}
+}
+
+// setupPending serves drawings pending confirmation, if enabled.
+func (h *Handler) setupPending() error {
+	cfg := h.cfg
+	pendingTTL, err := time.ParseDuration(cfg.PendingTTL)
+	if err != nil {
+		return err
+	}
+	if pendingTTL <= 0 {
+		return nil
+	}
+	pendingDir := cfg.PendingDir
+	if pendingDir == "" {
+		pendingDir = defaultPendingDir(cfg.ImagesDir)
+	}
+	pending, err := openPendingStore(pendingDir, pendingTTL, cfg.MaxPending)
+	if err != nil {
+		return err
+	}
+	h.run(func(ctx context.Context) { pending.Run(ctx, time.Minute) })
+	h.nameDirs = append(h.nameDirs, pending.dir)
+	// pendingID returns the pending drawing identifier in request path,
+	// the segment after the route prefix.
+	pendingID := func(r *http.Request) string {
+		p := strings.TrimPrefix(r.URL.Path, apiPrefix+"/pending/")
+		return strings.SplitN(p, "/", 2)[0]
+	}
+	// ownedPending returns the requested pending drawing, or writes an
+	// error if it does not exist or the request lacks its owner token.
+	ownedPending := func(w http.ResponseWriter, r *http.Request) (string, string, bool) {
+		id := pendingID(r)
+		path, err := pending.Path(id)
+		if err != nil {
+			writeAPIError(w, http.StatusNotFound, "unknown pending drawing")
+			return "", "", false
+		}
+		if !pending.Owned(id, deleteToken(r)) {
+			writeAPIError(w, http.StatusForbidden, "invalid token")
+			return "", "", false
+		}
+		return id, path, true
+	}
+	h.optional = append(h.optional, &apiRoute{
+		Method:   "POST",
+		Path:     "/pending",
+		Summary:  "Upload a PNG drawing to publish after confirmation",
+		Feature:  "pending",
+		Request:  "image/png",
+		Response: &pendingResponse{},
+		Handler: func(w http.ResponseWriter, r *http.Request) {
+			name, done, code, err := h.receive(r, pending.dir, nil)
+			if err != nil {
+				writeAPIError(w, code, err.Error())
+				return
+			}
+			admitted := ""
+			defer func() { done(admitted) }()
+			id := strings.TrimSuffix(name, ".png")
+			token, hash, err := newDeleteToken()
+			if err != nil {
+				slog.Error("could not generate pending token", "err", err)
+				pending.Remove(id)
+				writeAPIError(w, 500, "could not save image")
+				return
+			}
+			err = pending.Admit(id, hash)
+			if err == errTooManyPending {
+				writeAPIError(w, http.StatusServiceUnavailable, err.Error())
+				return
+			} else if err != nil {
+				slog.Error("could not admit pending drawing", "err", err)
+				writeAPIError(w, 500, "could not save image")
+				return
+			}
+			expires, err := pending.Expires(id)
+			if err != nil {
+				slog.Error("could not stat pending drawing", "err", err)
+				writeAPIError(w, 500, "could not save image")
+				return
+			}
+			admitted = name
+			u := h.proxies.baseURL(r)
+			u.Path += mountPrefix(r) + apiPrefix + "/pending/" + id
+			u.RawQuery = url.Values{"token": {token}}.Encode()
+			writeJSON(w, 200, &pendingResponse{
+				ID:          id,
+				Token:       token,
+				PreviewPath: u.RequestURI(),
+				PreviewURL:  u.String(),
+				Expires:     expires.UTC(),
+			})
+		},
+	}, &apiRoute{
+		Method:       "GET",
+		Path:         "/pending/{id}",
+		Summary:      "Return the pending PNG drawing",
+		Feature:      "pending",
+		ResponseType: "image/png",
+		Handler: func(w http.ResponseWriter, r *http.Request) {
+			_, path, ok := ownedPending(w, r)
+			if !ok {
+				return
+			}
+			w.Header().Set("Cache-Control", "no-store")
+			http.ServeFile(w, r, path)
+		},
+	}, &apiRoute{
+		Method:   "POST",
+		Path:     "/pending/{id}/confirm",
+		Summary:  "Publish the pending drawing",
+		Feature:  "pending",
+		Response: &saveResponse{},
+		Handler: func(w http.ResponseWriter, r *http.Request) {
+			m, code, err := h.parseCaptions(r)
+			if err != nil {
+				writeAPIError(w, code, err.Error())
+				return
+			}
+			id, path, ok := ownedPending(w, r)
+			if !ok {
+				return
+			}
+			// Run the hooks before the drawing is in the images
+			// directory
+			err = h.preSave(r, filepath.Base(path), path, m)
+			if err != nil {
+				h.requestLogger(r).Warn("save rejected", "reason", err)
+				writeAPIError(w, http.StatusUnprocessableEntity, err.Error())
+				return
+			}
+			name, err := pending.Publish(id, h.imgDir.Path())
+			if os.IsNotExist(err) {
+				writeAPIError(w, http.StatusNotFound, "unknown pending drawing")
+				return
+			} else if os.IsExist(err) {
+				writeAPIError(w, http.StatusConflict, "drawing already exists")
+				return
+			} else if err != nil {
+				slog.Error("could not publish pending drawing", "err", err)
+				writeAPIError(w, 500, "could not publish drawing")
+				return
+			}
+			rsp, err := h.publish(r, name, m)
+			if err != nil {
+				slog.Error("could not publish pending drawing", "err", err)
+				os.Remove(filepath.Join(h.imgDir.Path(), name))
+				writeAPIError(w, 500, "could not publish drawing")
+				return
+			}
+			writeJSON(w, 200, rsp)
+		},
+	}, &apiRoute{
+		Method:  "DELETE",
+		Path:    "/pending/{id}",
+		Summary: "Discard the pending drawing",
+		Feature: "pending",
+		Handler: func(w http.ResponseWriter, r *http.Request) {
+			id, _, ok := ownedPending(w, r)
+			if !ok {
+				return
+			}
+			err := pending.Remove(id)
+			if err != nil {
+				slog.Error("could not discard pending drawing", "err", err)
+				writeAPIError(w, 500, "could not discard drawing")
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		},
+	})
+	return nil
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPendingSave(t *testing.T) {
+	cfg, cleanup := newTestConfig(t)
+	defer cleanup()
+	cfg.PendingTTL = "1h"
+	cfg.MaxPending = 2
+	h, err := NewHandler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	do := func(method, path string, body []byte, v interface{}) int {
+		req, err := http.NewRequest(method, srv.URL+"/api/v1"+path,
+			bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rsp.Body.Close()
+		if v != nil && rsp.StatusCode == 200 {
+			err := json.NewDecoder(rsp.Body).Decode(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rsp.StatusCode
+	}
+	countImages := func() int {
+		entries, err := ioutil.ReadDir(cfg.ImagesDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(entries)
+	}
+
+	pending := pendingResponse{}
+	if code := do("POST", "/pending", encodeTestImage(t, 10, 10), &pending); code != 200 {
+		t.Fatalf("could not upload pending drawing: %d", code)
+	}
+	token := "?token=" + pending.Token
+	if pending.Token == "" ||
+		pending.PreviewURL != srv.URL+"/api/v1/pending/"+pending.ID+token ||
+		time.Until(pending.Expires) < 59*time.Minute {
+		t.Fatalf("unexpected pending response: %+v", pending)
+	}
+	if n := countImages(); n != 0 {
+		t.Fatalf("pending drawing was published: %d images", n)
+	}
+	rsp, err := http.Get(pending.PreviewURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != 200 || rsp.Header.Get("Content-Type") != "image/png" {
+		t.Fatalf("could not fetch pending drawing: %s", rsp.Status)
+	}
+
+	// Pending drawings are only accessible with their owner token
+	for _, method := range []string{"GET", "POST", "DELETE"} {
+		path := "/pending/" + pending.ID
+		if method == "POST" {
+			path += "/confirm"
+		}
+		for _, query := range []string{"", "?token=bad"} {
+			if code := do(method, path+query, nil, nil); code != 403 {
+				t.Fatalf("%s %s: expected 403, got %d", method, path+query, code)
+			}
+		}
+	}
+
+	saved := saveResponse{}
+	code := do("POST", "/pending/"+pending.ID+"/confirm"+token+"&title=Cat", nil, &saved)
+	if code != 200 {
+		t.Fatalf("could not confirm drawing: %d", code)
+	}
+	if saved.Path != "/saved/"+pending.ID+".png" || countImages() != 1 {
+		t.Fatalf("drawing was not published: %+v", saved)
+	}
+	if code := do("POST", "/pending/"+pending.ID+"/confirm"+token, nil, nil); code != 404 {
+		t.Fatalf("confirmed twice: %d", code)
+	}
+
+	// Discarded and expired drawings cannot be confirmed
+	for _, discard := range []func(id, token string){
+		func(id, token string) {
+			if code := do("DELETE", "/pending/"+id+token, nil, nil); code != 204 {
+				t.Fatalf("could not discard drawing: %d", code)
+			}
+		},
+		func(id, token string) {
+			old := time.Now().Add(-2 * time.Hour)
+			p := filepath.Join(defaultPendingDir(cfg.ImagesDir), id+".png")
+			if err := os.Chtimes(p, old, old); err != nil {
+				t.Fatal(err)
+			}
+		},
+	} {
+		pending := pendingResponse{}
+		if code := do("POST", "/pending", encodeTestImage(t, 10, 10), &pending); code != 200 {
+			t.Fatalf("could not upload pending drawing: %d", code)
+		}
+		token := "?token=" + pending.Token
+		discard(pending.ID, token)
+		if code := do("POST", "/pending/"+pending.ID+"/confirm"+token, nil, nil); code != 404 {
+			t.Fatalf("discarded drawing: expected 404, got %d", code)
+		}
+	}
+	if n := countImages(); n != 1 {
+		t.Fatalf("expected 1 image, got %d", n)
+	}
+
+	// Expired drawings do not count against the limit
+	for i := 0; i < 2; i++ {
+		if code := do("POST", "/pending", encodeTestImage(t, 10, 10), nil); code != 200 {
+			t.Fatalf("could not upload pending drawing: %d", code)
+		}
+	}
+	if code := do("POST", "/pending", encodeTestImage(t, 10, 10), nil); code != 503 {
+		t.Fatalf("expected 503 beyond the pending limit, got %d", code)
+	}
+	entries, err := ioutil.ReadDir(defaultPendingDir(cfg.ImagesDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".png") {
+			n++
+		}
+	}
+	if n != 3 {
+		t.Fatalf("rejected drawing was kept: %d pending drawings", n)
+	}
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"image"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pmezard/gribouillis/imageproc"
+)
+
+// previewer stores downscaled renditions of saved images, bounded by maxSize
+// pixels in both dimensions, in a directory of their own. Previews are not
+// accounted in the images directory limits but are removed with their
+// original.
+type previewer struct {
+	dir     string
+	maxSize int
+	enc     imageproc.Encoder
+	// images is the directory of original images, served when there is no
+	// preview.
+	images string
+}
+
+// newPreviewer returns a previewer of images stored in images directory,
+// writing them in dir. Previews of missing images, and temporary files, are
+// removed.
+func newPreviewer(dir, images string, maxSize int) (*previewer, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		_, err := os.Stat(filepath.Join(images, e.Name()))
+		if strings.HasPrefix(e.Name(), ".") || os.IsNotExist(err) {
+			os.Remove(filepath.Join(dir, e.Name()))
+		}
+	}
+	return &previewer{
+		dir:     dir,
+		maxSize: maxSize,
+		enc: &png.Encoder{
+			CompressionLevel: png.BestCompression,
+		},
+		images: images,
+	}, nil
+}
+
+// defaultPreviewsDir returns the previews directory used with imagesDir.
+func defaultPreviewsDir(imagesDir string) string {
+	return filepath.Clean(imagesDir) + "-previews"
+}
+
+// Generate writes the preview of image name, decoded in src. Images fitting
+// in the preview bounds have no preview, their original is served instead.
+func (p *previewer) Generate(name string, src image.Image) error {
+	b := src.Bounds()
+	if b.Dx() <= p.maxSize && b.Dy() <= p.maxSize {
+		return nil
+	}
+	w, h := imageproc.FitSize(b, p.maxSize)
+	tmp, err := ioutil.TempFile(p.dir, ".preview-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	err = p.enc.Encode(tmp, imageproc.Downscale(src, w, h))
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(p.dir, name))
+}
+
+// Remove deletes the preview of image name, if any.
+func (p *previewer) Remove(name string) {
+	os.Remove(filepath.Join(p.dir, name))
+}
+
+// ServeHTTP serves the preview named by the request path, or the original
+// image if it has none.
+func (p *previewer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	if name == "" || strings.ContainsAny(name, "/\\") ||
+		strings.HasPrefix(name, ".") {
+		http.NotFound(w, r)
+		return
+	}
+	path := filepath.Join(p.dir, name)
+	if _, err := os.Stat(path); err != nil {
+		path = filepath.Join(p.images, name)
+	}
+	fp, err := os.Open(path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer fp.Close()
+	st, err := fp.Stat()
+	if err != nil || !st.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeContent(w, r, name, st.ModTime(), fp)
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"image"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pmezard/gribouillis/storage"
+)
+
+func TestPreviews(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "gribouillis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	imagesDir := filepath.Join(tmpDir, "images")
+	d, err := storage.OpenLimitedDir(imagesDir, 1<<20, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := newPreviewer(defaultPreviewsDir(imagesDir), imagesDir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.OnRemove(p.Remove)
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	getPreview := func(name string) image.Config {
+		rsp, err := http.Get(srv.URL + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rsp.Body.Close()
+		if rsp.StatusCode != 200 {
+			t.Fatalf("could not get %s preview: %s", name, rsp.Status)
+		}
+		cfg, err := png.DecodeConfig(rsp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cfg
+	}
+	save := func(name string, w, h int) {
+		err := ioutil.WriteFile(filepath.Join(imagesDir, name),
+			encodeTestImage(t, w, h), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = d.Add(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = p.Generate(name, image.NewRGBA(image.Rect(0, 0, w, h)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Small images are their own preview
+	save("small.png", 8, 4)
+	if cfg := getPreview("small.png"); cfg.Width != 8 || cfg.Height != 4 {
+		t.Fatalf("unexpected small preview size: %dx%d", cfg.Width, cfg.Height)
+	}
+	save("large.png", 40, 100)
+	if cfg := getPreview("large.png"); cfg.Width != 4 || cfg.Height != 10 {
+		t.Fatalf("unexpected large preview size: %dx%d", cfg.Width, cfg.Height)
+	}
+	// Previews are removed with their image
+	save("other.png", 8, 4)
+	_, err = os.Stat(filepath.Join(p.dir, "large.png"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("evicted image preview was not removed: %v", err)
+	}
+	rsp, err := http.Get(srv.URL + "/large.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != 404 {
+		t.Fatalf("expected 404 for evicted preview, got %s", rsp.Status)
+	}
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// prompts is a list of drawing challenges, one being published per day.
+type prompts []string
+
+// loadPrompts reads prompts from path, one per line. Empty lines and lines
+// starting with "#" are ignored.
+func loadPrompts(path string) (prompts, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	var p prompts
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p = append(p, line)
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+	if len(p) == 0 {
+		return nil, fmt.Errorf("no prompts in %s", path)
+	}
+	return p, nil
+}
+
+// Get returns the prompt of room, or of the whole instance if empty, for the
+// UTC day of now. Prompts are cycled through in order, rooms starting at
+// different positions.
+func (p prompts) Get(room string, now time.Time) string {
+	day := now.UTC().Unix() / (24 * 3600)
+	if room != "" {
+		h := fnv.New32a()
+		h.Write([]byte(room))
+		day += int64(h.Sum32())
+	}
+	return p[day%int64(len(p))]
+}
+
+// promptResponse is returned by the prompt endpoint.
+type promptResponse struct {
+	Prompt string `json:"prompt"`
+	// Date is the UTC day of the prompt, as YYYY-MM-DD, and Expires the
+	// time it is replaced.
+	Date    string    `json:"date"`
+	Expires time.Time `json:"expires"`
+}
+
+func newPromptResponse(p prompts, room string, now time.Time) *promptResponse {
+	day := now.UTC().Truncate(24 * time.Hour)
+	return &promptResponse{
+		Prompt:  p.Get(room, now),
+		Date:    day.Format("2006-01-02"),
+		Expires: day.Add(24 * time.Hour),
+	}
+}
+
+// setupPrompts loads the daily prompts, if any, and serves them.
+func (h *Handler) setupPrompts() error {
+	if h.cfg.PromptsPath == "" {
+		return nil
+	}
+	dailyPrompts, err := loadPrompts(h.cfg.PromptsPath)
+	if err != nil {
+		return err
+	}
+	h.dailyPrompts = dailyPrompts
+	h.optional = append(h.optional, &apiRoute{
+		Method:   "GET",
+		Path:     "/prompt",
+		Summary:  "Return the drawing prompt of the day",
+		Feature:  "prompt",
+		Response: &promptResponse{},
+		Handler: func(w http.ResponseWriter, r *http.Request) {
+			room := r.URL.Query().Get("room")
+			if room != "" && !roomIDRe.MatchString(room) {
+				writeAPIError(w, http.StatusBadRequest, "invalid room identifier")
+				return
+			}
+			writeJSON(w, 200, newPromptResponse(dailyPrompts, room, time.Now()))
+		},
+	})
+	return nil
+}
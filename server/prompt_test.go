@@ -0,0 +1,54 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPrompts(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "gribouillis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "prompts")
+	err = ioutil.WriteFile(path, []byte("# daily\na cat\n\n  a dog \na bird\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := loadPrompts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p) != 3 || p[1] != "a dog" {
+		t.Fatalf("unexpected prompts: %q", p)
+	}
+
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	first := p.Get("", day)
+	if p.Get("", day.Add(23*time.Hour)) != first {
+		t.Fatal("prompt changed within a day")
+	}
+	if p.Get("", day.Add(24*time.Hour)) == first {
+		t.Fatal("prompt did not change the next day")
+	}
+	if p.Get("abc", day) != p.Get("abc", day.Add(time.Hour)) {
+		t.Fatal("room prompt changed within a day")
+	}
+	rsp := newPromptResponse(p, "", day.Add(10*time.Hour))
+	if rsp.Date != "2024-03-01" || !rsp.Expires.Equal(day.Add(24*time.Hour)) {
+		t.Fatalf("unexpected response: %+v", rsp)
+	}
+
+	err = ioutil.WriteFile(path, []byte("# nothing\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = loadPrompts(path)
+	if err == nil {
+		t.Fatal("empty prompts file was accepted")
+	}
+}
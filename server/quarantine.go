@@ -0,0 +1,59 @@
+package server
+
+import (
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// defaultQuarantineDir returns the quarantine directory used with imagesDir.
+func defaultQuarantineDir(imagesDir string) string {
+	return filepath.Clean(imagesDir) + "-quarantine"
+}
+
+// quarantineFile moves the file name of dir to quarantineDir, which must be
+// on the same filesystem. Its name is prefixed with the quarantine time so
+// successive corruptions of a drawing are all kept.
+func quarantineFile(dir, quarantineDir, name string, now time.Time) error {
+	err := os.MkdirAll(quarantineDir, 0755)
+	if err != nil {
+		return err
+	}
+	return os.Rename(filepath.Join(dir, name), filepath.Join(quarantineDir,
+		now.UTC().Format("20060102T150405Z")+"-"+name))
+}
+
+// quarantineCorrupted moves the stored files of imagesDir which are not
+// decodable PNG images to quarantineDir, and returns their names. Hidden
+// files are temporary files and left alone.
+func quarantineCorrupted(imagesDir, quarantineDir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(imagesDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	now := time.Now()
+	moved := []string{}
+	for _, e := range entries {
+		name := e.Name()
+		if !e.Mode().IsRegular() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		_, err := decodePNGFile(filepath.Join(imagesDir, name))
+		if err == nil {
+			continue
+		}
+		slog.Warn("quarantining corrupted image", "name", name, "err", err)
+		err = quarantineFile(imagesDir, quarantineDir, name, now)
+		if err != nil {
+			return nil, err
+		}
+		moved = append(moved, name)
+	}
+	return moved, nil
+}
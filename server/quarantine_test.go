@@ -0,0 +1,62 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/pmezard/gribouillis/storage"
+)
+
+func TestQuarantineCorrupted(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "gribouillis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	imagesDir := filepath.Join(tmpDir, "images")
+	err = os.Mkdir(imagesDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"a.png":       encodeTestImage(t, 4, 4),
+		"broken.png":  []byte("x"),
+		".save-1":     []byte("x"),
+		"trunc.png":   encodeTestImage(t, 4, 4)[:40],
+		"another.png": encodeTestImage(t, 2, 2),
+	}
+	for name, data := range files {
+		err := ioutil.WriteFile(filepath.Join(imagesDir, name), data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	quarantineDir := defaultQuarantineDir(imagesDir)
+	moved, err := quarantineCorrupted(imagesDir, quarantineDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(moved, " ") != "broken.png trunc.png" {
+		t.Fatalf("unexpected quarantined files: %v", moved)
+	}
+	d, err := storage.OpenLimitedDir(imagesDir, 1<<20, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := d.List()
+	sort.Strings(names)
+	if strings.Join(names, " ") != "a.png another.png" {
+		t.Fatalf("unexpected remaining files: %v", names)
+	}
+	entries, err := ioutil.ReadDir(quarantineDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || !strings.HasSuffix(entries[0].Name(), "-broken.png") {
+		t.Fatalf("unexpected quarantine content: %v", entries)
+	}
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket rate limiter per client key, like an IP
+// address. Each client gets one token every interval, up to burst tokens,
+// and spends one per allowed request.
+type rateLimiter struct {
+	interval time.Duration
+	burst    int
+	lock     sync.Mutex
+	buckets  map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(interval time.Duration, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		interval: interval,
+		burst:    burst,
+		buckets:  map[string]*bucket{},
+	}
+}
+
+// refill returns b tokens count at now.
+func (l *rateLimiter) refill(b *bucket, now time.Time) float64 {
+	tokens := b.tokens + float64(now.Sub(b.last))/float64(l.interval)
+	if tokens > float64(l.burst) {
+		tokens = float64(l.burst)
+	}
+	return tokens
+}
+
+// Allow spends a token of client key at now, and reports whether it had one.
+func (l *rateLimiter) Allow(key string, now time.Time) bool {
+	if l.interval <= 0 {
+		return true
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = l.refill(b, now)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Prune forgets clients whose bucket is full at now, they are no different
+// from new ones.
+func (l *rateLimiter) Prune(now time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for key, b := range l.buckets {
+		if l.refill(b, now) >= float64(l.burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Run prunes stale clients every interval, until ctx is done.
+func (l *rateLimiter) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			l.Prune(now)
+		}
+	}
+}
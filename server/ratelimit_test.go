@@ -0,0 +1,39 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(10*time.Second, 2)
+	now := time.Now()
+	check := func(key string, at time.Duration, expected bool) {
+		if l.Allow(key, now.Add(at)) != expected {
+			t.Fatalf("%s at %s: expected %v", key, at, expected)
+		}
+	}
+	check("a", 0, true)
+	check("a", 0, true)
+	check("a", time.Second, false)
+	// Other clients are not affected
+	check("b", time.Second, true)
+	check("a", 10*time.Second, true)
+	check("a", 11*time.Second, false)
+
+	l.Prune(now.Add(15 * time.Second))
+	if len(l.buckets) != 1 {
+		t.Fatalf("expected 1 client, got %d", len(l.buckets))
+	}
+	l.Prune(now.Add(time.Minute))
+	if len(l.buckets) != 0 {
+		t.Fatalf("stale clients were not pruned: %d", len(l.buckets))
+	}
+
+	l = newRateLimiter(0, 1)
+	for i := 0; i < 10; i++ {
+		if !l.Allow("a", now) {
+			t.Fatal("disabled limiter denied a request")
+		}
+	}
+}
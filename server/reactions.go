@@ -0,0 +1,208 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// drawingReactions aggregates the likes and reports of a drawing.
+type drawingReactions struct {
+	Likes   int64 `json:"likes"`
+	Reports int64 `json:"reports"`
+	// LastReported is the time of the last report, zero if never reported.
+	LastReported time.Time `json:"last_reported"`
+}
+
+// reactionStore counts the likes of saved drawings and their reports to the
+// moderators. Nothing is kept about visitors. Counts are persisted in a JSON
+// file.
+type reactionStore struct {
+	path     string
+	lock     sync.Mutex
+	Drawings map[string]*drawingReactions `json:"drawings"`
+	dirty    bool
+}
+
+// defaultReactionsPath returns the reactions file used with imagesDir.
+func defaultReactionsPath(imagesDir string) string {
+	return filepath.Clean(imagesDir) + "-reactions.json"
+}
+
+// openReactionStore loads the reactions persisted in path, if any.
+func openReactionStore(path string) (*reactionStore, error) {
+	s := &reactionStore{
+		path:     path,
+		Drawings: map[string]*drawingReactions{},
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, s)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %s", path, err)
+	}
+	return s, nil
+}
+
+// update calls fn with the reactions of drawing name, creating them if
+// necessary, and returns them once updated.
+func (s *reactionStore) update(name string, fn func(r *drawingReactions)) drawingReactions {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	r := s.Drawings[name]
+	if r == nil {
+		r = &drawingReactions{}
+		s.Drawings[name] = r
+	}
+	fn(r)
+	s.dirty = true
+	return *r
+}
+
+// Like counts a like of drawing name and returns its reactions.
+func (s *reactionStore) Like(name string) drawingReactions {
+	return s.update(name, func(r *drawingReactions) { r.Likes++ })
+}
+
+// Report counts a report of drawing name at now.
+func (s *reactionStore) Report(name string, now time.Time) {
+	s.update(name, func(r *drawingReactions) {
+		r.Reports++
+		r.LastReported = now.UTC()
+	})
+}
+
+// Get returns the reactions of drawing name, zero if there are none.
+func (s *reactionStore) Get(name string) drawingReactions {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if r := s.Drawings[name]; r != nil {
+		return *r
+	}
+	return drawingReactions{}
+}
+
+// Reported returns the names of the reported drawings, the most reported
+// first.
+func (s *reactionStore) Reported() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	names := []string{}
+	for name, r := range s.Drawings {
+		if r.Reports > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := s.Drawings[names[i]], s.Drawings[names[j]]
+		if a.Reports != b.Reports {
+			return a.Reports > b.Reports
+		}
+		return a.LastReported.After(b.LastReported)
+	})
+	return names
+}
+
+// Remove forgets the reactions of drawing name.
+func (s *reactionStore) Remove(name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.Drawings[name]; ok {
+		delete(s.Drawings, name)
+		s.dirty = true
+	}
+}
+
+// save writes the reactions if they changed since last call.
+func (s *reactionStore) save() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, s.path)
+	if err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// Run saves the reactions every interval, and a last time once ctx is done.
+func (s *reactionStore) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+		case <-ticker.C:
+		}
+		err := s.save()
+		if err != nil {
+			slog.Error("could not save reactions", "err", err)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// setupReactions serves the like and report endpoints, if enabled.
+func (h *Handler) setupReactions() error {
+	if h.reactions == nil {
+		return nil
+	}
+	h.optional = append(h.optional, &apiRoute{
+		Method:   "POST",
+		Path:     "/drawings/{name}/like",
+		Summary:  "Like the drawing and return its number of likes",
+		Feature:  "reactions",
+		Response: &likesResponse{},
+		Handler: func(w http.ResponseWriter, r *http.Request) {
+			name, ok := h.trackedDrawing(r)
+			if !ok {
+				writeAPIError(w, http.StatusNotFound, "unknown drawing")
+				return
+			}
+			writeJSON(w, 200, &likesResponse{Likes: h.reactions.Like(name).Likes})
+		},
+	}, &apiRoute{
+		Method:  "POST",
+		Path:    "/drawings/{name}/report",
+		Summary: "Report the drawing to the moderators",
+		Feature: "reactions",
+		Handler: func(w http.ResponseWriter, r *http.Request) {
+			name, ok := h.trackedDrawing(r)
+			if !ok {
+				writeAPIError(w, http.StatusNotFound, "unknown drawing")
+				return
+			}
+			h.reactions.Report(name, time.Now())
+			h.requestLogger(r).Info("drawing reported", "name", name)
+			w.WriteHeader(http.StatusNoContent)
+		},
+	})
+	return nil
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestReactions(t *testing.T) {
+	cfg, cleanup := newTestConfig(t)
+	defer cleanup()
+	cfg.Reactions = true
+	cfg.AdminToken = "secret"
+	h, err := NewHandler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	rsp, err := http.Post(srv.URL+"/api/v1/drawings", "image/png",
+		bytes.NewReader(encodeTestImage(t, 10, 10)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := saveResponse{}
+	err = json.NewDecoder(rsp.Body).Decode(&saved)
+	rsp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := path.Base(saved.Path)
+	post := func(action string) (int, *likesResponse) {
+		rsp, err := http.Post(srv.URL+"/api/v1/drawings/"+action, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rsp.Body.Close()
+		likes := &likesResponse{}
+		if rsp.StatusCode == 200 {
+			err = json.NewDecoder(rsp.Body).Decode(likes)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rsp.StatusCode, likes
+	}
+	for _, action := range []string{"missing.png/like", "missing.png/report"} {
+		if code, _ := post(action); code != 404 {
+			t.Fatalf("%s: expected 404, got %d", action, code)
+		}
+	}
+	post(name + "/like")
+	if code, likes := post(name + "/like"); code != 200 || likes.Likes != 2 {
+		t.Fatalf("could not like drawing: %d, %+v", code, likes)
+	}
+	if code, _ := post(name + "/report"); code != 204 {
+		t.Fatalf("could not report drawing: %d", code)
+	}
+
+	rsp, err = http.Get(srv.URL + saved.PagePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err := ioutil.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"Like (2)", "/api/v1/drawings/" + name + "/report"} {
+		if !strings.Contains(string(page), s) {
+			t.Fatalf("page does not contain %q:\n%s", s, page)
+		}
+	}
+
+	req, err := http.NewRequest("GET", srv.URL+"/admin/reports", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	rsp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reports := &adminReportsResponse{}
+	err = json.NewDecoder(rsp.Body).Decode(reports)
+	rsp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports.Drawings) != 1 || reports.Drawings[0].Name != name ||
+		reports.Drawings[0].Reports != 1 || reports.Drawings[0].LastReported.IsZero() {
+		t.Fatalf("unexpected reports: %+v", reports)
+	}
+
+	// Reactions are persisted
+	h.Close()
+	reactions, err := openReactionStore(defaultReactionsPath(cfg.ImagesDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := reactions.Get(name); r.Likes != 2 || r.Reports != 1 {
+		t.Fatalf("unexpected saved reactions: %+v", r)
+	}
+}
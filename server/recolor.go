@@ -0,0 +1,108 @@
+package server
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strings"
+
+	"github.com/pmezard/gribouillis/imageproc"
+)
+
+// colorKey identifies an RGB color regardless of its opacity.
+type colorKey [3]uint8
+
+// parseColorMapping parses a comma separated list of "from:to" colors, as
+// accepted by imageproc.ParseBackground, like "f00:00f,000000:404040".
+func parseColorMapping(s string) (map[colorKey]colorKey, error) {
+	mapping := map[colorKey]colorKey{}
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.Split(pair, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid color mapping: %q", pair)
+		}
+		from, err := imageproc.ParseBackground(parts[0])
+		if err != nil || from == nil {
+			return nil, fmt.Errorf("invalid color mapping: %q", pair)
+		}
+		to, err := imageproc.ParseBackground(parts[1])
+		if err != nil || to == nil {
+			return nil, fmt.Errorf("invalid color mapping: %q", pair)
+		}
+		mapping[colorKey{from.R, from.G, from.B}] = colorKey{to.R, to.G, to.B}
+	}
+	return mapping, nil
+}
+
+// rotateHue returns r, g, b with their hue rotated by degrees, keeping
+// saturation and lightness.
+func rotateHue(r, g, b uint8, degrees float64) (uint8, uint8, uint8) {
+	rf, gf, bf := float64(r)/255, float64(g)/255, float64(b)/255
+	max := math.Max(rf, math.Max(gf, bf))
+	min := math.Min(rf, math.Min(gf, bf))
+	if max == min {
+		// Grays have no hue
+		return r, g, b
+	}
+	l := (max + min) / 2
+	d := max - min
+	s := d / (1 - math.Abs(2*l-1))
+	var h float64
+	switch max {
+	case rf:
+		h = math.Mod((gf-bf)/d, 6)
+	case gf:
+		h = (bf-rf)/d + 2
+	default:
+		h = (rf-gf)/d + 4
+	}
+	h = math.Mod(h*60+degrees, 360)
+	if h < 0 {
+		h += 360
+	}
+	c := (1 - math.Abs(2*l-1)) * s
+	x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	m := l - c/2
+	var r1, g1, b1 float64
+	switch {
+	case h < 60:
+		r1, g1 = c, x
+	case h < 120:
+		r1, g1 = x, c
+	case h < 180:
+		g1, b1 = c, x
+	case h < 240:
+		g1, b1 = x, c
+	case h < 300:
+		r1, b1 = x, c
+	default:
+		r1, b1 = c, x
+	}
+	to8 := func(v float64) uint8 {
+		return uint8(math.Round(math.Min(math.Max(v+m, 0), 1) * 255))
+	}
+	return to8(r1), to8(g1), to8(b1)
+}
+
+// recolor returns a copy of m where colors listed in mapping are replaced,
+// keeping their opacity so antialiased edges follow, and the hue of other
+// colors rotated by hue degrees.
+func recolor(m image.Image, mapping map[colorKey]colorKey,
+	hue float64) *image.NRGBA {
+
+	b := m.Bounds()
+	out := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			c := color.NRGBAModel.Convert(m.At(b.Min.X+x, b.Min.Y+y)).(color.NRGBA)
+			if to, ok := mapping[colorKey{c.R, c.G, c.B}]; ok {
+				c.R, c.G, c.B = to[0], to[1], to[2]
+			} else if hue != 0 && c.A != 0 {
+				c.R, c.G, c.B = rotateHue(c.R, c.G, c.B, hue)
+			}
+			out.SetNRGBA(x, y, c)
+		}
+	}
+	return out
+}
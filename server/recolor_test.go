@@ -0,0 +1,42 @@
+package server
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestRecolor(t *testing.T) {
+	mapping, err := parseColorMapping("f00:00f,#00ff00:ffffff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"", "f00", "f00:00f:0f0", "red:blue", "none:fff"} {
+		if _, err := parseColorMapping(s); err == nil {
+			t.Errorf("%q: invalid mapping was accepted", s)
+		}
+	}
+
+	m := image.NewNRGBA(image.Rect(2, 2, 6, 3))
+	m.SetNRGBA(2, 2, color.NRGBA{0xff, 0, 0, 0xff})
+	m.SetNRGBA(3, 2, color.NRGBA{0xff, 0, 0, 0x80})
+	m.SetNRGBA(4, 2, color.NRGBA{0, 0, 0xff, 0xff})
+	m.SetNRGBA(5, 2, color.NRGBA{0x80, 0x80, 0x80, 0xff})
+	out := recolor(m, mapping, 120)
+	expected := []color.NRGBA{
+		{0, 0, 0xff, 0xff},
+		{0, 0, 0xff, 0x80},
+		{0xff, 0, 0, 0xff},
+		{0x80, 0x80, 0x80, 0xff},
+	}
+	for x, c := range expected {
+		if got := out.NRGBAAt(x, 0); got != c {
+			t.Errorf("%d: expected %v, got %v", x, c, got)
+		}
+	}
+
+	r, g, b := rotateHue(0x20, 0x40, 0xc0, 360)
+	if r != 0x20 || g != 0x40 || b != 0xc0 {
+		t.Fatalf("full rotation changed the color: %02x%02x%02x", r, g, b)
+	}
+}
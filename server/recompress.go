@@ -0,0 +1,142 @@
+package server
+
+import (
+	"bytes"
+	"image/png"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pmezard/gribouillis/imageproc"
+	"github.com/pmezard/gribouillis/storage"
+)
+
+// recompressor re-encodes stored images with the best compression level once
+// the server has been idle for a while, and keeps the result when smaller. It
+// runs as "recompress" jobs. Color space chunks are preserved and, if reduce
+// is set, images with few colors converted to grayscale or paletted ones.
+type recompressor struct {
+	dir    *storage.LimitedDir
+	idle   time.Duration
+	enc    *png.Encoder
+	reduce bool
+
+	lock     sync.Mutex
+	lastSave time.Time
+}
+
+func newRecompressor(dir *storage.LimitedDir, idle time.Duration,
+	reduce bool) *recompressor {
+
+	// Remove leftovers of interrupted runs
+	leftovers, _ := filepath.Glob(filepath.Join(dir.Path(), ".recompress-*"))
+	for _, path := range leftovers {
+		os.Remove(path)
+	}
+	return &recompressor{
+		dir:  dir,
+		idle: idle,
+		enc: &png.Encoder{
+			CompressionLevel: png.BestCompression,
+		},
+		reduce:   reduce,
+		lastSave: time.Now(),
+	}
+}
+
+// Touch records server activity, postponing recompression.
+func (rc *recompressor) Touch() {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	rc.lastSave = time.Now()
+}
+
+func (rc *recompressor) isIdle() bool {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	return time.Since(rc.lastSave) >= rc.idle
+}
+
+// Job recompresses the file named by job argument if the server is idle, and
+// postpones it otherwise.
+func (rc *recompressor) Job(job *Job) error {
+	if !rc.isIdle() {
+		return errPostponed
+	}
+	saved, err := rc.recompress(job.Arg)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if saved > 0 {
+		slog.Info("recompressed drawing", "name", job.Arg, "saved_bytes", saved)
+	}
+	return nil
+}
+
+// recompress re-encodes name and replaces it if the result is smaller. It
+// returns the number of saved bytes.
+func (rc *recompressor) recompress(name string) (int64, error) {
+	path := filepath.Join(rc.dir.Path(), name)
+	st, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	if rc.reduce {
+		img = imageproc.ReduceColors(img)
+	}
+	var enc imageproc.Encoder = rc.enc
+	chunks, err := imageproc.ColorChunks(data)
+	if err != nil {
+		return 0, err
+	}
+	if len(chunks) > 0 {
+		enc = &imageproc.ChunkEncoder{Encoder: enc, Chunks: chunks}
+	}
+	tmp, err := ioutil.TempFile(rc.dir.Path(), storage.RecompressTempPrefix)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	err = enc.Encode(tmp, img)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		return 0, err
+	}
+	tst, err := os.Stat(tmp.Name())
+	if err != nil {
+		return 0, err
+	}
+	if tst.Size() >= st.Size() {
+		return 0, nil
+	}
+	// Keep the modification time, it orders files on startup
+	err = os.Chtimes(tmp.Name(), st.ModTime(), st.ModTime())
+	if err != nil {
+		return 0, err
+	}
+	err = rc.dir.Replace(name, tmp.Name())
+	if err == storage.ErrNotTracked {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return st.Size() - tst.Size(), nil
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pmezard/gribouillis/storage"
+)
+
+func TestRecompress(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "gribouillis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, "a.png")
+	fp, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := &png.Encoder{CompressionLevel: png.NoCompression}
+	err = enc.Encode(fp, image.NewRGBA(image.Rect(0, 0, 100, 100)))
+	fp.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := storage.OpenLimitedDir(tmpDir, 1<<20, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := newRecompressor(d, time.Second, false)
+	saved, err := rc.recompress("a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st2, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved <= 0 || st2.Size() != st.Size()-saved || d.Size() != st2.Size() {
+		t.Fatalf("unexpected sizes: %d - %d != %d (tracked %d)", st.Size(),
+			saved, st2.Size(), d.Size())
+	}
+	if !st2.ModTime().Equal(st.ModTime()) {
+		t.Fatalf("modification time changed: %s != %s", st.ModTime(),
+			st2.ModTime())
+	}
+	// Already compressed
+	saved, err = rc.recompress("a.png")
+	if err != nil || saved != 0 {
+		t.Fatalf("unexpected second recompression: %d, %v", saved, err)
+	}
+	if files := d.List(); len(files) != 1 || files[0] != "a.png" {
+		t.Fatalf("unexpected files: %v", files)
+	}
+}
@@ -0,0 +1,236 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// maxDrawingReferrers bounds the number of domains tracked per drawing, the
+// extra ones being counted as otherReferrers.
+const (
+	maxDrawingReferrers = 50
+	otherReferrers      = "(other)"
+)
+
+// referrerStats counts views of saved images by referring domain, instance
+// wide and per drawing. Only domain names are kept, and views from the server
+// own pages are ignored. Counts are persisted in a JSON file.
+type referrerStats struct {
+	path string
+
+	lock     sync.Mutex
+	Total    map[string]int64            `json:"total"`
+	Drawings map[string]map[string]int64 `json:"drawings"`
+	dirty    bool
+}
+
+// defaultReferrersPath returns the referrer statistics file used with
+// imagesDir.
+func defaultReferrersPath(imagesDir string) string {
+	return filepath.Clean(imagesDir) + "-referrers.json"
+}
+
+// openReferrerStats loads the statistics persisted in path, if any.
+func openReferrerStats(path string) (*referrerStats, error) {
+	s := &referrerStats{
+		path:     path,
+		Total:    map[string]int64{},
+		Drawings: map[string]map[string]int64{},
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, s)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %s", path, err)
+	}
+	return s, nil
+}
+
+// referrerDomain returns the host name of referer, without "www." prefix, or
+// an empty string if it is invalid or refers to host.
+func referrerDomain(referer, host string) string {
+	u, err := url.Parse(referer)
+	if err != nil {
+		return ""
+	}
+	domain := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	if domain == strings.TrimPrefix(strings.ToLower(host), "www.") {
+		return ""
+	}
+	return domain
+}
+
+// Record counts a view of drawing name coming from referer.
+func (s *referrerStats) Record(name, referer, host string) {
+	domain := referrerDomain(referer, host)
+	if domain == "" {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.Total[domain]++
+	counts := s.Drawings[name]
+	if counts == nil {
+		counts = map[string]int64{}
+		s.Drawings[name] = counts
+	}
+	if _, ok := counts[domain]; !ok && len(counts) >= maxDrawingReferrers {
+		domain = otherReferrers
+	}
+	counts[domain]++
+	s.dirty = true
+}
+
+// Remove forgets the statistics of drawing name.
+func (s *referrerStats) Remove(name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.Drawings[name]; ok {
+		delete(s.Drawings, name)
+		s.dirty = true
+	}
+}
+
+// save writes the statistics if they changed since last call.
+func (s *referrerStats) save() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, s.path)
+	if err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// Run saves the statistics every interval, and a last time once ctx is
+// done.
+func (s *referrerStats) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+		case <-ticker.C:
+		}
+		err := s.save()
+		if err != nil {
+			slog.Error("could not save referrer statistics", "err", err)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// Handler wraps h, serving drawings from the images directory, to record
+// successful views.
+func (s *referrerStats) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, r)
+		referer := r.Header.Get("Referer")
+		if referer != "" && (sw.status == 200 || sw.status == 304) {
+			s.Record(strings.TrimPrefix(r.URL.Path, "/"), referer, r.Host)
+		}
+	})
+}
+
+type referrerCount struct {
+	Domain string
+	Views  int64
+}
+
+// topReferrers returns the n domains with most views in counts.
+func topReferrers(counts map[string]int64, n int) []referrerCount {
+	top := []referrerCount{}
+	for domain, views := range counts {
+		top = append(top, referrerCount{Domain: domain, Views: views})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Views != top[j].Views {
+			return top[i].Views > top[j].Views
+		}
+		return top[i].Domain < top[j].Domain
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// ReferrersCommand prints the top referrers of an instance, or of a drawing.
+func ReferrersCommand(args []string) error {
+	fs := flag.NewFlagSet("referrers", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Print(`Usage: gribouillis referrers [OPTIONS] [NAME]
+
+Print the domains referring most views of saved images, instance wide or for
+drawing NAME. Statistics are collected when -referrer-stats is enabled and
+saved every minute.
+
+`)
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	imagesDir := fs.String("images-dir", "images",
+		"directory where drawings are saved")
+	path := fs.String("referrers", "",
+		"file persisting referrer statistics, defaults to images directory with a -referrers.json suffix")
+	n := fs.Int("n", 10, "number of domains to print")
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		return fmt.Errorf("at most one drawing name expected")
+	}
+	if *path == "" {
+		*path = defaultReferrersPath(*imagesDir)
+	}
+	s, err := openReferrerStats(*path)
+	if err != nil {
+		return err
+	}
+	counts := s.Total
+	if fs.NArg() == 1 {
+		counts = s.Drawings[fs.Arg(0)]
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "DOMAIN\tVIEWS")
+	for _, c := range topReferrers(counts, *n) {
+		fmt.Fprintf(w, "%s\t%d\n", c.Domain, c.Views)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReferrerDomain(t *testing.T) {
+	tests := []struct {
+		referer  string
+		expected string
+	}{
+		{"https://www.Example.com/some/page?q=1", "example.com"},
+		{"http://forum.example.org:8080/t/1", "forum.example.org"},
+		{"http://localhost:5001/", ""},
+		{"not a url\x00", ""},
+	}
+	for _, test := range tests {
+		if d := referrerDomain(test.referer, "localhost:5001"); d != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.referer, test.expected, d)
+		}
+	}
+}
+
+func TestReferrerStats(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "gribouillis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	err = ioutil.WriteFile(filepath.Join(tmpDir, "a.png"), []byte("a"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(tmpDir, "referrers.json")
+	s, err := openReferrerStats(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s.Handler(http.FileServer(http.Dir(tmpDir))))
+	defer srv.Close()
+	get := func(name, referer string) {
+		req, err := http.NewRequest("GET", srv.URL+"/"+name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Referer", referer)
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp.Body.Close()
+	}
+	get("a.png", "https://a.example.com/")
+	get("a.png", "https://b.example.com/")
+	get("a.png", "https://b.example.com/other")
+	get("a.png", srv.URL+"/index.html")
+	get("missing.png", "https://c.example.com/")
+
+	err = s.save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = openReferrerStats(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(counts map[string]int64, expected string) {
+		got := fmt.Sprint(topReferrers(counts, 10))
+		if got != expected {
+			t.Fatalf("expected %s, got %s", expected, got)
+		}
+	}
+	check(s.Total, "[{b.example.com 2} {a.example.com 1}]")
+	check(s.Drawings["a.png"], "[{b.example.com 2} {a.example.com 1}]")
+	s.Remove("a.png")
+	check(s.Drawings["a.png"], "[]")
+	check(s.Total, "[{b.example.com 2} {a.example.com 1}]")
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pmezard/gribouillis/storage"
+)
+
+// remoteHeaders are the response headers of remote storages passed to
+// clients. Content-Type is derived from the file name instead, as objects
+// are stored without one.
+var remoteHeaders = []string{
+	"Accept-Ranges",
+	"Content-Length",
+	"Content-Range",
+	"ETag",
+	"Last-Modified",
+}
+
+// remoteFallback returns a handler serving the drawings named by request
+// paths with h, or streaming them from remote if they are missing from the
+// images directory. Range and conditional requests are answered by remote,
+// and bodies are copied as they are received.
+func remoteFallback(remote storage.Remote, images string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		if r.Method != "GET" && r.Method != "HEAD" || name == "" ||
+			strings.ContainsAny(name, "/\\") || strings.HasPrefix(name, ".") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if _, err := os.Stat(filepath.Join(images, name)); !os.IsNotExist(err) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		rsp, err := remote.Fetch(r.Method, name, r.Header)
+		if err != nil {
+			if os.IsNotExist(err) {
+				h.ServeHTTP(w, r)
+				return
+			}
+			slog.Warn("could not fetch remote drawing", "name", name, "err", err)
+			http.Error(w, "could not fetch drawing", http.StatusBadGateway)
+			return
+		}
+		defer rsp.Body.Close()
+		for _, k := range remoteHeaders {
+			if v := rsp.Header.Get(k); v != "" {
+				w.Header().Set(k, v)
+			}
+		}
+		if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+			// Error bodies describe the remote request, not the drawing
+			w.Header().Del("Content-Length")
+			w.WriteHeader(rsp.StatusCode)
+			return
+		}
+		if t := mime.TypeByExtension(filepath.Ext(name)); t != "" {
+			w.Header().Set("Content-Type", t)
+		}
+		w.WriteHeader(rsp.StatusCode)
+		if r.Method != "HEAD" {
+			io.Copy(w, rsp.Body)
+		}
+	})
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeRemote serves its files like a remote storage would.
+type fakeRemote map[string][]byte
+
+func (f fakeRemote) Fetch(method, name string, header http.Header) (*http.Response, error) {
+	if name == "broken.png" {
+		return nil, fmt.Errorf("connection reset")
+	}
+	data, ok := f[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	req := httptest.NewRequest(method, "/"+name, nil)
+	req.Header = header
+	rec := httptest.NewRecorder()
+	rec.Header().Set("ETag", `"remote"`)
+	rec.Header().Set("Content-Type", "binary/octet-stream")
+	http.ServeContent(rec, req, name, time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+		bytes.NewReader(data))
+	return rec.Result(), nil
+}
+
+func TestRemoteFallback(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "gribouillis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	err = ioutil.WriteFile(filepath.Join(tmpDir, "local.png"), []byte("local"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := fakeRemote{
+		"a.png":     []byte("0123456789"),
+		"local.png": []byte("stale"),
+	}
+	srv := httptest.NewServer(remoteFallback(remote, tmpDir,
+		http.FileServer(http.Dir(tmpDir))))
+	defer srv.Close()
+
+	get := func(method, name string, header http.Header) (*http.Response, string) {
+		req, err := http.NewRequest(method, srv.URL+"/"+name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header = header
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rsp.Body.Close()
+		data, err := ioutil.ReadAll(rsp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rsp, string(data)
+	}
+	rsp, data := get("GET", "a.png", http.Header{})
+	if rsp.StatusCode != 200 || data != "0123456789" ||
+		rsp.Header.Get("Content-Type") != "image/png" ||
+		rsp.Header.Get("ETag") != `"remote"` ||
+		rsp.Header.Get("Accept-Ranges") != "bytes" {
+		t.Fatalf("unexpected response: %d %q %v", rsp.StatusCode, data, rsp.Header)
+	}
+	rsp, data = get("GET", "a.png", http.Header{"Range": {"bytes=-3"}})
+	if rsp.StatusCode != 206 || data != "789" ||
+		rsp.Header.Get("Content-Range") != "bytes 7-9/10" {
+		t.Fatalf("unexpected range response: %d %q", rsp.StatusCode, data)
+	}
+	rsp, data = get("GET", "a.png", http.Header{"If-None-Match": {`"remote"`}})
+	if rsp.StatusCode != 304 || data != "" || rsp.Header.Get("ETag") != `"remote"` {
+		t.Fatalf("unexpected conditional response: %d %q", rsp.StatusCode, data)
+	}
+	rsp, data = get("HEAD", "a.png", http.Header{})
+	if rsp.StatusCode != 200 || rsp.ContentLength != 10 {
+		t.Fatalf("unexpected HEAD response: %d %d", rsp.StatusCode, rsp.ContentLength)
+	}
+	// Local drawings are not fetched
+	if _, data = get("GET", "local.png", http.Header{}); data != "local" {
+		t.Fatalf("unexpected local drawing: %q", data)
+	}
+	if rsp, _ = get("GET", "missing.png", http.Header{}); rsp.StatusCode != 404 {
+		t.Fatalf("expected 404, got %d", rsp.StatusCode)
+	}
+	if rsp, _ = get("GET", "broken.png", http.Header{}); rsp.StatusCode != 502 {
+		t.Fatalf("expected 502, got %d", rsp.StatusCode)
+	}
+}
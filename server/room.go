@@ -0,0 +1,899 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// roomMaxShapes bounds the number of shapes kept by a room.
+	roomMaxShapes = 10000
+	// roomMaxMessage is the maximum size of a message sent by a client.
+	roomMaxMessage = 256 * 1024
+	// roomIdleTTL is the delay after which rooms without clients are
+	// discarded with their shapes.
+	roomIdleTTL = time.Hour
+	// roomSnapshotTTL is the delay to use a snapshot token.
+	roomSnapshotTTL = 5 * time.Minute
+)
+
+var roomIDRe = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// roomTurns is the mode of rooms where participants draw in turn.
+const roomTurns = "turns"
+
+var (
+	errTooManyRooms   = errors.New("too many rooms")
+	errTooManyClients = errors.New("too many participants in room")
+)
+
+// roomLimits bounds the resources used by rooms, so a popular link cannot
+// exhaust the server memory. Zero values mean unlimited.
+type roomLimits struct {
+	// MaxRooms is the number of rooms kept in memory, idle ones included.
+	MaxRooms int
+	// MaxClients is the number of participants of a room, viewers
+	// included.
+	MaxClients int
+	// MessageDelay is the delay after which a participant may send another
+	// message, up to MessageBurst messages in a row.
+	MessageDelay time.Duration
+	MessageBurst int
+	// MaxSize is the total size of the shapes of a room, and MaxTotalSize
+	// of all rooms, in bytes.
+	MaxSize      int64
+	MaxTotalSize int64
+}
+
+// roomMessage is exchanged with room clients. Clients send "shape" messages
+// with the JSON serialization of a LiterallyCanvas shape, and "clear"
+// messages. The server forwards them to the other clients, sends a "state"
+// message with all shapes to joining clients, "clients" messages when the
+// number of participants or viewers changes and "error" messages. Viewers
+// receive the same messages but cannot draw.
+//
+// In turn-based rooms, only the current drawer may send shapes, and a "done"
+// message ends its turn early. The server sends "turn" messages when the
+// drawer changes, and a "snapshot" message to the participant who should
+// save the drawing of the ended turn, with a token exempting the save from
+// the rate limit.
+type roomMessage struct {
+	Type    string            `json:"type"`
+	Shape   json.RawMessage   `json:"shape,omitempty"`
+	Shapes  []json.RawMessage `json:"shapes,omitempty"`
+	Clients int               `json:"clients,omitempty"`
+	Viewers int               `json:"viewers,omitempty"`
+	Error   string            `json:"error,omitempty"`
+	// Mode is "turns" for turn-based rooms, You the participant identifier
+	// and Watch true for viewers, in "state" messages.
+	Mode  string `json:"mode,omitempty"`
+	You   int    `json:"you,omitempty"`
+	Watch bool   `json:"watch,omitempty"`
+	// Turn, Drawer and Ends describe the current turn, Previous is the
+	// drawer of the turn which just ended.
+	Turn     int        `json:"turn,omitempty"`
+	Drawer   int        `json:"drawer,omitempty"`
+	Previous int        `json:"previous,omitempty"`
+	Ends     *time.Time `json:"ends,omitempty"`
+	// Token is the snapshot token of "snapshot" messages.
+	Token string `json:"token,omitempty"`
+}
+
+// room is a shared drawing. It keeps the authoritative list of shapes so
+// late joiners get the current drawing.
+type room struct {
+	id       string
+	registry *roomRegistry
+	lock     sync.Mutex
+	shapes   []json.RawMessage
+	// size is the total size of shapes, in bytes.
+	size    int64
+	clients map[*hubClient]int
+	// viewers holds the clients which only watch the drawing.
+	viewers map[*hubClient]bool
+	lastID  int
+	// left is the time the last client left
+	left time.Time
+
+	// turnTime is the duration of a turn, if participants draw in turn.
+	// queue holds participants in drawing order, the current drawer
+	// first.
+	turnTime time.Duration
+	queue    []*hubClient
+	turn     int
+	ends     time.Time
+	timer    *time.Timer
+}
+
+// send queues m for c, disconnecting it if it does not keep up. It must be
+// called with the room lock held.
+func (r *room) send(c *hubClient, key string, m *roomMessage) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return
+	}
+	if !c.push(hubMessage{Key: key, Data: data}) {
+		// The read loop fails on the closed connection and leaves
+		c.close()
+	}
+}
+
+// broadcast sends m to all clients but from. It must be called with the
+// room lock held.
+func (r *room) broadcast(from *hubClient, key string, m *roomMessage) {
+	for c := range r.clients {
+		if c != from {
+			r.send(c, key, m)
+		}
+	}
+}
+
+// handle applies a message sent by client c.
+func (r *room) handle(c *hubClient, data []byte) {
+	m := &roomMessage{}
+	err := json.Unmarshal(data, m)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err != nil {
+		r.send(c, "", &roomMessage{Type: "error", Error: "invalid message"})
+		return
+	}
+	drawer := r.turnTime <= 0 || (len(r.queue) > 0 && r.queue[0] == c)
+	switch m.Type {
+	case "shape", "clear", "done":
+		if r.viewers[c] {
+			r.send(c, "", &roomMessage{Type: "error", Error: "viewers cannot draw"})
+			return
+		}
+		if !drawer {
+			r.send(c, "", &roomMessage{Type: "error", Error: "not your turn"})
+			return
+		}
+	}
+	switch m.Type {
+	case "shape":
+		if len(m.Shape) == 0 {
+			r.send(c, "", &roomMessage{Type: "error", Error: "missing shape"})
+			return
+		}
+		size := int64(len(m.Shape))
+		limits := r.registry.limits
+		if len(r.shapes) >= roomMaxShapes ||
+			(limits.MaxSize > 0 && r.size+size > limits.MaxSize) {
+			r.send(c, "", &roomMessage{Type: "error", Error: "room is full"})
+			return
+		}
+		total := r.registry.size.Add(size)
+		if limits.MaxTotalSize > 0 && total > limits.MaxTotalSize {
+			r.registry.size.Add(-size)
+			r.send(c, "", &roomMessage{Type: "error", Error: "server is full"})
+			return
+		}
+		r.shapes = append(r.shapes, m.Shape)
+		r.size += size
+		r.broadcast(c, "", &roomMessage{Type: "shape", Shape: m.Shape})
+	case "clear":
+		r.registry.size.Add(-r.size)
+		r.shapes = nil
+		r.size = 0
+		r.broadcast(c, "", &roomMessage{Type: "clear"})
+	case "done":
+		if r.turnTime > 0 {
+			r.endTurn()
+		}
+	default:
+		// Ignore unknown types, sent by newer clients
+	}
+}
+
+// turnMessage returns a "turn" message describing the current turn. It must
+// be called with the room lock held.
+func (r *room) turnMessage(previous int) *roomMessage {
+	m := &roomMessage{Type: "turn", Turn: r.turn, Previous: previous}
+	if len(r.queue) > 0 {
+		ends := r.ends.UTC()
+		m.Drawer = r.clients[r.queue[0]]
+		m.Ends = &ends
+	}
+	return m
+}
+
+// startTurn starts a turn for the first participant of the queue, previous
+// being the identifier of the drawer of the ended turn, if any. It must be
+// called with the room lock held.
+func (r *room) startTurn(previous int) {
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+	r.turn++
+	if len(r.queue) > 0 {
+		turn := r.turn
+		r.ends = time.Now().Add(r.turnTime)
+		r.timer = time.AfterFunc(r.turnTime, func() {
+			r.lock.Lock()
+			defer r.lock.Unlock()
+			if r.turn == turn && len(r.queue) > 0 {
+				r.endTurn()
+			}
+		})
+	}
+	r.broadcast(nil, "", r.turnMessage(previous))
+	if previous != 0 && len(r.shapes) > 0 {
+		r.requestSnapshot(previous)
+	}
+}
+
+// requestSnapshot asks the drawer of the turn which just ended, identified
+// by previous, to save the drawing, or the new drawer if the previous one
+// left. It must be called with the room lock held.
+func (r *room) requestSnapshot(previous int) {
+	var saver *hubClient
+	for c, id := range r.clients {
+		if id == previous {
+			saver = c
+		}
+	}
+	if saver == nil && len(r.queue) > 0 {
+		saver = r.queue[0]
+	}
+	if saver == nil {
+		return
+	}
+	token, err := r.registry.snapshots.Issue(r.id, time.Now())
+	if err != nil {
+		return
+	}
+	r.send(saver, "", &roomMessage{Type: "snapshot", Token: token})
+}
+
+// endTurn moves the current drawer to the end of the queue and starts the
+// next turn. It must be called with the room lock held.
+func (r *room) endTurn() {
+	c := r.queue[0]
+	r.queue = append(r.queue[1:], c)
+	r.startTurn(r.clients[c])
+}
+
+// clientsMessage returns a "clients" message counting the participants and
+// viewers. It must be called with the room lock held.
+func (r *room) clientsMessage() *roomMessage {
+	return &roomMessage{
+		Type:    "clients",
+		Clients: len(r.clients) - len(r.viewers),
+		Viewers: len(r.viewers),
+	}
+}
+
+// join adds c to the room, as a viewer if watch is true.
+func (r *room) join(c *hubClient, watch bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.lastID++
+	r.clients[c] = r.lastID
+	if watch {
+		r.viewers[c] = true
+	}
+	shapes := r.shapes
+	if shapes == nil {
+		shapes = []json.RawMessage{}
+	}
+	state := &roomMessage{Type: "state", Shapes: shapes, You: r.lastID,
+		Watch: watch}
+	if r.turnTime > 0 {
+		state.Mode = roomTurns
+	}
+	r.send(c, "", state)
+	r.broadcast(nil, "clients", r.clientsMessage())
+	if r.turnTime > 0 && watch {
+		r.send(c, "", r.turnMessage(0))
+	} else if r.turnTime > 0 {
+		r.queue = append(r.queue, c)
+		if len(r.queue) == 1 {
+			r.startTurn(0)
+		} else {
+			r.send(c, "", r.turnMessage(0))
+		}
+	}
+}
+
+func (r *room) leave(c *hubClient) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	id := r.clients[c]
+	drawing := len(r.queue) > 0 && r.queue[0] == c
+	for i, q := range r.queue {
+		if q == c {
+			r.queue = append(r.queue[:i:i], r.queue[i+1:]...)
+			break
+		}
+	}
+	delete(r.clients, c)
+	delete(r.viewers, c)
+	if len(r.clients) == 0 {
+		r.left = time.Now()
+	}
+	r.broadcast(nil, "clients", r.clientsMessage())
+	if drawing {
+		// The next participant is already first in the queue
+		r.startTurn(id)
+	}
+}
+
+// roomRegistry serves shared drawing rooms over WebSocket. Rooms are created
+// when first joined and live in memory, Close saving them so they survive
+// restarts.
+type roomRegistry struct {
+	upgrader websocket.Upgrader
+	turnTime time.Duration
+	limits   roomLimits
+	// invites checks the members of private rooms, if enabled.
+	invites   *roomInvites
+	snapshots *roomSnapshots
+	lock      sync.Mutex
+	rooms     map[string]*room
+	// rejected counts the connections refused by limits, throttled the
+	// messages dropped because their sender exceeded its rate.
+	rejected  int64
+	throttled int64
+	// size is the total size of the shapes of all rooms, in bytes, updated
+	// with the lock of the changed room held.
+	size atomic.Int64
+}
+
+// newRoomRegistry returns a registry whose turn-based rooms have turns of
+// turnTime, bounded by limits.
+func newRoomRegistry(turnTime time.Duration, limits roomLimits) *roomRegistry {
+	return &roomRegistry{
+		upgrader: websocket.Upgrader{
+			// Anyone knowing a room identifier may join it
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+		turnTime:  turnTime,
+		limits:    limits,
+		snapshots: newRoomSnapshots(),
+		rooms:     map[string]*room{},
+	}
+}
+
+// roomSnapshot is a pending snapshot of a room.
+type roomSnapshot struct {
+	room    string
+	expires time.Time
+}
+
+// roomSnapshots holds one-time tokens exempting the turn snapshots of rooms
+// from the save rate limit. A nil *roomSnapshots accepts no token.
+type roomSnapshots struct {
+	lock   sync.Mutex
+	tokens map[string]roomSnapshot
+}
+
+func newRoomSnapshots() *roomSnapshots {
+	return &roomSnapshots{tokens: map[string]roomSnapshot{}}
+}
+
+// Issue returns a new snapshot token of room, valid for roomSnapshotTTL.
+func (s *roomSnapshots) Issue(room string, now time.Time) (string, error) {
+	buf := make([]byte, 16)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for t, sn := range s.tokens {
+		if now.After(sn.expires) {
+			delete(s.tokens, t)
+		}
+	}
+	s.tokens[token] = roomSnapshot{room: room, expires: now.Add(roomSnapshotTTL)}
+	return token, nil
+}
+
+// Use returns true and forgets token if it is a valid snapshot token of
+// room.
+func (s *roomSnapshots) Use(room, token string, now time.Time) bool {
+	if s == nil {
+		return false
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	sn, ok := s.tokens[token]
+	if !ok || sn.room != room || now.After(sn.expires) {
+		return false
+	}
+	delete(s.tokens, token)
+	return true
+}
+
+// admit returns an error if a participant may not join room id. Creating a
+// room when there are too many discards the one idle for the longest time,
+// if any. It must be called with the registry lock held.
+func (g *roomRegistry) admit(id string) error {
+	r := g.rooms[id]
+	if r == nil {
+		if g.limits.MaxRooms <= 0 || len(g.rooms) < g.limits.MaxRooms {
+			return nil
+		}
+		idleID := ""
+		var idleSince time.Time
+		for other, o := range g.rooms {
+			o.lock.Lock()
+			if len(o.clients) == 0 && (idleID == "" || o.left.Before(idleSince)) {
+				idleID, idleSince = other, o.left
+			}
+			o.lock.Unlock()
+		}
+		if idleID == "" {
+			g.rejected++
+			return errTooManyRooms
+		}
+		g.remove(idleID)
+		return nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if g.limits.MaxClients > 0 && len(r.clients) >= g.limits.MaxClients {
+		g.rejected++
+		return errTooManyClients
+	}
+	return nil
+}
+
+// newRoom returns an empty room id of the registry.
+func (g *roomRegistry) newRoom(id string) *room {
+	return &room{
+		id:       id,
+		registry: g,
+		clients:  map[*hubClient]int{},
+		viewers:  map[*hubClient]bool{},
+	}
+}
+
+// join adds c to room id, as a viewer if watch is true, creating the room in
+// mode if necessary, unless limits are exceeded.
+func (g *roomRegistry) join(id, mode string, watch bool, c *hubClient) (*room, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	err := g.admit(id)
+	if err != nil {
+		return nil, err
+	}
+	r := g.rooms[id]
+	if r == nil {
+		r = g.newRoom(id)
+		if mode == roomTurns {
+			r.turnTime = g.turnTime
+		}
+		g.rooms[id] = r
+	}
+	r.join(c, watch)
+	return r, nil
+}
+
+// Prune discards rooms without clients since roomIdleTTL.
+func (g *roomRegistry) Prune(now time.Time) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for id, r := range g.rooms {
+		r.lock.Lock()
+		idle := len(r.clients) == 0 && now.Sub(r.left) > roomIdleTTL
+		r.lock.Unlock()
+		if idle {
+			g.remove(id)
+		}
+	}
+}
+
+// remove discards room id and its shapes. It must be called with the
+// registry lock held.
+func (g *roomRegistry) remove(id string) {
+	r := g.rooms[id]
+	r.lock.Lock()
+	g.size.Add(-r.size)
+	r.lock.Unlock()
+	delete(g.rooms, id)
+}
+
+// savedRoom is a room saved by roomRegistry.Close.
+type savedRoom struct {
+	Mode   string            `json:"mode,omitempty"`
+	Shapes []json.RawMessage `json:"shapes"`
+}
+
+// defaultRoomsPath returns the rooms file used with imagesDir.
+func defaultRoomsPath(imagesDir string) string {
+	return filepath.Clean(imagesDir) + "-rooms.json"
+}
+
+// Load restores the rooms saved in path, if any, as idle rooms. The file is
+// removed so a later crash does not restore them again.
+func (g *roomRegistry) Load(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	saved := map[string]*savedRoom{}
+	err = json.Unmarshal(data, &saved)
+	if err != nil {
+		return fmt.Errorf("could not parse %s: %s", path, err)
+	}
+	now := time.Now()
+	g.lock.Lock()
+	for id, s := range saved {
+		if !roomIDRe.MatchString(id) {
+			continue
+		}
+		r := g.newRoom(id)
+		r.shapes = s.Shapes
+		r.left = now
+		for _, shape := range s.Shapes {
+			r.size += int64(len(shape))
+		}
+		g.size.Add(r.size)
+		if s.Mode == roomTurns {
+			r.turnTime = g.turnTime
+		}
+		g.rooms[id] = r
+	}
+	g.lock.Unlock()
+	return os.Remove(path)
+}
+
+// Close disconnects the participants, telling them the server is
+// restarting, and saves the rooms with shapes in path, for Load.
+func (g *roomRegistry) Close(path string) error {
+	saved := map[string]*savedRoom{}
+	clients := []*hubClient{}
+	g.lock.Lock()
+	for id, r := range g.rooms {
+		r.lock.Lock()
+		if r.timer != nil {
+			r.timer.Stop()
+			r.timer = nil
+		}
+		for c := range r.clients {
+			clients = append(clients, c)
+		}
+		if len(r.shapes) > 0 {
+			s := &savedRoom{Shapes: r.shapes}
+			if r.turnTime > 0 {
+				s.Mode = roomTurns
+			}
+			saved[id] = s
+		}
+		r.lock.Unlock()
+	}
+	g.lock.Unlock()
+	for _, c := range clients {
+		c.closeWith(websocket.CloseServiceRestart, "server restarting")
+	}
+	if len(saved) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// disconnect closes the connections of the participants of room id, with
+// code and text.
+func (g *roomRegistry) disconnect(id string, code int, text string) {
+	clients := []*hubClient{}
+	g.lock.Lock()
+	if r := g.rooms[id]; r != nil {
+		r.lock.Lock()
+		for c := range r.clients {
+			clients = append(clients, c)
+		}
+		r.lock.Unlock()
+	}
+	g.lock.Unlock()
+	for _, c := range clients {
+		c.closeWith(code, text)
+	}
+}
+
+// roomStats describes a room to administrators.
+type roomStats struct {
+	ID   string `json:"id"`
+	Mode string `json:"mode,omitempty"`
+	// Clients counts the participants who may draw, Viewers the ones only
+	// watching.
+	Clients int `json:"clients"`
+	Viewers int `json:"viewers"`
+	Shapes  int `json:"shapes"`
+	// Size is the total size of the shapes, in bytes.
+	Size int64 `json:"size"`
+	// Left is the time the last participant left empty rooms.
+	Left *time.Time `json:"left,omitempty"`
+}
+
+// adminRoomsResponse is returned by the admin rooms endpoint. Zero limits
+// mean unlimited.
+type adminRoomsResponse struct {
+	Rooms      []roomStats `json:"rooms"`
+	MaxRooms   int         `json:"max_rooms"`
+	MaxClients int         `json:"max_clients"`
+	// Size is the total size of the rooms shapes, bounded by MaxTotalSize,
+	// and MaxSize the bound of each room, in bytes.
+	Size         int64 `json:"size"`
+	MaxSize      int64 `json:"max_size"`
+	MaxTotalSize int64 `json:"max_total_size"`
+	Rejected     int64 `json:"rejected"`
+	Throttled    int64 `json:"throttled"`
+}
+
+// Stats describes the rooms, the most populated first, and the limits.
+func (g *roomRegistry) Stats() *adminRoomsResponse {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	rsp := &adminRoomsResponse{
+		Rooms:        []roomStats{},
+		MaxRooms:     g.limits.MaxRooms,
+		MaxClients:   g.limits.MaxClients,
+		Size:         g.size.Load(),
+		MaxSize:      g.limits.MaxSize,
+		MaxTotalSize: g.limits.MaxTotalSize,
+		Rejected:     g.rejected,
+		Throttled:    g.throttled,
+	}
+	for id, r := range g.rooms {
+		r.lock.Lock()
+		st := roomStats{
+			ID:      id,
+			Clients: len(r.clients) - len(r.viewers),
+			Viewers: len(r.viewers),
+			Shapes:  len(r.shapes),
+			Size:    r.size,
+		}
+		if r.turnTime > 0 {
+			st.Mode = roomTurns
+		}
+		if len(r.clients) == 0 {
+			left := r.left.UTC()
+			st.Left = &left
+		}
+		r.lock.Unlock()
+		rsp.Rooms = append(rsp.Rooms, st)
+	}
+	sort.Slice(rsp.Rooms, func(i, j int) bool {
+		a, b := rsp.Rooms[i], rsp.Rooms[j]
+		if a.Clients+a.Viewers != b.Clients+b.Viewers {
+			return a.Clients+a.Viewers > b.Clients+b.Viewers
+		}
+		return a.ID < b.ID
+	})
+	return rsp
+}
+
+// Run prunes idle rooms every interval, until ctx is done.
+func (g *roomRegistry) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			g.Prune(now)
+		}
+	}
+}
+
+// ServeHTTP upgrades the request to a WebSocket connection and joins the
+// room named by the last path element. Rooms created with a "mode" query
+// parameter set to "turns" are turn-based.
+func (g *roomRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	id := path.Base(req.URL.Path)
+	if !roomIDRe.MatchString(id) {
+		writeAPIError(w, http.StatusBadRequest, "invalid room identifier")
+		return
+	}
+	mode := req.URL.Query().Get("mode")
+	if mode != "" && mode != roomTurns {
+		writeAPIError(w, http.StatusBadRequest, "invalid room mode")
+		return
+	}
+	watch := req.URL.Query().Get("watch") == "1"
+	err := g.invites.Check(id, req)
+	if err != nil {
+		writeAPIError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	g.lock.Lock()
+	err = g.admit(id)
+	g.lock.Unlock()
+	if err != nil {
+		writeAPIError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	conn, err := g.upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		// The upgrader already replied
+		return
+	}
+	c := newHubClient(conn)
+	r, err := g.join(id, mode, watch, c)
+	if err != nil {
+		// Limits were reached while upgrading
+		c.closeWith(websocket.CloseTryAgainLater, err.Error())
+		return
+	}
+	defer func() {
+		r.leave(c)
+		c.close()
+	}()
+	go c.writeLoop()
+	conn.SetReadLimit(roomMaxMessage)
+	limiter := newRateLimiter(g.limits.MessageDelay, g.limits.MessageBurst)
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if !limiter.Allow("", time.Now()) {
+			g.lock.Lock()
+			g.throttled++
+			g.lock.Unlock()
+			r.lock.Lock()
+			r.send(c, "", &roomMessage{Type: "error", Error: "too many messages"})
+			r.lock.Unlock()
+			continue
+		}
+		r.handle(c, data)
+	}
+}
+
+// roomPage serves index.html for "{id}" paths, and other frontend files as
+// is, so the page relative links work.
+func roomPage(web http.FileSystem) http.Handler {
+	files := http.FileServer(web)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/")
+		if !roomIDRe.MatchString(id) {
+			files.ServeHTTP(w, r)
+			return
+		}
+		f, err := web.Open("/index.html")
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+		st, err := f.Stat()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-cache")
+		http.ServeContent(w, r, "index.html", st.ModTime(), f)
+	})
+}
+
+// setupRooms serves shared drawing rooms, if enabled.
+func (h *Handler) setupRooms() error {
+	cfg := h.cfg
+	if cfg.RoomSecret != "" {
+		invitesPath := cfg.RoomInvitesPath
+		if invitesPath == "" {
+			invitesPath = defaultRoomInvitesPath(cfg.ImagesDir)
+		}
+		invites, err := openRoomInvites(cfg.RoomSecret, invitesPath)
+		if err != nil {
+			return err
+		}
+		h.invites = invites
+		h.onClose(func() {
+			err := invites.Save()
+			if err != nil {
+				slog.Error("could not save private rooms", "err", err)
+			}
+		})
+	}
+	if !cfg.Rooms {
+		return nil
+	}
+	turnTime, err := time.ParseDuration(cfg.RoomTurnTime)
+	if err != nil {
+		return err
+	}
+	if turnTime <= 0 {
+		return fmt.Errorf("room turn time must be positive: %s",
+			cfg.RoomTurnTime)
+	}
+	messageDelay, err := time.ParseDuration(cfg.RoomMessageDelay)
+	if err != nil {
+		return err
+	}
+	maxRoomSize, err := humanize.ParseBytes(cfg.RoomMaxSize)
+	if err != nil {
+		return err
+	}
+	maxRoomsSize, err := humanize.ParseBytes(cfg.RoomMaxTotalSize)
+	if err != nil {
+		return err
+	}
+	h.rooms = newRoomRegistry(turnTime, roomLimits{
+		MaxRooms:     cfg.RoomMaxCount,
+		MaxClients:   cfg.RoomMaxClients,
+		MessageDelay: messageDelay,
+		MessageBurst: cfg.RoomMessageBurst,
+		MaxSize:      int64(maxRoomSize),
+		MaxTotalSize: int64(maxRoomsSize),
+	})
+	roomsPath := cfg.RoomsPath
+	if roomsPath == "" {
+		roomsPath = defaultRoomsPath(cfg.ImagesDir)
+	}
+	err = h.rooms.Load(roomsPath)
+	if err != nil {
+		return err
+	}
+	h.onClose(func() {
+		err := h.rooms.Close(roomsPath)
+		if err != nil {
+			slog.Error("could not save rooms", "err", err)
+		}
+	})
+	h.run(func(ctx context.Context) { h.rooms.Run(ctx, time.Minute) })
+	h.rooms.invites = h.invites
+	h.optional = append(h.optional, &apiRoute{
+		Method:  "GET",
+		Path:    "/rooms/{id}",
+		Summary: "Join a shared drawing room over a WebSocket",
+		Feature: "rooms",
+		Handler: h.rooms.ServeHTTP,
+	})
+	if h.invites != nil {
+		h.optional = append(h.optional, &apiRoute{
+			Method:   "POST",
+			Path:     "/rooms",
+			Summary:  "Create a private room and return its invite",
+			Feature:  "room-invites",
+			Response: &inviteResponse{},
+			Handler:  h.invites.serveNewRoom,
+		}, &apiRoute{
+			Method:   "POST",
+			Path:     "/rooms/{id}/revoke",
+			Summary:  "Replace the invite of a private room and remove its members",
+			Feature:  "room-invites",
+			Response: &inviteResponse{},
+			Handler:  h.revokeInvite,
+		})
+	}
+	h.mux.Handle("/room/", h.redeemInvites(
+		http.StripPrefix("/room", roomPage(h.web))))
+	return nil
+}
@@ -0,0 +1,491 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// readRoomMessage returns the next message of conn which is not a "clients"
+// one.
+func readRoomMessage(t *testing.T, conn *websocket.Conn) *roomMessage {
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		m := &roomMessage{}
+		err := conn.ReadJSON(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Type != "clients" {
+			return m
+		}
+	}
+}
+
+func TestRoom(t *testing.T) {
+	rooms := newRoomRegistry(time.Minute, roomLimits{})
+	srv := httptest.NewServer(rooms)
+	defer srv.Close()
+
+	alice := dialTestHub(t, srv.URL+"/rooms/abc")
+	defer alice.Close()
+	if m := readRoomMessage(t, alice); m.Type != "state" || len(m.Shapes) != 0 {
+		t.Fatalf("unexpected initial state: %+v", m)
+	}
+	bob := dialTestHub(t, srv.URL+"/rooms/abc")
+	defer bob.Close()
+	readRoomMessage(t, bob)
+
+	err := alice.WriteMessage(websocket.TextMessage,
+		[]byte(`{"type":"shape","shape":{"className":"Line"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := readRoomMessage(t, bob)
+	if m.Type != "shape" || string(m.Shape) != `{"className":"Line"}` {
+		t.Fatalf("unexpected shape message: %+v", m)
+	}
+
+	// Late joiners get the current drawing, other rooms are independent
+	carol := dialTestHub(t, srv.URL+"/rooms/abc")
+	defer carol.Close()
+	if m := readRoomMessage(t, carol); m.Type != "state" || len(m.Shapes) != 1 {
+		t.Fatalf("unexpected late joiner state: %+v", m)
+	}
+	other := dialTestHub(t, srv.URL+"/rooms/def")
+	defer other.Close()
+	if m := readRoomMessage(t, other); len(m.Shapes) != 0 {
+		t.Fatalf("unexpected other room state: %+v", m)
+	}
+
+	err = bob.WriteMessage(websocket.TextMessage, []byte(`{"type":"clear"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := readRoomMessage(t, alice); m.Type != "clear" {
+		t.Fatalf("unexpected clear message: %+v", m)
+	}
+	err = bob.WriteMessage(websocket.TextMessage, []byte(`{"type":`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := readRoomMessage(t, bob); m.Type != "error" {
+		t.Fatalf("expected an error, got %+v", m)
+	}
+
+	// Rooms outlive their participants for a while
+	alice.Close()
+	bob.Close()
+	carol.Close()
+	other.Close()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		rooms.Prune(time.Now())
+		rooms.lock.Lock()
+		n := len(rooms.rooms)
+		r := rooms.rooms["abc"]
+		rooms.lock.Unlock()
+		if n != 2 {
+			t.Fatalf("rooms were pruned too early: %d left", n)
+		}
+		r.lock.Lock()
+		clients := len(r.clients)
+		r.lock.Unlock()
+		if clients == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("clients did not leave")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	rooms.Prune(time.Now().Add(2 * roomIdleTTL))
+	rooms.lock.Lock()
+	_, ok := rooms.rooms["abc"]
+	rooms.lock.Unlock()
+	if ok {
+		t.Fatal("idle room was not pruned")
+	}
+}
+
+func TestRoomTurns(t *testing.T) {
+	rooms := newRoomRegistry(time.Minute, roomLimits{})
+	srv := httptest.NewServer(rooms)
+	defer srv.Close()
+
+	alice := dialTestHub(t, srv.URL+"/rooms/abc?mode=turns")
+	defer alice.Close()
+	state := readRoomMessage(t, alice)
+	if state.Mode != roomTurns || state.You != 1 {
+		t.Fatalf("unexpected state: %+v", state)
+	}
+	m := readRoomMessage(t, alice)
+	if m.Type != "turn" || m.Turn != 1 || m.Drawer != 1 || m.Ends == nil {
+		t.Fatalf("unexpected first turn: %+v", m)
+	}
+	// The mode is set when the room is created
+	bob := dialTestHub(t, srv.URL+"/rooms/abc")
+	defer bob.Close()
+	if m := readRoomMessage(t, bob); m.Mode != roomTurns || m.You != 2 {
+		t.Fatalf("unexpected state: %+v", m)
+	}
+	if m := readRoomMessage(t, bob); m.Type != "turn" || m.Drawer != 1 {
+		t.Fatalf("unexpected turn: %+v", m)
+	}
+
+	send := func(conn *websocket.Conn, data string) {
+		err := conn.WriteMessage(websocket.TextMessage, []byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	send(bob, `{"type":"shape","shape":{}}`)
+	if m := readRoomMessage(t, bob); m.Error != "not your turn" {
+		t.Fatalf("expected an error, got %+v", m)
+	}
+	send(alice, `{"type":"shape","shape":{}}`)
+	if m := readRoomMessage(t, bob); m.Type != "shape" {
+		t.Fatalf("unexpected message: %+v", m)
+	}
+	send(alice, `{"type":"done"}`)
+	for _, conn := range []*websocket.Conn{alice, bob} {
+		m := readRoomMessage(t, conn)
+		if m.Type != "turn" || m.Turn != 2 || m.Drawer != 2 || m.Previous != 1 {
+			t.Fatalf("unexpected second turn: %+v", m)
+		}
+	}
+	// The previous drawer saves the drawing, exempted from the rate limit
+	// once
+	m = readRoomMessage(t, alice)
+	if m.Type != "snapshot" || m.Token == "" {
+		t.Fatalf("expected a snapshot request, got %+v", m)
+	}
+	now := time.Now()
+	if rooms.snapshots.Use("def", m.Token, now) ||
+		!rooms.snapshots.Use("abc", m.Token, now) ||
+		rooms.snapshots.Use("abc", m.Token, now) {
+		t.Fatalf("snapshot token is not a one-time token of its room")
+	}
+
+	// The turn passes to the next participant when the drawer leaves, and
+	// the new drawer saves the drawing in place of the departed one
+	bob.Close()
+	m = readRoomMessage(t, alice)
+	if m.Type != "turn" || m.Turn != 3 || m.Drawer != 1 || m.Previous != 2 {
+		t.Fatalf("unexpected third turn: %+v", m)
+	}
+	if m = readRoomMessage(t, alice); m.Type != "snapshot" {
+		t.Fatalf("expected a snapshot request, got %+v", m)
+	}
+}
+
+func TestRoomTurnTimeout(t *testing.T) {
+	rooms := newRoomRegistry(50*time.Millisecond, roomLimits{})
+	srv := httptest.NewServer(rooms)
+	defer srv.Close()
+
+	alice := dialTestHub(t, srv.URL+"/rooms/abc?mode=turns")
+	defer alice.Close()
+	readRoomMessage(t, alice)
+	if m := readRoomMessage(t, alice); m.Turn != 1 {
+		t.Fatalf("unexpected turn: %+v", m)
+	}
+	if m := readRoomMessage(t, alice); m.Turn != 2 || m.Previous != 1 ||
+		m.Drawer != 1 {
+		t.Fatalf("turn did not time out: %+v", m)
+	}
+}
+
+func TestRoomLimits(t *testing.T) {
+	rooms := newRoomRegistry(time.Minute, roomLimits{
+		MaxRooms:     1,
+		MaxClients:   2,
+		MessageDelay: time.Hour,
+		MessageBurst: 1,
+	})
+	srv := httptest.NewServer(rooms)
+	defer srv.Close()
+	dialRejected := func(id string) {
+		url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/rooms/" + id
+		conn, rsp, err := websocket.DefaultDialer.Dial(url, nil)
+		if err == nil {
+			conn.Close()
+			t.Fatalf("%s: expected a rejected connection", id)
+		}
+		if rsp == nil || rsp.StatusCode != 503 {
+			t.Fatalf("%s: expected 503, got %v", id, err)
+		}
+	}
+
+	alice := dialTestHub(t, srv.URL+"/rooms/abc")
+	defer alice.Close()
+	readRoomMessage(t, alice)
+	bob := dialTestHub(t, srv.URL+"/rooms/abc")
+	defer bob.Close()
+	readRoomMessage(t, bob)
+	dialRejected("abc")
+	dialRejected("def")
+
+	// Messages beyond the burst are dropped
+	for i := 0; i < 2; i++ {
+		err := alice.WriteMessage(websocket.TextMessage,
+			[]byte(`{"type":"shape","shape":{}}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if m := readRoomMessage(t, bob); m.Type != "shape" {
+		t.Fatalf("unexpected message: %+v", m)
+	}
+	if m := readRoomMessage(t, alice); m.Error != "too many messages" {
+		t.Fatalf("expected an error, got %+v", m)
+	}
+	stats := rooms.Stats()
+	if len(stats.Rooms) != 1 || stats.Rooms[0] != (roomStats{
+		ID: "abc", Clients: 2, Shapes: 1, Size: 2,
+	}) || stats.MaxRooms != 1 || stats.MaxClients != 2 ||
+		stats.Rejected != 2 || stats.Throttled != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	// Idle rooms make room for new ones
+	alice.Close()
+	bob.Close()
+	deadline := time.Now().Add(10 * time.Second)
+	for rooms.Stats().Rooms[0].Clients != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("clients did not leave")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	carol := dialTestHub(t, srv.URL+"/rooms/def")
+	defer carol.Close()
+	readRoomMessage(t, carol)
+	stats = rooms.Stats()
+	if len(stats.Rooms) != 1 || stats.Rooms[0].ID != "def" {
+		t.Fatalf("unexpected rooms: %+v", stats.Rooms)
+	}
+}
+
+func TestRoomRestart(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "gribouillis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "rooms.json")
+
+	rooms := newRoomRegistry(time.Minute, roomLimits{})
+	srv := httptest.NewServer(rooms)
+	defer srv.Close()
+	alice := dialTestHub(t, srv.URL+"/rooms/abc?mode=turns")
+	defer alice.Close()
+	readRoomMessage(t, alice)
+	readRoomMessage(t, alice)
+	err = alice.WriteMessage(websocket.TextMessage,
+		[]byte(`{"type":"shape","shape":{"className":"Line"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Wait for the shape to be applied
+	err = alice.WriteMessage(websocket.TextMessage, []byte(`{"type":`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	readRoomMessage(t, alice)
+	empty := dialTestHub(t, srv.URL+"/rooms/def")
+	defer empty.Close()
+	readRoomMessage(t, empty)
+
+	// Participants are asked to reconnect
+	err = rooms.Close(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice.SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, _, err = alice.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseServiceRestart) {
+		t.Fatalf("expected a restart close message, got %v", err)
+	}
+
+	restarted := newRoomRegistry(time.Minute, roomLimits{})
+	err = restarted.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("rooms file was not removed: %v", err)
+	}
+	srv2 := httptest.NewServer(restarted)
+	defer srv2.Close()
+	bob := dialTestHub(t, srv2.URL+"/rooms/abc")
+	defer bob.Close()
+	if m := readRoomMessage(t, bob); m.Type != "state" || m.Mode != roomTurns ||
+		len(m.Shapes) != 1 || string(m.Shapes[0]) != `{"className":"Line"}` {
+		t.Fatalf("unexpected restored state: %+v", m)
+	}
+	// Rooms without shapes are not saved
+	stats := restarted.Stats()
+	if len(stats.Rooms) != 1 || stats.Rooms[0].Size != 20 {
+		t.Fatalf("unexpected restored rooms: %+v", stats.Rooms)
+	}
+}
+
+func TestRoomSizeLimits(t *testing.T) {
+	rooms := newRoomRegistry(time.Minute, roomLimits{
+		MaxSize:      30,
+		MaxTotalSize: 50,
+	})
+	srv := httptest.NewServer(rooms)
+	defer srv.Close()
+	// draw sends a 20 bytes shape in conn room and returns the error it
+	// caused, if any.
+	draw := func(conn *websocket.Conn) string {
+		for _, m := range []string{
+			`{"type":"shape","shape":{"className":"Line"}}`,
+			`{"type":`,
+		} {
+			err := conn.WriteMessage(websocket.TextMessage, []byte(m))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		m := readRoomMessage(t, conn)
+		if m.Error == "invalid message" {
+			return ""
+		}
+		readRoomMessage(t, conn)
+		return m.Error
+	}
+	join := func(id string) *websocket.Conn {
+		conn := dialTestHub(t, srv.URL+"/rooms/"+id)
+		readRoomMessage(t, conn)
+		return conn
+	}
+
+	alice := join("abc")
+	defer alice.Close()
+	if e := draw(alice); e != "" {
+		t.Fatalf("unexpected error: %s", e)
+	}
+	if e := draw(alice); e != "room is full" {
+		t.Fatalf("expected a full room, got %q", e)
+	}
+	bob := join("def")
+	defer bob.Close()
+	if e := draw(bob); e != "" {
+		t.Fatalf("unexpected error: %s", e)
+	}
+	carol := join("ghi")
+	defer carol.Close()
+	if e := draw(carol); e != "server is full" {
+		t.Fatalf("expected a full server, got %q", e)
+	}
+	if st := rooms.Stats(); st.Size != 40 || st.MaxSize != 30 ||
+		st.MaxTotalSize != 50 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+
+	// Clearing a room frees space for the others
+	for _, m := range []string{`{"type":"clear"}`, `{"type":`} {
+		err := alice.WriteMessage(websocket.TextMessage, []byte(m))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	readRoomMessage(t, alice)
+	if e := draw(carol); e != "" {
+		t.Fatalf("unexpected error: %s", e)
+	}
+	if st := rooms.Stats(); st.Size != 40 {
+		t.Fatalf("unexpected size: %d", st.Size)
+	}
+	bob.Close()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		rooms.Prune(time.Now().Add(2 * roomIdleTTL))
+		if rooms.Stats().Size == 20 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pruned room size was not released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRoomViewers(t *testing.T) {
+	rooms := newRoomRegistry(time.Minute, roomLimits{})
+	srv := httptest.NewServer(rooms)
+	defer srv.Close()
+	// readClients returns the next "clients" message of conn.
+	readClients := func(conn *websocket.Conn) *roomMessage {
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		for {
+			m := &roomMessage{}
+			err := conn.ReadJSON(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Type == "clients" {
+				return m
+			}
+		}
+	}
+
+	teacher := dialTestHub(t, srv.URL+"/rooms/abc?mode=turns")
+	defer teacher.Close()
+	if m := readClients(teacher); m.Clients != 1 || m.Viewers != 0 {
+		t.Fatalf("unexpected clients: %+v", m)
+	}
+	readRoomMessage(t, teacher)
+	viewer := dialTestHub(t, srv.URL+"/rooms/abc?watch=1")
+	defer viewer.Close()
+	if m := readRoomMessage(t, viewer); m.Type != "state" || !m.Watch {
+		t.Fatalf("unexpected viewer state: %+v", m)
+	}
+	// Viewers do not take turns
+	if m := readRoomMessage(t, viewer); m.Type != "turn" || m.Drawer != 1 {
+		t.Fatalf("unexpected turn: %+v", m)
+	}
+	if m := readClients(teacher); m.Clients != 1 || m.Viewers != 1 {
+		t.Fatalf("unexpected clients: %+v", m)
+	}
+
+	err := teacher.WriteMessage(websocket.TextMessage,
+		[]byte(`{"type":"shape","shape":{"className":"Line"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := readRoomMessage(t, viewer); m.Type != "shape" {
+		t.Fatalf("unexpected message: %+v", m)
+	}
+	for _, msg := range []string{
+		`{"type":"shape","shape":{"className":"Line"}}`,
+		`{"type":"clear"}`,
+		`{"type":"done"}`,
+	} {
+		err := viewer.WriteMessage(websocket.TextMessage, []byte(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m := readRoomMessage(t, viewer); m.Error != "viewers cannot draw" {
+			t.Fatalf("%s: expected an error, got %+v", msg, m)
+		}
+	}
+	stats := rooms.Stats()
+	if len(stats.Rooms) != 1 || stats.Rooms[0].Clients != 1 ||
+		stats.Rooms[0].Viewers != 1 || stats.Rooms[0].Shapes != 1 {
+		t.Fatalf("unexpected stats: %+v", stats.Rooms)
+	}
+	viewer.Close()
+	if m := readClients(teacher); m.Clients != 1 || m.Viewers != 0 {
+		t.Fatalf("unexpected clients: %+v", m)
+	}
+}
@@ -0,0 +1,618 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/pmezard/gribouillis/imageproc"
+	"github.com/pmezard/gribouillis/storage"
+)
+
+// saveOptions controls how posted drawings are processed.
+type saveOptions struct {
+	maxImgSize int64
+	// minImgSize, minWidth and minHeight reject smaller posted images, if
+	// positive.
+	minImgSize int64
+	minWidth   int
+	minHeight  int
+	// processTimeout bounds image processing duration, if positive.
+	processTimeout time.Duration
+	imageproc.Options
+	// fsync flushes saved drawings and the images directory to stable
+	// storage before they are registered.
+	fsync bool
+	// namePattern is the stored file name pattern, see checkNamePattern.
+	namePattern string
+	// taken, if set, reports file names which must not be allocated, like
+	// reserved or existing ones.
+	taken func(name string) bool
+	// check, if set, is called with the allocated file name and the path of
+	// the hidden temporary file before the drawing is linked into the
+	// directory. Returning an error rejects the drawing.
+	check func(name, path string) error
+}
+
+// save decode posted PNG, or JPEG and GIF converted to PNG, and save it with
+// a random name into dir. It returns the file name, to be registered by the
+// caller in the images LimitedDir. Processing is abandoned, and the partial
+// file removed, if the client disconnects or if decoding, padding and encoding
+// the image take longer than the processing timeout.
+// imageproc.ErrProcessTimeout is returned in the latter case. Payloads which
+// are not PNG, JPEG or GIF images are rejected with a
+// *imageproc.MediaTypeError before creating any file, images smaller than the
+// minimum size or dimensions with a *imageproc.RejectedImageError before being
+// kept. With a content addressed name pattern, images identical to a stored
+// drawing are discarded and a *duplicateError returned, with the drawing
+// name if it is in dir. Errors returned by the check option are returned as
+// is.
+func save(dir string, opts *saveOptions, r *http.Request) (string, error) {
+	start := time.Now()
+	lr := &io.LimitedReader{
+		R: r.Body,
+		N: opts.maxImgSize,
+	}
+	body, err := imageproc.CheckUpload(r.Header.Get("Content-Type"), lr, true)
+	if err != nil {
+		return "", err
+	}
+	width, height, err := imageproc.Dimensions(body)
+	if err != nil {
+		return "", err
+	}
+	if width < opts.minWidth || height < opts.minHeight {
+		return "", &imageproc.RejectedImageError{Reason: fmt.Sprintf(
+			"%dx%d image is smaller than %dx%d", width, height, opts.minWidth,
+			opts.minHeight)}
+	}
+	// Write into a hidden temporary file, ignored by LimitedDir, so
+	// interrupted saves never leave truncated drawings behind
+	fp, err := ioutil.TempFile(dir, storage.SaveTempPrefix)
+	if err != nil {
+		return "", err
+	}
+	tmp := fp.Name()
+	err = fp.Chmod(0644)
+	if err != nil {
+		fp.Close()
+		os.Remove(tmp)
+		return "", err
+	}
+	defer func() {
+		if fp != nil {
+			fp.Close()
+		}
+		os.Remove(tmp)
+	}()
+
+	ctx := r.Context()
+	if opts.processTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.processTimeout)
+		defer cancel()
+	}
+	hash := sha256.New()
+	err = imageproc.Process(ctx, io.MultiWriter(fp, hash), body, &opts.Options)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return "", imageproc.ErrProcessTimeout
+		}
+		return "", err
+	}
+	received := opts.maxImgSize - lr.N
+	if received < opts.minImgSize {
+		return "", &imageproc.RejectedImageError{Reason: fmt.Sprintf(
+			"%d bytes image is smaller than %d bytes", received, opts.minImgSize)}
+	}
+	st, err := fp.Stat()
+	if err != nil {
+		return "", err
+	}
+	written := st.Size()
+	if opts.fsync {
+		err = fp.Sync()
+		if err != nil {
+			return "", err
+		}
+	}
+	err = fp.Close()
+	fp = nil
+	if err != nil {
+		return "", err
+	}
+	// Short random parts may collide, retry with another name. Linking
+	// fails instead of replacing existing files. Content addressed names
+	// only collide with identical drawings.
+	sum := fmt.Sprintf("%x", hash.Sum(nil)[:16])
+	deduplicate := contentAddressed(opts.namePattern)
+	for i := 0; ; i++ {
+		if i >= 10 {
+			return "", fmt.Errorf("could not find a free file name")
+		}
+		name, err := drawingName(opts.namePattern, time.Now(), sum)
+		if err != nil {
+			return "", err
+		}
+		path := filepath.Join(dir, name)
+		if deduplicate {
+			if _, err := os.Stat(path); err == nil {
+				return name, &duplicateError{name: name, saved: true}
+			}
+		}
+		if opts.taken != nil && opts.taken(name) {
+			if deduplicate {
+				return "", &duplicateError{name: name}
+			}
+			continue
+		}
+		if opts.check != nil {
+			err := opts.check(name, tmp)
+			if err != nil {
+				return "", err
+			}
+		}
+		err = os.Link(tmp, path)
+		if err == nil && opts.fsync {
+			err = syncDir(dir)
+			if err != nil {
+				os.Remove(path)
+				return "", err
+			}
+		}
+		if err == nil {
+			slog.Info("wrote drawing", "path", path, "received", received,
+				"bytes", written, "duration", time.Since(start))
+			return name, nil
+		}
+		if !os.IsExist(err) {
+			return "", err
+		}
+		if deduplicate {
+			return name, &duplicateError{name: name, saved: true}
+		}
+	}
+}
+
+// duplicateError is returned when a posted image is identical to a drawing
+// already stored under its content addressed name. If saved, the drawing is
+// in the directory the image was saved to, otherwise it is pending, archived
+// or removed.
+type duplicateError struct {
+	name  string
+	saved bool
+}
+
+func (e *duplicateError) Error() string {
+	if e.saved {
+		return "identical drawing already saved: " + e.name
+	}
+	return "identical drawing already submitted or removed: " + e.name
+}
+
+// setupSaving parses the options of saved drawings and sets up the upload
+// rate limiting and deduplication.
+func (h *Handler) setupSaving() error {
+	cfg := h.cfg
+	maxImgSize, err := humanize.ParseBytes(cfg.MaxImageSize)
+	if err != nil {
+		return err
+	}
+	minImgSize, err := humanize.ParseBytes(cfg.MinImageSize)
+	if err != nil {
+		return err
+	}
+	minDelay, err := time.ParseDuration(cfg.MinDelay)
+	if err != nil {
+		return err
+	}
+	processTimeout, err := time.ParseDuration(cfg.ProcessTimeout)
+	if err != nil {
+		return err
+	}
+	if cfg.Padding < 0 {
+		return fmt.Errorf("padding must be positive or zero: %d", cfg.Padding)
+	}
+	encoder, err := imageproc.NewEncoder(cfg.PNGEncoder, cfg.PNGCompression,
+		cfg.PNGParallelism)
+	if err != nil {
+		return err
+	}
+	opts := &saveOptions{
+		maxImgSize:     int64(maxImgSize),
+		minImgSize:     int64(minImgSize),
+		minWidth:       cfg.MinWidth,
+		minHeight:      cfg.MinHeight,
+		processTimeout: processTimeout,
+		Options: imageproc.Options{
+			Padding:      cfg.Padding,
+			Encoder:      encoder,
+			ReduceColors: cfg.ReduceColors,
+		},
+		fsync:       cfg.Fsync,
+		namePattern: cfg.FilenamePattern,
+	}
+	if opts.namePattern == "" {
+		opts.namePattern = "{id}"
+	}
+	err = checkNamePattern(opts.namePattern)
+	if err != nil {
+		return err
+	}
+	opts.Background, err = imageproc.ParseBackground(cfg.Background)
+	if err != nil {
+		return err
+	}
+	paddingColor := color.NRGBA{0xff, 0xff, 0xff, 0xff}
+	if cfg.PaddingColor != "" {
+		paddingColor, err = imageproc.ParseColor(cfg.PaddingColor)
+		if err != nil {
+			return err
+		}
+	}
+	opts.PaddingColor = &paddingColor
+	if cfg.WatermarkText != "" && cfg.WatermarkImage != "" {
+		return fmt.Errorf("watermark text and image are mutually exclusive")
+	}
+	if cfg.WatermarkText != "" || cfg.WatermarkImage != "" {
+		position := cfg.WatermarkPosition
+		if position == "" {
+			position = "bottom-right"
+		}
+		opts.Watermark, err = imageproc.NewWatermark(cfg.WatermarkText, cfg.WatermarkImage,
+			position, cfg.WatermarkOpacity)
+		if err != nil {
+			return err
+		}
+	}
+	switch cfg.ColorProfile {
+	case "keep":
+		opts.KeepColorProfile = true
+	case "strip":
+	default:
+		return fmt.Errorf("unknown color profile mode: %s", cfg.ColorProfile)
+	}
+	if cfg.RejectBlank {
+		if cfg.MinInk < 0 || cfg.MinInk >= 100 {
+			return fmt.Errorf("minimum ink must be between 0 and 100: %v",
+				cfg.MinInk)
+		}
+		opts.Check = imageproc.BlankCheck(cfg.MinInk / 100)
+	}
+	h.opts = opts
+	h.proxies, err = parseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	h.limiter = newRateLimiter(minDelay, cfg.RateBurst)
+	h.run(func(ctx context.Context) { h.limiter.Run(ctx, time.Minute) })
+	if cfg.DedupWindow != "" && cfg.DedupWindow != "0" {
+		window, err := time.ParseDuration(cfg.DedupWindow)
+		if err != nil {
+			return err
+		}
+		h.dedup = newUploadDedup(window)
+		h.run(func(ctx context.Context) { h.dedup.Run(ctx, time.Minute) })
+	}
+	return nil
+}
+
+// postProcess derives previews and metadata from saved image name, and
+// stores them with m. Failures are logged, the drawing being saved
+// already.
+func (h *Handler) postProcess(name string, rsp *saveResponse, m *Metadata) {
+	if h.pv != nil || h.cfg.BlurHash {
+		img, err := decodePNGFile(filepath.Join(h.imgDir.Path(), name))
+		if err != nil {
+			slog.Error("could not decode drawing", "name", name, "err", err)
+			return
+		}
+		if h.pv != nil {
+			err := h.pv.Generate(name, img)
+			if err != nil {
+				slog.Error("could not generate preview", "name", name, "err", err)
+			}
+		}
+		if h.cfg.BlurHash {
+			m.BlurHash = blurHash(img, 4, 3)
+			rsp.BlurHash = m.BlurHash
+		}
+	}
+	if *m == (Metadata{}) {
+		return
+	}
+	err := h.meta.Put(name, m)
+	if err != nil {
+		slog.Error("could not write metadata", "name", name, "err", err)
+	}
+}
+
+// putShapes stores the shapes of drawing name, and their SVG rendering.
+// Failures are logged, the drawing being saved already.
+func (h *Handler) putShapes(name string, shapes []byte) {
+	err := h.meta.PutShapes(name, shapes)
+	if err != nil {
+		slog.Error("could not write shapes", "name", name, "err", err)
+		return
+	}
+	svg, err := renderSVG(shapes, h.cfg.Padding, *h.opts.PaddingColor)
+	if err == nil {
+		err = h.meta.PutSVG(name, svg)
+	}
+	if err != nil {
+		slog.Error("could not write SVG", "name", name, "err", err)
+	}
+}
+
+// parseCaptions returns the metadata set by the request parameters,
+// tagged with the optional room parameter and its prompt of the day.
+// Private rooms require a member session. It returns the HTTP
+// status code to use on error.
+func (h *Handler) parseCaptions(r *http.Request) (*Metadata, int, error) {
+	m := &Metadata{}
+	for _, p := range []struct {
+		key string
+		v   *string
+	}{{"title", &m.Title}, {"author", &m.Author}} {
+		v, err := parseCaption(p.key, r.URL.Query().Get(p.key))
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		*p.v = v
+	}
+	room := r.URL.Query().Get("room")
+	if room != "" && !roomIDRe.MatchString(room) {
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid room identifier")
+	}
+	err := h.invites.Check(room, r)
+	if err != nil {
+		return nil, http.StatusForbidden, err
+	}
+	m.Room = room
+	if h.dailyPrompts != nil {
+		m.Prompt = h.dailyPrompts.Get(room, time.Now())
+	}
+	return m, 0, nil
+}
+
+// store writes the posted drawing in dir, after running the pre-save
+// hooks with m on it if m is set. It returns the drawing file name, or
+// the HTTP status code to use on error.
+func (h *Handler) store(r *http.Request, dir string, m *Metadata) (string, int, error) {
+	reqOpts := *h.opts
+	if bg := r.URL.Query().Get("background"); bg != "" {
+		background, err := imageproc.ParseBackground(bg)
+		if err != nil {
+			return "", http.StatusBadRequest, err
+		}
+		reqOpts.Background = background
+	}
+	if m != nil {
+		reqOpts.check = func(name, path string) error {
+			return h.preSave(r, name, path, m)
+		}
+	}
+	name, err := save(dir, &reqOpts, r)
+	if e, ok := err.(*imageproc.MediaTypeError); ok {
+		h.requestLogger(r).Warn("save rejected", "reason", e.Reason)
+		return "", http.StatusUnsupportedMediaType, err
+	} else if e, ok := err.(*imageproc.RejectedImageError); ok {
+		h.requestLogger(r).Warn("save rejected", "reason", e.Reason)
+		return "", http.StatusUnprocessableEntity, err
+	} else if _, ok := err.(*hookRejection); ok {
+		h.requestLogger(r).Warn("save rejected", "reason", err)
+		return "", http.StatusUnprocessableEntity, err
+	} else if e, ok := err.(*duplicateError); ok {
+		h.requestLogger(r).Info("duplicate drawing", "name", e.name, "saved", e.saved)
+		return name, http.StatusConflict, err
+	} else if err != nil && r.Context().Err() != nil {
+		h.requestLogger(r).Info("save abandoned: client disconnected")
+		return "", 499, fmt.Errorf("client disconnected")
+	} else if err == imageproc.ErrProcessTimeout {
+		h.requestLogger(r).Error("could not save drawing", "err", err)
+		return "", http.StatusServiceUnavailable, fmt.Errorf(
+			"could not save image: processing took longer than %s",
+			h.opts.processTimeout)
+	} else if err != nil {
+		h.requestLogger(r).Error("could not save drawing", "err", err)
+		return "", 500, fmt.Errorf("could not save image: %s", err)
+	}
+	return name, 200, nil
+}
+
+// receive applies the rate limit, unless the request has the snapshot
+// token of a room turn, and stores the posted drawing in dir, running the
+// pre-save hooks with m on it if m is set. Uploads
+// identical to one saved, or being saved, by the same client IP within
+// the dedup window return its name with a *duplicateError instead. On
+// success, done must be called with the drawing name once it is
+// published, or an empty string if it is not, to release identical
+// uploads waiting for it.
+func (h *Handler) receive(r *http.Request, dir string, m *Metadata) (name string,
+	done func(string), code int, err error) {
+
+	ip := h.proxies.clientIP(r)
+	done = func(string) {}
+	if h.dedup != nil {
+		data, err := ioutil.ReadAll(io.LimitReader(r.Body, h.opts.maxImgSize+1))
+		if err != nil {
+			return "", done, http.StatusBadRequest, err
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(data))
+		hash := fmt.Sprintf("%x", sha256.Sum256(data))
+		saved, release := h.dedup.Start(ip, hash, dir, time.Now())
+		if saved != "" {
+			h.requestLogger(r).Info("duplicate upload", "name", saved)
+			return saved, done, http.StatusConflict,
+				&duplicateError{name: saved, saved: true}
+		}
+		done = release
+	}
+	defer func() {
+		if err != nil {
+			done("")
+		}
+	}()
+	snapshot := h.rooms != nil && h.rooms.snapshots.Use(r.URL.Query().Get("room"),
+		r.URL.Query().Get("snapshot"), time.Now())
+	if !snapshot && !h.limiter.Allow(ip, time.Now()) {
+		h.requestLogger(r).Warn("rate limited")
+		return "", done, 429, fmt.Errorf("rate limited")
+	}
+	name, code, err = h.store(r, dir, m)
+	return name, done, code, err
+}
+
+// saveURLs returns a save response locating drawing name.
+func (h *Handler) saveURLs(r *http.Request, name string) *saveResponse {
+	u := h.proxies.baseURL(r)
+	u.Path += mountPrefix(r) + imgURL
+	rsp := &saveResponse{
+		Path: u.Path + name,
+		URL:  u.String() + name,
+	}
+	if h.imgBaseURL != nil {
+		rsp.URL = h.imgBaseURL.ResolveReference(&url.URL{Path: name}).String()
+	}
+	loc := h.locateDrawing(r, name)
+	rsp.PagePath = strings.TrimSuffix(loc.Base+pageURL+name, ".png")
+	rsp.PageURL = loc.PageURL
+	if h.pv != nil {
+		pu := h.proxies.baseURL(r)
+		pu.Path += mountPrefix(r) + previewURL + name
+		rsp.PreviewPath = pu.Path
+		rsp.PreviewURL = pu.String()
+	}
+	return rsp
+}
+
+// publish registers drawing name, written in the images directory, and
+// runs the save side effects. A delete token is generated unless m
+// already has one.
+func (h *Handler) publish(r *http.Request, name string, m *Metadata) (*saveResponse, error) {
+	token := ""
+	if m.DeleteTokenHash == "" {
+		t, hash, err := newDeleteToken()
+		if err != nil {
+			return nil, err
+		}
+		token = t
+		m.DeleteTokenHash = hash
+	}
+	// The room is the retention class of the drawing
+	err := h.imgDir.AddClass(name, m.Room)
+	if err != nil {
+		return nil, err
+	}
+	rsp := h.saveURLs(r, name)
+	rsp.DeleteToken = token
+	rsp.Prompt = m.Prompt
+	if st, err := os.Stat(filepath.Join(h.imgDir.Path(), name)); err == nil {
+		h.usage.RecordSave(h.proxies.clientIP(r), st.Size(), h.imgDir.Size())
+	}
+	if err := h.events.Append(eventSave, name); err != nil {
+		slog.Error("could not log save", "name", name, "err", err)
+	}
+	h.postProcess(name, rsp, m)
+	h.broadcast("", &liveMessage{
+		Type:       eventSave,
+		Name:       name,
+		URL:        rsp.URL,
+		PreviewURL: rsp.PreviewURL,
+	})
+	h.broadcast("count", &liveMessage{Type: "count", Count: len(h.imgDir.List())})
+	for _, kind := range h.announcers {
+		err := h.jobs.Push(kind, rsp.URL, 0)
+		if err != nil {
+			slog.Error("could not queue announcement", "kind", kind, "err", err)
+		}
+	}
+	if h.ap != nil {
+		for _, inbox := range h.ap.Inboxes() {
+			err := h.jobs.Push("activitypub", name+" "+inbox, 0)
+			if err != nil {
+				slog.Error("could not queue activitypub delivery", "name", name,
+					"err", err)
+			}
+		}
+	}
+	for i := range h.postHooks {
+		err := h.jobs.Push("post-save", fmt.Sprintf("%d %s", i, name), 0)
+		if err != nil {
+			slog.Error("could not queue post-save hook", "name", name, "err", err)
+		}
+	}
+	if h.rc != nil {
+		h.rc.Touch()
+		err := h.jobs.Push("recompress", name, h.recompressIdle)
+		if err != nil {
+			slog.Error("could not queue recompression", "name", name, "err", err)
+		}
+	}
+	return rsp, nil
+}
+
+// saveDrawing applies the rate limit and saves posted drawing, or
+// schedules its publication if requested. It returns the HTTP status code
+// to use on error.
+func (h *Handler) saveDrawing(r *http.Request) (*saveResponse, int, error) {
+	m, code, err := h.parseCaptions(r)
+	if err != nil {
+		return nil, code, err
+	}
+	var publishAt time.Time
+	if v := r.URL.Query().Get("publish_at"); v != "" {
+		if h.scheduled == nil {
+			return nil, http.StatusBadRequest, fmt.Errorf(
+				"scheduled publication is disabled")
+		}
+		publishAt, err = parsePublishAt(v, time.Now(), h.maxSchedule)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+	}
+	r, shapes, err := splitShapesForm(r, h.opts.maxImgSize)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if !publishAt.IsZero() {
+		return h.scheduleDrawing(r, m, shapes, publishAt)
+	}
+	name, done, code, err := h.receive(r, h.imgDir.Path(), m)
+	if e, ok := err.(*duplicateError); ok && e.saved {
+		// Point to the existing drawing, whose delete token belongs to
+		// its first uploader
+		h.imgDir.Touch(name)
+		rsp := h.saveURLs(r, name)
+		rsp.Duplicate = true
+		return rsp, 200, nil
+	} else if err != nil {
+		return nil, code, err
+	}
+	published := ""
+	defer func() { done(published) }()
+	if shapes != nil {
+		h.putShapes(name, shapes)
+	}
+	rsp, err := h.publish(r, name, m)
+	if err != nil {
+		h.requestLogger(r).Error("could not save drawing", "err", err)
+		os.Remove(filepath.Join(h.imgDir.Path(), name))
+		h.meta.Remove(name)
+		return nil, 500, fmt.Errorf("could not save image: %s", err)
+	}
+	published = name
+	return rsp, 200, nil
+}
@@ -0,0 +1,390 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// scheduledRequest keeps the parts of a save request needed to publish its
+// drawing later, like the client address and the headers locating the
+// server.
+type scheduledRequest struct {
+	Host       string      `json:"host"`
+	RemoteAddr string      `json:"remote_addr"`
+	RequestURI string      `json:"request_uri"`
+	Path       string      `json:"path"`
+	TLS        bool        `json:"tls,omitempty"`
+	Header     http.Header `json:"header,omitempty"`
+}
+
+func newScheduledRequest(r *http.Request) *scheduledRequest {
+	s := &scheduledRequest{
+		Host:       r.Host,
+		RemoteAddr: r.RemoteAddr,
+		RequestURI: r.RequestURI,
+		Path:       r.URL.Path,
+		TLS:        r.TLS != nil,
+		Header:     http.Header{},
+	}
+	for k, v := range r.Header {
+		if strings.HasPrefix(k, "X-Forwarded-") {
+			s.Header[k] = v
+		}
+	}
+	return s
+}
+
+// Request returns a request equivalent to the original one for publication
+// purposes.
+func (s *scheduledRequest) Request() *http.Request {
+	r := &http.Request{
+		Method:     "POST",
+		Host:       s.Host,
+		RemoteAddr: s.RemoteAddr,
+		RequestURI: s.RequestURI,
+		URL:        &url.URL{Path: s.Path},
+		Header:     s.Header,
+	}
+	if r.Header == nil {
+		r.Header = http.Header{}
+	}
+	if s.TLS {
+		r.TLS = &tls.ConnectionState{}
+	}
+	return r
+}
+
+// scheduledDrawing is a drawing waiting for its publication time.
+type scheduledDrawing struct {
+	Name      string            `json:"name"`
+	PublishAt time.Time         `json:"publish_at"`
+	Metadata  *Metadata         `json:"metadata"`
+	Shapes    json.RawMessage   `json:"shapes,omitempty"`
+	Request   *scheduledRequest `json:"request"`
+}
+
+// scheduleStore holds saved drawings, hidden until their publication time,
+// with their description in a JSON file named after them.
+type scheduleStore struct {
+	dir  string
+	wake chan struct{}
+	// lock serializes publications and cancellations.
+	lock sync.Mutex
+}
+
+// defaultScheduledDir returns the scheduled drawings directory used with
+// imagesDir.
+func defaultScheduledDir(imagesDir string) string {
+	return filepath.Clean(imagesDir) + "-scheduled"
+}
+
+// openScheduleStore returns a scheduleStore writing in dir. Drawings without
+// description, and temporary files, are removed.
+func openScheduleStore(dir string) (*scheduleStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasPrefix(name, ".") {
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		if strings.HasSuffix(name, ".json") {
+			continue
+		}
+		_, err := os.Stat(filepath.Join(dir, name+".json"))
+		if os.IsNotExist(err) {
+			os.Remove(filepath.Join(dir, name))
+		}
+	}
+	return &scheduleStore{
+		dir:  dir,
+		wake: make(chan struct{}, 1),
+	}, nil
+}
+
+// Add records the description of d, whose drawing was written in the store
+// directory.
+func (s *scheduleStore) Add(d *scheduledDrawing) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(s.dir, ".scheduled-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), filepath.Join(s.dir, d.Name+".json"))
+	if err != nil {
+		return err
+	}
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Get returns scheduled drawing name, or an os.IsNotExist error.
+func (s *scheduleStore) Get(name string) (*scheduledDrawing, error) {
+	if !drawingIDRe.MatchString(strings.TrimSuffix(name, ".png")) {
+		return nil, os.ErrNotExist
+	}
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, name+".json"))
+	if err != nil {
+		return nil, err
+	}
+	d := &scheduledDrawing{}
+	err = json.Unmarshal(data, d)
+	return d, err
+}
+
+// List returns scheduled drawings sorted by publication time.
+func (s *scheduleStore) List() ([]*scheduledDrawing, error) {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	drawings := []*scheduledDrawing{}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		d, err := s.Get(strings.TrimSuffix(e.Name(), ".json"))
+		if err != nil {
+			slog.Error("could not read scheduled drawing", "name", e.Name(),
+				"err", err)
+			continue
+		}
+		drawings = append(drawings, d)
+	}
+	sort.Slice(drawings, func(i, j int) bool {
+		return drawings[i].PublishAt.Before(drawings[j].PublishAt)
+	})
+	return drawings, nil
+}
+
+// Publish moves scheduled drawing name to dir, under the same name, and
+// forgets it.
+func (s *scheduleStore) Publish(name, dir string) error {
+	path := filepath.Join(s.dir, name)
+	dst := filepath.Join(dir, name)
+	// Link fails instead of replacing a drawing with the same name
+	err := os.Link(path, dst)
+	if err != nil {
+		return err
+	}
+	// Date the drawing from its publication
+	now := time.Now()
+	err = os.Chtimes(dst, now, now)
+	if err != nil {
+		return err
+	}
+	return s.Remove(name)
+}
+
+// Remove discards scheduled drawing name, if any.
+func (s *scheduleStore) Remove(name string) error {
+	for _, p := range []string{name + ".json", name} {
+		err := os.Remove(filepath.Join(s.dir, p))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run calls publish with scheduled drawings once due, until ctx is done.
+// Drawings are removed from the store before publish is called.
+func (s *scheduleStore) Run(ctx context.Context, dir string, publish func(d *scheduledDrawing)) {
+	for {
+		delay := time.Hour
+		drawings, err := s.List()
+		if err != nil {
+			slog.Error("could not list scheduled drawings", "err", err)
+		}
+		for _, d := range drawings {
+			if wait := time.Until(d.PublishAt); wait > 0 {
+				if wait < delay {
+					delay = wait
+				}
+				break
+			}
+			s.lock.Lock()
+			err := s.Publish(d.Name, dir)
+			s.lock.Unlock()
+			if err != nil {
+				slog.Error("could not publish scheduled drawing", "name", d.Name,
+					"err", err)
+				continue
+			}
+			publish(d)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		case <-s.wake:
+		}
+	}
+}
+
+// parsePublishAt parses the RFC 3339 publication time v, which must be at
+// most maxDelay after now. It returns the zero time if v is not in the
+// future, the drawing being published immediately.
+func parsePublishAt(v string, now time.Time, maxDelay time.Duration) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid publication time: %s", v)
+	}
+	if !t.After(now) {
+		return time.Time{}, nil
+	}
+	if t.Sub(now) > maxDelay {
+		return time.Time{}, fmt.Errorf("publication time is more than %s ahead",
+			maxDelay)
+	}
+	return t.UTC(), nil
+}
+
+// setupSchedule opens the scheduled drawings store and publishes them in
+// time, if scheduled publication is enabled.
+func (h *Handler) setupSchedule() error {
+	cfg := h.cfg
+	if cfg.MaxSchedule == "" || cfg.MaxSchedule == "0" {
+		return nil
+	}
+	maxSchedule, err := time.ParseDuration(cfg.MaxSchedule)
+	if err != nil {
+		return err
+	}
+	scheduledDir := cfg.ScheduledDir
+	if scheduledDir == "" {
+		scheduledDir = defaultScheduledDir(cfg.ImagesDir)
+	}
+	scheduled, err := openScheduleStore(scheduledDir)
+	if err != nil {
+		return err
+	}
+	h.maxSchedule, h.scheduled = maxSchedule, scheduled
+	h.nameDirs = append(h.nameDirs, scheduled.dir)
+	publishScheduled := func(d *scheduledDrawing) {
+		name := d.Name
+		if d.Shapes != nil {
+			h.putShapes(name, d.Shapes)
+		}
+		_, err := h.publish(d.Request.Request(), name, d.Metadata)
+		if err != nil {
+			slog.Error("could not publish scheduled drawing", "name", name,
+				"err", err)
+			os.Remove(filepath.Join(h.imgDir.Path(), name))
+			h.meta.Remove(name)
+			return
+		}
+		slog.Info("published scheduled drawing", "name", name)
+	}
+	h.run(func(ctx context.Context) {
+		scheduled.Run(ctx, h.imgDir.Path(), publishScheduled)
+	})
+	h.optional = append(h.optional, &apiRoute{
+		Method:  "DELETE",
+		Path:    "/scheduled/{name}",
+		Summary: "Cancel the scheduled publication of a drawing",
+		Feature: "schedule",
+		Handler: func(w http.ResponseWriter, r *http.Request) {
+			name := strings.TrimPrefix(r.URL.Path, apiPrefix+"/scheduled/")
+			// Hold the lock so the drawing is not published meanwhile
+			scheduled.lock.Lock()
+			defer scheduled.lock.Unlock()
+			d, err := scheduled.Get(name)
+			if os.IsNotExist(err) {
+				writeAPIError(w, http.StatusNotFound, "unknown scheduled drawing")
+				return
+			} else if err != nil {
+				slog.Error("could not read scheduled drawing", "name", name,
+					"err", err)
+				writeAPIError(w, 500, "could not cancel publication")
+				return
+			}
+			if !checkDeleteToken(d.Metadata, deleteToken(r)) {
+				writeAPIError(w, http.StatusForbidden, "invalid delete token")
+				return
+			}
+			err = scheduled.Remove(name)
+			if err != nil {
+				slog.Error("could not cancel publication", "name", name, "err", err)
+				writeAPIError(w, 500, "could not cancel publication")
+				return
+			}
+			h.requestLogger(r).Info("cancelled publication", "name", name)
+			w.WriteHeader(http.StatusNoContent)
+		},
+	})
+	return nil
+}
+
+// scheduleDrawing saves posted drawing in the scheduled drawings
+// directory, to be published at publishAt. It returns the HTTP status
+// code to use on error.
+func (h *Handler) scheduleDrawing(r *http.Request, m *Metadata, shapes []byte,
+	publishAt time.Time) (*saveResponse, int, error) {
+
+	name, done, code, err := h.receive(r, h.scheduled.dir, m)
+	if err != nil {
+		return nil, code, err
+	}
+	added := ""
+	defer func() { done(added) }()
+	token, hash, err := newDeleteToken()
+	if err == nil {
+		m.DeleteTokenHash = hash
+		err = h.scheduled.Add(&scheduledDrawing{
+			Name:      name,
+			PublishAt: publishAt.UTC(),
+			Metadata:  m,
+			Shapes:    shapes,
+			Request:   newScheduledRequest(r),
+		})
+	}
+	if err != nil {
+		h.requestLogger(r).Error("could not save drawing", "err", err)
+		os.Remove(filepath.Join(h.scheduled.dir, name))
+		return nil, 500, fmt.Errorf("could not save image: %s", err)
+	}
+	added = name
+	h.requestLogger(r).Info("scheduled drawing", "name", name,
+		"publish_at", publishAt.UTC())
+	rsp := h.saveURLs(r, name)
+	rsp.DeleteToken = token
+	rsp.Prompt = m.Prompt
+	rsp.PublishAt = &publishAt
+	return rsp, 200, nil
+}
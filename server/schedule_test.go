@@ -0,0 +1,120 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestScheduledSave(t *testing.T) {
+	cfg, cleanup := newTestConfig(t)
+	defer cleanup()
+	cfg.MaxSchedule = "1h"
+	h, err := NewHandler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	do := func(method, p, token string, body []byte, v interface{}) int {
+		req, err := http.NewRequest(method, srv.URL+"/api/v1"+p,
+			bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rsp.Body.Close()
+		if v != nil && rsp.StatusCode == 200 {
+			err := json.NewDecoder(rsp.Body).Decode(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rsp.StatusCode
+	}
+	schedule := func(at time.Time) (*saveResponse, int) {
+		saved := &saveResponse{}
+		code := do("POST", "/drawings?publish_at="+
+			url.QueryEscape(at.Format(time.RFC3339)), "",
+			encodeTestImage(t, 10, 10), saved)
+		return saved, code
+	}
+	listed := func(name string) bool {
+		drawings := drawingsResponse{}
+		if code := do("GET", "/drawings", "", nil, &drawings); code != 200 {
+			t.Fatalf("could not list drawings: %d", code)
+		}
+		for _, d := range drawings.Drawings {
+			if d.Name == name {
+				return true
+			}
+		}
+		return false
+	}
+
+	if _, code := schedule(time.Now().Add(2 * time.Hour)); code != 400 {
+		t.Fatalf("expected 400 beyond the maximum delay, got %d", code)
+	}
+	if code := do("POST", "/drawings?publish_at=tomorrow", "",
+		encodeTestImage(t, 10, 10), nil); code != 400 {
+		t.Fatalf("expected 400 for an invalid time, got %d", code)
+	}
+
+	// Cancelled drawings are never published
+	cancelled, code := schedule(time.Now().Add(time.Hour))
+	if code != 200 || cancelled.PublishAt == nil {
+		t.Fatalf("could not schedule drawing: %d, %+v", code, cancelled)
+	}
+	name := path.Base(cancelled.Path)
+	if code := do("DELETE", "/scheduled/"+name, "invalid", nil, nil); code != 403 {
+		t.Fatalf("expected 403 with an invalid token, got %d", code)
+	}
+	code = do("DELETE", "/scheduled/"+name, cancelled.DeleteToken, nil, nil)
+	if code != 204 {
+		t.Fatalf("could not cancel publication: %d", code)
+	}
+	if code := do("DELETE", "/scheduled/"+name, cancelled.DeleteToken, nil, nil); code != 404 {
+		t.Fatalf("expected 404 once cancelled, got %d", code)
+	}
+
+	saved, code := schedule(time.Now().Add(2 * time.Second))
+	if code != 200 || saved.PublishAt == nil || saved.DeleteToken == "" {
+		t.Fatalf("could not schedule drawing: %d, %+v", code, saved)
+	}
+	name = path.Base(saved.Path)
+	if listed(name) {
+		t.Fatal("scheduled drawing was published early")
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for !listed(name) {
+		if time.Now().After(deadline) {
+			t.Fatal("scheduled drawing was not published")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	rsp, err := http.Get(saved.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != 200 {
+		t.Fatalf("could not fetch published drawing: %s", rsp.Status)
+	}
+	// The token returned at scheduling time deletes the published drawing
+	if code := do("DELETE", "/drawings/"+name, saved.DeleteToken, nil, nil); code != 204 {
+		t.Fatalf("could not delete published drawing: %d", code)
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+
+package server
+
+import (
+	"fmt"
+)
+
+func IsService() bool {
+	return false
+}
+
+func RunService(run func() error) error {
+	return run()
+}
+
+func ControlService(cmd string, args []string) error {
+	return fmt.Errorf("services are only supported on Windows")
+}
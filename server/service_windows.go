@@ -0,0 +1,172 @@
+//go:build windows
+
+package server
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const serviceName = "gribouillis"
+
+// IsService returns true if the process was started by the Windows service
+// control manager.
+func IsService() bool {
+	ok, err := svc.IsWindowsService()
+	return err == nil && ok
+}
+
+// eventLogWriter forwards log package output to the Windows event log.
+type eventLogWriter struct {
+	elog *eventlog.Log
+}
+
+func (w *eventLogWriter) Write(p []byte) (int, error) {
+	err := w.elog.Info(1, strings.TrimRight(string(p), "\n"))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+type service struct {
+	run func() error
+}
+
+func (s *service) Execute(args []string, r <-chan svc.ChangeRequest,
+	status chan<- svc.Status) (bool, uint32) {
+
+	status <- svc.Status{State: svc.StartPending}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.run()
+	}()
+	status <- svc.Status{
+		State:   svc.Running,
+		Accepts: svc.AcceptStop | svc.AcceptShutdown,
+	}
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				slog.Error("service failed", "err", err)
+				return true, 1
+			}
+			return false, 0
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				status <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				slog.Info("stopping service")
+				status <- svc.Status{State: svc.StopPending}
+				close(serviceStop)
+				err := <-done
+				if err != nil {
+					slog.Error("service failed", "err", err)
+				}
+				return false, 0
+			}
+		}
+	}
+}
+
+// RunService executes run under the service control manager. Logs are
+// redirected to the event log and the working directory is set to the
+// executable one, so "images/" and other relative paths are resolved like
+// when started from a shell in the application directory.
+func RunService(run func() error) error {
+	elog, err := eventlog.Open(serviceName)
+	if err != nil {
+		return err
+	}
+	defer elog.Close()
+	log.SetOutput(&eventLogWriter{elog: elog})
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	err = os.Chdir(filepath.Dir(exe))
+	if err != nil {
+		return err
+	}
+	return svc.Run(serviceName, &service{run: run})
+}
+
+// ControlService installs or removes the gribouillis service. Installed
+// service is started with supplied command line arguments.
+func ControlService(cmd string, args []string) error {
+	switch cmd {
+	case "install":
+		return installService(args)
+	case "remove":
+		return removeService()
+	}
+	return fmt.Errorf("unknown service command: %s", cmd)
+}
+
+func installService(args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", serviceName)
+	}
+	s, err = m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "gribouillis",
+		Description: "gribouillis drawing server",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	err = eventlog.InstallAsEventCreate(serviceName,
+		eventlog.Error|eventlog.Warning|eventlog.Info)
+	if err != nil {
+		s.Delete()
+		return err
+	}
+	slog.Info("service installed", "name", serviceName)
+	return nil
+}
+
+func removeService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", serviceName)
+	}
+	defer s.Close()
+	err = s.Delete()
+	if err != nil {
+		return err
+	}
+	err = eventlog.Remove(serviceName)
+	if err != nil {
+		return err
+	}
+	slog.Info("service removed", "name", serviceName)
+	return nil
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// splitShapesForm extracts the drawing shapes from multipart/form-data save
+// requests. They have a "shapes" part, holding the JSON serialization of the
+// LiterallyCanvas drawing, followed by an "image" part with the PNG image.
+// It returns a request whose body is the image part and the shapes, of at
+// most maxSize bytes. Other requests are returned as is, without shapes.
+func splitShapesForm(r *http.Request, maxSize int64) (*http.Request, []byte, error) {
+	mr, err := r.MultipartReader()
+	if err == http.ErrNotMultipart {
+		return r, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var shapes []byte
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, nil, fmt.Errorf("missing image part")
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		switch part.FormName() {
+		case "shapes":
+			shapes, err = ioutil.ReadAll(io.LimitReader(part, maxSize+1))
+			if err != nil {
+				return nil, nil, err
+			}
+			if int64(len(shapes)) > maxSize {
+				return nil, nil, fmt.Errorf("shapes are larger than %d bytes",
+					maxSize)
+			}
+			if !json.Valid(shapes) {
+				return nil, nil, fmt.Errorf("shapes are not valid JSON")
+			}
+		case "image":
+			img := r.WithContext(r.Context())
+			img.Header = r.Header.Clone()
+			img.Header.Set("Content-Type", part.Header.Get("Content-Type"))
+			img.Body = ioutil.NopCloser(part)
+			return img, shapes, nil
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+func newHandler() *Handler {
+	h := &Handler{}
+	h.ctx, h.cancel = context.WithCancel(context.Background())
+	return h
+}
+
+// run calls f in a new goroutine, with a context done once Close is called.
+func (h *Handler) run(f func(ctx context.Context)) {
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		f(h.ctx)
+	}()
+}
+
+// onClose registers f to be called by Close, to complete background work.
+func (h *Handler) onClose(f func()) {
+	h.closers = append(h.closers, f)
+}
+
+// Close stops the background tasks and waits for them to complete, running
+// jobs included. It must be called once the handler stopped serving requests.
+func (h *Handler) Close() {
+	h.once.Do(func() {
+		h.cancel()
+		h.wg.Wait()
+		for _, f := range h.closers {
+			f()
+		}
+	})
+}
+
+// Opener builds the handler served by Serve. It returns it with a release
+// function saving and closing its state, called once it stopped serving.
+type Opener func() (http.Handler, func(), error)
+
+// shutdownServer closes server listener and waits at most timeout for active
+// requests, like drawings being saved, to complete.
+func shutdownServer(server *http.Server, timeout time.Duration) error {
+	slog.Info("draining connections", "timeout", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return server.Shutdown(ctx)
+}
@@ -0,0 +1,465 @@
+package server
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"html/template"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pmezard/gribouillis/imageproc"
+)
+
+const (
+	// siteThumbSize bounds the dimensions of exported thumbnails, in pixels.
+	siteThumbSize = 200
+	// siteFeedEntries is the number of latest drawings listed in the feed.
+	siteFeedEntries = 50
+	// siteListing is the machine readable list of exported drawings.
+	siteListing = "drawings.json"
+)
+
+// siteDrawing is a drawing exported in a static site.
+type siteDrawing struct {
+	Name     string
+	ID       string
+	Size     int64
+	Modified time.Time
+	Meta     *Metadata
+}
+
+// siteExporter writes a static HTML gallery of the drawings saved in
+// imagesDir. Drawings are copied in "images/", their thumbnails written in
+// "thumbnails/" and their pages in "drawings/<id>.html".
+type siteExporter struct {
+	imagesDir string
+	meta      *metaStore
+	// siteURL is the URL the site is served from, used to make feed and embed
+	// links absolute. Links are relative if empty.
+	siteURL string
+	title   string
+	enc     imageproc.Encoder
+}
+
+// url returns the location of site file path.
+func (e *siteExporter) url(path string) string {
+	if e.siteURL == "" {
+		return path
+	}
+	return strings.TrimRight(e.siteURL, "/") + "/" + path
+}
+
+// drawings returns the saved drawings, newest first.
+func (e *siteExporter) drawings() ([]*siteDrawing, error) {
+	entries, err := ioutil.ReadDir(e.imagesDir)
+	if err != nil {
+		return nil, err
+	}
+	drawings := []*siteDrawing{}
+	for _, entry := range entries {
+		id := strings.TrimSuffix(entry.Name(), ".png")
+		if !entry.Mode().IsRegular() || !strings.HasSuffix(entry.Name(), ".png") ||
+			!drawingIDRe.MatchString(id) {
+			continue
+		}
+		m, err := e.meta.Get(entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		drawings = append(drawings, &siteDrawing{
+			Name:     entry.Name(),
+			ID:       id,
+			Size:     entry.Size(),
+			Modified: entry.ModTime().UTC(),
+			Meta:     m,
+		})
+	}
+	sort.SliceStable(drawings, func(i, j int) bool {
+		return drawings[i].Modified.After(drawings[j].Modified)
+	})
+	return drawings, nil
+}
+
+// upToDate returns true if path exists and was modified after t.
+func upToDate(path string, t time.Time) bool {
+	st, err := os.Stat(path)
+	return err == nil && !st.ModTime().Before(t)
+}
+
+// copyImage copies drawing d in "images/" unless already there.
+func (e *siteExporter) copyImage(dir string, d *siteDrawing) error {
+	dst := filepath.Join(dir, "images", d.Name)
+	if upToDate(dst, d.Modified) {
+		return nil
+	}
+	src, err := os.Open(filepath.Join(e.imagesDir, d.Name))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, src)
+	if err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(dst, d.Modified, d.Modified)
+}
+
+// writeThumbnail writes the thumbnail of drawing d in "thumbnails/" unless
+// already there.
+func (e *siteExporter) writeThumbnail(dir string, d *siteDrawing) error {
+	dst := filepath.Join(dir, "thumbnails", d.Name)
+	if upToDate(dst, d.Modified) {
+		return nil
+	}
+	m, err := decodePNGFile(filepath.Join(e.imagesDir, d.Name))
+	if err != nil {
+		return err
+	}
+	b := m.Bounds()
+	if b.Empty() {
+		return fmt.Errorf("image is empty")
+	}
+	var thumb image.Image = m
+	if b.Dx() > siteThumbSize || b.Dy() > siteThumbSize {
+		w, h := imageproc.FitSize(b, siteThumbSize)
+		thumb = imageproc.Downscale(m, w, h)
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	err = e.enc.Encode(out, thumb)
+	if err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+	return err
+}
+
+// writePage writes the page of drawing d in "drawings/".
+func (e *siteExporter) writePage(dir string, d *siteDrawing) error {
+	data := &drawingPageData{
+		Name:       d.Name,
+		Title:      d.Meta.Title,
+		Author:     d.Meta.Author,
+		Room:       d.Meta.Room,
+		Date:       d.Modified,
+		Base:       "..",
+		ImagePath:  "../images/" + d.Name,
+		ImageURL:   "../images/" + d.Name,
+		DisplayURL: "../images/" + d.Name,
+		Static:     true,
+	}
+	if e.siteURL != "" {
+		data.PageURL = e.url("drawings/" + d.ID + ".html")
+		data.ImageURL = e.url("images/" + d.Name)
+	}
+	out, err := os.Create(filepath.Join(dir, "drawings", d.ID+".html"))
+	if err != nil {
+		return err
+	}
+	err = drawingTemplate.Execute(out, data)
+	if err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+	return err
+}
+
+var siteTemplate = template.Must(template.New("site").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<link rel="alternate" type="application/atom+xml" title="{{.Title}}" href="feed.xml">
+<style>
+body { font-family: sans-serif; max-width: 60em; margin: 1em auto; padding: 0 1em; }
+ul { list-style: none; padding: 0; display: flex; flex-wrap: wrap; gap: 1em; }
+li { width: 200px; font-size: small; }
+img { max-width: 200px; max-height: 200px; border: 1px solid #ddd; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{len .Drawings}} drawings, exported on <time datetime="{{.Exported.Format "2006-01-02T15:04:05Z07:00"}}">{{.Exported.Format "January 2, 2006"}}</time>. <a href="feed.xml">Feed</a></p>
+<ul>
+{{range .Drawings}}<li><a href="drawings/{{.ID}}.html"><img src="thumbnails/{{.Name}}" alt="{{.Meta.Title}}"></a><br>{{if .Meta.Title}}{{.Meta.Title}}, {{end}}{{if .Meta.Author}}by {{.Meta.Author}}, {{end}}<time datetime="{{.Modified.Format "2006-01-02T15:04:05Z07:00"}}">{{.Modified.Format "January 2, 2006"}}</time></li>
+{{end}}</ul>
+</body>
+</html>
+`))
+
+// sitePageData is rendered by siteTemplate.
+type sitePageData struct {
+	Title    string
+	Drawings []*siteDrawing
+	Exported time.Time
+}
+
+// writeIndex writes the gallery page.
+func (e *siteExporter) writeIndex(dir string, drawings []*siteDrawing, now time.Time) error {
+	out, err := os.Create(filepath.Join(dir, "index.html"))
+	if err != nil {
+		return err
+	}
+	err = siteTemplate.Execute(out, &sitePageData{
+		Title:    e.title,
+		Drawings: drawings,
+		Exported: now,
+	})
+	if err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+	return err
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Author  *atomAuthor `xml:"author,omitempty"`
+	Content atomContent `xml:"content"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+// writeFeed writes the Atom feed of the latest drawings.
+func (e *siteExporter) writeFeed(dir string, drawings []*siteDrawing, now time.Time) error {
+	feed := &atomFeed{
+		Title:   e.title,
+		ID:      e.url("feed.xml"),
+		Updated: now.Format(time.RFC3339),
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: e.url("feed.xml")},
+			{Rel: "alternate", Type: "text/html", Href: e.url("index.html")},
+		},
+	}
+	if len(drawings) > 0 {
+		feed.Updated = drawings[0].Modified.Format(time.RFC3339)
+	}
+	for i, d := range drawings {
+		if i >= siteFeedEntries {
+			break
+		}
+		title := d.Meta.Title
+		if title == "" {
+			title = "Drawing"
+		}
+		page := e.url("drawings/" + d.ID + ".html")
+		entry := atomEntry{
+			Title:   title,
+			ID:      page,
+			Updated: d.Modified.Format(time.RFC3339),
+			Links: []atomLink{
+				{Rel: "alternate", Type: "text/html", Href: page},
+				{Rel: "enclosure", Type: "image/png", Href: e.url("images/" + d.Name)},
+			},
+			Content: atomContent{
+				Type: "html",
+				Body: fmt.Sprintf(`<img src="%s" alt="%s">`,
+					template.HTMLEscapeString(e.url("images/"+d.Name)),
+					template.HTMLEscapeString(d.Meta.Title)),
+			},
+		}
+		if d.Meta.Author != "" {
+			entry.Author = &atomAuthor{Name: d.Meta.Author}
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+	data, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "feed.xml"),
+		append([]byte(xml.Header), data...), 0644)
+}
+
+// writeListing writes "drawings.json", listing the drawings like the API
+// does, so the site can be imported back.
+func (e *siteExporter) writeListing(dir string, drawings []*siteDrawing) error {
+	listing := &drawingsResponse{Drawings: []drawingInfo{}}
+	for _, d := range drawings {
+		listing.Drawings = append(listing.Drawings, drawingInfo{
+			Name:    d.Name,
+			Path:    "images/" + d.Name,
+			URL:     e.url("images/" + d.Name),
+			PageURL: e.url("drawings/" + d.ID + ".html"),
+			Size:    d.Size,
+			Created: d.Modified,
+			Title:   d.Meta.Title,
+			Author:  d.Meta.Author,
+			Room:    d.Meta.Room,
+		})
+	}
+	data, err := json.MarshalIndent(listing, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, siteListing), data, 0644)
+}
+
+// removeStale removes the exported files of drawings which are not in
+// drawings anymore.
+func removeStale(dir string, drawings []*siteDrawing) error {
+	exported := map[string]bool{}
+	for _, d := range drawings {
+		exported["images/"+d.Name] = true
+		exported["thumbnails/"+d.Name] = true
+		exported["drawings/"+d.ID+".html"] = true
+	}
+	for _, sub := range []string{"images", "thumbnails", "drawings"} {
+		entries, err := ioutil.ReadDir(filepath.Join(dir, sub))
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if !exported[sub+"/"+entry.Name()] && entry.Mode().IsRegular() {
+				err := os.Remove(filepath.Join(dir, sub, entry.Name()))
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Export writes the static site in dir and returns the number of exported
+// drawings. Exporting again in the same directory only copies new drawings
+// and removes evicted ones.
+func (e *siteExporter) Export(dir string, now time.Time) (int, error) {
+	for _, sub := range []string{"images", "thumbnails", "drawings"} {
+		err := os.MkdirAll(filepath.Join(dir, sub), 0755)
+		if err != nil {
+			return 0, err
+		}
+	}
+	drawings, err := e.drawings()
+	if err != nil {
+		return 0, err
+	}
+	for _, d := range drawings {
+		err := e.copyImage(dir, d)
+		if err == nil {
+			err = e.writeThumbnail(dir, d)
+		}
+		if err == nil {
+			err = e.writePage(dir, d)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("could not export %s: %s", d.Name, err)
+		}
+	}
+	err = removeStale(dir, drawings)
+	if err != nil {
+		return 0, err
+	}
+	err = e.writeIndex(dir, drawings, now)
+	if err != nil {
+		return 0, err
+	}
+	err = e.writeFeed(dir, drawings, now)
+	if err != nil {
+		return 0, err
+	}
+	err = e.writeListing(dir, drawings)
+	if err != nil {
+		return 0, err
+	}
+	return len(drawings), nil
+}
+
+// ExportSiteCommand writes a static gallery of the saved drawings.
+func ExportSiteCommand(args []string) error {
+	fs := flag.NewFlagSet("export-site", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Print(`Usage: gribouillis export-site [OPTIONS] DIR
+
+Write a static HTML gallery of the saved drawings in DIR: an index of
+thumbnails, a page per drawing, an Atom feed of the latest ones and a
+drawings.json listing read by "gribouillis import". The result can be archived
+or served by any static web server, for instance after an event ends.
+Exporting again in the same directory updates it.
+
+Set -site-url to the URL the site will be served from, so the feed and the
+embedding snippets of drawings pages use absolute URLs.
+
+`)
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	imagesDir := fs.String("images-dir", "images",
+		"directory where drawings are saved")
+	metaDir := fs.String("meta-dir", "",
+		"directory where drawings metadata are saved, defaults to images directory with a -meta suffix")
+	siteURL := fs.String("site-url", "", "URL the exported site is served from")
+	title := fs.String("title", "gribouillis", "gallery title")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("one output directory expected")
+	}
+	if *metaDir == "" {
+		*metaDir = defaultMetaDir(*imagesDir)
+	}
+	e := &siteExporter{
+		imagesDir: *imagesDir,
+		meta:      &metaStore{dir: *metaDir},
+		siteURL:   *siteURL,
+		title:     *title,
+		enc: &png.Encoder{
+			CompressionLevel: png.BestCompression,
+		},
+	}
+	n, err := e.Export(fs.Arg(0), time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("exported %d drawings in %s\n", n, fs.Arg(0))
+	return nil
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"encoding/xml"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportSite(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "gribouillis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	imagesDir := filepath.Join(tmpDir, "images")
+	meta, err := openMetaStore(defaultMetaDir(imagesDir), imagesDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(imagesDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i, name := range []string{"a.png", "b.png", "c.png"} {
+		path := filepath.Join(imagesDir, name)
+		err := ioutil.WriteFile(path, encodeTestImage(t, 400, 100), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		modified := now.Add(time.Duration(i-3) * time.Hour)
+		err = os.Chtimes(path, modified, modified)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = meta.Put("b.png", &Metadata{Title: "Cat <3", Author: "Alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &siteExporter{
+		imagesDir: imagesDir,
+		meta:      meta,
+		siteURL:   "https://example.com/party/",
+		title:     "Party",
+		enc:       &png.Encoder{},
+	}
+	siteDir := filepath.Join(tmpDir, "site")
+	n, err := e.Export(siteDir, now)
+	if err != nil || n != 3 {
+		t.Fatalf("unexpected export result: %d, %v", n, err)
+	}
+
+	thumb, err := decodePNGFile(filepath.Join(siteDir, "thumbnails", "a.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := thumb.Bounds(); b.Dx() != siteThumbSize || b.Dy() != 50 {
+		t.Fatalf("unexpected thumbnail size: %v", b)
+	}
+	index, err := ioutil.ReadFile(filepath.Join(siteDir, "index.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Newest first
+	c := strings.Index(string(index), "drawings/c.html")
+	a := strings.Index(string(index), "drawings/a.html")
+	if c < 0 || a < c {
+		t.Fatalf("unexpected index:\n%s", index)
+	}
+	page, err := ioutil.ReadFile(filepath.Join(siteDir, "drawings", "b.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"Cat &lt;3", "By Alice", `src="../images/b.png"`,
+		"https://example.com/party/drawings/b.html", `href="../index.html"`} {
+		if !strings.Contains(string(page), s) {
+			t.Fatalf("page does not contain %q:\n%s", s, page)
+		}
+	}
+	if strings.Contains(string(page), "api/v1") {
+		t.Fatalf("static page links to the server:\n%s", page)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(siteDir, "feed.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	feed := atomFeed{}
+	err = xml.Unmarshal(data, &feed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(feed.Entries) != 3 || feed.Entries[1].Title != "Cat <3" ||
+		feed.Entries[1].Author == nil || feed.Entries[1].Author.Name != "Alice" ||
+		feed.Entries[1].ID != "https://example.com/party/drawings/b.html" {
+		t.Fatalf("unexpected feed:\n%s", data)
+	}
+
+	// Evicted drawings disappear from the site
+	err = os.Remove(filepath.Join(imagesDir, "a.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err = e.Export(siteDir, now)
+	if err != nil || n != 2 {
+		t.Fatalf("unexpected export result: %d, %v", n, err)
+	}
+	for _, path := range []string{"images/a.png", "thumbnails/a.png", "drawings/a.html"} {
+		_, err := os.Stat(filepath.Join(siteDir, filepath.FromSlash(path)))
+		if !os.IsNotExist(err) {
+			t.Fatalf("%s was not removed: %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// sketchbookMaxPages is the maximum number of drawings in a sketchbook.
+const sketchbookMaxPages = 100
+
+// sketchbookQuery selects the drawings of an author or a room, saved between
+// From and To.
+type sketchbookQuery struct {
+	Author string
+	Room   string
+	From   time.Time
+	To     time.Time
+}
+
+// parseSketchbookTime parses v as an RFC 3339 time or a YYYY-MM-DD date. Dates
+// designate their first instant, or their last one if end is true.
+func parseSketchbookTime(v string, end bool) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, v)
+	if err == nil {
+		return t, nil
+	}
+	t, err = time.Parse("2006-01-02", v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date: %s", v)
+	}
+	if end {
+		t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	}
+	return t, nil
+}
+
+// parseSketchbookQuery returns the query of author, room, from and to
+// parameters. An author or a room is required.
+func parseSketchbookQuery(q url.Values) (*sketchbookQuery, error) {
+	s := &sketchbookQuery{
+		Author: strings.TrimSpace(q.Get("author")),
+		Room:   q.Get("room"),
+	}
+	if s.Author == "" && s.Room == "" {
+		return nil, fmt.Errorf("author or room is required")
+	}
+	if s.Room != "" && !roomIDRe.MatchString(s.Room) {
+		return nil, fmt.Errorf("invalid room identifier")
+	}
+	var err error
+	if v := q.Get("from"); v != "" {
+		s.From, err = parseSketchbookTime(v, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		s.To, err = parseSketchbookTime(v, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Match returns whether the drawing with metadata m, saved at t, belongs to
+// the sketchbook.
+func (s *sketchbookQuery) Match(m *Metadata, t time.Time) bool {
+	if s.Author != "" && !strings.EqualFold(s.Author, m.Author) {
+		return false
+	}
+	if s.Room != "" && s.Room != m.Room {
+		return false
+	}
+	if !s.From.IsZero() && t.Before(s.From) {
+		return false
+	}
+	return s.To.IsZero() || !t.After(s.To)
+}
+
+// sketchbookCaption returns the caption of the drawing with metadata m, saved
+// at t.
+func sketchbookCaption(m *Metadata, t time.Time) string {
+	caption := m.Title
+	if caption == "" {
+		caption = "Untitled"
+	}
+	if m.Author != "" {
+		caption += " by " + m.Author
+	}
+	return caption + ", " + t.Format("January 2, 2006 15:04")
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSketchbookQuery(t *testing.T) {
+	q, err := parseSketchbookQuery(url.Values{
+		"author": {"Ann"},
+		"from":   {"2024-03-01"},
+		"to":     {"2024-03-02"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Metadata{Author: "ann"}
+	for _, test := range []struct {
+		date  time.Time
+		match bool
+	}{
+		{time.Date(2024, 2, 29, 23, 59, 0, 0, time.UTC), false},
+		{time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), true},
+		{time.Date(2024, 3, 2, 23, 59, 0, 0, time.UTC), true},
+		{time.Date(2024, 3, 3, 0, 0, 0, 0, time.UTC), false},
+	} {
+		if q.Match(m, test.date) != test.match {
+			t.Errorf("%s: expected match %v", test.date, test.match)
+		}
+	}
+	if q.Match(&Metadata{Author: "Bob"}, time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Error("drawing of another author matched")
+	}
+	for _, v := range []url.Values{
+		{},
+		{"room": {"../etc"}},
+		{"author": {"Ann"}, "from": {"yesterday"}},
+	} {
+		if _, err := parseSketchbookQuery(v); err == nil {
+			t.Errorf("%v was accepted", v)
+		}
+	}
+}
+
+func TestSketchbookHandler(t *testing.T) {
+	cfg, cleanup := newTestConfig(t)
+	defer cleanup()
+	h, err := NewHandler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	for _, query := range []string{
+		"title=Cat&author=Ann",
+		"title=(Dog)&author=ann",
+		"author=Bob&room=workshop",
+	} {
+		rsp, err := http.Post(srv.URL+"/api/v1/drawings?"+query, "image/png",
+			bytes.NewReader(encodeTestImage(t, 10, 10)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp.Body.Close()
+		if rsp.StatusCode != 200 {
+			t.Fatalf("could not save drawing: %s", rsp.Status)
+		}
+	}
+	get := func(query string) (int, string) {
+		rsp, err := http.Get(srv.URL + "/api/v1/sketchbook?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rsp.Body.Close()
+		data, err := ioutil.ReadAll(rsp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rsp.StatusCode, string(data)
+	}
+	code, data := get("author=Ann")
+	if code != 200 || strings.Count(data, "/Type /Page ") != 2 ||
+		!strings.Contains(data, "(Cat by Ann, ") ||
+		!strings.Contains(data, `(\(Dog\) by ann, `) {
+		t.Fatalf("unexpected author sketchbook: %d\n%s", code, data)
+	}
+	code, data = get("room=workshop")
+	if code != 200 || strings.Count(data, "/Type /Page ") != 1 {
+		t.Fatalf("unexpected room sketchbook: %d", code)
+	}
+	if code, _ := get("author=Zed"); code != 404 {
+		t.Fatalf("expected 404 without drawings, got %d", code)
+	}
+	if code, _ := get(""); code != 400 {
+		t.Fatalf("expected 400 without author or room, got %d", code)
+	}
+}
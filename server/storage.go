@@ -0,0 +1,36 @@
+package server
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pmezard/gribouillis/storage"
+)
+
+// openStorage returns the storage of cfg images directory.
+func openStorage(cfg *Config) (storage.Storage, error) {
+	switch cfg.Storage {
+	case "", "dir":
+		return storage.DirStorage(cfg.ImagesDir), nil
+	case "s3":
+		endpoint := cfg.S3Endpoint
+		if endpoint == "" {
+			endpoint = "https://s3." + cfg.S3Region + ".amazonaws.com"
+		}
+		accessKey := cfg.S3AccessKey
+		if accessKey == "" {
+			accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		}
+		secretKey := cfg.S3SecretKey
+		if secretKey == "" {
+			secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		}
+		client, err := storage.NewS3Client(endpoint, cfg.S3Bucket, cfg.S3Region,
+			accessKey, secretKey)
+		if err != nil {
+			return nil, err
+		}
+		return storage.NewS3Storage(cfg.ImagesDir, cfg.S3Prefix, client), nil
+	}
+	return nil, fmt.Errorf("unknown storage: %s", cfg.Storage)
+}
@@ -0,0 +1,409 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"image/color"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// lcShape is a serialized LiterallyCanvas shape.
+type lcShape struct {
+	ClassName string          `json:"className"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// lcSnapshot is the part of a LiterallyCanvas snapshot, as returned by
+// getSnapshot, rendered to SVG.
+type lcSnapshot struct {
+	Shapes           []lcShape `json:"shapes"`
+	BackgroundShapes []lcShape `json:"backgroundShapes"`
+	Colors           struct {
+		Background string `json:"background"`
+	} `json:"colors"`
+}
+
+// lcShapeData holds the properties of all supported LiterallyCanvas shapes.
+type lcShapeData struct {
+	// Rectangle, Ellipse, Text and Point
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+	// Line
+	X1           float64   `json:"x1"`
+	Y1           float64   `json:"y1"`
+	X2           float64   `json:"x2"`
+	Y2           float64   `json:"y2"`
+	Color        string    `json:"color"`
+	CapStyle     string    `json:"capStyle"`
+	Dash         []float64 `json:"dash"`
+	EndCapShapes []string  `json:"endCapShapes"`
+	// Rectangle, Ellipse and Polygon
+	StrokeWidth float64 `json:"strokeWidth"`
+	StrokeColor string  `json:"strokeColor"`
+	FillColor   string  `json:"fillColor"`
+	IsClosed    *bool   `json:"isClosed"`
+	// LinePath and Polygon, points being either coordinates pairs sharing a
+	// style or Point shapes.
+	PointCoordinatePairs         [][2]float64 `json:"pointCoordinatePairs"`
+	SmoothedPointCoordinatePairs [][2]float64 `json:"smoothedPointCoordinatePairs"`
+	PointSize                    float64      `json:"pointSize"`
+	PointColor                   string       `json:"pointColor"`
+	Points                       []lcShape    `json:"points"`
+	Smooth                       *bool        `json:"smooth"`
+	// Point
+	Size float64 `json:"size"`
+	// Text
+	Text        string  `json:"text"`
+	Font        string  `json:"font"`
+	ForcedWidth float64 `json:"forcedWidth"`
+}
+
+// svgRect is a rectangle in drawing coordinates.
+type svgRect struct {
+	MinX, MinY, MaxX, MaxY float64
+}
+
+// svgWriter renders LiterallyCanvas shapes to SVG elements, like the
+// LiterallyCanvas SVG renderer. All values come from clients and are escaped.
+type svgWriter struct {
+	buf bytes.Buffer
+	// bounds is the bounding rectangle of rendered shapes
+	bounds *svgRect
+	// background strokes erased paths, if not empty
+	background string
+}
+
+func svgNum(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func svgEscape(s string) string {
+	b := &strings.Builder{}
+	xml.EscapeText(b, []byte(s))
+	return b.String()
+}
+
+// svgFont keeps the characters of CSS font shorthands, like "18px
+// sans-serif", so fonts cannot inject other properties.
+func svgFont(font string) string {
+	return strings.Map(func(c rune) rune {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			strings.ContainsRune(" ,.-'\"%", c) {
+			return c
+		}
+		return -1
+	}, font)
+}
+
+// svgFontSize returns the size in pixels of a CSS font shorthand, or 18.
+func svgFontSize(font string) float64 {
+	for _, f := range strings.Fields(font) {
+		if strings.HasSuffix(f, "px") {
+			size, err := strconv.ParseFloat(strings.TrimSuffix(f, "px"), 64)
+			if err == nil && size > 0 {
+				return size
+			}
+		}
+	}
+	return 18
+}
+
+// include extends the bounds to the rectangle, rounded to pixels.
+func (w *svgWriter) include(minX, minY, maxX, maxY float64) {
+	minX, minY = math.Floor(minX), math.Floor(minY)
+	maxX, maxY = math.Ceil(maxX), math.Ceil(maxY)
+	if w.bounds == nil {
+		w.bounds = &svgRect{minX, minY, maxX, maxY}
+		return
+	}
+	r := w.bounds
+	r.MinX, r.MinY = math.Min(r.MinX, minX), math.Min(r.MinY, minY)
+	r.MaxX, r.MaxY = math.Max(r.MaxX, maxX), math.Max(r.MaxY, maxY)
+}
+
+// points returns the coordinates and style of LinePath and Polygon shapes.
+// Smoothed points are preferred if smooth is set.
+func (d *lcShapeData) points(smooth bool) ([][2]float64, float64, string, error) {
+	if d.Points == nil {
+		pairs := d.PointCoordinatePairs
+		if smooth && len(d.SmoothedPointCoordinatePairs) > 0 {
+			pairs = d.SmoothedPointCoordinatePairs
+		}
+		return pairs, d.PointSize, d.PointColor, nil
+	}
+	pairs := [][2]float64{}
+	size, color := 0.0, ""
+	for i, s := range d.Points {
+		p := &lcShapeData{}
+		err := json.Unmarshal(s.Data, p)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		if i == 0 {
+			size, color = p.Size, p.Color
+		}
+		pairs = append(pairs, [2]float64{p.X, p.Y})
+	}
+	return pairs, size, color, nil
+}
+
+func (w *svgWriter) polyline(pairs [][2]float64, width float64) string {
+	offset := 0.0
+	if math.Mod(width, 2) != 0 {
+		offset = 0.5
+	}
+	parts := []string{}
+	for _, p := range pairs {
+		parts = append(parts, svgNum(p[0]+offset)+","+svgNum(p[1]+offset))
+		w.include(p[0]-width/2, p[1]-width/2, p[0]+width/2, p[1]+width/2)
+	}
+	return strings.Join(parts, " ")
+}
+
+// arrow returns the points of an arrow head at x, y, pointing to angle.
+func (w *svgWriter) arrow(x, y, angle, width float64) string {
+	points := [][2]float64{
+		{x + math.Cos(angle+math.Pi/2)*width/2, y + math.Sin(angle+math.Pi/2)*width/2},
+		{x + math.Cos(angle)*width, y + math.Sin(angle)*width},
+		{x + math.Cos(angle-math.Pi/2)*width/2, y + math.Sin(angle-math.Pi/2)*width/2},
+	}
+	parts := []string{}
+	for _, p := range points {
+		parts = append(parts, svgNum(p[0])+","+svgNum(p[1]))
+		w.include(p[0], p[1], p[0], p[1])
+	}
+	return strings.Join(parts, " ")
+}
+
+// Shape renders s. Images, selection boxes and unknown shapes are ignored.
+func (w *svgWriter) Shape(s lcShape) error {
+	d := &lcShapeData{}
+	if len(s.Data) > 0 {
+		err := json.Unmarshal(s.Data, d)
+		if err != nil {
+			return fmt.Errorf("invalid %s shape: %s", s.ClassName, err)
+		}
+	}
+	if d.StrokeWidth == 0 {
+		d.StrokeWidth = 1
+	}
+	if d.StrokeColor == "" {
+		d.StrokeColor = "black"
+	}
+	switch s.ClassName {
+	case "Rectangle", "Ellipse":
+		if d.FillColor == "" {
+			d.FillColor = "transparent"
+		}
+		x := math.Min(d.X, d.X+d.Width)
+		y := math.Min(d.Y, d.Y+d.Height)
+		width, height := math.Abs(d.Width), math.Abs(d.Height)
+		w.include(x-d.StrokeWidth/2, y-d.StrokeWidth/2,
+			x+width+d.StrokeWidth/2, y+height+d.StrokeWidth/2)
+		style := fmt.Sprintf("stroke='%s' fill='%s' stroke-width='%s'",
+			svgEscape(d.StrokeColor), svgEscape(d.FillColor), svgNum(d.StrokeWidth))
+		if s.ClassName == "Ellipse" {
+			fmt.Fprintf(&w.buf, "<ellipse cx='%s' cy='%s' rx='%s' ry='%s' %s/>\n",
+				svgNum(x+width/2), svgNum(y+height/2), svgNum(width/2),
+				svgNum(height/2), style)
+			return nil
+		}
+		if math.Mod(d.StrokeWidth, 2) != 0 {
+			x += 0.5
+			y += 0.5
+		}
+		fmt.Fprintf(&w.buf, "<rect x='%s' y='%s' width='%s' height='%s' %s/>\n",
+			svgNum(x), svgNum(y), svgNum(width), svgNum(height), style)
+	case "Line":
+		if d.Color == "" {
+			d.Color = "black"
+		}
+		if d.CapStyle != "butt" && d.CapStyle != "square" {
+			d.CapStyle = "round"
+		}
+		x1, y1, x2, y2 := d.X1, d.Y1, d.X2, d.Y2
+		w.include(math.Min(x1, x2)-d.StrokeWidth/2, math.Min(y1, y2)-d.StrokeWidth/2,
+			math.Max(x1, x2)+d.StrokeWidth/2, math.Max(y1, y2)+d.StrokeWidth/2)
+		if math.Mod(d.StrokeWidth, 2) != 0 {
+			x1, y1, x2, y2 = x1+0.5, y1+0.5, x2+0.5, y2+0.5
+		}
+		dash := ""
+		if len(d.Dash) > 0 {
+			parts := []string{}
+			for _, v := range d.Dash {
+				parts = append(parts, svgNum(v))
+			}
+			dash = fmt.Sprintf(" stroke-dasharray='%s'", strings.Join(parts, ", "))
+		}
+		color := svgEscape(d.Color)
+		fmt.Fprintf(&w.buf, "<line x1='%s' y1='%s' x2='%s' y2='%s'%s stroke-linecap='%s' stroke='%s' stroke-width='%s'/>\n",
+			svgNum(x1), svgNum(y1), svgNum(x2), svgNum(y2), dash, d.CapStyle,
+			color, svgNum(d.StrokeWidth))
+		width := math.Max(d.StrokeWidth*2.2, 5)
+		for i, cap := range d.EndCapShapes {
+			if cap != "arrow" || i > 1 {
+				continue
+			}
+			x, y, angle := x1, y1, math.Atan2(y1-y2, x1-x2)
+			if i == 1 {
+				x, y, angle = x2, y2, math.Atan2(y2-y1, x2-x1)
+			}
+			fmt.Fprintf(&w.buf, "<polygon fill='%s' stroke='none' points='%s'/>\n",
+				color, w.arrow(x, y, angle, width))
+		}
+	case "LinePath", "ErasedLinePath":
+		pairs, size, color, err := d.points(d.Smooth == nil || *d.Smooth)
+		if err != nil {
+			return fmt.Errorf("invalid %s shape: %s", s.ClassName, err)
+		}
+		if len(pairs) == 0 {
+			return nil
+		}
+		if s.ClassName == "ErasedLinePath" {
+			// Erasing is only visible on opaque backgrounds
+			if w.background == "" {
+				return nil
+			}
+			color = w.background
+		}
+		fmt.Fprintf(&w.buf, "<polyline fill='none' points='%s' stroke='%s' stroke-linecap='round' stroke-linejoin='round' stroke-width='%s'/>\n",
+			w.polyline(pairs, size), svgEscape(color), svgNum(size))
+	case "Polygon":
+		pairs, _, _, err := d.points(false)
+		if err != nil {
+			return fmt.Errorf("invalid polygon shape: %s", err)
+		}
+		if len(pairs) == 0 {
+			return nil
+		}
+		if d.FillColor == "" {
+			d.FillColor = "white"
+		}
+		points := w.polyline(pairs, d.StrokeWidth)
+		element := "polyline"
+		if d.IsClosed == nil || *d.IsClosed {
+			element = "polygon"
+		}
+		fmt.Fprintf(&w.buf, "<%s fill='%s' points='%s' stroke='%s' stroke-width='%s'/>\n",
+			element, svgEscape(d.FillColor), points, svgEscape(d.StrokeColor),
+			svgNum(d.StrokeWidth))
+	case "Text":
+		if d.Color == "" {
+			d.Color = "black"
+		}
+		if d.Font == "" {
+			d.Font = "18px sans-serif"
+		}
+		lines := strings.Split(strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(d.Text), "\n")
+		size := svgFontSize(d.Font)
+		width := d.ForcedWidth
+		for _, line := range lines {
+			// Rough estimate, glyphs metrics are not known
+			width = math.Max(width, float64(len([]rune(line)))*size*0.6)
+		}
+		w.include(d.X, d.Y, d.X+width, d.Y+float64(len(lines))*size*1.2)
+		fmt.Fprintf(&w.buf, "<text x='%s' y='%s' fill='%s' style='font: %s;'>",
+			svgNum(d.X), svgNum(d.Y), svgEscape(d.Color), svgEscape(svgFont(d.Font)))
+		for i, line := range lines {
+			dy := "0"
+			if i > 0 {
+				dy = "1.2em"
+			}
+			fmt.Fprintf(&w.buf, "<tspan x='%s' dy='%s' dominant-baseline='text-before-edge'>%s</tspan>",
+				svgNum(d.X), dy, svgEscape(line))
+		}
+		w.buf.WriteString("</text>\n")
+	}
+	return nil
+}
+
+// renderSVG renders the LiterallyCanvas snapshot data like its bitmap export:
+// cropped to the shapes, with padding pixels of paddingColor around.
+func renderSVG(data []byte, padding int, paddingColor color.NRGBA) ([]byte, error) {
+	snapshot := &lcSnapshot{}
+	err := json.Unmarshal(data, snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("invalid shapes: %s", err)
+	}
+	w := &svgWriter{}
+	background := snapshot.Colors.Background
+	if background != "" && background != "transparent" {
+		w.background = background
+	}
+	for _, s := range append(snapshot.BackgroundShapes, snapshot.Shapes...) {
+		err := w.Shape(s)
+		if err != nil {
+			return nil, err
+		}
+	}
+	r := w.bounds
+	if r == nil {
+		r = &svgRect{}
+	}
+	p := float64(padding)
+	width, height := r.MaxX-r.MinX, r.MaxY-r.MinY
+	out := &bytes.Buffer{}
+	fmt.Fprintf(out, "<svg xmlns='http://www.w3.org/2000/svg' width='%s' height='%s' viewBox='%s %s %s %s'>\n",
+		svgNum(width+2*p), svgNum(height+2*p), svgNum(r.MinX-p), svgNum(r.MinY-p),
+		svgNum(width+2*p), svgNum(height+2*p))
+	if padding > 0 {
+		fmt.Fprintf(out, "<rect x='%s' y='%s' width='%s' height='%s' fill='#%02x%02x%02x'/>\n",
+			svgNum(r.MinX-p), svgNum(r.MinY-p), svgNum(width+2*p), svgNum(height+2*p),
+			paddingColor.R, paddingColor.G, paddingColor.B)
+	}
+	if w.background != "" {
+		fmt.Fprintf(out, "<rect x='%s' y='%s' width='%s' height='%s' fill='%s'/>\n",
+			svgNum(r.MinX), svgNum(r.MinY), svgNum(width), svgNum(height),
+			svgEscape(w.background))
+	}
+	out.Write(w.buf.Bytes())
+	out.WriteString("</svg>\n")
+	return out.Bytes(), nil
+}
+
+// serveSVG serves the SVG rendering of drawing name, if any.
+func (h *Handler) serveSVG(w http.ResponseWriter, r *http.Request, name string) {
+	if !drawingIDRe.MatchString(strings.TrimSuffix(name, ".png")) ||
+		!containsString(h.imgDir.List(), name) {
+		http.NotFound(w, r)
+		return
+	}
+	path := h.meta.SVGPath(name)
+	if h.variants != nil {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			gz, err := h.variants.GzipSVG(name, path)
+			if err == nil {
+				path = gz
+				w.Header().Set("Content-Encoding", "gzip")
+			} else if !os.IsNotExist(err) {
+				slog.Warn("could not compress SVG", "name", name, "err", err)
+			}
+		}
+	}
+	fp, err := os.Open(path)
+	if err != nil {
+		w.Header().Del("Content-Encoding")
+		http.NotFound(w, r)
+		return
+	}
+	defer fp.Close()
+	st, err := fp.Stat()
+	if err != nil {
+		http.Error(w, "could not read SVG", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	// SVG documents are rendered by browsers like HTML ones
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'")
+	http.ServeContent(w, r, name+".svg", st.ModTime(), fp)
+}
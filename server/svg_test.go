@@ -0,0 +1,81 @@
+package server
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/pmezard/gribouillis/imageproc"
+)
+
+func TestRenderSVG(t *testing.T) {
+	snapshot := `{
+  "colors": {"primary": "black", "background": "#ffeecc"},
+  "shapes": [
+    {"className": "LinePath", "data": {"order": 3, "tailSize": 3, "smooth": true,
+      "pointCoordinatePairs": [[10, 10], [20, 20]],
+      "smoothedPointCoordinatePairs": [[10, 10], [15, 16], [20, 20]],
+      "pointSize": 4, "pointColor": "hsla(0, 0%, 0%, 1)"}},
+    {"className": "ErasedLinePath", "data": {"points": [
+      {"className": "Point", "data": {"x": 12, "y": 12, "size": 6, "color": "red"}},
+      {"className": "Point", "data": {"x": 14, "y": 14, "size": 6, "color": "red"}}]}},
+    {"className": "Rectangle", "data": {"x": 30, "y": 5, "width": -10, "height": 20,
+      "strokeWidth": 2, "strokeColor": "'/><script>alert(1)</script>",
+      "fillColor": "transparent"}},
+    {"className": "Line", "data": {"x1": 0, "y1": 0, "x2": 10, "y2": 0,
+      "strokeWidth": 1, "color": "blue", "capStyle": "round", "dash": [2, 4],
+      "endCapShapes": [null, "arrow"]}},
+    {"className": "Text", "data": {"x": 5, "y": 40, "text": "a<b>\nc",
+      "color": "green", "font": "18px sans-serif;} body{display:none"}},
+    {"className": "Image", "data": {"x": 0, "y": 0,
+      "imageSrc": "https://tracker.example.com/pixel.png"}}
+  ]
+}`
+	data, err := renderSVG([]byte(snapshot), 10, imageproc.NamedColors["navy"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	svg := string(data)
+	// Every client value is escaped, the result is well formed
+	d := xml.NewDecoder(bytes.NewReader(data))
+	elements := []string{}
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("invalid SVG: %s\n%s", err, svg)
+		}
+		if e, ok := tok.(xml.StartElement); ok {
+			elements = append(elements, e.Name.Local)
+		}
+	}
+	if strings.Join(elements, " ") !=
+		"svg rect rect polyline polyline rect line polygon text tspan tspan" {
+		t.Fatalf("unexpected elements: %v\n%s", elements, svg)
+	}
+	for _, s := range []string{
+		// Padded bounds of the shapes
+		"viewBox='-11 -12 70 106'",
+		"fill='#000080'",
+		"points='10,10 15,16 20,20'",
+		"stroke='#ffeecc'",
+		"font: 18px sans-serif bodydisplaynone;",
+		"a&lt;b&gt;</tspan>",
+	} {
+		if !strings.Contains(svg, s) {
+			t.Fatalf("%q not found in:\n%s", s, svg)
+		}
+	}
+	if strings.Contains(svg, "tracker") {
+		t.Fatalf("images are rendered:\n%s", svg)
+	}
+
+	_, err = renderSVG([]byte(`{"shapes": [{"className": "Line", "data": []}]}`), 0, imageproc.NamedColors["white"])
+	if err == nil {
+		t.Fatal("invalid shapes were rendered")
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !windows
+
+package server
+
+import (
+	"os"
+)
+
+// syncDir flushes the entries of directory dir to stable storage, so files
+// linked or renamed into it survive a crash.
+func syncDir(dir string) error {
+	fp, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = fp.Sync()
+	if err != nil {
+		fp.Close()
+		return err
+	}
+	return fp.Close()
+}
@@ -0,0 +1,9 @@
+//go:build windows
+
+package server
+
+// syncDir does nothing: directories cannot be synced on Windows, where
+// NTFS journals their entries.
+func syncDir(dir string) error {
+	return nil
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TLSOptions configures HTTPS, either with a certificate and key files or
+// with certificates obtained from Let's Encrypt for AutocertDomains.
+type TLSOptions struct {
+	CertFile string
+	KeyFile  string
+	// AutocertDomains is a comma separated list of domain names.
+	AutocertDomains string
+	AutocertCache   string
+	AutocertEmail   string
+	// AutocertHTTP, if set, is the address answering ACME HTTP challenges
+	// and redirecting other requests to HTTPS.
+	AutocertHTTP string
+}
+
+// TLSConfig returns the TLS configuration described by opts, or nil if HTTPS
+// is not enabled.
+func (opts *TLSOptions) TLSConfig() (*tls.Config, error) {
+	if opts.AutocertDomains != "" {
+		if opts.CertFile != "" || opts.KeyFile != "" {
+			return nil, fmt.Errorf(
+				"-autocert-domain cannot be used with -tls-cert and -tls-key")
+		}
+		domains := []string{}
+		for _, d := range strings.Split(opts.AutocertDomains, ",") {
+			d = strings.TrimSpace(d)
+			if d != "" {
+				domains = append(domains, d)
+			}
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(opts.AutocertCache),
+			HostPolicy: autocert.HostWhitelist(domains...),
+			Email:      opts.AutocertEmail,
+		}
+		if opts.AutocertHTTP != "" {
+			go func() {
+				slog.Info("answering ACME challenges", "addr", opts.AutocertHTTP)
+				err := http.ListenAndServe(opts.AutocertHTTP, m.HTTPHandler(nil))
+				slog.Error("could not answer ACME challenges", "err", err)
+			}()
+		}
+		return m.TLSConfig(), nil
+	}
+	if opts.CertFile == "" && opts.KeyFile == "" {
+		return nil, nil
+	}
+	if opts.CertFile == "" || opts.KeyFile == "" {
+		return nil, fmt.Errorf("-tls-cert and -tls-key must be set together")
+	}
+	cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}, nil
+}
+
+// runServer serves HTTP requests on l, or HTTPS ones if server has a TLS
+// configuration. It returns http.ErrServerClosed once shut down.
+func runServer(server *http.Server, l net.Listener) error {
+	if server.TLSConfig != nil {
+		return server.ServeTLS(l, "", "")
+	}
+	return server.Serve(l)
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(
+		&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(
+		&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestTLS(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "gribouillis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	certFile, keyFile := writeTestCertificate(t, tmpDir)
+
+	cfg, err := (&TLSOptions{}).TLSConfig()
+	if err != nil || cfg != nil {
+		t.Fatalf("HTTPS is enabled by default: %v, %v", cfg, err)
+	}
+	invalid := []*TLSOptions{
+		{CertFile: certFile},
+		{KeyFile: keyFile},
+		{CertFile: certFile, KeyFile: keyFile, AutocertDomains: "example.com"},
+	}
+	for _, opts := range invalid {
+		_, err := opts.TLSConfig()
+		if err == nil {
+			t.Errorf("invalid options were accepted: %+v", opts)
+		}
+	}
+
+	cfg, err = (&TLSOptions{CertFile: certFile, KeyFile: keyFile}).TLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		}),
+		TLSConfig: cfg,
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- runServer(server, l)
+	}()
+	defer func() {
+		server.Close()
+		if err := <-done; err != http.ErrServerClosed {
+			t.Fatalf("unexpected server error: %v", err)
+		}
+	}()
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	rsp, err := client.Get("https://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+	data, err := ioutil.ReadAll(rsp.Body)
+	if err != nil || string(data) != "ok" || rsp.TLS == nil {
+		t.Fatalf("unexpected response: %q, %v", data, err)
+	}
+}
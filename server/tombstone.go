@@ -0,0 +1,211 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pmezard/gribouillis/storage"
+)
+
+// Reasons of drawings removals recorded in tombstones.
+const (
+	// removalDeleted drawings were deleted with their delete token.
+	removalDeleted = "deleted"
+	// removalModerated drawings were deleted with the admin API.
+	removalModerated = "moderated"
+	// removalEvicted drawings were evicted to enforce the storage limits or
+	// the maximum age.
+	removalEvicted = "evicted"
+)
+
+// tombstone records the removal of a drawing.
+type tombstone struct {
+	Reason  string    `json:"reason"`
+	Removed time.Time `json:"removed"`
+}
+
+// Message returns a sentence explaining the removal.
+func (t *tombstone) Message() string {
+	switch t.Reason {
+	case removalDeleted:
+		return "This drawing was deleted by its author."
+	case removalModerated:
+		return "This drawing was removed by a moderator."
+	case removalEvicted:
+		return "This drawing was removed to make room for newer ones."
+	}
+	return "This drawing was removed."
+}
+
+// tombstoneStore keeps tombstones of removed drawings in dir for age, so
+// their URLs explain what happened instead of returning a 404.
+type tombstoneStore struct {
+	dir string
+	age time.Duration
+}
+
+// defaultTombstonesDir returns the tombstones directory used with imagesDir.
+func defaultTombstonesDir(imagesDir string) string {
+	return filepath.Clean(imagesDir) + "-tombstones"
+}
+
+// openTombstoneStore returns a tombstoneStore keeping tombstones in dir for
+// age.
+func openTombstoneStore(dir string, age time.Duration) (*tombstoneStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &tombstoneStore{dir: dir, age: age}, nil
+}
+
+func (s *tombstoneStore) path(name string) string {
+	return filepath.Join(s.dir, name+".json")
+}
+
+// Put records that drawing name was removed for reason.
+func (s *tombstoneStore) Put(name, reason string, now time.Time) error {
+	data, err := json.Marshal(&tombstone{Reason: reason, Removed: now.UTC()})
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(s.dir, ".tombstone-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(name))
+}
+
+// Get returns the tombstone of drawing name, or nil if it has none or it is
+// older than the store age.
+func (s *tombstoneStore) Get(name string, now time.Time) (*tombstone, error) {
+	if strings.ContainsAny(name, "/\\") || strings.HasPrefix(name, ".") {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(s.path(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	t := &tombstone{}
+	err = json.Unmarshal(data, t)
+	if err != nil {
+		return nil, err
+	}
+	if now.Sub(t.Removed) > s.age {
+		return nil, nil
+	}
+	return t, nil
+}
+
+// Taken reports whether a drawing called name has a tombstone, its name not
+// being reusable until the tombstone expires.
+func (s *tombstoneStore) Taken(name string) bool {
+	_, err := os.Lstat(s.path(name))
+	return !os.IsNotExist(err)
+}
+
+// Expire removes tombstones older than the store age, and leftovers.
+func (s *tombstoneStore) Expire(now time.Time) error {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasPrefix(name, ".") {
+			if now.Sub(e.ModTime()) > storage.StaleTempAge {
+				os.Remove(filepath.Join(s.dir, name))
+			}
+			continue
+		}
+		t, err := s.Get(strings.TrimSuffix(name, ".json"), now)
+		if err != nil {
+			slog.Warn("could not read tombstone", "name", name, "err", err)
+			continue
+		}
+		if t == nil {
+			os.Remove(filepath.Join(s.dir, name))
+		}
+	}
+	return nil
+}
+
+// Run expires tombstones every interval, until ctx is done.
+func (s *tombstoneStore) Run(ctx context.Context, interval time.Duration) {
+	for {
+		err := s.Expire(time.Now())
+		if err != nil {
+			slog.Error("could not expire tombstones", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Gone returns a handler serving the drawings named by request paths with h,
+// or a 410 explaining their removal if images does not have them anymore.
+func (s *tombstoneStore) Gone(images string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		if _, err := os.Stat(filepath.Join(images, name)); !os.IsNotExist(err) ||
+			(r.Method != "GET" && r.Method != "HEAD") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		t, err := s.Get(name, time.Now())
+		if err != nil || t == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		http.Error(w, t.Message(), http.StatusGone)
+	})
+}
+
+var tombstoneTemplate = template.Must(template.New("tombstone").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Drawing removed - gribouillis</title>
+<meta name="robots" content="noindex">
+<style>
+body { font-family: sans-serif; max-width: 60em; margin: 1em auto; padding: 0 1em; }
+</style>
+</head>
+<body>
+<h1>Drawing removed</h1>
+<p>{{.Tombstone.Message}} It was removed on <time datetime="{{.Tombstone.Removed.Format "2006-01-02T15:04:05Z07:00"}}">{{.Tombstone.Removed.Format "January 2, 2006"}}</time>.</p>
+<p><a href="{{.Base}}/">Draw your own</a></p>
+</body>
+</html>
+`))
+
+// tombstonePageData is rendered by tombstoneTemplate.
+type tombstonePageData struct {
+	Base      string
+	Tombstone *tombstone
+}
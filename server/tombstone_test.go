@@ -0,0 +1,102 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTombstones(t *testing.T) {
+	cfg, cleanup := newTestConfig(t)
+	defer cleanup()
+	cfg.MaxCount = 1
+	cfg.ColdGrace = "1h"
+	cfg.TombstoneAge = "24h"
+	cfg.AdminToken = "admin"
+	h, err := NewHandler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	save := func() *saveResponse {
+		t.Helper()
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/drawings",
+			bytes.NewReader(encodeTestImage(t, 10, 10))))
+		saved := &saveResponse{}
+		err := json.Unmarshal(w.Body.Bytes(), saved)
+		if err != nil || w.Code != 200 {
+			t.Fatalf("could not save drawing: %d, %v", w.Code, err)
+		}
+		return saved
+	}
+	remove := func(path, token string) {
+		t.Helper()
+		req := httptest.NewRequest("DELETE", path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("could not delete drawing: %d", w.Code)
+		}
+	}
+	checkGone := func(saved *saveResponse, message string) {
+		t.Helper()
+		for _, p := range []string{saved.Path, saved.PagePath} {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", p, nil))
+			if w.Code != http.StatusGone || !strings.Contains(w.Body.String(), message) {
+				t.Fatalf("unexpected response for %s: %d\n%s", p, w.Code, w.Body.String())
+			}
+		}
+	}
+	evicted := save()
+	deleted := save()
+	remove(deleted.Path, deleted.DeleteToken)
+	checkGone(deleted, "deleted by its author")
+	moderated := save()
+	remove("/admin/drawings/"+path.Base(moderated.Path), cfg.AdminToken)
+	checkGone(moderated, "removed by a moderator")
+
+	// Cold storage takes precedence until the grace period is over
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", evicted.PagePath, nil))
+	if w.Code != 200 {
+		t.Fatalf("evicted drawing not served from cold storage: %d", w.Code)
+	}
+	cold, err := openColdStore(defaultColdDir(cfg.ImagesDir), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cold.Expire(time.Now().Add(2 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGone(evicted, "make room for newer ones")
+
+	tombstones, err := openTombstoneStore(defaultTombstonesDir(cfg.ImagesDir), 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := path.Base(deleted.Path)
+	if !tombstones.Taken(name) {
+		t.Fatalf("name of removed drawing can be reused")
+	}
+	err = tombstones.Expire(time.Now().Add(48 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tombstones.Taken(name) {
+		t.Fatalf("tombstone was not expired")
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", deleted.PagePath, nil))
+	if w.Code != 404 {
+		t.Fatalf("expired tombstone is still served: %d", w.Code)
+	}
+}
@@ -0,0 +1,271 @@
+//go:build !windows
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// upgradeEnv is set in the environment of a process started by upgrade(). It
+// inherits the listening socket as file descriptor 3, reports its progress
+// by writing on file descriptor 4 and waits for the parent process to
+// release its state until file descriptor 5 is closed.
+const upgradeEnv = "GRIBOUILLIS_UPGRADE"
+
+const (
+	// upgradeAccepting is written by an upgraded process once it accepts
+	// connections on the inherited socket.
+	upgradeAccepting = 1
+	// upgradeServing is written by an upgraded process once it loaded its
+	// state and serves the accepted connections.
+	upgradeServing = 2
+)
+
+// Listen returns a listener on addr, or the one inherited from the parent
+// process during an upgrade.
+func Listen(addr string) (net.Listener, error) {
+	if os.Getenv(upgradeEnv) == "" {
+		return net.Listen("tcp", addr)
+	}
+	f := os.NewFile(3, "listener")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// handoffGate holds requests until the handler of an upgraded process is
+// opened.
+type handoffGate struct {
+	opened  chan struct{}
+	handler http.Handler
+}
+
+func (g *handoffGate) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-g.opened:
+		g.handler.ServeHTTP(w, r)
+	case <-r.Context().Done():
+	}
+}
+
+// Serve runs server on l with the handler returned by open, until it fails,
+// SIGINT or SIGTERM are received. The server then stops accepting
+// connections, waits at most timeout for active ones to complete and
+// releases the handler state.
+//
+// On SIGHUP, a new instance of the executable is started with the same
+// arguments and inherits l. Once it accepts connections, this server is
+// drained and its state released, then the new instance opens its handler,
+// so the instances never share state files, and Serve returns. If the new
+// instance fails, this one keeps serving.
+func Serve(server *http.Server, l net.Listener, timeout time.Duration,
+	open Opener) error {
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	// Serving sets up HTTP/2 in server TLS configuration, even without TLS
+	tlsConfig := server.TLSConfig
+	done := make(chan error, 1)
+	serve := func() {
+		go func(server *http.Server) {
+			done <- runServer(server, l)
+		}(server)
+	}
+	var release func()
+	if os.Getenv(upgradeEnv) != "" {
+		os.Unsetenv(upgradeEnv)
+		gate := &handoffGate{opened: make(chan struct{})}
+		server.Handler = gate
+		serve()
+		h, r, err := handoff(open)
+		if err != nil {
+			server.Close()
+			return err
+		}
+		gate.handler, release = h, r
+		close(gate.opened)
+	} else {
+		h, r, err := open()
+		if err != nil {
+			return err
+		}
+		server.Handler, release = h, r
+		serve()
+	}
+	for {
+		select {
+		case err := <-done:
+			release()
+			return err
+		case sig := <-stop:
+			slog.Info("shutting down", "signal", sig.String())
+			err := shutdownServer(server, timeout)
+			release()
+			return err
+		case <-hup:
+			slog.Info("upgrading server")
+			f, err := listenerFile(l)
+			if err != nil {
+				slog.Error("upgrade failed", "err", err)
+				continue
+			}
+			child, err := startUpgrade(f)
+			if err != nil {
+				f.Close()
+				slog.Error("upgrade failed", "err", err)
+				continue
+			}
+			// The new instance accepts connections meanwhile
+			err = shutdownServer(server, timeout)
+			<-done
+			release()
+			uerr := child.Handoff()
+			if uerr == nil {
+				f.Close()
+				return err
+			}
+			slog.Error("upgrade failed, serving again", "err", uerr)
+			// The duplicated descriptor kept the socket listening
+			l, err = net.FileListener(f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+			h, r, err := open()
+			if err != nil {
+				l.Close()
+				return err
+			}
+			server = &http.Server{
+				Addr:      server.Addr,
+				Handler:   h,
+				TLSConfig: tlsConfig,
+			}
+			release = r
+			serve()
+		}
+	}
+}
+
+// handoff reports an upgraded process accepts connections, waits for the
+// parent process to release its state, then opens the handler and reports it
+// is serving.
+func handoff(open Opener) (http.Handler, func(), error) {
+	progress := os.NewFile(4, "progress")
+	defer progress.Close()
+	_, err := progress.Write([]byte{upgradeAccepting})
+	if err != nil {
+		return nil, nil, err
+	}
+	released := os.NewFile(5, "released")
+	_, err = io.Copy(io.Discard, released)
+	released.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	h, release, err := open()
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = progress.Write([]byte{upgradeServing})
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	return h, release, nil
+}
+
+// listenerFile returns a duplicate of the descriptor of l, to be passed to a
+// child process.
+func listenerFile(l net.Listener) (*os.File, error) {
+	tl, ok := l.(*net.TCPListener)
+	if !ok {
+		return nil, fmt.Errorf("cannot pass %T listener to a child process", l)
+	}
+	return tl.File()
+}
+
+// upgradeProcess is a new instance of the executable started by
+// startUpgrade.
+type upgradeProcess struct {
+	cmd      *exec.Cmd
+	progress *os.File
+	released *os.File
+}
+
+// startUpgrade starts a new instance of the executable, passing it the
+// listening socket f, and waits for it to accept connections.
+func startUpgrade(f *os.File) (*upgradeProcess, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	rr, rw, err := os.Pipe()
+	if err != nil {
+		pr.Close()
+		pw.Close()
+		return nil, err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), upgradeEnv+"=1")
+	cmd.ExtraFiles = []*os.File{f, pw, rr}
+	err = cmd.Start()
+	pw.Close()
+	rr.Close()
+	if err != nil {
+		pr.Close()
+		rw.Close()
+		return nil, err
+	}
+	p := &upgradeProcess{cmd: cmd, progress: pr, released: rw}
+	err = p.wait(upgradeAccepting)
+	if err != nil {
+		p.progress.Close()
+		p.released.Close()
+		cmd.Wait()
+		return nil, err
+	}
+	return p, nil
+}
+
+// wait reads the next progress report of p and checks it is step. The pipe
+// is closed without data if the process fails before.
+func (p *upgradeProcess) wait(step byte) error {
+	buf := make([]byte, 1)
+	_, err := io.ReadFull(p.progress, buf)
+	if err != nil || buf[0] != step {
+		return fmt.Errorf("child process exited before being ready")
+	}
+	return nil
+}
+
+// Handoff tells p the state was released and waits for it to serve.
+func (p *upgradeProcess) Handoff() error {
+	defer p.progress.Close()
+	p.released.Close()
+	err := p.wait(upgradeServing)
+	if err != nil {
+		p.cmd.Wait()
+		return err
+	}
+	return p.cmd.Process.Release()
+}
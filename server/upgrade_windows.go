@@ -0,0 +1,51 @@
+//go:build windows
+
+package server
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+)
+
+// serviceStop is closed when the Windows service is asked to stop.
+var serviceStop = make(chan struct{})
+
+func Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+// Serve runs server on l with the handler returned by open, until it fails,
+// an interrupt is received or the service is stopped. In the latter cases,
+// the server stops accepting connections, waits at most timeout for active
+// ones to complete, the handler state is released and Serve returns.
+func Serve(server *http.Server, l net.Listener, timeout time.Duration,
+	open Opener) error {
+
+	h, release, err := open()
+	if err != nil {
+		return err
+	}
+	defer release()
+	server.Handler = h
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt)
+	defer signal.Stop(stop)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- runServer(server, l)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case sig := <-stop:
+		slog.Info("shutting down", "signal", sig.String())
+	case <-serviceStop:
+		slog.Info("shutting down")
+	}
+	return shutdownServer(server, timeout)
+}
@@ -0,0 +1,251 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const dayFormat = "2006-01-02"
+
+// dayUsage holds the usage counters of one day.
+type dayUsage struct {
+	Day        string `json:"day"`
+	Saves      int64  `json:"saves"`
+	SavedBytes int64  `json:"saved_bytes"`
+	// StoredBytes is the images directory size after the last change of the
+	// day.
+	StoredBytes int64 `json:"stored_bytes"`
+	Evictions   int64 `json:"evictions"`
+	Uploaders   int   `json:"uploaders"`
+}
+
+// usageStats records daily usage counters in a JSON file. Uploaders are
+// counted with salted hashes of their address. Hashes and salt are only kept
+// for the current day.
+type usageStats struct {
+	path string
+
+	lock sync.Mutex
+	Days []*dayUsage `json:"days"`
+	// Salt and Hashes identify the current day uploaders.
+	Salt   string          `json:"salt"`
+	Hashes map[string]bool `json:"hashes"`
+	dirty  bool
+}
+
+// defaultUsagePath returns the usage statistics file used with imagesDir.
+func defaultUsagePath(imagesDir string) string {
+	return filepath.Clean(imagesDir) + "-usage.json"
+}
+
+// openUsageStats loads the statistics persisted in path, if any.
+func openUsageStats(path string) (*usageStats, error) {
+	s := &usageStats{
+		path: path,
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		err = json.Unmarshal(data, s)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse %s: %s", path, err)
+		}
+	}
+	return s, nil
+}
+
+// today returns the counters of the current day, starting a new one if
+// necessary.
+func (s *usageStats) today() *dayUsage {
+	day := time.Now().Format(dayFormat)
+	if n := len(s.Days); n > 0 && s.Days[n-1].Day == day {
+		return s.Days[n-1]
+	}
+	stored := int64(0)
+	if n := len(s.Days); n > 0 {
+		stored = s.Days[n-1].StoredBytes
+	}
+	d := &dayUsage{
+		Day:         day,
+		StoredBytes: stored,
+	}
+	s.Days = append(s.Days, d)
+	s.Salt = ""
+	s.Hashes = nil
+	return d
+}
+
+// RecordSave counts a drawing of size bytes saved by client ip, the images
+// directory size becoming stored bytes.
+func (s *usageStats) RecordSave(ip string, size, stored int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	d := s.today()
+	d.Saves++
+	d.SavedBytes += size
+	d.StoredBytes = stored
+	if s.Salt == "" {
+		salt := make([]byte, 16)
+		_, err := rand.Read(salt)
+		if err != nil {
+			slog.Error("could not generate usage salt", "err", err)
+		}
+		s.Salt = hex.EncodeToString(salt)
+	}
+	h := sha256.Sum256([]byte(s.Salt + ip))
+	if s.Hashes == nil {
+		s.Hashes = map[string]bool{}
+	}
+	s.Hashes[hex.EncodeToString(h[:])] = true
+	d.Uploaders = len(s.Hashes)
+	s.dirty = true
+}
+
+// RecordEviction counts a drawing removed by the images directory limits.
+func (s *usageStats) RecordEviction(name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.today().Evictions++
+	s.dirty = true
+}
+
+// save writes the statistics if they changed since last call.
+func (s *usageStats) save() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, s.path)
+	if err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// Run saves the statistics every interval, and a last time once ctx is
+// done.
+func (s *usageStats) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+		case <-ticker.C:
+		}
+		err := s.save()
+		if err != nil {
+			slog.Error("could not save usage statistics", "err", err)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// Between returns the counters of days between from and to included, both
+// formatted like dayFormat, empty meaning unbounded.
+func (s *usageStats) Between(from, to string) []dayUsage {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	days := []dayUsage{}
+	for _, d := range s.Days {
+		if (from == "" || d.Day >= from) && (to == "" || d.Day <= to) {
+			days = append(days, *d)
+		}
+	}
+	return days
+}
+
+// StatsCommand exports the daily usage statistics of an instance.
+func StatsCommand(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Print(`Usage: gribouillis stats [OPTIONS]
+
+Export per-day usage statistics of a gribouillis instance: number of saved
+drawings and their size, images directory size at the end of the day, number
+of evicted drawings and of unique uploaders. Statistics are saved every
+minute by the server.
+
+`)
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	imagesDir := fs.String("images-dir", "images",
+		"directory where drawings are saved")
+	path := fs.String("usage", "",
+		"file persisting usage statistics, defaults to images directory with a -usage.json suffix")
+	from := fs.String("from", "", "first exported day, as YYYY-MM-DD")
+	to := fs.String("to", "", "last exported day, as YYYY-MM-DD")
+	format := fs.String("format", "csv", "output format: csv or json")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return fmt.Errorf("no argument expected")
+	}
+	for _, day := range []string{*from, *to} {
+		if day == "" {
+			continue
+		}
+		_, err := time.Parse(dayFormat, day)
+		if err != nil {
+			return fmt.Errorf("invalid day %q, expected YYYY-MM-DD", day)
+		}
+	}
+	if *path == "" {
+		*path = defaultUsagePath(*imagesDir)
+	}
+	s, err := openUsageStats(*path)
+	if err != nil {
+		return err
+	}
+	days := s.Between(*from, *to)
+	switch *format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(days)
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		w.Write([]string{"day", "saves", "saved_bytes", "stored_bytes",
+			"evictions", "uploaders"})
+		for _, d := range days {
+			w.Write([]string{
+				d.Day,
+				strconv.FormatInt(d.Saves, 10),
+				strconv.FormatInt(d.SavedBytes, 10),
+				strconv.FormatInt(d.StoredBytes, 10),
+				strconv.FormatInt(d.Evictions, 10),
+				strconv.Itoa(d.Uploaders),
+			})
+		}
+		w.Flush()
+		return w.Error()
+	}
+	return fmt.Errorf("unknown format: %s", *format)
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUsageStats(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "gribouillis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "usage.json")
+	s, err := openUsageStats(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Days = []*dayUsage{{Day: "2020-01-01", Saves: 3, StoredBytes: 100}}
+	s.RecordSave("1.2.3.4", 10, 110)
+	s.RecordSave("1.2.3.4", 20, 130)
+	s.RecordEviction("a.png")
+	err = s.save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reload and count another uploader the same day
+	s, err = openUsageStats(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.RecordSave("5.6.7.8", 5, 120)
+	today := time.Now().Format(dayFormat)
+	days := s.Between("2020-01-02", "")
+	if len(days) != 1 {
+		t.Fatalf("expected a single day, got %+v", days)
+	}
+	expected := dayUsage{
+		Day:         today,
+		Saves:       3,
+		SavedBytes:  35,
+		StoredBytes: 120,
+		Evictions:   1,
+		Uploaders:   2,
+	}
+	if days[0] != expected {
+		t.Fatalf("expected %+v, got %+v", expected, days[0])
+	}
+	if days := s.Between("", "2020-01-01"); len(days) != 1 || days[0].Saves != 3 {
+		t.Fatalf("unexpected past days: %+v", days)
+	}
+}
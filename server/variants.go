@@ -0,0 +1,317 @@
+package server
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// variantTimeout bounds the encoding of an image variant.
+const variantTimeout = time.Minute
+
+// variantType is an alternate media type of saved images.
+type variantType struct {
+	mediaType string
+	ext       string
+}
+
+// variantTypes are the alternate media types of saved images, by decreasing
+// preference when clients accept several of them equally.
+var variantTypes = []variantType{
+	{"image/avif", ".avif"},
+	{"image/webp", ".webp"},
+}
+
+// svgGzipExt is the extension of gzip compressed SVG renderings.
+const svgGzipExt = ".svg.gz"
+
+// variantCache stores alternate renditions of saved images, negotiated with
+// clients Accept and Accept-Encoding headers, in a directory of their own.
+// They are generated the first time a client asks for them, by external
+// encoders for images and gzip for SVG renderings, and regenerated when
+// their source changes. Like previews, they are not accounted in the images
+// directory limits but are removed with their original.
+type variantCache struct {
+	dir    string
+	images string
+	// commands are the encoder command lines by media type, with {in} and
+	// {out} arguments replaced by the PNG and variant paths.
+	commands map[string][]string
+	// lock serializes encodings, bounding the resources they use.
+	lock sync.Mutex
+}
+
+// defaultVariantsDir returns the variants directory used with imagesDir.
+func defaultVariantsDir(imagesDir string) string {
+	return filepath.Clean(imagesDir) + "-variants"
+}
+
+// newVariantCache returns a cache of variants of images stored in images
+// directory, writing them in dir, and encoded with commands by media type.
+// Encoders which cannot be found are skipped. Variants of missing images,
+// and temporary files, are removed.
+func newVariantCache(dir, images string, commands map[string]string) (*variantCache, error) {
+	c := &variantCache{
+		dir:      dir,
+		images:   images,
+		commands: map[string][]string{},
+	}
+	for _, t := range variantTypes {
+		args := strings.Fields(commands[t.mediaType])
+		if len(args) == 0 {
+			continue
+		}
+		if !containsString(args, "{in}") || !containsString(args, "{out}") {
+			return nil, fmt.Errorf("%s encoder command must have {in} and {out} arguments",
+				t.mediaType)
+		}
+		_, err := exec.LookPath(args[0])
+		if err != nil {
+			slog.Warn("image variant encoder not available", "type", t.mediaType,
+				"err", err)
+			continue
+		}
+		c.commands[t.mediaType] = args
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		i := strings.Index(e.Name(), ".png")
+		if strings.HasPrefix(e.Name(), ".") || i < 0 {
+			os.Remove(filepath.Join(dir, e.Name()))
+			continue
+		}
+		_, err := os.Stat(filepath.Join(images, e.Name()[:i+4]))
+		if os.IsNotExist(err) {
+			os.Remove(filepath.Join(dir, e.Name()))
+		}
+	}
+	return c, nil
+}
+
+// Remove deletes the variants of image name, if any.
+func (c *variantCache) Remove(name string) {
+	for _, t := range variantTypes {
+		os.Remove(filepath.Join(c.dir, name+t.ext))
+	}
+	os.Remove(filepath.Join(c.dir, name+svgGzipExt))
+}
+
+// parseAccept returns the quality of the values listed in an Accept or
+// Accept-Encoding header, by lowercase value.
+func parseAccept(header string) map[string]float64 {
+	values := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		value := strings.ToLower(strings.TrimSpace(params[0]))
+		if value == "" {
+			continue
+		}
+		q := 1.0
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				v, err := strconv.ParseFloat(p[2:], 64)
+				if err == nil {
+					q = v
+				}
+			}
+		}
+		values[value] = q
+	}
+	return values
+}
+
+// negotiate returns the variant type preferred by a client sending accept,
+// or nil if it should get the PNG image. Variants must be listed explicitly:
+// wildcards only match PNG, which every client supports.
+func (c *variantCache) negotiate(accept string) *variantType {
+	values := parseAccept(accept)
+	var best *variantType
+	bestQ := 0.0
+	for i, t := range variantTypes {
+		q := values[t.mediaType]
+		if c.commands[t.mediaType] != nil && q > bestQ {
+			best, bestQ = &variantTypes[i], q
+		}
+	}
+	return best
+}
+
+// acceptsGzip returns true if a client sending the Accept-Encoding header
+// accepts gzip compressed responses.
+func acceptsGzip(header string) bool {
+	return parseAccept(header)["gzip"] > 0
+}
+
+// fresh returns true if the variant at path exists and is not older than its
+// source.
+func fresh(path string, src os.FileInfo) bool {
+	st, err := os.Stat(path)
+	return err == nil && !st.ModTime().Before(src.ModTime())
+}
+
+// generate returns the path of the variant of src in the cache, named name,
+// writing it with write first if it is missing or older than src.
+func (c *variantCache) generate(src, name string, write func(src, dst string) error) (string, error) {
+	st, err := os.Stat(src)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(c.dir, name)
+	if fresh(path, st) {
+		return path, nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if fresh(path, st) {
+		return path, nil
+	}
+	tmp, err := ioutil.TempFile(c.dir, ".variant-*"+filepath.Ext(name))
+	if err != nil {
+		return "", err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	err = write(src, tmp.Name())
+	if err != nil {
+		return "", err
+	}
+	return path, os.Rename(tmp.Name(), path)
+}
+
+// encode runs the encoder args of a variant on the PNG image at src, writing
+// the variant at dst.
+func encode(args []string, src, dst string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), variantTimeout)
+	defer cancel()
+	argv := []string{}
+	for _, a := range args[1:] {
+		switch a {
+		case "{in}":
+			a = src
+		case "{out}":
+			a = dst
+		}
+		argv = append(argv, a)
+	}
+	out, err := exec.CommandContext(ctx, args[0], argv...).CombinedOutput()
+	if err != nil {
+		msg := strings.TrimSpace(string(out))
+		if msg == "" {
+			msg = err.Error()
+		}
+		return fmt.Errorf("%s failed: %s", args[0], msg)
+	}
+	return nil
+}
+
+// Image returns the path of the t variant of image name, encoding it if
+// necessary.
+func (c *variantCache) Image(name string, t *variantType) (string, error) {
+	args := c.commands[t.mediaType]
+	return c.generate(filepath.Join(c.images, name), name+t.ext,
+		func(src, dst string) error {
+			return encode(args, src, dst)
+		})
+}
+
+// GzipSVG returns the path of the gzip compressed SVG rendering of image
+// name, stored at svgPath, compressing it if necessary.
+func (c *variantCache) GzipSVG(name, svgPath string) (string, error) {
+	return c.generate(svgPath, name+svgGzipExt, func(src, dst string) error {
+		in, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.Create(dst)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+		w, err := gzip.NewWriterLevel(out, gzip.BestCompression)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, in)
+		if err == nil {
+			err = w.Close()
+		}
+		if err == nil {
+			err = out.Close()
+		}
+		return err
+	})
+}
+
+// serveVariant serves the file at path as the content of name, with
+// mediaType, and the ETag already set in w, if any, suffixed by tag.
+func serveVariant(w http.ResponseWriter, r *http.Request, name, path,
+	mediaType, tag string) error {
+	fp, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	st, err := fp.Stat()
+	if err != nil {
+		return err
+	}
+	if etag := w.Header().Get("ETag"); strings.HasSuffix(etag, `"`) {
+		w.Header().Set("ETag", strings.TrimSuffix(etag, `"`)+"-"+tag+`"`)
+	}
+	w.Header().Set("Content-Type", mediaType)
+	http.ServeContent(w, r, name, st.ModTime(), fp)
+	return nil
+}
+
+// Handler returns a handler serving the saved images named by GET and HEAD
+// request paths in the variant preferred by clients, or with h otherwise,
+// like when encoding fails or the image is missing. It must be wrapped by
+// the ETag handler so variants get their own ETags.
+func (c *variantCache) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		if len(c.commands) == 0 || r.Method != "GET" && r.Method != "HEAD" ||
+			!strings.HasSuffix(name, ".png") || strings.ContainsAny(name, "/\\") ||
+			strings.HasPrefix(name, ".") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept")
+		t := c.negotiate(r.Header.Get("Accept"))
+		if t == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		path, err := c.Image(name, t)
+		if err == nil {
+			err = serveVariant(w, r, name, path, t.mediaType, t.ext[1:])
+		}
+		if err != nil {
+			if !os.IsNotExist(err) {
+				slog.Warn("could not serve image variant", "name", name,
+					"type", t.mediaType, "err", err)
+			}
+			h.ServeHTTP(w, r)
+		}
+	})
+}
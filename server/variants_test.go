@@ -0,0 +1,170 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestVariants(t *testing.T) {
+	if _, err := exec.LookPath("cp"); err != nil {
+		t.Skip("cp is not available")
+	}
+	tmpDir, err := ioutil.TempDir("", "gribouillis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	images := filepath.Join(tmpDir, "images")
+	err = os.Mkdir(images, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	png := encodeTestImage(t, 10, 10)
+	err = ioutil.WriteFile(filepath.Join(images, "a.png"), png, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := defaultVariantsDir(images)
+	// Stale variants are removed when opening the cache
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "gone.png.webp"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := newVariantCache(dir, images, map[string]string{
+		"image/webp": "cp {in} {out}",
+		"image/avif": "missing-avif-encoder {in} {out}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "gone.png.webp")); !os.IsNotExist(err) {
+		t.Fatalf("stale variant was not removed: %v", err)
+	}
+
+	for accept, expected := range map[string]string{
+		"":                                 "",
+		"*/*":                              "",
+		"image/*":                          "",
+		"image/png":                        "",
+		"image/avif,image/webp,*/*;q=0.8":  "image/webp",
+		"image/webp;q=0":                   "",
+		"image/avif;q=0.9,IMAGE/WEBP;q=.5": "image/webp",
+	} {
+		mediaType := ""
+		if v := c.negotiate(accept); v != nil {
+			mediaType = v.mediaType
+		}
+		if mediaType != expected {
+			t.Errorf("%q: expected %q, got %q", accept, expected, mediaType)
+		}
+	}
+
+	etags := newETagCache(images)
+	srv := httptest.NewServer(etags.Handler(c.Handler(
+		http.FileServer(http.Dir(images)))))
+	defer srv.Close()
+	get := func(name, accept, etag string) (*http.Response, []byte) {
+		req, err := http.NewRequest("GET", srv.URL+"/"+name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", accept)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rsp.Body.Close()
+		data, err := ioutil.ReadAll(rsp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rsp, data
+	}
+	rsp, data := get("a.png", "image/png", "")
+	if ct := rsp.Header.Get("Content-Type"); ct != "image/png" || !bytes.Equal(data, png) {
+		t.Fatalf("unexpected PNG response: %s", ct)
+	}
+	if rsp.Header.Get("Vary") != "Accept" {
+		t.Fatalf("unexpected Vary: %q", rsp.Header.Get("Vary"))
+	}
+	pngETag := rsp.Header.Get("ETag")
+	rsp, data = get("a.png", "image/webp", "")
+	if ct := rsp.Header.Get("Content-Type"); ct != "image/webp" || !bytes.Equal(data, png) {
+		t.Fatalf("unexpected WebP response: %s", ct)
+	}
+	webpETag := rsp.Header.Get("ETag")
+	if webpETag == "" || webpETag == pngETag {
+		t.Fatalf("unexpected WebP ETag: %q", webpETag)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.png.webp")); err != nil {
+		t.Fatalf("variant was not cached: %s", err)
+	}
+	if rsp, _ := get("a.png", "image/webp", webpETag); rsp.StatusCode != 304 {
+		t.Fatalf("expected 304, got %d", rsp.StatusCode)
+	}
+	if rsp, _ := get("a.png", "image/png", webpETag); rsp.StatusCode != 200 {
+		t.Fatalf("expected 200 for PNG with WebP ETag, got %d", rsp.StatusCode)
+	}
+	if rsp, _ := get("missing.png", "image/webp", ""); rsp.StatusCode != 404 {
+		t.Fatalf("expected 404, got %d", rsp.StatusCode)
+	}
+
+	// Variants are regenerated when their source changes
+	err = os.Chtimes(filepath.Join(dir, "a.png.webp"), time.Unix(0, 0), time.Unix(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	get("a.png", "image/webp", "")
+	st, err := os.Stat(filepath.Join(dir, "a.png.webp"))
+	if err != nil || st.ModTime().Equal(time.Unix(0, 0)) {
+		t.Fatalf("variant was not regenerated: %v", err)
+	}
+
+	svg := []byte(`<svg xmlns="http://www.w3.org/2000/svg"></svg>`)
+	svgPath := filepath.Join(tmpDir, "a.png.svg")
+	err = ioutil.WriteFile(svgPath, svg, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz, err := c.GzipSVG("a.png", svgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp, err := os.Open(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	r, err := gzip.NewReader(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(data, svg) {
+		t.Fatalf("unexpected decompressed SVG: %v %q", err, data)
+	}
+	if !acceptsGzip("deflate, GZIP;q=0.5") || acceptsGzip("gzip;q=0, br") {
+		t.Fatal("unexpected gzip negotiation")
+	}
+
+	c.Remove("a.png")
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("variants were not removed: %v %d", err, len(entries))
+	}
+}
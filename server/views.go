@@ -0,0 +1,301 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// maxShares is the number of share tokens of a drawing.
+const maxShares = 20
+
+var errTooManyShares = errors.New("too many shares")
+
+// shareViews aggregates the views of a drawing through one of its share
+// links.
+type shareViews struct {
+	Label      string    `json:"label,omitempty"`
+	Created    time.Time `json:"created"`
+	Views      int64     `json:"views"`
+	LastViewed time.Time `json:"last_viewed"`
+}
+
+// drawingViews aggregates the views of a drawing. Shares holds the views
+// through share links, by share token.
+type drawingViews struct {
+	Views      int64                  `json:"views"`
+	LastViewed time.Time              `json:"last_viewed"`
+	Shares     map[string]*shareViews `json:"shares,omitempty"`
+}
+
+// viewStats counts the views of saved drawings, pages and images alike, and
+// remembers when they were last viewed. Nothing is kept about viewers.
+// Counts are persisted in a JSON file.
+type viewStats struct {
+	path string
+
+	lock     sync.Mutex
+	Drawings map[string]*drawingViews `json:"drawings"`
+	dirty    bool
+}
+
+// defaultViewsPath returns the view statistics file used with imagesDir.
+func defaultViewsPath(imagesDir string) string {
+	return filepath.Clean(imagesDir) + "-views.json"
+}
+
+// openViewStats loads the statistics persisted in path, if any.
+func openViewStats(path string) (*viewStats, error) {
+	s := &viewStats{
+		path:     path,
+		Drawings: map[string]*drawingViews{},
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, s)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %s", path, err)
+	}
+	return s, nil
+}
+
+// get returns the views of drawing name, creating them if necessary. It
+// must be called with the lock held.
+func (s *viewStats) get(name string) *drawingViews {
+	v := s.Drawings[name]
+	if v == nil {
+		v = &drawingViews{}
+		s.Drawings[name] = v
+	}
+	return v
+}
+
+// Record counts a view of drawing name at now, through share link share
+// if it is one of its share tokens.
+func (s *viewStats) Record(name, share string, now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	v := s.get(name)
+	v.Views++
+	v.LastViewed = now.UTC()
+	if sv := v.Shares[share]; sv != nil {
+		sv.Views++
+		sv.LastViewed = now.UTC()
+	}
+	s.dirty = true
+}
+
+// Share returns a new share token of drawing name, labelled with label.
+func (s *viewStats) Share(name, label string, now time.Time) (string, error) {
+	buf := make([]byte, 8)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	v := s.get(name)
+	if len(v.Shares) >= maxShares {
+		return "", errTooManyShares
+	}
+	if v.Shares == nil {
+		v.Shares = map[string]*shareViews{}
+	}
+	v.Shares[token] = &shareViews{Label: label, Created: now.UTC()}
+	s.dirty = true
+	return token, nil
+}
+
+// Get returns the views of drawing name, zero if it was never viewed.
+func (s *viewStats) Get(name string) drawingViews {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	v := s.Drawings[name]
+	if v == nil {
+		return drawingViews{}
+	}
+	views := *v
+	views.Shares = map[string]*shareViews{}
+	for token, sv := range v.Shares {
+		c := *sv
+		views.Shares[token] = &c
+	}
+	return views
+}
+
+// Remove forgets the views of drawing name.
+func (s *viewStats) Remove(name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.Drawings[name]; ok {
+		delete(s.Drawings, name)
+		s.dirty = true
+	}
+}
+
+// save writes the statistics if they changed since last call.
+func (s *viewStats) save() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, s.path)
+	if err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// Run saves the statistics every interval, and a last time once ctx is
+// done.
+func (s *viewStats) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+		case <-ticker.C:
+		}
+		err := s.save()
+		if err != nil {
+			slog.Error("could not save view statistics", "err", err)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// maxShareLabel is the length of share labels, in bytes.
+const maxShareLabel = 64
+
+// setupViews serves views statistics, if enabled.
+func (h *Handler) setupViews() error {
+	if h.views == nil {
+		return nil
+	}
+	// authorized returns the name of the requested drawing, if the request
+	// carries its delete token.
+	authorized := func(w http.ResponseWriter, r *http.Request) (string, bool) {
+		name, ok := h.trackedDrawing(r)
+		if !ok {
+			writeAPIError(w, http.StatusNotFound, "unknown drawing")
+			return "", false
+		}
+		m, err := h.meta.Get(name)
+		if err != nil {
+			slog.Error("could not read metadata", "name", name, "err", err)
+			writeAPIError(w, 500, "could not read views")
+			return "", false
+		}
+		if !checkDeleteToken(m, deleteToken(r)) {
+			writeAPIError(w, http.StatusForbidden, "invalid delete token")
+			return "", false
+		}
+		return name, true
+	}
+	h.optional = append(h.optional, &apiRoute{
+		Method:   "GET",
+		Path:     "/drawings/{name}/views",
+		Summary:  "Return the views of the drawing, given its delete token",
+		Feature:  "views",
+		Response: &viewsResponse{},
+		Handler: func(w http.ResponseWriter, r *http.Request) {
+			name, ok := authorized(w, r)
+			if !ok {
+				return
+			}
+			v := h.views.Get(name)
+			rsp := &viewsResponse{Views: v.Views}
+			if !v.LastViewed.IsZero() {
+				rsp.LastViewed = &v.LastViewed
+			}
+			for token, sv := range v.Shares {
+				info := shareInfo{
+					Token:   token,
+					Label:   sv.Label,
+					Created: sv.Created,
+					Views:   sv.Views,
+				}
+				if !sv.LastViewed.IsZero() {
+					info.LastViewed = &sv.LastViewed
+				}
+				rsp.Shares = append(rsp.Shares, info)
+			}
+			sort.Slice(rsp.Shares, func(i, j int) bool {
+				a, b := rsp.Shares[i], rsp.Shares[j]
+				if !a.Created.Equal(b.Created) {
+					return a.Created.Before(b.Created)
+				}
+				return a.Token < b.Token
+			})
+			writeJSON(w, 200, rsp)
+		},
+	}, &apiRoute{
+		Method:   "POST",
+		Path:     "/drawings/{name}/shares",
+		Summary:  "Create a share link counting its views, given the delete token",
+		Feature:  "views",
+		Response: &shareResponse{},
+		Handler: func(w http.ResponseWriter, r *http.Request) {
+			name, ok := authorized(w, r)
+			if !ok {
+				return
+			}
+			label := strings.TrimSpace(r.URL.Query().Get("label"))
+			if len(label) > maxShareLabel || !utf8.ValidString(label) {
+				writeAPIError(w, http.StatusBadRequest, "invalid label")
+				return
+			}
+			token, err := h.views.Share(name, label, time.Now())
+			if err == errTooManyShares {
+				writeAPIError(w, http.StatusConflict, err.Error())
+				return
+			} else if err != nil {
+				h.requestLogger(r).Error("could not create share", "name", name, "err", err)
+				writeAPIError(w, 500, "could not create share")
+				return
+			}
+			d := h.locateDrawing(r, name)
+			query := "?" + url.Values{"share": {token}}.Encode()
+			writeJSON(w, 200, &shareResponse{
+				Token:    token,
+				Label:    label,
+				URL:      d.PageURL + query,
+				ImageURL: d.ImageURL + query,
+			})
+		},
+	})
+	return nil
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestViewStats(t *testing.T) {
+	cfg, cleanup := newTestConfig(t)
+	defer cleanup()
+	cfg.ViewStats = true
+	h, err := NewHandler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	rsp, err := http.Post(srv.URL+"/api/v1/drawings", "image/png",
+		bytes.NewReader(encodeTestImage(t, 10, 10)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := saveResponse{}
+	err = json.NewDecoder(rsp.Body).Decode(&saved)
+	rsp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(u, token string) *http.Response {
+		req, err := http.NewRequest("GET", u, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rsp
+	}
+	viewsURL := srv.URL + "/api/v1/drawings/" + path.Base(saved.Path) + "/views"
+	getViews := func() *viewsResponse {
+		rsp := get(viewsURL, saved.DeleteToken)
+		defer rsp.Body.Close()
+		if rsp.StatusCode != 200 {
+			t.Fatalf("could not get views: %s", rsp.Status)
+		}
+		views := &viewsResponse{}
+		err := json.NewDecoder(rsp.Body).Decode(views)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return views
+	}
+	if v := getViews(); v.Views != 0 || v.LastViewed != nil {
+		t.Fatalf("unexpected views before viewing: %+v", v)
+	}
+	for _, u := range []string{saved.URL, saved.URL, srv.URL + saved.PagePath,
+		srv.URL + "/saved/missing.png"} {
+		get(u, "").Body.Close()
+	}
+	v := getViews()
+	if v.Views != 3 || v.LastViewed == nil || time.Since(*v.LastViewed) > time.Minute {
+		t.Fatalf("unexpected views: %+v", v)
+	}
+	for _, token := range []string{"", "wrong"} {
+		rsp := get(viewsURL, token)
+		rsp.Body.Close()
+		if rsp.StatusCode != 403 {
+			t.Fatalf("expected 403 with %q token, got %d", token, rsp.StatusCode)
+		}
+	}
+
+	// Share links count their views separately
+	share := func(label, token string) (int, *shareResponse) {
+		req, err := http.NewRequest("POST", srv.URL+"/api/v1/drawings/"+
+			path.Base(saved.Path)+"/shares?label="+url.QueryEscape(label), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rsp.Body.Close()
+		s := &shareResponse{}
+		if rsp.StatusCode == 200 {
+			err = json.NewDecoder(rsp.Body).Decode(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rsp.StatusCode, s
+	}
+	if code, _ := share("mail", "wrong"); code != 403 {
+		t.Fatalf("expected 403 with wrong token, got %d", code)
+	}
+	_, mail := share("mail", saved.DeleteToken)
+	_, chat := share("", saved.DeleteToken)
+	if mail.Token == "" || mail.Token == chat.Token || mail.Label != "mail" ||
+		mail.ImageURL != saved.URL+"?share="+mail.Token ||
+		mail.URL != srv.URL+saved.PagePath+"?share="+mail.Token {
+		t.Fatalf("unexpected shares: %+v, %+v", mail, chat)
+	}
+	for _, u := range []string{mail.ImageURL, mail.URL, chat.URL,
+		saved.URL + "?share=unknown"} {
+		get(u, "").Body.Close()
+	}
+	v = getViews()
+	if v.Views != 7 || len(v.Shares) != 2 ||
+		v.Shares[0].Token != mail.Token || v.Shares[0].Views != 2 ||
+		v.Shares[0].Label != "mail" || v.Shares[0].LastViewed == nil ||
+		v.Shares[1].Token != chat.Token || v.Shares[1].Views != 1 {
+		t.Fatalf("unexpected share views: %+v", v)
+	}
+	for i := len(v.Shares); i < maxShares; i++ {
+		share("", saved.DeleteToken)
+	}
+	if code, _ := share("", saved.DeleteToken); code != 409 {
+		t.Fatalf("expected 409 beyond %d shares, got %d", maxShares, code)
+	}
+}
@@ -0,0 +1,26 @@
+package server
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// embeddedWeb holds the literallycanvas frontend, so the executable can run
+// from any directory.
+//
+//go:embed literallycanvas
+var embeddedWeb embed.FS
+
+// webFiles returns the frontend files, read from dir if set, or the embedded
+// ones otherwise.
+func webFiles(dir string) (http.FileSystem, error) {
+	if dir != "" {
+		return http.Dir(dir), nil
+	}
+	sub, err := fs.Sub(embeddedWeb, "literallycanvas")
+	if err != nil {
+		return nil, err
+	}
+	return http.FS(sub), nil
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWebFiles(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "gribouillis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	err = ioutil.WriteFile(filepath.Join(tmpDir, "index.html"),
+		[]byte("custom"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		dir      string
+		expected string
+	}{
+		{"", "literallycanvas.js"},
+		{tmpDir, "custom"},
+	} {
+		web, err := webFiles(test.dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, u := range []string{"/room/abc", "/room/"} {
+			w := httptest.NewRecorder()
+			h := roomPage(web)
+			r := httptest.NewRequest("GET", strings.TrimPrefix(u, "/room"), nil)
+			h.ServeHTTP(w, r)
+			if w.Code != 200 || !strings.Contains(w.Body.String(), test.expected) {
+				t.Fatalf("%q %s: unexpected response: %d %.100q", test.dir, u,
+					w.Code, w.Body.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,818 @@
+// Package storage implements the stores of saved drawings: local directories
+// bounded in size and count, and S3 compatible buckets.
+package storage
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotTracked is returned when operating on a file the LimitedDir does not
+// track, like an evicted one.
+var ErrNotTracked = errors.New("file is not tracked")
+
+type File struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+	// Views counts the Touch calls since the file was added or the
+	// LimitedDir opened.
+	Views int
+	// Class is the retention class of the file, see SetRetention.
+	Class string
+}
+
+// Retention overrides the policy of the files of a retention class.
+type Retention struct {
+	// MaxAge replaces the directory maximum age, if positive.
+	MaxAge time.Duration
+	// Keep exempts the files from eviction, they are only deleted by
+	// Remove. They still count in the size and count limits.
+	Keep bool
+}
+
+// Scorer returns the eviction scores of files, the file with the highest
+// score being evicted first. Ties are broken in favor of evicting the first
+// files in deletion order.
+type Scorer func(files []File, now time.Time) []float64
+
+// LimitedDir tracks child files of a directory and ensure there are at most
+// maxCount of them or the total size is less than maxSize. Otherwise, oldest
+// one are deleted until the conditions are matched. Files older than maxAge,
+// if set, are deleted too. LimitedDir can be used concurrently.
+//
+// Files whose names start with a given prefix can be further limited with
+// SetQuota, evicting the oldest of them independently of the other files.
+//
+// In LRU mode, files accessed with Touch are evicted after the others, so
+// popular files outlive ignored ones. Accesses are not persisted, the files
+// being evicted in creation order again after a restart.
+//
+// With a Scorer, the size, count and quota limits evict the files with the
+// highest score first instead, the maximum age still applying to all of them.
+//
+// SetRetention overrides the maximum age of some files, or keeps them
+// forever, according to their retention class.
+//
+// Empty files are tolerated, which is not a problem since gribouillis stores
+// valid PNG files.
+type LimitedDir struct {
+	path     string
+	storage  Storage
+	maxSize  int64
+	maxCount int
+	maxAge   time.Duration
+	lru      bool
+	scorer   Scorer
+	// classify returns the retention class of files, whose Retention
+	// overrides are in retention.
+	classify  func(name string) string
+	retention map[string]Retention
+	lock      sync.Mutex
+	files     []File
+	size      int64
+	// quotas are sorted by prefix
+	quotas []PrefixStats
+	// removed functions are called with the names of deleted files, evicted
+	// functions only with those deleted by the size and count policy, and
+	// evicting ones with the latter before deleting them.
+	removed  []func(name string)
+	evicted  []func(name string)
+	evicting []func(name string)
+	// removing holds the untracked files being deleted from storage, which
+	// Reconcile must not adopt again.
+	removing map[string]bool
+	// added holds the files added while Reconcile lists the storage, nil
+	// otherwise, which it must not drop.
+	added map[string]bool
+	// reconciling serializes Reconcile calls.
+	reconciling sync.Mutex
+}
+
+type sortedFiles []os.FileInfo
+
+func (s sortedFiles) Len() int {
+	return len(s)
+}
+
+func (s sortedFiles) Less(i, j int) bool {
+	ti := s[i].ModTime()
+	tj := s[j].ModTime()
+	return ti != tj && tj.After(ti)
+}
+
+func (s sortedFiles) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+// ListFiles returns the regular, non-hidden, files of dir sorted by
+// modification time. Hidden files are temporary files, not drawings.
+func ListFiles(dir string) ([]File, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(sortedFiles(entries))
+	files := []File{}
+	for _, e := range entries {
+		if !e.Mode().IsRegular() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		files = append(files, File{
+			Name:    e.Name(),
+			Size:    e.Size(),
+			ModTime: e.ModTime(),
+		})
+	}
+	return files, nil
+}
+
+const (
+	// SaveTempPrefix starts the names of drawings being saved.
+	SaveTempPrefix = ".save-"
+	// RecompressTempPrefix starts the names of images being recompressed.
+	RecompressTempPrefix = ".recompress-"
+	// StaleTempAge is the age after which temporary files of saves and
+	// recompressions are assumed to have been abandoned by a killed process.
+	// Younger ones may belong to a process being upgraded.
+	StaleTempAge = time.Hour
+)
+
+// removeStaleTempFiles deletes temporary files left in dir by interrupted
+// saves and recompressions.
+func removeStaleTempFiles(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if !e.Mode().IsRegular() || time.Since(e.ModTime()) < StaleTempAge ||
+			!strings.HasPrefix(name, SaveTempPrefix) &&
+				!strings.HasPrefix(name, RecompressTempPrefix) {
+			continue
+		}
+		slog.Info("removing stale temporary file", "name", name)
+		err := os.Remove(filepath.Join(dir, name))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// OpenLimitedDir returns a LimitedDir initialized on supplied directory. Hidden
+// files are ignored.
+func OpenLimitedDir(path string, maxSize int64, maxCount int) (*LimitedDir, error) {
+	return OpenLimitedStorage(DirStorage(path), maxSize, maxCount)
+}
+
+// OpenLimitedStorage returns a LimitedDir tracking the files of storage.
+func OpenLimitedStorage(storage Storage, maxSize int64, maxCount int) (*LimitedDir, error) {
+	path := storage.Path()
+	err := os.MkdirAll(path, 0755)
+	if err != nil {
+		return nil, err
+	}
+	err = removeStaleTempFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	files, err := storage.List()
+	if err != nil {
+		return nil, err
+	}
+	total := int64(0)
+	for _, f := range files {
+		total += f.Size
+	}
+	d := &LimitedDir{
+		path:     path,
+		storage:  storage,
+		maxCount: maxCount,
+		files:    files,
+		size:     total,
+		maxSize:  maxSize,
+		removing: map[string]bool{},
+	}
+	err = d.evict(d.shrink())
+	if err != nil {
+		return nil, err
+	}
+	return d, err
+}
+
+func (d *LimitedDir) Path() string {
+	return d.path
+}
+
+// untrack stops tracking the i-th file and marks it as being removed. The
+// caller deletes it from storage once d.lock is released. d.lock must be held.
+func (d *LimitedDir) untrack(i int) File {
+	f := d.files[i]
+	d.size -= f.Size
+	d.files = append(d.files[:i], d.files[i+1:]...)
+	d.removing[f.Name] = true
+	return f
+}
+
+// unmarkRemoving unmarks name as being removed.
+func (d *LimitedDir) unmarkRemoving(name string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.removing, name)
+}
+
+// evict deletes the files untracked by shrink and calls the eviction
+// functions. It must be called without holding d.lock, so slow storages do
+// not block the other operations. It returns the first storage error, the
+// failed files being adopted again by the next Reconcile.
+func (d *LimitedDir) evict(victims []File) error {
+	var first error
+	for _, f := range victims {
+		slog.Info("evicting file", "name", f.Name, "bytes", f.Size)
+		for _, evicting := range d.evicting {
+			evicting(f.Name)
+		}
+		err := d.storage.Remove(f.Name)
+		d.unmarkRemoving(f.Name)
+		if err != nil && !os.IsNotExist(err) {
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		for _, removed := range d.removed {
+			removed(f.Name)
+		}
+		for _, evicted := range d.evicted {
+			evicted(f.Name)
+		}
+	}
+	return first
+}
+
+// usage returns the total size and count of tracked files starting with
+// prefix.
+func (d *LimitedDir) usage(prefix string) (int64, int) {
+	size, count := int64(0), 0
+	for _, f := range d.files {
+		if strings.HasPrefix(f.Name, prefix) {
+			size += f.Size
+			count++
+		}
+	}
+	return size, count
+}
+
+// maxFileAge returns the age after which f is deleted, zero meaning
+// never.
+func (d *LimitedDir) maxFileAge(f File) time.Duration {
+	r, ok := d.retention[f.Class]
+	if !ok {
+		return d.maxAge
+	}
+	if r.Keep {
+		return 0
+	}
+	if r.MaxAge > 0 {
+		return r.MaxAge
+	}
+	return d.maxAge
+}
+
+// victim returns the index of the next file starting with prefix to evict,
+// or -1 if there is none.
+func (d *LimitedDir) victim(prefix string, now time.Time) int {
+	indices := []int{}
+	files := []File{}
+	for i, f := range d.files {
+		if !strings.HasPrefix(f.Name, prefix) || d.retention[f.Class].Keep {
+			continue
+		}
+		if d.scorer == nil {
+			return i
+		}
+		indices = append(indices, i)
+		files = append(files, f)
+	}
+	if len(files) == 0 {
+		return -1
+	}
+	scores := d.scorer(files, now)
+	best := 0
+	for i, score := range scores {
+		if score > scores[best] {
+			best = i
+		}
+	}
+	return indices[best]
+}
+
+// shrink untracks the files to evict to enforce the policy and returns them,
+// for evict to delete once d.lock is released. d.lock must be held.
+func (d *LimitedDir) shrink() []File {
+	now := time.Now()
+	victims := []File{}
+	for (d.size > d.maxSize && len(d.files) > 0) || len(d.files) > d.maxCount {
+		i := d.victim("", now)
+		if i < 0 {
+			// Only kept files are left
+			break
+		}
+		victims = append(victims, d.untrack(i))
+	}
+	// Files are not sorted by age in LRU mode, nor by expiration time with
+	// retention overrides
+	sorted := !d.lru && len(d.retention) == 0
+	for i := 0; i < len(d.files); {
+		maxAge := d.maxFileAge(d.files[i])
+		if maxAge <= 0 || now.Sub(d.files[i].ModTime) <= maxAge {
+			if sorted {
+				break
+			}
+			i++
+			continue
+		}
+		victims = append(victims, d.untrack(i))
+	}
+	for _, q := range d.quotas {
+		size, count := d.usage(q.Prefix)
+		for (q.MaxSize > 0 && size > q.MaxSize) || (q.MaxCount > 0 && count > q.MaxCount) {
+			i := d.victim(q.Prefix, now)
+			if i < 0 {
+				break
+			}
+			f := d.untrack(i)
+			victims = append(victims, f)
+			size -= f.Size
+			count--
+		}
+	}
+	return victims
+}
+
+// PrefixStats reports the usage and the quota of the files whose names start
+// with Prefix. Zero limits mean unlimited.
+type PrefixStats struct {
+	Prefix   string `json:"prefix"`
+	Count    int    `json:"count"`
+	Size     int64  `json:"size"`
+	MaxCount int    `json:"max_count"`
+	MaxSize  int64  `json:"max_size"`
+}
+
+// SetQuota limits the files whose names start with prefix to maxSize bytes
+// and maxCount files, zero meaning no limit, on top of the directory limits,
+// and applies the policy. Quotas of overlapping prefixes apply independently.
+func (d *LimitedDir) SetQuota(prefix string, maxSize int64, maxCount int) error {
+	d.lock.Lock()
+	q := PrefixStats{Prefix: prefix, MaxSize: maxSize, MaxCount: maxCount}
+	i := sort.Search(len(d.quotas), func(i int) bool {
+		return d.quotas[i].Prefix >= prefix
+	})
+	if i < len(d.quotas) && d.quotas[i].Prefix == prefix {
+		d.quotas[i] = q
+	} else {
+		d.quotas = append(d.quotas[:i], append([]PrefixStats{q}, d.quotas[i:]...)...)
+	}
+	victims := d.shrink()
+	d.lock.Unlock()
+	return d.evict(victims)
+}
+
+// Stats returns the usage of the prefixes limited by SetQuota, sorted by
+// prefix.
+func (d *LimitedDir) Stats() []PrefixStats {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	stats := []PrefixStats{}
+	for _, q := range d.quotas {
+		q.Size, q.Count = d.usage(q.Prefix)
+		stats = append(stats, q)
+	}
+	return stats
+}
+
+// SetMaxAge sets the age after which files are deleted, zero meaning no
+// limit, and applies the policy.
+func (d *LimitedDir) SetMaxAge(maxAge time.Duration) error {
+	d.lock.Lock()
+	d.maxAge = maxAge
+	victims := d.shrink()
+	d.lock.Unlock()
+	return d.evict(victims)
+}
+
+// SetRetention sets the function returning the retention class of files,
+// and the Retention overrides of classes, and applies the policy. Files of
+// other classes follow the directory policy. classify is called without
+// holding the lock, on the tracked files and on the ones later added
+// without a class or adopted by Reconcile.
+func (d *LimitedDir) SetRetention(classify func(name string) string, overrides map[string]Retention) error {
+	classes := map[string]string{}
+	for _, name := range d.List() {
+		classes[name] = classify(name)
+	}
+	d.lock.Lock()
+	d.classify = classify
+	d.retention = overrides
+	for i, f := range d.files {
+		if class, ok := classes[f.Name]; ok {
+			d.files[i].Class = class
+		}
+	}
+	victims := d.shrink()
+	d.lock.Unlock()
+	return d.evict(victims)
+}
+
+// SetLRU enables or disables the LRU mode, where files are evicted in Touch
+// order instead of creation order.
+func (d *LimitedDir) SetLRU(lru bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.lru = lru
+}
+
+// SetScorer sets the function selecting the files evicted by the size, count
+// and quota limits, nil restoring the deletion order, and applies the policy.
+func (d *LimitedDir) SetScorer(scorer Scorer) error {
+	d.lock.Lock()
+	d.scorer = scorer
+	victims := d.shrink()
+	d.lock.Unlock()
+	return d.evict(victims)
+}
+
+// Touch records an access to the tracked file name, counting it in its Views
+// and making it the last one to be evicted in LRU mode. It does nothing if
+// name is not tracked.
+func (d *LimitedDir) Touch(name string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for i, f := range d.files {
+		if f.Name != name {
+			continue
+		}
+		f.Views++
+		if d.lru {
+			d.files = append(append(d.files[:i], d.files[i+1:]...), f)
+		} else {
+			d.files[i] = f
+		}
+		return
+	}
+}
+
+// WeightedScorer returns a Scorer preferring to evict old, large and
+// unviewed files according to the supplied weights. Each criterion is
+// relative to its average over the candidate files, so the weights compare
+// regardless of units.
+func WeightedScorer(age, size, views float64) Scorer {
+	return func(files []File, now time.Time) []float64 {
+		totalAge, totalSize, totalViews := 0.0, 0.0, 0.0
+		for _, f := range files {
+			totalAge += now.Sub(f.ModTime).Seconds()
+			totalSize += float64(f.Size)
+			totalViews += float64(f.Views)
+		}
+		n := float64(len(files))
+		scores := make([]float64, len(files))
+		for i, f := range files {
+			if totalAge > 0 {
+				scores[i] += age * now.Sub(f.ModTime).Seconds() * n / totalAge
+			}
+			if totalSize > 0 {
+				scores[i] += size * float64(f.Size) * n / totalSize
+			}
+			if totalViews > 0 {
+				scores[i] -= views * float64(f.Views) * n / totalViews
+			}
+		}
+		return scores
+	}
+}
+
+// Run applies the policy every interval, until ctx is done, so files expire
+// even when nothing is added.
+func (d *LimitedDir) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		d.lock.Lock()
+		victims := d.shrink()
+		d.lock.Unlock()
+		err := d.evict(victims)
+		if err != nil {
+			slog.Error("could not evict expired files", "err", err)
+		}
+	}
+}
+
+// OnRemove registers a function called with the names of deleted files,
+// whether to enforce the size and count limits or by Remove, to clean up
+// derived data.
+func (d *LimitedDir) OnRemove(removed func(name string)) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.removed = append(d.removed, removed)
+}
+
+// OnEvict registers a function called with the names of files deleted to
+// enforce the size and count limits, after OnRemove ones.
+func (d *LimitedDir) OnEvict(evicted func(name string)) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.evicted = append(d.evicted, evicted)
+}
+
+// OnEvicting registers a function called with the names of files about to
+// be deleted to enforce the size and count limits, while they are still in
+// the directory.
+func (d *LimitedDir) OnEvicting(evicting func(name string)) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.evicting = append(d.evicting, evicting)
+}
+
+// index returns the position of the tracked file name, or -1. d.lock must be
+// held.
+func (d *LimitedDir) index(name string) int {
+	for i, f := range d.files {
+		if f.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Remove deletes the tracked file name and calls OnRemove functions. It
+// returns ErrNotTracked if name is not tracked. The file is untracked before
+// being deleted from storage without holding the lock, and tracked again if
+// that fails.
+func (d *LimitedDir) Remove(name string) error {
+	d.lock.Lock()
+	i := d.index(name)
+	if i < 0 {
+		d.lock.Unlock()
+		return ErrNotTracked
+	}
+	f := d.untrack(i)
+	d.lock.Unlock()
+
+	err := d.storage.Remove(name)
+	if err != nil && !os.IsNotExist(err) {
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		delete(d.removing, name)
+		if i > len(d.files) {
+			i = len(d.files)
+		}
+		d.files = append(d.files[:i], append([]File{f}, d.files[i:]...)...)
+		d.size += f.Size
+		return err
+	}
+	d.unmarkRemoving(name)
+	for _, removed := range d.removed {
+		removed(name)
+	}
+	return nil
+}
+
+// Add registers a new file in the LimitedDir, stores it and applies the
+// maxCount/maxSize policy. Adding a tracked file again updates its size and
+// makes it the newest one instead of counting it twice.
+func (d *LimitedDir) Add(name string) error {
+	d.lock.Lock()
+	classify := d.classify
+	d.lock.Unlock()
+	class := ""
+	if classify != nil {
+		class = classify(name)
+	}
+	return d.AddClass(name, class)
+}
+
+// AddClass is like Add, with the retention class of the file instead of the
+// one returned by the SetRetention function.
+func (d *LimitedDir) AddClass(name, class string) error {
+	path := filepath.Join(d.path, name)
+	st, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	err = d.storage.Store(name)
+	if err != nil {
+		return err
+	}
+
+	d.lock.Lock()
+	for i, f := range d.files {
+		if f.Name == name {
+			d.size -= f.Size
+			d.files = append(d.files[:i], d.files[i+1:]...)
+			break
+		}
+	}
+	d.files = append(d.files, File{
+		Name:    name,
+		Size:    st.Size(),
+		ModTime: st.ModTime(),
+		Class:   class,
+	})
+	d.size += st.Size()
+	if d.added != nil {
+		d.added[name] = true
+	}
+	victims := d.shrink()
+	d.lock.Unlock()
+	return d.evict(victims)
+}
+
+// Size returns the total size of tracked files.
+func (d *LimitedDir) Size() int64 {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.size
+}
+
+// Limits returns the maximum total size and count of tracked files.
+func (d *LimitedDir) Limits() (int64, int) {
+	return d.maxSize, d.maxCount
+}
+
+// List returns the list of tracked files in deletion order.
+func (d *LimitedDir) List() []string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	names := []string{}
+	for _, f := range d.files {
+		names = append(names, f.Name)
+	}
+	return names
+}
+
+// Files returns a copy of tracked files in deletion order.
+func (d *LimitedDir) Files() []File {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return append([]File{}, d.files...)
+}
+
+// Replace atomically replaces the tracked file name with the one at path,
+// which must be on the same filesystem, and updates the size accounting. The
+// file at path is removed and ErrNotTracked returned if name is no longer
+// tracked. Like Add, the replaced file is stored without holding the lock.
+func (d *LimitedDir) Replace(name, path string) error {
+	err := d.replace(name, path)
+	if err != nil {
+		return err
+	}
+	err = d.storage.Store(name)
+	if err != nil {
+		return err
+	}
+	d.lock.Lock()
+	victims := d.shrink()
+	d.lock.Unlock()
+	return d.evict(victims)
+}
+
+// replace renames path to the tracked file name and updates its size.
+func (d *LimitedDir) replace(name, path string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for i, f := range d.files {
+		if f.Name != name {
+			continue
+		}
+		st, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(path, filepath.Join(d.path, name))
+		if err != nil {
+			return err
+		}
+		d.size += st.Size() - f.Size
+		d.files[i].Size = st.Size()
+		if d.added != nil {
+			d.added[name] = true
+		}
+		return nil
+	}
+	os.Remove(path)
+	return ErrNotTracked
+}
+
+// Reconciliation reports the differences found by Reconcile.
+type Reconciliation struct {
+	// Adopted lists files present on disk but unknown to the LimitedDir.
+	Adopted []string
+	// Dropped lists tracked files which disappeared from disk.
+	Dropped []string
+	// Resized lists tracked files whose size changed on disk.
+	Resized []string
+}
+
+// Reconcile updates the tracked files with the storage content, in case it
+// was modified externally, and applies the maxCount/maxSize policy. Adopted
+// files are inserted according to their modification time. The storage is
+// listed without holding the lock, files added or removed meanwhile being
+// left as they are.
+func (d *LimitedDir) Reconcile() (*Reconciliation, error) {
+	d.reconciling.Lock()
+	defer d.reconciling.Unlock()
+	d.lock.Lock()
+	d.added = map[string]bool{}
+	tracked := map[string]bool{}
+	for _, f := range d.files {
+		tracked[f.Name] = true
+	}
+	classify := d.classify
+	d.lock.Unlock()
+	onDisk, err := d.storage.List()
+	if err == nil && classify != nil {
+		for i, f := range onDisk {
+			if !tracked[f.Name] {
+				onDisk[i].Class = classify(f.Name)
+			}
+		}
+	}
+
+	d.lock.Lock()
+	added := d.added
+	d.added = nil
+	if err != nil {
+		d.lock.Unlock()
+		return nil, err
+	}
+	res := &Reconciliation{}
+	known := map[string]File{}
+	for _, f := range d.files {
+		known[f.Name] = f
+	}
+	disk := map[string]File{}
+	for _, f := range onDisk {
+		if d.removing[f.Name] {
+			continue
+		}
+		disk[f.Name] = f
+		if k, ok := known[f.Name]; !ok {
+			res.Adopted = append(res.Adopted, f.Name)
+		} else if k.Size != f.Size && !added[f.Name] {
+			res.Resized = append(res.Resized, f.Name)
+		}
+	}
+	// Keep the order of tracked files, merging adopted ones by modification
+	// time.
+	files := []File{}
+	size := int64(0)
+	adopt := func(f File) {
+		if _, ok := known[f.Name]; !ok && !d.removing[f.Name] {
+			files = append(files, f)
+			size += f.Size
+		}
+	}
+	i := 0
+	for _, f := range d.files {
+		if added[f.Name] {
+			files = append(files, f)
+			size += f.Size
+			continue
+		}
+		df, ok := disk[f.Name]
+		if !ok {
+			res.Dropped = append(res.Dropped, f.Name)
+			continue
+		}
+		for ; i < len(onDisk) && onDisk[i].ModTime.Before(f.ModTime); i++ {
+			adopt(onDisk[i])
+		}
+		f.Size = df.Size
+		files = append(files, f)
+		size += f.Size
+	}
+	for ; i < len(onDisk); i++ {
+		adopt(onDisk[i])
+	}
+	d.files = files
+	d.size = size
+	victims := d.shrink()
+	d.lock.Unlock()
+	return res, d.evict(victims)
+}
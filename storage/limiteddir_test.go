@@ -0,0 +1,618 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func checkFiles(t *testing.T, d *LimitedDir, wanted []string) {
+	files := d.List()
+	if len(files) != len(wanted) {
+		t.Fatalf("expected %d files, got %d, %v != %v", len(wanted), len(files),
+			wanted, files)
+	}
+	for i, f := range wanted {
+		if f != files[i] {
+			t.Fatalf("expected '%s' file, got '%s' at position %d, %v != %v",
+				f, files[i], i, wanted, files)
+		}
+	}
+}
+
+func TestLimitedDir(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "gribouillis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	writeFile := func(name string, size int) {
+		data := make([]byte, size)
+		path := filepath.Join(tmpDir, name)
+		err := ioutil.WriteFile(path, data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d, err := OpenLimitedDir(tmpDir, 5, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addFile := func(name string, size int) {
+		writeFile(name, size)
+		err := d.Add(name)
+		if err != nil {
+			t.Fatalf("could not add %s: %s", name, err)
+		}
+	}
+
+	checkFiles(t, d, nil)
+
+	// Test maxcount
+	for i := 0; i < 5; i++ {
+		name := fmt.Sprintf("%d-1", i)
+		addFile(name, 1)
+	}
+	checkFiles(t, d, []string{"1-1", "2-1", "3-1", "4-1"})
+
+	// Test maxsize
+	addFile("5-2", 2)
+	checkFiles(t, d, []string{"2-1", "3-1", "4-1", "5-2"})
+	addFile("6-2", 2)
+	checkFiles(t, d, []string{"4-1", "5-2", "6-2"})
+	addFile("7-3", 3)
+	checkFiles(t, d, []string{"6-2", "7-3"})
+	addFile("8-4", 4)
+	checkFiles(t, d, []string{"8-4"})
+	addFile("9-5", 5)
+	checkFiles(t, d, []string{"9-5"})
+	addFile("10-6", 6)
+	checkFiles(t, d, []string{})
+
+	// Reopen and shrink
+	writeFile("11-1", 1)
+	writeFile("12-1", 1)
+	writeFile("13-2", 2)
+	writeFile("14-1", 1)
+	writeFile("15-2", 2)
+	d2, err := OpenLimitedDir(tmpDir, 5, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, d2, []string{"13-2", "14-1", "15-2"})
+}
+
+func TestLimitedDirReconcile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "gribouillis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	now := time.Now()
+	writeFile := func(name string, size int, age time.Duration) {
+		path := filepath.Join(tmpDir, name)
+		err := ioutil.WriteFile(path, make([]byte, size), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Chtimes(path, now.Add(-age), now.Add(-age))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile("a", 1, 4*time.Hour)
+	writeFile("c", 1, 2*time.Hour)
+	writeFile("d", 1, time.Hour)
+	d, err := OpenLimitedDir(tmpDir, 10, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Orphans are inserted by age, ghosts dropped, sizes updated
+	writeFile("b", 1, 3*time.Hour)
+	writeFile("e", 1, 0)
+	writeFile("d", 3, time.Hour)
+	writeFile(".tmp", 1, 0)
+	err = os.Remove(filepath.Join(tmpDir, "c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := d.Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, d, []string{"a", "b", "d", "e"})
+	got := fmt.Sprintf("%v %v %v", res.Adopted, res.Dropped, res.Resized)
+	if got != "[b e] [c] [d]" {
+		t.Fatalf("unexpected reconciliation: %s", got)
+	}
+
+	// Limits are applied to adopted files
+	writeFile("f", 6, 0)
+	_, err = d.Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, d, []string{"d", "e", "f"})
+}
+
+func TestLimitedDirRemove(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "gribouillis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	d, err := OpenLimitedDir(tmpDir, 5, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed := []string{}
+	evicted := []string{}
+	d.OnRemove(func(name string) { removed = append(removed, name) })
+	d.OnEvict(func(name string) { evicted = append(evicted, name) })
+	for _, name := range []string{"a", "b", "c"} {
+		err := ioutil.WriteFile(filepath.Join(tmpDir, name), []byte("x"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = d.Add(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = d.Remove("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, d, []string{"b"})
+	if d.Size() != 1 {
+		t.Fatalf("unexpected size: %d", d.Size())
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "c")); !os.IsNotExist(err) {
+		t.Fatalf("c was not deleted: %v", err)
+	}
+	if fmt.Sprint(removed) != "[a c]" || fmt.Sprint(evicted) != "[a]" {
+		t.Fatalf("unexpected hook calls: %v, %v", removed, evicted)
+	}
+	err = d.Remove("c")
+	if err != ErrNotTracked {
+		t.Fatalf("expected errNotTracked, got %v", err)
+	}
+}
+
+// blockingStorage is a DirStorage whose Remove waits for unblock.
+type blockingStorage struct {
+	DirStorage
+	removing chan string
+	unblock  chan error
+}
+
+func (s *blockingStorage) Remove(name string) error {
+	s.removing <- name
+	err := <-s.unblock
+	if err != nil {
+		return err
+	}
+	return s.DirStorage.Remove(name)
+}
+
+func TestLimitedDirRemoveUnlocked(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "gribouillis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	s := &blockingStorage{
+		DirStorage: DirStorage(tmpDir),
+		removing:   make(chan string),
+		unblock:    make(chan error),
+	}
+	d, err := OpenLimitedStorage(s, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b"} {
+		err := ioutil.WriteFile(filepath.Join(tmpDir, name), []byte("x"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = d.Add(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The directory remains usable while the storage deletes a file, and
+	// Reconcile does not adopt it again.
+	done := make(chan error)
+	go func() { done <- d.Remove("a") }()
+	if name := <-s.removing; name != "a" {
+		t.Fatalf("unexpected removal: %s", name)
+	}
+	checkFiles(t, d, []string{"b"})
+	res, err := d.Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Adopted) != 0 || len(res.Dropped) != 0 {
+		t.Fatalf("unexpected reconciliation: %+v", res)
+	}
+	s.unblock <- nil
+	err = <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, d, []string{"b"})
+
+	// A failed deletion tracks the file again.
+	go func() { done <- d.Remove("b") }()
+	<-s.removing
+	s.unblock <- fmt.Errorf("unavailable")
+	err = <-done
+	if err == nil {
+		t.Fatal("removal did not fail")
+	}
+	checkFiles(t, d, []string{"b"})
+	if d.Size() != 1 {
+		t.Fatalf("unexpected size: %d", d.Size())
+	}
+}
+
+func TestLimitedDirAddExisting(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "gribouillis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	d, err := OpenLimitedDir(tmpDir, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	add := func(name string, size int) {
+		err := ioutil.WriteFile(filepath.Join(tmpDir, name), make([]byte, size), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = d.Add(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	add("a", 2)
+	add("b", 2)
+	add("a", 3)
+	checkFiles(t, d, []string{"b", "a"})
+	if d.Size() != 5 {
+		t.Fatalf("unexpected size: %d", d.Size())
+	}
+	// Re-added files are the newest ones
+	add("c", 1)
+	add("d", 1)
+	checkFiles(t, d, []string{"a", "c", "d"})
+	if d.Size() != 5 {
+		t.Fatalf("unexpected size: %d", d.Size())
+	}
+}
+
+func TestLimitedDirQuotas(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "gribouillis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	d, err := OpenLimitedDir(tmpDir, 100, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	add := func(name string, size int) {
+		err := ioutil.WriteFile(filepath.Join(tmpDir, name), make([]byte, size), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = d.Add(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	add("a-1", 1)
+	add("b-1", 1)
+	add("a-2", 1)
+	add("a-3", 1)
+	err = d.SetQuota("a-", 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, d, []string{"b-1", "a-2", "a-3"})
+	err = d.SetQuota("b-", 5, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	add("b-2", 3)
+	add("a-4", 1)
+	checkFiles(t, d, []string{"b-1", "a-3", "b-2", "a-4"})
+	add("b-3", 2)
+	checkFiles(t, d, []string{"a-3", "b-2", "a-4", "b-3"})
+	stats := fmt.Sprint(d.Stats())
+	if stats != "[{a- 2 2 2 0} {b- 2 5 0 5}]" {
+		t.Fatalf("unexpected stats: %s", stats)
+	}
+	if d.Size() != 7 {
+		t.Fatalf("unexpected size: %d", d.Size())
+	}
+}
+
+func TestLimitedDirMaxAge(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "gribouillis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	now := time.Now()
+	for i, name := range []string{"a", "b", "c"} {
+		path := filepath.Join(tmpDir, name)
+		err := ioutil.WriteFile(path, []byte("x"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mtime := now.Add(time.Duration(i-3) * 24 * time.Hour)
+		err = os.Chtimes(path, mtime, mtime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	d, err := OpenLimitedDir(tmpDir, 100, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	evicted := []string{}
+	d.OnEvict(func(name string) { evicted = append(evicted, name) })
+	checkFiles(t, d, []string{"a", "b", "c"})
+	err = d.SetMaxAge(36 * time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, d, []string{"c"})
+	if fmt.Sprint(evicted) != "[a b]" {
+		t.Fatalf("unexpected evictions: %v", evicted)
+	}
+
+	// Files expire in the background until Run is stopped
+	err = d.SetMaxAge(time.Since(d.Files()[0].ModTime) + 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		d.Run(ctx, 10*time.Millisecond)
+		close(done)
+	}()
+	deadline := time.Now().Add(10 * time.Second)
+	for len(d.List()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("file did not expire")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run did not stop")
+	}
+}
+
+func TestLimitedDirRetention(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "gribouillis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	write := func(name string, mtime time.Time) {
+		path := filepath.Join(tmpDir, name)
+		err := ioutil.WriteFile(path, []byte("x"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Chtimes(path, mtime, mtime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	for i, name := range []string{"a", "b", "c", "d"} {
+		write(name, now.Add(time.Duration(i-3)*24*time.Hour))
+	}
+	d, err := OpenLimitedDir(tmpDir, 100, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	classes := map[string]string{"a": "keep", "c": "short", "g": "keep"}
+	err = d.SetRetention(func(name string) string { return classes[name] },
+		map[string]Retention{
+			"keep":  {Keep: true},
+			"short": {MaxAge: 12 * time.Hour},
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Overrides apply without a directory maximum age
+	checkFiles(t, d, []string{"a", "b", "d"})
+	err = d.SetMaxAge(60 * time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, d, []string{"a", "b", "d"})
+
+	// Kept files are not evicted by the count limit
+	write("e", now)
+	err = d.AddClass("e", "keep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	write("f", now)
+	err = d.Add("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, d, []string{"a", "d", "e", "f"})
+	write("g", now.Add(time.Hour))
+	_, err = d.Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, d, []string{"a", "e", "f", "g"})
+	if f := d.Files()[3]; f.Name != "g" || f.Class != "keep" {
+		t.Fatalf("unexpected adopted file: %+v", f)
+	}
+}
+
+func TestLimitedDirLRU(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "gribouillis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	d, err := OpenLimitedDir(tmpDir, 100, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	add := func(name string, age time.Duration) {
+		path := filepath.Join(tmpDir, name)
+		err := ioutil.WriteFile(path, []byte("x"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Chtimes(path, now.Add(-age), now.Add(-age))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = d.Add(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	add("a", 3*time.Hour)
+	add("b", 2*time.Hour)
+	// Accesses are ignored in the default mode
+	d.Touch("a")
+	checkFiles(t, d, []string{"a", "b"})
+	d.SetLRU(true)
+	d.Touch("a")
+	d.Touch("unknown")
+	checkFiles(t, d, []string{"b", "a"})
+	add("c", time.Hour)
+	add("d", 0)
+	checkFiles(t, d, []string{"a", "c", "d"})
+	// Old files expire whatever their accesses
+	d.Touch("a")
+	err = d.SetMaxAge(90 * time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, d, []string{"c", "d"})
+}
+
+func TestLimitedDirWeighted(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "gribouillis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	d, err := OpenLimitedDir(tmpDir, 1000, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	add := func(name string, size int, age time.Duration) {
+		path := filepath.Join(tmpDir, name)
+		err := ioutil.WriteFile(path, bytes.Repeat([]byte("x"), size), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Chtimes(path, now.Add(-age), now.Add(-age))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = d.Add(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	add("a", 1, 3*time.Hour)
+	add("b", 10, 2*time.Hour)
+	add("c", 1, time.Hour)
+	d.Touch("a")
+	d.Touch("a")
+	err = d.SetScorer(WeightedScorer(1, 2, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The large unviewed file goes before the older but viewed one
+	add("d", 1, 0)
+	checkFiles(t, d, []string{"a", "c", "d"})
+	err = d.SetScorer(WeightedScorer(1, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	add("e", 1, 0)
+	checkFiles(t, d, []string{"c", "d", "e"})
+}
+
+func TestLimitedDirStaleTempFiles(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "gribouillis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	old := time.Now().Add(-2 * StaleTempAge)
+	for _, name := range []string{".save-old", ".save-new", ".recompress-old",
+		".other-old", "a"} {
+		path := filepath.Join(tmpDir, name)
+		err := ioutil.WriteFile(path, []byte("x"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasSuffix(name, "-old") {
+			err = os.Chtimes(path, old, old)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	d, err := OpenLimitedDir(tmpDir, 100, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, d, []string{"a"})
+	entries, err := ioutil.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if fmt.Sprint(names) != "[.other-old .save-new a]" {
+		t.Fatalf("unexpected files: %v", names)
+	}
+}
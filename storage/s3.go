@@ -0,0 +1,542 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// emptySHA256 is the hex encoded SHA-256 hash of an empty payload.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3Client is a minimal client of S3 compatible object storages, sending
+// path-style requests signed with AWS Signature Version 4.
+type S3Client struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+// s3Error is returned when the object storage answers with an error status.
+type s3Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("s3 error %d: %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// S3Object describes a stored object, as listed by S3Client.List.
+type S3Object struct {
+	Key          string    `xml:"Key"`
+	Size         int64     `xml:"Size"`
+	LastModified time.Time `xml:"LastModified"`
+}
+
+// NewS3Client returns a client of bucket at endpoint, signing requests for
+// region with the access and secret keys.
+func NewS3Client(endpoint, bucket, region, accessKey, secretKey string) (
+	*S3Client, error) {
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint: %s", endpoint)
+	}
+	if bucket == "" {
+		return nil, fmt.Errorf("S3 bucket is not set")
+	}
+	if accessKey == "" || secretKey == "" {
+		return nil, fmt.Errorf("S3 credentials are not set")
+	}
+	return &S3Client{
+		endpoint:  u,
+		bucket:    bucket,
+		region:    region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Timeout: 5 * time.Minute},
+	}, nil
+}
+
+// awsEscape percent-encodes s as required by AWS signatures, leaving only
+// unreserved characters, and slashes if keepSlash is true.
+func awsEscape(s string, keepSlash bool) string {
+	b := &strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '.' || c == '_' || c == '~' || (c == '/' && keepSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// sign adds AWS Signature Version 4 headers to req, whose payload has the
+// hex encoded SHA-256 hash payloadHash. The host and all headers set in req
+// are signed.
+func (c *S3Client) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := []string{}
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, k := range names {
+		canonicalHeaders += k + ":" + headers[k] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + c.region + "/s3/aws4_request"
+	h := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" +
+		hex.EncodeToString(h[:])
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), day)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders,
+		hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+// newRequest returns an unsigned request for key, with the sorted query
+// parameters and body.
+func (c *S3Client) newRequest(method, key string, query [][2]string,
+	body io.Reader, size int64) (*http.Request, error) {
+
+	u := *c.endpoint
+	p := strings.TrimRight(u.Path, "/") + "/" + c.bucket + "/" + key
+	u.Path = p
+	u.RawPath = awsEscape(p, true)
+	params := []string{}
+	for _, q := range query {
+		params = append(params, awsEscape(q[0], false)+"="+awsEscape(q[1], false))
+	}
+	u.RawQuery = strings.Join(params, "&")
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	return req, nil
+}
+
+// send signs and sends req, whose payload has the hex encoded SHA-256 hash
+// payloadHash. It returns the response if its status is successful or one of
+// accepted ones.
+func (c *S3Client) send(req *http.Request, payloadHash string, accepted ...int) (
+	*http.Response, error) {
+
+	c.sign(req, payloadHash, time.Now())
+	rsp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range accepted {
+		if rsp.StatusCode == status {
+			return rsp, nil
+		}
+	}
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		defer rsp.Body.Close()
+		e := &s3Error{}
+		data, _ := ioutil.ReadAll(io.LimitReader(rsp.Body, 64*1024))
+		xml.Unmarshal(data, e)
+		e.StatusCode = rsp.StatusCode
+		return nil, e
+	}
+	return rsp, nil
+}
+
+// do sends a signed request for key, with the sorted query parameters and
+// body. It returns the response if its status is successful.
+func (c *S3Client) do(method, key string, query [][2]string, body io.Reader,
+	size int64, payloadHash string) (*http.Response, error) {
+
+	req, err := c.newRequest(method, key, query, body, size)
+	if err != nil {
+		return nil, err
+	}
+	return c.send(req, payloadHash)
+}
+
+// Put uploads the file at path as key.
+func (c *S3Client) Put(key, path string) error {
+	fp, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, fp)
+	if err != nil {
+		return err
+	}
+	_, err = fp.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	rsp, err := c.do("PUT", key, nil, fp, size, hex.EncodeToString(h.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+	return nil
+}
+
+// Get writes key content into w.
+func (c *S3Client) Get(key string, w io.Writer) error {
+	rsp, err := c.do("GET", key, nil, nil, 0, emptySHA256)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	_, err = io.Copy(w, rsp.Body)
+	return err
+}
+
+// Fetch sends a GET or HEAD request for key, with header. Unlike Get, it
+// returns the response without reading its body, and also when its status
+// is 304, 412 or 416, so range and conditional requests can be proxied.
+func (c *S3Client) Fetch(method, key string, header http.Header) (
+	*http.Response, error) {
+
+	req, err := c.newRequest(method, key, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	return c.send(req, emptySHA256, http.StatusNotModified,
+		http.StatusPreconditionFailed, http.StatusRequestedRangeNotSatisfiable)
+}
+
+// Delete removes key. Deleting a missing key is not an error.
+func (c *S3Client) Delete(key string) error {
+	rsp, err := c.do("DELETE", key, nil, nil, 0, emptySHA256)
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+	return nil
+}
+
+// List returns the objects whose key starts with prefix.
+func (c *S3Client) List(prefix string) ([]S3Object, error) {
+	objects := []S3Object{}
+	token := ""
+	for {
+		query := [][2]string{}
+		if token != "" {
+			query = append(query, [2]string{"continuation-token", token})
+		}
+		query = append(query, [2]string{"list-type", "2"},
+			[2]string{"prefix", prefix})
+		rsp, err := c.do("GET", "", query, nil, 0, emptySHA256)
+		if err != nil {
+			return nil, err
+		}
+		result := struct {
+			Contents              []S3Object `xml:"Contents"`
+			IsTruncated           bool       `xml:"IsTruncated"`
+			NextContinuationToken string     `xml:"NextContinuationToken"`
+		}{}
+		err = xml.NewDecoder(rsp.Body).Decode(&result)
+		rsp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("could not parse S3 listing: %s", err)
+		}
+		objects = append(objects, result.Contents...)
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// S3Storage mirrors a local directory in an S3 bucket, so its files survive
+// the loss of the directory. The bucket is restored into the directory when
+// listed, and local files missing from it are uploaded.
+//
+// Objects which could not be deleted are recorded in a hidden file of the
+// directory, deleted again on the next listings and never restored meanwhile.
+type S3Storage struct {
+	dir    string
+	prefix string
+	client *S3Client
+	lock   sync.Mutex
+	// deleting holds the names of the objects still to delete, nil until
+	// loaded from s3DeletionsFile.
+	deleting map[string]bool
+}
+
+// s3DeletionsFile lists, one per line, the names of the objects which could
+// not be deleted yet.
+const s3DeletionsFile = ".s3-deletions"
+
+// NewS3Storage returns a storage of dir mirrored in client bucket, below
+// prefix.
+func NewS3Storage(dir, prefix string, client *S3Client) *S3Storage {
+	return &S3Storage{
+		dir:    dir,
+		prefix: prefix,
+		client: client,
+	}
+}
+
+func (s *S3Storage) Path() string {
+	return s.dir
+}
+
+// deletions returns the names of the objects still to delete, loading them
+// on first call. s.lock must be held.
+func (s *S3Storage) deletions() (map[string]bool, error) {
+	if s.deleting != nil {
+		return s.deleting, nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, s3DeletionsFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	s.deleting = map[string]bool{}
+	for _, name := range strings.Fields(string(data)) {
+		s.deleting[name] = true
+	}
+	return s.deleting, nil
+}
+
+// saveDeletions atomically writes the names of the objects still to delete,
+// or removes the file if there is none. s.lock must be held.
+func (s *S3Storage) saveDeletions() error {
+	path := filepath.Join(s.dir, s3DeletionsFile)
+	if len(s.deleting) == 0 {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	names := []string{}
+	for name := range s.deleting {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tmp := path + ".tmp"
+	err := ioutil.WriteFile(tmp, []byte(strings.Join(names, "\n")+"\n"), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// retryDeletions deletes again the objects which could not be deleted and
+// returns the names of those still remaining.
+func (s *S3Storage) retryDeletions() (map[string]bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	deleting, err := s.deletions()
+	if err != nil {
+		return nil, err
+	}
+	if len(deleting) == 0 {
+		return map[string]bool{}, nil
+	}
+	for name := range deleting {
+		err := s.client.Delete(s.prefix + name)
+		if err != nil {
+			slog.Warn("could not delete from S3", "name", name, "err", err)
+			continue
+		}
+		delete(deleting, name)
+	}
+	remaining := map[string]bool{}
+	for name := range deleting {
+		remaining[name] = true
+	}
+	return remaining, s.saveDeletions()
+}
+
+// download fetches object o as local file name, with the object
+// modification time.
+func (s *S3Storage) download(name string, o S3Object) error {
+	tmp, err := ioutil.TempFile(s.dir, ".s3-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	err = s.client.Get(o.Key, tmp)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.dir, name)
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(path, o.LastModified, o.LastModified)
+}
+
+func (s *S3Storage) List() ([]File, error) {
+	deleting, err := s.retryDeletions()
+	if err != nil {
+		return nil, err
+	}
+	objects, err := s.client.List(s.prefix)
+	if err != nil {
+		return nil, err
+	}
+	local, err := ListFiles(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	sizes := map[string]int64{}
+	for _, f := range local {
+		sizes[f.Name] = f.Size
+	}
+	remote := map[string]bool{}
+	for _, o := range objects {
+		name := strings.TrimPrefix(o.Key, s.prefix)
+		if name == "" || strings.Contains(name, "/") || strings.HasPrefix(name, ".") ||
+			deleting[name] {
+			continue
+		}
+		remote[name] = true
+		if size, ok := sizes[name]; ok && size == o.Size {
+			continue
+		}
+		slog.Info("restoring from S3", "name", name, "bytes", o.Size)
+		err := s.download(name, o)
+		if err != nil {
+			return nil, fmt.Errorf("could not restore %s: %s", name, err)
+		}
+	}
+	for _, f := range local {
+		if !remote[f.Name] && !deleting[f.Name] {
+			slog.Info("uploading to S3", "name", f.Name, "bytes", f.Size)
+			err := s.Store(f.Name)
+			if err != nil {
+				return nil, fmt.Errorf("could not upload %s: %s", f.Name, err)
+			}
+		}
+	}
+	return ListFiles(s.dir)
+}
+
+// Store uploads name, which is no longer to delete if it was.
+func (s *S3Storage) Store(name string) error {
+	err := s.client.Put(s.prefix+name, filepath.Join(s.dir, name))
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	deleting, err := s.deletions()
+	if err != nil || !deleting[name] {
+		return err
+	}
+	delete(deleting, name)
+	return s.saveDeletions()
+}
+
+// Fetch implements Remote.
+func (s *S3Storage) Fetch(method, name string, header http.Header) (
+	*http.Response, error) {
+
+	s.lock.Lock()
+	deleting, err := s.deletions()
+	s.lock.Unlock()
+	if err == nil && deleting[name] {
+		return nil, &os.PathError{Op: "fetch", Path: s.prefix + name, Err: os.ErrNotExist}
+	}
+	forwarded := http.Header{}
+	for _, k := range fetchHeaders {
+		if v := header.Get(k); v != "" {
+			forwarded.Set(k, v)
+		}
+	}
+	rsp, err := s.client.Fetch(method, s.prefix+name, forwarded)
+	if e, ok := err.(*s3Error); ok && e.StatusCode == http.StatusNotFound {
+		return nil, &os.PathError{Op: "fetch", Path: s.prefix + name, Err: os.ErrNotExist}
+	}
+	return rsp, err
+}
+
+// Remove deletes the local file and the object. An object which cannot be
+// deleted is recorded, to be deleted again by the next listings.
+func (s *S3Storage) Remove(name string) error {
+	err := s.client.Delete(s.prefix + name)
+	if err != nil {
+		slog.Warn("could not delete from S3, retrying later", "name", name, "err", err)
+		s.lock.Lock()
+		deleting, err := s.deletions()
+		if err == nil {
+			deleting[name] = true
+			err = s.saveDeletions()
+		}
+		s.lock.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return os.Remove(filepath.Join(s.dir, name))
+}
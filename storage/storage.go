@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// Storage persists the files of a LimitedDir. Files are always written and
+// read in a local directory, returned by Path, which implementations may
+// mirror elsewhere.
+type Storage interface {
+	// Path returns the local directory holding the files.
+	Path() string
+	// List returns the regular, non-hidden, files sorted by modification
+	// time.
+	List() ([]File, error)
+	// Store persists name, a complete file of the local directory.
+	Store(name string) error
+	// Remove deletes name, returning an error satisfying os.IsNotExist if
+	// it does not exist locally.
+	Remove(name string) error
+}
+
+// fetchHeaders are the range and conditional request headers forwarded by
+// Remote implementations.
+var fetchHeaders = []string{
+	"If-Match",
+	"If-Modified-Since",
+	"If-None-Match",
+	"If-Range",
+	"If-Unmodified-Since",
+	"Range",
+}
+
+// Remote is implemented by storages mirroring their files remotely, which
+// can serve files missing from the local directory, like files stored by
+// other instances sharing the remote storage and not listed yet.
+type Remote interface {
+	// Fetch sends a GET or HEAD request for name remote content, with the
+	// range and conditional headers of header. The response is returned
+	// unread, if its status is successful, 304, 412 or 416. The error
+	// satisfies os.IsNotExist if name does not exist remotely.
+	Fetch(method, name string, header http.Header) (*http.Response, error)
+}
+
+// DirStorage stores files in a local directory only.
+type DirStorage string
+
+func (s DirStorage) Path() string {
+	return string(s)
+}
+
+func (s DirStorage) List() ([]File, error) {
+	return ListFiles(string(s))
+}
+
+func (s DirStorage) Store(name string) error {
+	return nil
+}
+
+func (s DirStorage) Remove(name string) error {
+	return os.Remove(filepath.Join(string(s), name))
+}